@@ -0,0 +1,29 @@
+// Pin and unpin buttons on post pages. The button flips between the two once the request goes through.
+if (!window.pinButtonsReady) {
+	window.pinButtonsReady = true;
+
+	document.addEventListener('click', function(event) {
+		var button = event.target.closest('.pin-post-button');
+		if (!button || button.disabled) {
+			return;
+		}
+		button.disabled = true;
+		fetch(button.dataset.action, {
+			method: 'POST',
+			credentials: 'same-origin',
+			headers: {'X-CSRF-Token': document.body.getAttribute('csrf-token')}
+		}).then(function(response) {
+			if (!response.ok) {
+				return response.text().then(function(text) {
+					alert(text);
+				});
+			}
+			var pinned = !button.classList.contains('done');
+			button.classList.toggle('done', pinned);
+			button.dataset.action = button.dataset.action.replace(/\/(un)?pin$/, pinned ? '/unpin' : '/pin');
+			button.textContent = pinned ? 'Unpin' : 'Pin';
+		}).finally(function() {
+			button.disabled = false;
+		});
+	});
+}
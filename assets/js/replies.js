@@ -0,0 +1,36 @@
+// Reply-to-comment buttons on post pages. The comment form is sent in the background,
+// so the comment being replied to is forgotten once it's been sent.
+if (!window.replyButtonsReady) {
+	window.replyButtonsReady = true;
+
+	function setReplyParent(form, parentID, parentName) {
+		form.parent.value = parentID;
+		form.querySelector('.replying-to-name').textContent = parentName;
+		form.querySelector('.replying-to').classList.toggle('none', !parentID);
+	}
+
+	document.addEventListener('click', function(event) {
+		var form = document.getElementById('reply-form');
+		var button = event.target.closest('[data-reply-to], [data-reply-cancel]');
+		if (!form || !button) {
+			return;
+		}
+		if (button.hasAttribute('data-reply-cancel')) {
+			setReplyParent(form, '', '');
+			return;
+		}
+		setReplyParent(form, button.dataset.replyTo, button.dataset.replyName);
+		form.body.focus();
+	});
+
+	document.addEventListener('submit', function(event) {
+		var form = event.target;
+		if (form.id !== 'reply-form') {
+			return;
+		}
+		// wait until the form's been read before clearing it
+		setTimeout(function() {
+			setReplyParent(form, '', '');
+		}, 0);
+	});
+}
@@ -9,18 +9,17 @@ import (
 	"crypto/md5"
 	"crypto/tls"
 	"database/sql"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime"
-	"mime/multipart"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/smtp"
 	"net/url"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -28,8 +27,6 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"os"
-
 	// Externals
 	//"github.com/badoux/checkmail"
 	"github.com/gorilla/csrf"
@@ -182,6 +179,206 @@ func addCommunityFavorite(w http.ResponseWriter, r *http.Request, CurrentUser us
 	stmt.Close()
 }
 
+// Invite a user to a community, or let them in if they've asked to join.
+func addCommunityMember(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityOwner(communityID, CurrentUser) {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	var userID int
+	db.QueryRow("SELECT id FROM users WHERE username = ?", r.FormValue("username")).Scan(&userID)
+	if userID == 0 {
+		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+		return
+	}
+	switch getCommunityMembership(communityID, userID) {
+	case 0:
+		_, err := db.Exec("UPDATE community_members SET status = 1, added_by = ? WHERE community = ? AND user = ?", CurrentUser.ID, communityID, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// type 8 - add member
+		logCommunityModAction(communityID, 8, userID, userID, CurrentUser)
+	case -1:
+		_, err := db.Exec("INSERT INTO community_members (community, user, status, added_by) VALUES (?, ?, 2, ?)", communityID, userID, CurrentUser.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// type 10 - invite member
+		logCommunityModAction(communityID, 10, userID, userID, CurrentUser)
+	}
+
+	http.Redirect(w, r, "/communities/"+communityID+"/members", 302)
+}
+
+// Make a user a moderator of a community.
+func addCommunityModerator(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityOwner(communityID, CurrentUser) {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	var userID int
+	db.QueryRow("SELECT id FROM users WHERE username = ?", r.FormValue("username")).Scan(&userID)
+	if userID == 0 {
+		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+		return
+	}
+	_, err := db.Exec("INSERT IGNORE INTO community_moderators (community, user, created_by) VALUES (?, ?, ?)", communityID, userID, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 6 - add moderator
+	logCommunityModAction(communityID, 6, userID, userID, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// RSVP to a community event, so it shows up in the user's calendar and they get reminded before it starts.
+func addEventRSVP(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	eventID := vars["id"]
+	events := getCommunityEvents(CurrentUser, "community_events.id = ? AND communities.rm = 0", eventID)
+	if len(events) == 0 || !checkIfCommunityMember(events[0].Community, CurrentUser) {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if events[0].Ended {
+		http.Error(w, "This event has already ended.", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("INSERT IGNORE INTO community_event_rsvps (event, user) VALUES (?, ?)", eventID, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/events/"+eventID, 302)
+}
+
+// Approve a community request, creating the community with the requester as its owner.
+func adminApproveCommunityRequest(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	vars := mux.Vars(r)
+	requestID := vars["id"]
+
+	// Claim the request first so approving it twice at once can't create two communities.
+	res, err := db.Exec("UPDATE community_requests SET status = 1, reviewed_by = ?, reviewed_at = NOW() WHERE id = ? AND status = 0", CurrentUser.ID, requestID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	claimed, _ := res.RowsAffected()
+	if claimed != 1 {
+		http.Error(w, "The request does not exist or has already been reviewed.", http.StatusNotFound)
+		return
+	}
+
+	var request communityRequest
+	var createdBy int
+	db.QueryRow("SELECT title, description, icon, banner, category, created_by FROM community_requests WHERE id = ?", requestID).Scan(&request.Title, &request.Description, &request.Icon, &request.Banner, &request.Category, &createdBy)
+	res, err = db.Exec("INSERT INTO communities (title, description, icon, banner, is_featured, owner, category) VALUES (?, ?, ?, ?, 0, ?, ?)", request.Title, request.Description, request.Icon, request.Banner, createdBy, request.Category)
+	if err != nil {
+		// put it back in the queue so it can be tried again
+		db.Exec("UPDATE community_requests SET status = 0, reviewed_by = NULL, reviewed_at = NULL WHERE id = ?", requestID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	communityID, _ := res.LastInsertId()
+	_, err = db.Exec("UPDATE community_requests SET community = ? WHERE id = ?", communityID, requestID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 13 - community request review
+	logAuditEvent(r, 13, requestID, createdBy, CurrentUser, map[string]interface{}{"status": "pending"}, map[string]interface{}{"status": "approved", "community": communityID})
+}
+
+// Approve a post or comment from the review queue.
+func adminApprovePending(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < 1 {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if vars["type"] == "posts" {
+		var posts = &post{}
+		err = db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, communities.id, title, icon, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND pending = 1 AND is_rm = 0 AND is_rm_by_admin = 0", id).Scan(&posts.ID, &posts.CreatedBy, &posts.CreatedAtTime, &posts.EditedAtTime, &posts.Feeling, &posts.BodyText, &posts.Image, &posts.AttachmentType, &posts.IsSpoiler, &posts.PostType, &posts.URL, &posts.URLType, &posts.Pinned, &posts.Privacy, &posts.RepostID, &posts.MigrationID, &posts.MigratedID, &posts.MigratedCommunity, &posts.CommunityID, &posts.CommunityName, &posts.CommunityIcon, &posts.PosterUsername, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.PosterOnline, &posts.PosterHideOnline, &posts.PosterColor, &posts.PosterRoleID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "The post could not be found.", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = db.Exec("UPDATE posts SET pending = 0 WHERE id = ?", id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		db.Exec("DELETE FROM reports WHERE pid = ? AND type = 0", id)
+		// type 16 - approve post
+		logAuditEvent(r, 16, id, posts.CreatedBy, CurrentUser, map[string]interface{}{"pending": true}, map[string]interface{}{"pending": false})
+
+		poster := QueryUser(posts.PosterUsername, settings.DefaultTimezone)
+		posts = setupPost(posts, poster, 0, 0)
+		setupPostAttachments(posts)
+		publishPost(*posts, poster)
+	} else {
+		var comments = comment{}
+		var timestamp time.Time
+		var role int
+		var postBy int
+		err = db.QueryRow("SELECT comments.id, comments.created_by, comments.created_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.painting_alt, comments.url, comments.url_type, post, IFNULL(comments.parent, 0), posts.created_by, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments LEFT JOIN posts ON posts.id = post LEFT JOIN users ON users.id = comments.created_by WHERE comments.id = ? AND comments.pending = 1 AND comments.is_rm = 0 AND comments.is_rm_by_admin = 0", id).Scan(&comments.ID, &comments.CreatedBy, &timestamp, &comments.Feeling, &comments.BodyText, &comments.Image, &comments.AttachmentType, &comments.IsSpoiler, &comments.PostType, &comments.PaintingAlt, &comments.URL, &comments.URLType, &comments.PostID, &comments.ParentID, &postBy, &comments.CommenterUsername, &comments.CommenterNickname, &comments.CommenterIcon, &comments.CommenterHasMii, &comments.CommenterOnline, &comments.CommenterHideOnline, &comments.CommenterColor, &role)
+		if err == sql.ErrNoRows {
+			http.Error(w, "The comment could not be found.", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = db.Exec("UPDATE comments SET pending = 0 WHERE id = ?", id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		db.Exec("DELETE FROM reports WHERE pid = ? AND type = 1", id)
+		// type 17 - approve comment
+		logAuditEvent(r, 17, id, comments.CreatedBy, CurrentUser, map[string]interface{}{"pending": true}, map[string]interface{}{"pending": false})
+
+		commenter := QueryUser(comments.CommenterUsername, settings.DefaultTimezone)
+		comments.CommenterIcon = getAvatar(comments.CommenterIcon, comments.CommenterHasMii, comments.Feeling)
+		if role > 0 {
+			comments.CommenterRoleImage = getRoleImage(role)
+		}
+		comments.CreatedAt = humanTiming(timestamp, commenter.Timezone)
+		comments.CreatedAtUnix = timestamp.Unix()
+		comments.Body = parseBody(comments.BodyText, false, true)
+		comments.Attachments = getAttachments(1, comments.ID)
+		publishComment(comments, strconv.Itoa(comments.PostID), postBy, commenter)
+	}
+
+	w.Write([]byte("Success!"))
+}
+
 // Ban a user.
 func adminBanUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if CurrentUser.Level < admin.Manage.MinimumLevel {
@@ -190,9 +387,11 @@ func adminBanUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 
 	length := r.FormValue("length")
-	cidr := r.FormValue("cidr")
-	if cidr != "1" && cidr != "2" {
-		cidr = "0"
+	bits, _ := strconv.Atoi(r.FormValue("range"))
+	reason := r.FormValue("reason")
+	if utf8.RuneCountInString(reason) > 255 {
+		http.Error(w, "The reason is too long. (255 characters maximum)", http.StatusBadRequest)
+		return
 	}
 	username := r.FormValue("username")
 	userID := -1
@@ -202,11 +401,23 @@ func adminBanUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		http.Error(w, "The user does not exist.", http.StatusBadRequest)
 		return
 	}
-	if len(ip) > 0 && (cidr == "1" || cidr == "2") {
-		ip = getCIDR(ip, cidr)
+
+	// Ban the range the user's last IP is in too, if they have one.
+	var banRange string
+	var rangeStart, rangeEnd []byte
+	if len(ip) > 0 {
+		prefix, err := parseIPRange(ip, bits)
+		if err == nil {
+			err = checkIPRangeSize(prefix)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			banRange = prefix.String()
+			rangeStart, rangeEnd = getIPRangeBounds(prefix)
+		}
 	}
-	fmt.Println(length)
-	_, err = db.Exec("REPLACE INTO bans (user, ip, cidr, until, ban_by) VALUES (?, ?, ?, NOW() + INTERVAL ? DAY, ?)", userID, ip, cidr, length, CurrentUser.ID)
+	_, err = db.Exec("INSERT INTO bans (user, ip, range_start, range_end, reason, until, ban_by) VALUES (?, ?, ?, ?, ?, NOW() + INTERVAL ? DAY, ?)", userID, banRange, rangeStart, rangeEnd, reason, length, CurrentUser.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -227,153 +438,610 @@ func adminBanUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	w.Write([]byte("Success!"))
 	// audit log
 	// type 2 - ban user
-	db.Exec("INSERT INTO audit_log_entries(type, context, created_by) values(2, ?, ?)", userID, CurrentUser.ID)
+	logAuditEvent(r, 2, userID, userID, CurrentUser, nil, map[string]interface{}{"reason": reason, "length": length, "range": banRange})
 }
 
-// Unban a user.
-func adminUnbanUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+// Add a moderator note to a user's dossier.
+func adminCreateModNote(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if CurrentUser.Level < admin.Manage.MinimumLevel {
 		http.Redirect(w, r, "/", 302)
 		return
 	}
+	vars := mux.Vars(r)
+	var userID int
+	db.QueryRow("SELECT id FROM users WHERE username = ?", vars["username"]).Scan(&userID)
+	if userID == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
 
-	username := r.FormValue("username")
-	userID := -1
-	var ip string
-	db.QueryRow("SELECT id, ip FROM users WHERE username = ? LIMIT 1", username).Scan(&userID, &ip)
-	if userID == -1 {
-		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+	body := strings.TrimSpace(r.FormValue("body"))
+	if len(body) == 0 {
+		http.Error(w, "The note can't be empty.", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > 2000 {
+		http.Error(w, "The note is too long. (2000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO mod_notes (user, body, created_by) VALUES (?, ?, ?)", userID, body, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/"+vars["username"]+"/dossier", 302)
+}
+
+// Delete an automod rule.
+func adminDeleteAutomodRule(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	vars := mux.Vars(r)
+	ruleBefore := getAutomodRuleForAuditLog(vars["id"])
+	_, err = db.Exec("DELETE FROM automod_rules WHERE id = ?", vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	cidr := getCIDR(ip, "1")
-	cidr2 := getCIDR(ip, "2")
-	db.Exec("DELETE FROM bans WHERE user = ? OR (cidr = 0 AND ip = ?) OR (cidr = 1 AND ip = ?) OR (cidr = 2 AND ip = ?)", userID, ip, cidr, cidr2)
+
 	w.Write([]byte("Success!"))
 	// audit log
-	// type 3 - unban user
-	db.Exec("INSERT INTO audit_log_entries(type, context, created_by) values(3, ?, ?)", userID, CurrentUser.ID)
+	// type 12 - change automod rule
+	logAuditEvent(r, 12, vars["id"], 0, CurrentUser, ruleBefore, nil)
 }
 
-// audit log
-func showAdminAuditLog(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+// Delete a moderator note.
+func adminDeleteModNote(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if CurrentUser.Level < admin.Manage.MinimumLevel {
 		http.Redirect(w, r, "/", 302)
 		return
 	}
+	vars := mux.Vars(r)
 
-	offset, _ := strconv.Atoi(r.FormValue("offset"))
-	offsetTime, err := strconv.ParseInt(r.FormValue("offset_time"), 10, 64)
+	// Notes can only be deleted by whoever wrote them, or by someone ranked above them.
+	_, err := db.Exec("DELETE mod_notes FROM mod_notes LEFT JOIN users ON users.id = mod_notes.created_by WHERE mod_notes.id = ? AND (mod_notes.created_by = ? OR IFNULL(users.level, 0) < ?)", vars["id"], CurrentUser.ID, CurrentUser.Level)
 	if err != nil {
-		offsetTime = time.Now().Unix()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	typee := r.FormValue("type")
-	username := r.FormValue("username")
+	http.Redirect(w, r, "/users/"+vars["username"]+"/dossier", 302)
+}
 
-	var rows *sql.Rows
-	//var err error
+// Edit an automod rule.
+func adminEditAutomodRule(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
 
-	if typee != "" {
-		if username != "" {
-			var userIdThing int
-			db.QueryRow("SELECT id FROM users WHERE username = ? LIMIT 1", username).Scan(&userIdThing)
-			rows, err = db.Query("SELECT id, type, context, created_at, created_by FROM audit_log_entries WHERE type = ? AND created_by = ? AND UNIX_TIMESTAMP(created_at) <= ? ORDER BY created_at DESC LIMIT 50 OFFSET ?", typee, userIdThing, offsetTime, offset)
-		} else {
-			rows, err = db.Query("SELECT id, type, context, created_at, created_by FROM audit_log_entries WHERE type = ? AND UNIX_TIMESTAMP(created_at) <= ? ORDER BY created_at DESC LIMIT 50 OFFSET ?", typee, offsetTime, offset)
-		}
-	} else {
-		if username != "" {
-			var userIdThing int
-			db.QueryRow("SELECT id FROM users WHERE username = ? LIMIT 1", username).Scan(&userIdThing)
-			rows, err = db.Query("SELECT id, type, context, created_at, created_by FROM audit_log_entries WHERE created_by = ? AND UNIX_TIMESTAMP(created_at) <= ? ORDER BY created_at DESC LIMIT 50 OFFSET ?", userIdThing, offsetTime, offset)
-		} else {
-			rows, err = db.Query("SELECT id, type, context, created_at, created_by FROM audit_log_entries WHERE UNIX_TIMESTAMP(created_at) <= ? ORDER BY created_at DESC LIMIT 50 OFFSET ?", offsetTime, offset)
-		}
+	vars := mux.Vars(r)
+	var rule automodRule
+	rule.Name = r.FormValue("name")
+	rule.ConditionType, _ = strconv.Atoi(r.FormValue("condition_type"))
+	rule.Value = r.FormValue("value")
+	rule.Action, _ = strconv.Atoi(r.FormValue("action"))
+	rule.DryRun = r.FormValue("dry_run") == "1"
+	rule.Enabled = r.FormValue("enabled") == "1"
+
+	if ruleError := checkAutomodRule(rule); len(ruleError) > 0 {
+		http.Error(w, ruleError, http.StatusBadRequest)
+		return
 	}
+	ruleBefore := getAutomodRuleForAuditLog(vars["id"])
+	_, err = db.Exec("UPDATE automod_rules SET name = ?, condition_type = ?, value = ?, action = ?, dry_run = ?, enabled = ? WHERE id = ?", rule.Name, rule.ConditionType, rule.Value, rule.Action, rule.DryRun, rule.Enabled, vars["id"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var auditLogEntries []auditLogEntry
 
-	for rows.Next() {
-		var row = auditLogEntry{}
-		var targetUser user
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 12 - change automod rule
+	logAuditEvent(r, 12, vars["id"], 0, CurrentUser, ruleBefore, getAutomodRuleForAuditLog(vars["id"]))
+}
+
+// Edit a ban's reason, length or range.
+func adminEditBan(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	vars := mux.Vars(r)
+	table := "bans"
+	if vars["type"] == "asn" {
+		table = "ip_bans"
+	}
+	reason := r.FormValue("reason")
+	if utf8.RuneCountInString(reason) > 255 {
+		http.Error(w, "The reason is too long. (255 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	banBefore, target := getBanForAuditLog(table, vars["id"])
+	if banBefore == nil {
+		handle404(w, r, CurrentUser)
+		return
+	}
 
-		err = rows.Scan(&row.ID, &row.Type, &row.Context, &row.CreatedAt, &row.CreatedBy)
+	_, err = db.Exec("UPDATE "+table+" SET reason = ? WHERE id = ?", reason, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if length := r.FormValue("length"); len(length) > 0 {
+		_, err = db.Exec("UPDATE "+table+" SET until = created_at + INTERVAL ? DAY WHERE id = ?", length, vars["id"])
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if row.Type == 2 || row.Type == 3 {
-			// ONLY get user
-			db.QueryRow("SELECT username, avatar, has_mh FROM users WHERE id = ? LIMIT 1", row.Context).Scan(&targetUser.Username, &targetUser.Avatar, &targetUser.HasMii)
-		} else {
-			// post and then user
-			var targetUserId int
-			var postBody string
-			if row.Type == 0 {
-				db.QueryRow("SELECT body, created_by FROM posts WHERE id = ? LIMIT 1", row.Context).Scan(&postBody, &targetUserId)
-			} else if row.Type == 1 {
-				db.QueryRow("SELECT body, created_by FROM comments WHERE id = ? LIMIT 1", row.Context).Scan(&postBody, &targetUserId)
-			} else if row.Type == 4 {
-				db.QueryRow("SELECT token, user FROM password_resets WHERE id = ? LIMIT 1", row.Context).Scan(&postBody, &targetUserId)
-				if targetUserId == 1 {
-					targetUserId = row.CreatedBy
-					targetUser.ID = row.CreatedBy
-					targetUser.Username = postBody
-				}
-			}
-			if postBody != "" {
-				row.PostSummary = " ("
-				if len(postBody) > 50 {
-					row.PostSummary += postBody[0:50] + "..."
-				} else {
-					row.PostSummary += postBody
-				}
-				row.PostSummary += ")"
-			}
-			db.QueryRow("SELECT avatar, has_mh FROM users WHERE id = ? LIMIT 1", targetUserId).Scan(&targetUser.Avatar, &targetUser.HasMii)
+	}
+	if ip := r.FormValue("ip"); table == "bans" && len(ip) > 0 {
+		prefix, err := parseIPRange(ip, 0)
+		if err != nil {
+			http.Error(w, "Invalid IP range.", http.StatusBadRequest)
+			return
 		}
-		row.TargetUserAvatar = getAvatar(targetUser.Avatar, targetUser.HasMii, 0)
-		switch row.Type {
-		case 0:
-			row.TypeText = "post delete"
-			row.TypeURI = "/posts/" + strconv.Itoa(row.Context)
-		case 1:
-			row.TypeText = "comment delete"
-			row.TypeURI = "/comments/" + strconv.Itoa(row.Context)
-		case 2:
-			row.TypeText = "ban"
-			row.TypeURI = "/users/" + targetUser.Username
-		case 3:
-			row.TypeText = "unban"
-			row.TypeURI = "/users/" + targetUser.Username
-		case 4:
-			row.TypeText = "invite"
-			if targetUser.ID == row.CreatedBy {
-				row.TypeURI = "/invite/" + targetUser.Username
-			} else {
-				row.TypeURI = "/users/" + targetUser.Username
-			}
+		err = checkIPRangeSize(prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rangeStart, rangeEnd := getIPRangeBounds(prefix)
+		_, err = db.Exec("UPDATE bans SET ip = ?, range_start = ?, range_end = ? WHERE id = ?", prefix.String(), rangeStart, rangeEnd, vars["id"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		db.QueryRow("SELECT username, nickname, avatar, has_mh FROM users WHERE id = ? LIMIT 1", row.CreatedBy).Scan(&row.CreatorUsername, &row.CreatorNickname, &row.CreatorAvatar, &row.CreatorHasMii)
-		row.CreatorFinalAva = getAvatar(row.CreatorAvatar, row.CreatorHasMii, 3)
-		auditLogEntries = append(auditLogEntries, row)
 	}
-	rows.Close()
 
-	var data = map[string]interface{}{
-		"AuditLogEntries": auditLogEntries,
-		"Offset":          offset,
-		"OffsetTime":      offsetTime,
-		"Type":            typee,
-		"User":            username,
-	}
-	err = templates.ExecuteTemplate(w, "audit_logs.html", data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 11 - edit ban
+	banAfter, _ := getBanForAuditLog(table, vars["id"])
+	logAuditEvent(r, 11, vars["id"], target, CurrentUser, banBefore, banAfter)
+}
+
+// Feature, unfeature, archive or unarchive a community.
+func adminEditCommunityStatus(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+
+	var isFeatured, rm bool
+	err := db.QueryRow("SELECT is_featured, rm FROM communities WHERE id = ?", communityID).Scan(&isFeatured, &rm)
+	if err == sql.ErrNoRows {
+		http.Error(w, "The community does not exist.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	before := map[string]interface{}{"is_featured": isFeatured, "rm": rm}
+
+	switch vars["action"] {
+	case "feature":
+		isFeatured = true
+	case "unfeature":
+		isFeatured = false
+	case "archive":
+		rm = true
+	case "unarchive":
+		rm = false
+	}
+	_, err = db.Exec("UPDATE communities SET is_featured = ?, rm = ? WHERE id = ?", isFeatured, rm, communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 14 - community change
+	logAuditEvent(r, 14, communityID, 0, CurrentUser, before, map[string]interface{}{"is_featured": isFeatured, "rm": rm})
+}
+
+// Expire a ban early.
+func adminExpireBan(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if vars["type"] == "asn" {
+		_, err = db.Exec("UPDATE ip_bans SET until = NOW() WHERE id = ? AND until > NOW()", vars["id"])
+	} else {
+		_, err = db.Exec("UPDATE bans SET until = NOW() WHERE id = ? AND until > NOW()", vars["id"])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Success!"))
+	if vars["type"] == "ip" {
+		var userID sql.NullInt64
+		db.QueryRow("SELECT user FROM bans WHERE id = ?", vars["id"]).Scan(&userID)
+		if userID.Valid {
+			// audit log
+			// type 3 - unban user
+			logAuditEvent(r, 3, userID.Int64, int(userID.Int64), CurrentUser, map[string]interface{}{"ban": vars["id"], "banned": true}, map[string]interface{}{"ban": vars["id"], "banned": false})
+		}
+	}
+}
+
+// Limit a user's visibility.
+func adminLimitUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	username := r.FormValue("username")
+	userID := -1
+	var level int
+	db.QueryRow("SELECT id, level FROM users WHERE username = ? LIMIT 1", username).Scan(&userID, &level)
+	if userID == -1 {
+		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+		return
+	}
+	if level > 0 {
+		http.Error(w, "You can't limit admins.", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("UPDATE users SET limited = 1 WHERE id = ?", userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 5 - limit user
+	logAuditEvent(r, 5, userID, userID, CurrentUser, map[string]interface{}{"limited": false}, map[string]interface{}{"limited": true})
+}
+
+// Reject a community request.
+func adminRejectCommunityRequest(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	vars := mux.Vars(r)
+	requestID := vars["id"]
+	reason := r.FormValue("reason")
+	if utf8.RuneCountInString(reason) > 255 {
+		http.Error(w, "The reason is too long. (255 characters maximum)", http.StatusBadRequest)
+		return
+	}
+
+	var createdBy int
+	db.QueryRow("SELECT created_by FROM community_requests WHERE id = ? AND status = 0", requestID).Scan(&createdBy)
+	if createdBy == 0 {
+		http.Error(w, "The request does not exist or has already been reviewed.", http.StatusNotFound)
+		return
+	}
+	_, err := db.Exec("UPDATE community_requests SET status = 2, reviewed_by = ?, reviewed_at = NOW(), reason = ? WHERE id = ?", CurrentUser.ID, reason, requestID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 13 - community request review
+	logAuditEvent(r, 13, requestID, createdBy, CurrentUser, map[string]interface{}{"status": "pending"}, map[string]interface{}{"status": "rejected", "reason": reason})
+}
+
+// Unban a user.
+func adminUnbanUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	username := r.FormValue("username")
+	userID := -1
+	var ip string
+	db.QueryRow("SELECT id, ip FROM users WHERE username = ? LIMIT 1", username).Scan(&userID, &ip)
+	if userID == -1 {
+		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+		return
+	}
+	ipBytes := getIPBytes(ip)
+	_, err = db.Exec("UPDATE bans SET until = NOW() WHERE (user = ? OR (LENGTH(range_start) = ? AND ? BETWEEN range_start AND range_end)) AND until > NOW()", userID, len(ipBytes), ipBytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 3 - unban user
+	logAuditEvent(r, 3, userID, userID, CurrentUser, map[string]interface{}{"banned": true}, map[string]interface{}{"banned": false})
+}
+
+// Undo a nuke.
+func adminUndoNuke(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	vars := mux.Vars(r)
+	nukeID := vars["id"]
+
+	var userID int
+	err := db.QueryRow("SELECT IFNULL(user, 0) FROM nukes WHERE id = ?", nukeID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		handle404(w, r, CurrentUser)
+		return
+	}
+
+	// Mark it as undone before putting anything back, so two people undoing it at once can't both go through.
+	res, err := db.Exec("UPDATE nukes SET undone = 1 WHERE id = ? AND undone = 0", nukeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if claimed, _ := res.RowsAffected(); claimed != 1 {
+		http.Error(w, "This nuke has already been undone.", http.StatusBadRequest)
+		return
+	}
+
+	for _, table := range []string{"posts", "comments", "messages"} {
+		_, err = db.Exec("UPDATE "+table+" SET is_rm_by_admin = 0, nuke = NULL WHERE nuke = ?", nukeID)
+		if err != nil {
+			db.Exec("UPDATE nukes SET undone = 0 WHERE id = ?", nukeID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = db.Exec("INSERT IGNORE INTO yeahs (id, yeah_post, yeah_by, on_comment, created_at) SELECT yeah_id, yeah_post, yeah_by, on_comment, created_at FROM nuked_yeahs WHERE nuke = ?", nukeID)
+	if err != nil {
+		db.Exec("UPDATE nukes SET undone = 0 WHERE id = ?", nukeID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.Exec("DELETE FROM nuked_yeahs WHERE nuke = ?", nukeID)
+	_, err = db.Exec("INSERT IGNORE INTO reports (id, type, pid, message, user, reason, is_rm, community_reason, created_at) SELECT report_id, type, pid, message, user, reason, is_rm, community_reason, created_at FROM nuked_reports WHERE nuke = ?", nukeID)
+	if err != nil {
+		db.Exec("UPDATE nukes SET undone = 0 WHERE id = ?", nukeID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.Exec("DELETE FROM nuked_reports WHERE nuke = ?", nukeID)
+
+	// audit log
+	// type 8 - undo nuke
+	logAuditEvent(r, 8, nukeID, userID, CurrentUser, map[string]interface{}{"undone": false}, map[string]interface{}{"undone": true})
+
+	w.Write([]byte("Success!"))
+}
+
+// Lift a user's visibility limit.
+func adminUnlimitUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	username := r.FormValue("username")
+	userID := -1
+	db.QueryRow("SELECT id FROM users WHERE username = ? LIMIT 1", username).Scan(&userID)
+	if userID == -1 {
+		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("UPDATE users SET limited = 0 WHERE id = ?", userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Success!"))
+	// audit log
+	// type 6 - unlimit user
+	logAuditEvent(r, 6, userID, userID, CurrentUser, map[string]interface{}{"limited": true}, map[string]interface{}{"limited": false})
+}
+
+// audit log
+func showAdminAuditLog(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	offsetTime, err := strconv.ParseInt(r.FormValue("offset_time"), 10, 64)
+	if err != nil {
+		offsetTime = time.Now().Unix()
+	}
+	typee := r.FormValue("type")
+	username := r.FormValue("username")
+	format := r.FormValue("format")
+	location, err := time.LoadLocation(CurrentUser.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	since, err := time.ParseInLocation("2006-01-02", r.FormValue("since"), location)
+	if err != nil {
+		since = time.Unix(0, 0)
+	}
+	until, err := time.ParseInLocation("2006-01-02", r.FormValue("until"), location)
+	if err != nil {
+		until = time.Now()
+	} else {
+		until = until.AddDate(0, 0, 1)
+	}
+	var userIdThing int
+	if username != "" {
+		userIdThing = -1
+		db.QueryRow("SELECT id FROM users WHERE username = ? LIMIT 1", username).Scan(&userIdThing)
+	}
+
+	// Exports get everything that matches instead of a page at a time.
+	pagination := " LIMIT 50 OFFSET ?"
+	args := []interface{}{typee, typee, userIdThing, userIdThing, since, until, offsetTime}
+	if format == "csv" || format == "json" {
+		pagination = ""
+	} else {
+		args = append(args, offset)
+	}
+
+	rows, err := db.Query("SELECT audit_log_entries.id, audit_log_entries.type, context, audit_log_entries.created_at, audit_log_entries.created_by, IFNULL(before_value, ''), IFNULL(after_value, ''), IFNULL(audit_log_entries.ip, ''), IFNULL(creator.username, ''), IFNULL(creator.nickname, ''), IFNULL(creator.avatar, ''), IFNULL(creator.has_mh, 0), IFNULL(target.username, ''), IFNULL(target.avatar, ''), IFNULL(target.has_mh, 0), IFNULL(CASE audit_log_entries.type WHEN 0 THEN posts.body WHEN 1 THEN comments.body WHEN 4 THEN password_resets.token WHEN 7 THEN nukes.ip WHEN 8 THEN nukes.ip END, ''), IFNULL(password_resets.user, 0) FROM audit_log_entries LEFT JOIN posts ON audit_log_entries.type = 0 AND posts.id = context LEFT JOIN comments ON audit_log_entries.type = 1 AND comments.id = context LEFT JOIN password_resets ON audit_log_entries.type = 4 AND password_resets.id = context LEFT JOIN nukes ON audit_log_entries.type IN (7, 8) AND nukes.id = context LEFT JOIN users AS creator ON creator.id = audit_log_entries.created_by LEFT JOIN users AS target ON target.id = COALESCE(audit_log_entries.target, posts.created_by, comments.created_by, nukes.user, password_resets.user, IF(audit_log_entries.type IN (2, 3, 5, 6), context, NULL)) WHERE (? = '' OR audit_log_entries.type = ?) AND (? = 0 OR audit_log_entries.created_by = ?) AND audit_log_entries.created_at BETWEEN ? AND ? AND UNIX_TIMESTAMP(audit_log_entries.created_at) <= ? ORDER BY audit_log_entries.created_at DESC"+pagination, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var auditLogEntries []auditLogEntry
+
+	for rows.Next() {
+		var row = auditLogEntry{}
+		var targetAvatar, postBody string
+		var targetHasMii bool
+		var inviteUser int
+
+		err = rows.Scan(&row.ID, &row.Type, &row.Context, &row.CreatedAtTime, &row.CreatedBy, &row.Before, &row.After, &row.IP, &row.CreatorUsername, &row.CreatorNickname, &row.CreatorAvatar, &row.CreatorHasMii, &row.TargetUsername, &targetAvatar, &targetHasMii, &postBody, &inviteUser)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if postBody != "" {
+			row.PostSummary = " ("
+			if len(postBody) > 50 {
+				row.PostSummary += postBody[0:50] + "..."
+			} else {
+				row.PostSummary += postBody
+			}
+			row.PostSummary += ")"
+		}
+		row.CreatedAt = row.CreatedAtTime.Format("2006-01-02 15:04:05")
+		row.TargetUserAvatar = getAvatar(targetAvatar, targetHasMii, 0)
+		switch row.Type {
+		case 0:
+			row.TypeText = "post delete"
+			row.TypeURI = "/posts/" + strconv.Itoa(row.Context)
+		case 1:
+			row.TypeText = "comment delete"
+			row.TypeURI = "/comments/" + strconv.Itoa(row.Context)
+		case 2:
+			row.TypeText = "ban"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 3:
+			row.TypeText = "unban"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 5:
+			row.TypeText = "limit"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 6:
+			row.TypeText = "unlimit"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 7:
+			row.TypeText = "nuke"
+			row.TypeURI = "/admin/nuke"
+		case 8:
+			row.TypeText = "undo nuke"
+			row.TypeURI = "/admin/nuke"
+		case 9:
+			row.TypeText = "settings change"
+			row.TypeURI = "/admin/settings"
+		case 10:
+			row.TypeText = "report dismiss"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 11:
+			row.TypeText = "ban edit"
+			row.TypeURI = "/admin/bans"
+		case 12:
+			row.TypeText = "automod rule change"
+			row.TypeURI = "/admin/automod"
+		case 13:
+			row.TypeText = "community request review"
+			row.TypeURI = "/admin/communities"
+		case 14:
+			row.TypeText = "community change"
+			row.TypeURI = "/communities/" + strconv.Itoa(row.Context)
+		case 15:
+			row.TypeText = "ban create"
+			row.TypeURI = "/admin/bans"
+		case 16:
+			row.TypeText = "post approve"
+			row.TypeURI = "/posts/" + strconv.Itoa(row.Context)
+		case 17:
+			row.TypeText = "comment approve"
+			row.TypeURI = "/comments/" + strconv.Itoa(row.Context)
+		case 4:
+			row.TypeText = "invite"
+			if inviteUser == 1 {
+				row.TypeURI = "/invite/" + postBody
+				row.TargetUsername = row.CreatorUsername
+				row.TargetUserAvatar = getAvatar(row.CreatorAvatar, row.CreatorHasMii, 0)
+			} else {
+				row.TypeURI = "/users/" + row.TargetUsername
+			}
+		}
+		row.CreatorFinalAva = getAvatar(row.CreatorAvatar, row.CreatorHasMii, 3)
+		auditLogEntries = append(auditLogEntries, row)
+	}
+	rows.Close()
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=audit_log.csv")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "type", "action", "actor", "target", "context", "before", "after", "ip", "created_at"})
+		for _, entry := range auditLogEntries {
+			writer.Write([]string{strconv.Itoa(entry.ID), strconv.Itoa(entry.Type), entry.TypeText, entry.CreatorUsername, entry.TargetUsername, strconv.Itoa(entry.Context), entry.Before, entry.After, entry.IP, entry.CreatedAtTime.Format(time.RFC3339)})
+		}
+		writer.Flush()
+		return
+	case "json":
+		var export []auditLogExport
+		for _, entry := range auditLogEntries {
+			row := auditLogExport{
+				ID:        entry.ID,
+				Type:      entry.Type,
+				Action:    entry.TypeText,
+				Actor:     entry.CreatorUsername,
+				Target:    entry.TargetUsername,
+				Context:   entry.Context,
+				IP:        entry.IP,
+				CreatedAt: entry.CreatedAtTime.Format(time.RFC3339),
+			}
+			if len(entry.Before) > 0 {
+				row.Before = json.RawMessage(entry.Before)
+			}
+			if len(entry.After) > 0 {
+				row.After = json.RawMessage(entry.After)
+			}
+			export = append(export, row)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=audit_log.json")
+		json.NewEncoder(w).Encode(export)
+		return
+	}
+
+	var data = map[string]interface{}{
+		"AuditLogEntries": auditLogEntries,
+		"Offset":          offset,
+		"OffsetTime":      offsetTime,
+		"Type":            typee,
+		"User":            username,
+		"Since":           r.FormValue("since"),
+		"Until":           r.FormValue("until"),
+	}
+	err = templates.ExecuteTemplate(w, "audit_logs.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
 // Block a user.
 func blockUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
@@ -474,7 +1142,6 @@ func cancelFriendRequest(w http.ResponseWriter, r *http.Request, CurrentUser use
 func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
 	post_id := vars["id"]
-	user_id := CurrentUser.ID
 	post_type := r.FormValue("post_type")
 	body := r.FormValue("body")
 	painting := r.FormValue("painting")
@@ -487,11 +1154,13 @@ func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	url_type := 0
 	is_spoiler := r.FormValue("is_spoiler")
 	feeling := r.FormValue("feeling_id")
+	parent_id := r.FormValue("parent")
+	var paintingAlt string
 
 	// Check if a comment has been made recently.
-	var post_by int
+	var post_by, communityID int
 	var recent_comment int
-	db.QueryRow("SELECT created_by FROM posts WHERE id = ?", post_id).Scan(&post_by)
+	db.QueryRow("SELECT created_by, community_id FROM posts WHERE id = ?", post_id).Scan(&post_by, &communityID)
 	if CurrentUser.ID != post_by {
 		db.QueryRow("SELECT COUNT(*) FROM comments WHERE created_by = ? AND created_at > DATE_SUB(NOW(), INTERVAL 10 SECOND)", CurrentUser.ID).Scan(&recent_comment)
 		if recent_comment > 0 {
@@ -511,40 +1180,33 @@ func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		http.Error(w, "Your comment is empty.", http.StatusBadRequest)
 		return
 	}
-	if len(image) > 0 {
-		imageURL := ""
-		db.QueryRow("SELECT value FROM images WHERE id = ?", image).Scan(&imageURL)
-		if len(imageURL) == 0 {
-			http.Error(w, "Invalid image.", http.StatusBadRequest)
-			return
-		}
-		image = imageURL
+	if checkIfCommunityBanned(communityID, CurrentUser.ID) {
+		http.Error(w, "You have been banned from commenting in this community.", http.StatusForbidden)
+		return
+	}
+	if !checkIfCommunityMember(communityID, CurrentUser) {
+		http.Error(w, "You have to be a member of this community to comment in it.", http.StatusForbidden)
+		return
+	}
+	attachments, err := getFormAttachments(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if len(attachment_type) == 0 {
-		attachment_type = "0"
+	if len(attachments) > 0 {
+		image = attachments[0].URL
+	}
+	attachment_type, err = getAttachmentType(attachment_type, attachments)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	if len(is_spoiler) == 0 {
 		is_spoiler = "0"
 	}
 
-	if len(body) > 0 {
-		matched := youtube.FindAllStringSubmatch(body, 1)
-		if len(matched) > 0 {
-			url = matched[0][1]
-			url_type = 1
-		} else {
-			matched = spotify.FindAllStringSubmatch(body, 1)
-			if len(matched) > 0 {
-				url = matched[0][1]
-				url_type = 2
-			} else {
-				matched = soundcloud.FindAllStringSubmatch(body, 1)
-				if len(matched) > 0 {
-					url = "https://" + matched[0][0]
-					url_type = 3
-				}
-			}
-		}
+	if embedURL, embedType := getEmbed(body); embedType > 0 {
+		url, url_type = embedURL, embedType
 	}
 	if len(post_type) == 0 {
 		post_type = "0"
@@ -558,6 +1220,11 @@ func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			http.Error(w, "Invalid drawing.", http.StatusBadRequest)
 			return
 		}
+		paintingAlt, err = getFormPaintingAlt(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	} else if post_type != "0" {
 		http.Error(w, "Invalid post type.", http.StatusBadRequest)
 		return
@@ -574,10 +1241,40 @@ func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		return
 	}
 
-	stmt, err := db.Prepare("INSERT comments SET created_by = ?, post = ?, body = ?, image = ?, attachment_type = ?, url = ?, url_type = ?, is_spoiler = ?, post_type = ?, feeling = ?")
+	// Replies have to be to a visible comment on the same post.
+	var parent sql.NullInt64
+	var parentNickname string
+	if len(parent_id) > 0 && parent_id != "0" {
+		err := db.QueryRow("SELECT comments.id, nickname FROM comments LEFT JOIN users ON users.id = created_by WHERE comments.id = ? AND post = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND pending = 0", parent_id, post_id).Scan(&parent.Int64, &parentNickname)
+		if err != nil {
+			http.Error(w, "The comment you're replying to could not be found.", http.StatusBadRequest)
+			return
+		}
+		parent.Valid = true
+	}
+
+	// Run the comment through the automod. Drawings only have an image URL as their body.
+	automodBody := body
+	if post_type == "1" {
+		automodBody = ""
+	}
+	automod := checkAutomod(CurrentUser, 1, automodBody, len(image) > 0 || post_type == "1")
+	if automod.Block {
+		http.Error(w, "Your comment was blocked by the automatic moderation.", http.StatusBadRequest)
+		return
+	}
+	if automod.Spoiler {
+		is_spoiler = "1"
+	}
+	if automod.Limit {
+		CurrentUser.Limited = true
+	}
+	pending := automod.Hold || shouldHoldContent(CurrentUser)
+
+	stmt, err := db.Prepare("INSERT comments SET created_by = ?, post = ?, body = ?, image = ?, attachment_type = ?, painting_alt = ?, url = ?, url_type = ?, is_spoiler = ?, post_type = ?, feeling = ?, pending = ?, parent = ?")
 	if err == nil {
 		// If there's no errors, we can go ahead and execute the statement.
-		_, err := stmt.Exec(CurrentUser.ID, post_id, body, image, attachment_type, url, url_type, is_spoiler, post_type, feeling)
+		_, err := stmt.Exec(CurrentUser.ID, post_id, body, image, attachment_type, paintingAlt, url, url_type, is_spoiler, post_type, feeling, pending, parent)
 		stmt.Close()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -598,6 +1295,16 @@ func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		comments.CreatedAt = humanTiming(timestamp, CurrentUser.Timezone)
 		comments.CreatedAtUnix = timestamp.Unix()
 		comments.Body = parseBody(comments.BodyText, false, true)
+		comments.Pending = pending
+		comments.ParentID = int(parent.Int64)
+		comments.ParentNickname = parentNickname
+		err = saveAttachments(1, comments.ID, attachments)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		comments.Attachments = attachments
+		comments.PaintingAlt = paintingAlt
 
 		comments.ByMii = true
 		var data = map[string]interface{}{
@@ -606,65 +1313,21 @@ func createComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		}
 
 		data["ByMe"] = CurrentUser.ID == post_by
-		if data["ByMe"] == true {
-			notif_getcomments, _ := db.Query("SELECT created_by FROM comments WHERE post = ? AND created_by != ? AND is_rm = 0 GROUP BY created_by", &post_id, &user_id)
-			var notif_comment_by int
-
-			for notif_getcomments.Next() {
-				notif_getcomments.Scan(&notif_comment_by)
-
-				createNotif(notif_comment_by, 3, post_id, CurrentUser.ID)
-			}
-			notif_getcomments.Close()
-		} else {
-			createNotif(post_by, 2, post_id, CurrentUser.ID)
-		}
 
 		err = templates.ExecuteTemplate(w, "create_comment.html", data)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
-		var commentTpl bytes.Buffer
-		var commentPreviewTpl bytes.Buffer
-		comments.ByMii = false
-		data["CanYeah"] = true
-		templates.ExecuteTemplate(&commentTpl, "create_comment.html", data)
-		var commentCount int
-		db.QueryRow("SELECT COUNT(*) FROM comments WHERE post = ?", post_id).Scan(&commentCount)
-		data = map[string]interface{}{
-			"CommentPreview": comments,
-			"CommentCount":   commentCount,
+		// Held comments aren't sent out until they're approved.
+		if automod.Report || automod.Hold {
+			createAutomodReport(1, comments.ID, automod.Rules)
 		}
-		templates.ExecuteTemplate(&commentPreviewTpl, "render_comment_preview.html", data)
-
-		var msg wsMessage
-		var community_id string
-
-		db.QueryRow("SELECT community_id FROM posts WHERE id = ?", post_id).Scan(&community_id)
-
-		for client := range clients {
-			if (!checkIfEitherBlocked(clients[client].UserID, comments.CreatedBy) || clients[client].Level > 0) && !inForbiddenKeywords(body, clients[client].UserID) {
-				if clients[client].OnPage == "/posts/"+post_id && clients[client].UserID != comments.CreatedBy {
-					msg.Type = "comment"
-					msg.Content = commentTpl.String()
-					err := writeWs(clients[client], client, msg)
-					if err != nil {
-						client.Close()
-						delete(clients, client)
-					}
-				} else if clients[client].OnPage == "/communities/"+community_id && is_spoiler == "0" {
-					msg.Type = "commentPreview"
-					msg.ID = post_id
-					msg.Content = commentPreviewTpl.String()
-					err := writeWs(clients[client], client, msg)
-					if err != nil {
-						client.Close()
-						delete(clients, client)
-					}
-				}
-			}
+		if comments.Pending {
+			return
 		}
+
+		publishComment(comments, post_id, post_by, CurrentUser)
 	}
 }
 
@@ -677,20 +1340,21 @@ func createCommentYeah(w http.ResponseWriter, r *http.Request, CurrentUser user)
 
 	var comment_by int
 	var post_id string
+	var community_id int
 	var yeah_exists int
 	var feeling int
 
-	db.QueryRow("SELECT created_by, post, feeling FROM comments WHERE id = ?", comment_id).Scan(&comment_by, &post_id, &feeling)
+	db.QueryRow("SELECT comments.created_by, post, comments.feeling, community_id FROM comments INNER JOIN posts ON posts.id = post WHERE comments.id = ?", comment_id).Scan(&comment_by, &post_id, &feeling, &community_id)
 
 	// Check if the comment exists first.
-	if comment_by != 0 {
+	if comment_by != 0 && checkIfCommunityMember(community_id, CurrentUser) {
 		db.QueryRow("SELECT id FROM yeahs WHERE yeah_post = ? AND yeah_by = ? AND on_comment = 1", comment_id, user_id).Scan(&yeah_exists)
 		if yeah_exists != 0 {
 			return
 		}
 
 		if checkIfCanYeah(CurrentUser, comment_by) {
-			stmt, err := db.Prepare("INSERT yeahs SET yeah_post = ?, yeah_by = ?, on_comment = 1")
+			stmt, err := db.Prepare("INSERT yeahs SET yeah_post = ?, yeah_by = ?, on_comment = 1, created_at = NOW()")
 			if err == nil {
 				// If there's no errors, we can go ahead and execute the statement.
 				_, err := stmt.Exec(&comment_id, &user_id)
@@ -734,6 +1398,374 @@ func createCommentYeah(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 }
 
+// Ban a user from a community.
+func createCommunityBan(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	length, err := strconv.Atoi(r.FormValue("length"))
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid ban length.", http.StatusBadRequest)
+		return
+	}
+	reason := r.FormValue("reason")
+	if utf8.RuneCountInString(reason) > 255 {
+		http.Error(w, "The reason is too long. (255 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	userID := -1
+	var level int
+	db.QueryRow("SELECT id, level FROM users WHERE username = ? LIMIT 1", r.FormValue("username")).Scan(&userID, &level)
+	if userID == -1 {
+		http.Error(w, "The user does not exist.", http.StatusBadRequest)
+		return
+	}
+	// Community moderators can't ban staff or each other, only admins can.
+	// Nobody can ban the owner, since they aren't in the moderators table and could be banned by people they appointed.
+	var moderatorCount, ownerCount int
+	db.QueryRow("SELECT COUNT(*) FROM community_moderators WHERE community = ? AND user = ?", communityID, userID).Scan(&moderatorCount)
+	db.QueryRow("SELECT COUNT(*) FROM communities WHERE id = ? AND owner = ?", communityID, userID).Scan(&ownerCount)
+	if userID == CurrentUser.ID || ownerCount > 0 || level > CurrentUser.Level || (CurrentUser.Level < admin.Manage.MinimumLevel && (level > 0 || moderatorCount > 0)) {
+		http.Error(w, "You can't ban this user from the community.", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.Exec("INSERT INTO community_bans (community, user, reason, until, ban_by) VALUES (?, ?, ?, NOW() + INTERVAL ? DAY, ?)", communityID, userID, reason, length, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	banID, _ := res.LastInsertId()
+	// type 3 - ban user
+	logCommunityModAction(communityID, 3, banID, userID, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Create a sub-community under a community. It starts off with the parent's owner, banner, category and visibility.
+func createCommunityChild(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityOwner(communityID, CurrentUser) {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	parent := QueryCommunity(communityID, false)
+	if len(parent.Title) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if parent.Parent >= 0 {
+		http.Error(w, "Sub-communities can't have sub-communities of their own.", http.StatusBadRequest)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	description := r.FormValue("description")
+	if len(title) == 0 || utf8.RuneCountInString(title) > 64 {
+		http.Error(w, "Sub-communities need a title of up to 64 characters.", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(description) > 2000 {
+		http.Error(w, "The description is too long. (2000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	// The icon has to go through the uploader like the parent's, and the parent's is used if there isn't one.
+	icon := parent.Icon
+	if len(r.FormValue("icon")) > 0 {
+		icon = ""
+		db.QueryRow("SELECT value FROM images WHERE id = ?", r.FormValue("icon")).Scan(&icon)
+		if len(icon) == 0 {
+			http.Error(w, "Invalid icon.", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(getCommunityChildren(communityID)) >= 20 {
+		http.Error(w, "Communities can't have more than 20 sub-communities.", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("INSERT INTO communities (title, description, icon, banner, is_featured, permissions, owner, category, visibility, parent) SELECT ?, ?, ?, banner, 0, permissions, owner, category, visibility, id FROM communities WHERE id = ?", title, description, icon, communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	childID, _ := res.LastInsertId()
+	// type 14 - create sub-community
+	logCommunityModAction(communityID, 14, childID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+strconv.FormatInt(childID, 10)+"/moderation", 302)
+}
+
+// Schedule an event in a community. The times are entered in the moderator's timezone.
+func createCommunityEvent(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	if len(title) == 0 || utf8.RuneCountInString(title) > 100 {
+		http.Error(w, "Events need a title of up to 100 characters.", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(description) > 2000 {
+		http.Error(w, "The description is too long. (2000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	location, err := time.LoadLocation(CurrentUser.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	startsAt, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("starts_at"), location)
+	if err != nil {
+		http.Error(w, "The start time is invalid.", http.StatusBadRequest)
+		return
+	}
+	endsAt, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("ends_at"), location)
+	if err != nil {
+		http.Error(w, "The end time is invalid.", http.StatusBadRequest)
+		return
+	}
+	if !endsAt.After(startsAt) || !endsAt.After(time.Now()) {
+		http.Error(w, "Events have to end after they start, and can't end in the past.", http.StatusBadRequest)
+		return
+	}
+	var eventCount int
+	db.QueryRow("SELECT COUNT(*) FROM community_events WHERE community = ? AND ends_at > NOW()", communityID).Scan(&eventCount)
+	if eventCount >= 25 {
+		http.Error(w, "Communities can't have more than 25 upcoming events.", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("INSERT INTO community_events (community, title, description, starts_at, ends_at, created_by) VALUES (?, ?, ?, ?, ?, ?)", communityID, title, description, startsAt, endsAt, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	eventID, _ := res.LastInsertId()
+	// type 15 - schedule event
+	logCommunityModAction(communityID, 15, eventID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/events/"+strconv.FormatInt(eventID, 10), 302)
+}
+
+// Add a flair people can pick for their posts in a community.
+func createCommunityFlair(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	color := strings.TrimSpace(r.FormValue("color"))
+	if len(name) == 0 || utf8.RuneCountInString(name) > 32 {
+		http.Error(w, "Flairs need a name of up to 32 characters.", http.StatusBadRequest)
+		return
+	}
+	colorCheck, _ := regexp.MatchString("^(#[0-9A-Fa-f]{6})?$", color)
+	if !colorCheck {
+		http.Error(w, "Invalid color.", http.StatusBadRequest)
+		return
+	}
+	var flairCount int
+	db.QueryRow("SELECT COUNT(*) FROM community_flairs WHERE community = ?", communityID).Scan(&flairCount)
+	if flairCount >= 25 {
+		http.Error(w, "Communities can't have more than 25 flairs.", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO community_flairs (community, name, color) VALUES (?, ?, ?)", communityID, name, color)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 12 - edit flairs
+	logCommunityModAction(communityID, 12, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Add a report reason that only applies to a community.
+func createCommunityReportReason(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if len(name) == 0 || utf8.RuneCountInString(name) > 64 {
+		http.Error(w, "Report reasons need a name of up to 64 characters.", http.StatusBadRequest)
+		return
+	}
+	var reasonCount int
+	db.QueryRow("SELECT COUNT(*) FROM community_report_reasons WHERE community = ?", communityID).Scan(&reasonCount)
+	if reasonCount >= 10 {
+		http.Error(w, "Communities can't have more than 10 report reasons.", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO community_report_reasons (community, name, body_required) VALUES (?, ?, ?)", communityID, name, r.FormValue("body_required") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 13 - edit report reasons
+	logCommunityModAction(communityID, 13, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Add a rule to a community. Everyone has to agree to the rules again before their next post.
+func createCommunityRule(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	if len(title) == 0 || utf8.RuneCountInString(title) > 100 {
+		http.Error(w, "Rules need a title of up to 100 characters.", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > 1000 {
+		http.Error(w, "The rule is too long. (1000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	var position, ruleCount int
+	db.QueryRow("SELECT IFNULL(MAX(position), 0) + 1, COUNT(*) FROM community_rules WHERE community = ?", communityID).Scan(&position, &ruleCount)
+	if ruleCount >= 15 {
+		http.Error(w, "Communities can't have more than 15 rules.", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO community_rules (community, position, title, body) VALUES (?, ?, ?, ?)", communityID, position, title, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.Exec("DELETE FROM community_rule_agreements WHERE community = ?", communityID)
+	// type 11 - edit rules
+	logCommunityModAction(communityID, 11, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Save a post as a draft, or schedule it to be published later.
+func createDraft(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	communityID := r.FormValue("community")
+	var communityCount int
+	db.QueryRow("SELECT COUNT(*) FROM communities WHERE id = ? AND (rm = 0 OR id = 0) AND permissions <= ?", communityID, CurrentUser.Level).Scan(&communityCount)
+	if communityCount == 0 {
+		http.Error(w, "The community could not be found.", http.StatusBadRequest)
+		return
+	}
+	if !checkIfCommunityMember(communityID, CurrentUser) {
+		http.Error(w, "You have to be a member of this community to post in it.", http.StatusForbidden)
+		return
+	}
+	var draftCount int
+	db.QueryRow("SELECT COUNT(*) FROM drafts WHERE created_by = ?", CurrentUser.ID).Scan(&draftCount)
+	if draftCount >= 50 {
+		http.Error(w, "You can't have more than 50 drafts.", http.StatusBadRequest)
+		return
+	}
+
+	body := r.FormValue("body")
+	if utf8.RuneCountInString(body) > 2000 {
+		http.Error(w, "Your post is too long. (2000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	postType, _ := strconv.Atoi(r.FormValue("post_type"))
+	if postType < 0 || postType > 2 {
+		http.Error(w, "Invalid post type.", http.StatusBadRequest)
+		return
+	}
+	// Images are kept by their ID so the draft goes through the same checks as a post when it's published.
+	var painting, image, flair sql.NullInt64
+	var paintingAlt string
+	if postType == 1 {
+		db.QueryRow("SELECT id FROM images WHERE id = ?", r.FormValue("painting")).Scan(&painting)
+		if !painting.Valid {
+			http.Error(w, "You must add a drawing.", http.StatusBadRequest)
+			return
+		}
+		alt, err := getFormPaintingAlt(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		paintingAlt = alt
+	}
+	var attachments sql.NullString
+	images, err := getFormAttachments(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(images) > 0 {
+		image = sql.NullInt64{Int64: int64(images[0].ImageID), Valid: true}
+		attachmentsJSON, _ := json.Marshal(images)
+		attachments = sql.NullString{String: string(attachmentsJSON), Valid: true}
+	}
+	if len(r.FormValue("flair")) > 0 && r.FormValue("flair") != "0" {
+		db.QueryRow("SELECT id FROM community_flairs WHERE id = ? AND community = ?", r.FormValue("flair"), communityID).Scan(&flair)
+		if !flair.Valid {
+			http.Error(w, "Invalid flair.", http.StatusBadRequest)
+			return
+		}
+	}
+	var pollOptions sql.NullString
+	if postType == 2 {
+		var options []string
+		for i := 0; i < 26; i++ {
+			option := strings.TrimSpace(r.FormValue("option-" + string(rune('a'+i))))
+			if len(option) > 0 {
+				options = append(options, option)
+			}
+		}
+		optionsJSON, _ := json.Marshal(options)
+		pollOptions = sql.NullString{String: string(optionsJSON), Valid: true}
+	}
+	if len(body) == 0 && !painting.Valid && !image.Valid && !pollOptions.Valid {
+		http.Error(w, "Your post is empty.", http.StatusBadRequest)
+		return
+	}
+	attachmentType, _ := strconv.Atoi(r.FormValue("attachment_type"))
+	feeling, _ := strconv.Atoi(r.FormValue("feeling_id"))
+	privacy, _ := strconv.Atoi(r.FormValue("privacy"))
+	pollResults, _ := strconv.Atoi(r.FormValue("poll_results"))
+	pollCloses, _ := strconv.Atoi(r.FormValue("poll_closes"))
+
+	publishAt, err := getDraftPublishTime(r.Form, communityID, CurrentUser)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO drafts (created_by, community, post_type, body, painting, painting_alt, image, attachment_type, is_spoiler, feeling, privacy, flair, poll_options, attachments, poll_multiple_choice, poll_results, poll_closes, publish_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", CurrentUser.ID, communityID, postType, body, painting, paintingAlt, image, attachmentType, r.FormValue("is_spoiler") == "1", feeling, privacy, flair, pollOptions, attachments, r.FormValue("poll_multiple_choice") == "1", pollResults, pollCloses, publishAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/drafts", 302)
+}
+
 // Follow a user.
 func createFollow(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
@@ -844,26 +1876,9 @@ func createGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 
 // Create a post.
 func createPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
-	user_id := CurrentUser.ID
-	community_id := r.FormValue("community")
-	post_type := r.FormValue("post_type")
-	body := r.FormValue("body")
-	painting := r.FormValue("painting")
-	if post_type == "1" {
-		body = painting
-	}
-	image := r.FormValue("image")
-	attachment_type := r.FormValue("attachment_type")
-	url := ""
-	url_type := 0
-	is_spoiler := r.FormValue("is_spoiler")
-	feeling := r.FormValue("feeling_id")
-	privacy := r.FormValue("privacy")
-	repost := r.FormValue("repost")
-
 	// Check if a post has been made recently.
 	var recent_post int
-	db.QueryRow("SELECT id FROM posts WHERE created_by = ? AND created_at > DATE_SUB(NOW(), INTERVAL 10 SECOND)", user_id).Scan(&recent_post)
+	db.QueryRow("SELECT id FROM posts WHERE created_by = ? AND created_at > DATE_SUB(NOW(), INTERVAL 10 SECOND)", CurrentUser.ID).Scan(&recent_post)
 	if recent_post != 0 {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -872,216 +1887,15 @@ func createPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		return
 	}
 
-	if len(community_id) == 0 {
-		http.Error(w, "You must specify a community.", http.StatusBadRequest)
-		return
-	}
-	var communityCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM communities WHERE id = ? AND (rm = 0 OR id = 0) AND permissions <= ? LIMIT 1", community_id, CurrentUser.Level).Scan(&communityCount)
+	r.ParseMultipartForm(32 << 20)
+	posts, status, err := submitPost(r.Form, CurrentUser)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if communityCount == 0 {
-		http.Error(w, "The community could not be found.", http.StatusBadRequest)
-		return
-	}
-	if utf8.RuneCountInString(body) > 2000 {
-		http.Error(w, "Your post is too long. (2000 characters maximum)", http.StatusBadRequest)
-		return
-	}
-	if len(body) == 0 && len(image) == 0 && len(repost) == 0 {
-		http.Error(w, "Your post is empty.", http.StatusBadRequest)
-		return
-	}
-	if len(image) > 0 {
-		imageURL := ""
-		db.QueryRow("SELECT value FROM images WHERE id = ?", image).Scan(&imageURL)
-		if len(imageURL) == 0 {
-			http.Error(w, "Invalid image.", http.StatusBadRequest)
-			return
-		}
-		image = imageURL
-	}
-	if len(attachment_type) == 0 {
-		attachment_type = "0"
-	}
-	if is_spoiler != "1" {
-		is_spoiler = "0"
-	}
-	if len(privacy) != 1 {
-		privacy = "0"
-	}
-	if len(repost) == 0 {
-		repost = "0"
-	} else {
-		var count int
-		err = db.QueryRow("SELECT COUNT(*) FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", repost, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&count)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if count != 1 {
-			http.Error(w, "The post could not be found.", http.StatusBadRequest)
-			return
-		}
-	}
-	if len(post_type) == 0 {
-		post_type = "0"
-	} else if post_type == "1" {
-		if len(painting) == 0 {
-			http.Error(w, "You must add a drawing.", http.StatusBadRequest)
-			return
-		}
-		db.QueryRow("SELECT value FROM images WHERE id = ?", painting).Scan(&body)
-		if body == painting {
-			http.Error(w, "Invalid drawing.", http.StatusBadRequest)
-			return
-		}
-	} else if post_type == "2" {
-		if len(r.FormValue("option-a")) == 0 || len(r.FormValue("option-b")) == 0 {
-			http.Error(w, "Polls must have at least two options.", http.StatusBadRequest)
-			return
-		}
-	} else if post_type != "0" {
-		http.Error(w, "Invalid post type.", http.StatusBadRequest)
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	if len(body) > 0 {
-		matched := youtube.FindAllStringSubmatch(body, 1)
-		if len(matched) > 0 {
-			url = matched[0][1]
-			url_type = 1
-		} else {
-			matched = spotify.FindAllStringSubmatch(body, 1)
-			if len(matched) > 0 {
-				url = matched[0][1]
-				url_type = 2
-			} else {
-				matched = soundcloud.FindAllStringSubmatch(body, 1)
-				if len(matched) > 0 {
-					url = "https://" + matched[0][0]
-					url_type = 3
-				}
-			}
-		}
-	}
-
-	stmt, err := db.Prepare("INSERT posts SET created_by = ?, community_id = ?, body = ?, image = ?, attachment_type = ?, url = ?, url_type = ?, is_spoiler = ?, feeling = ?, privacy = ?, repost = ?, post_type = ?, migrated_id = '', migrated_community = 0")
-	if err == nil {
-		// If there's no errors, we can go ahead and execute the statement.
-		_, err = stmt.Exec(&user_id, &community_id, &body, &image, &attachment_type, &url, &url_type, &is_spoiler, &feeling, &privacy, &repost, &post_type)
-		stmt.Close()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		var posts = post{}
-		var timestamp time.Time
-		var role int
-
-		err = db.QueryRow("SELECT posts.id, created_by, created_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, communities.id, title, icon, username, nickname, avatar, has_mh, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE created_by = ? ORDER BY created_at DESC LIMIT 1", user_id).Scan(&posts.ID, &posts.CreatedBy, &timestamp, &posts.Feeling, &posts.BodyText, &posts.Image, &posts.AttachmentType, &posts.IsSpoiler, &posts.PostType, &posts.URL, &posts.URLType, &posts.Pinned, &posts.Privacy, &posts.RepostID, &posts.CommunityID, &posts.CommunityName, &posts.CommunityIcon, &posts.PosterUsername, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.PosterHideOnline, &posts.PosterColor, &role)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if posts.PostType == 2 {
-			_, err = db.Exec("INSERT INTO options (post, name) VALUES (?, ?), (?, ?)", posts.ID, r.FormValue("option-a"), posts.ID, r.FormValue("option-b"))
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if len(r.FormValue("option-c")) > 0 {
-				_, err = db.Exec("INSERT INTO options (post, name) VALUES (?, ?)", posts.ID, r.FormValue("option-c"))
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
-			if len(r.FormValue("option-d")) > 0 {
-				_, err = db.Exec("INSERT INTO options (post, name) VALUES (?, ?)", posts.ID, r.FormValue("option-d"))
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
-			if len(r.FormValue("option-e")) > 0 {
-				_, err = db.Exec("INSERT INTO options (post, name) VALUES (?, ?)", posts.ID, r.FormValue("option-e"))
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-			}
-			posts.Poll = getPoll(posts.ID, CurrentUser.ID)
-		}
-
-		posts.PosterIcon = getAvatar(posts.PosterIcon, posts.PosterHasMii, posts.Feeling)
-		if role > 0 {
-			posts.PosterRoleImage = getRoleImage(role)
-		}
-		posts.CreatedAt = humanTiming(timestamp, CurrentUser.Timezone)
-		posts.CreatedAtUnix = timestamp.Unix()
-		posts.Body = parseBodyWithLineBreaks(posts.BodyText, true, true)
-		posts.ByMe = true
-		posts.CanYeah = true // temporary!
-		if posts.RepostID > 0 {
-			var repost post
-			db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, communities.id, title, icon, rm, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", posts.RepostID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&repost.ID, &repost.CreatedBy, &repost.CreatedAtTime, &repost.EditedAtTime, &repost.Feeling, &repost.BodyText, &repost.Image, &repost.AttachmentType, &repost.IsSpoiler, &repost.PostType, &repost.URL, &repost.URLType, &repost.Pinned, &repost.Privacy, &repost.RepostID, &repost.MigrationID, &repost.MigratedID, &repost.MigratedCommunity, &repost.IsRMByAdmin, &repost.CommunityID, &repost.CommunityName, &repost.CommunityIcon, &repost.CommunityRM, &repost.PosterUsername, &repost.PosterNickname, &repost.PosterIcon, &repost.PosterHasMii, &repost.PosterOnline, &repost.PosterHideOnline, &repost.PosterColor, &repost.PosterRoleID)
-			posts.Repost = &repost
-			posts.Repost.Type = 3
-			if len(posts.Repost.CommunityName) > 0 {
-				posts.Repost = setupPost(posts.Repost, CurrentUser, 3, 0)
-			}
-		}
-
-		err = templates.ExecuteTemplate(w, "render_post.html", posts)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-
-		var CommunityPostTpl, UserPostTpl bytes.Buffer
-		posts.ByMe = false
-		templates.ExecuteTemplate(&CommunityPostTpl, "render_post.html", posts)
-		posts.Type = 1
-		templates.ExecuteTemplate(&UserPostTpl, "render_post.html", posts)
-
-		if repost != "0" && posts.Repost.CreatedBy != CurrentUser.ID {
-			createNotif(posts.Repost.CreatedBy, 7, strconv.Itoa(posts.ID), CurrentUser.ID)
-		}
-
-		var msg wsMessage
-		msg.Type = "post"
-		msg.Content = CommunityPostTpl.String()
-
-		for client := range clients {
-			if clients[client].OnPage == "/communities/"+community_id &&
-				clients[client].UserID != posts.CreatedBy &&
-				(!checkIfEitherBlocked(clients[client].UserID, posts.CreatedBy) ||
-					clients[client].Level > 0) &&
-				!inForbiddenKeywords(body, clients[client].UserID) &&
-				(posts.Privacy == 0) {
-				msg.Content = CommunityPostTpl.String()
-				err := writeWs(clients[client], client, msg)
-				if err != nil {
-					fmt.Println("posts")
-					fmt.Println(clients)
-					client.Close()
-					delete(clients, client)
-				}
-			} else if clients[client].OnPage == "/users/"+CurrentUser.Username+"/posts" && (!checkIfEitherBlocked(clients[client].UserID, posts.CreatedBy) || clients[client].Level > 0) && !inForbiddenKeywords(body, clients[client].UserID) && (posts.Privacy == 0) {
-				msg.Content = UserPostTpl.String()
-				err := writeWs(clients[client], client, msg)
-				if err != nil {
-					fmt.Println("postsuser")
-					client.Close()
-					delete(clients, client)
-				}
-			}
-		}
-	} else {
+	err = templates.ExecuteTemplate(w, "render_post.html", posts)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -1101,7 +1915,7 @@ func createPostYeah(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	// Check if the post exists; if it doesn't, the Yeah wont be added.
 	db.QueryRow("SELECT created_by, community_id, feeling FROM posts WHERE id = ?", post_id).Scan(&post_by, &community_id, &feeling)
 
-	if post_by != 0 {
+	if post_by != 0 && checkIfCommunityMember(community_id, CurrentUser) {
 		// Check if the post has already been yeahed.
 		db.QueryRow("SELECT id FROM yeahs WHERE yeah_post = ? AND yeah_by = ? AND on_comment = 0", post_id, user_id).Scan(&yeah_exists)
 		if yeah_exists != 0 {
@@ -1109,7 +1923,7 @@ func createPostYeah(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		}
 
 		if checkIfCanYeah(CurrentUser, post_by) {
-			stmt, err := db.Prepare("INSERT yeahs SET yeah_post = ?, yeah_by = ?, on_comment = 0")
+			stmt, err := db.Prepare("INSERT yeahs SET yeah_post = ?, yeah_by = ?, on_comment = 0, created_at = NOW()")
 			if err == nil {
 				// If there's no errors, we can go ahead and execute the statement.
 				_, err := stmt.Exec(&post_id, &user_id)
@@ -1175,7 +1989,7 @@ func deleteComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		_, err = db.Exec("UPDATE comments SET is_rm_by_admin = 1 WHERE id = ?", comment_id)
 		// audit log
 		// type 1 - delete comment
-		db.Exec("INSERT INTO audit_log_entries(type, context, created_by) values(1, ?, ?)", comment_id, CurrentUser.ID)
+		logAuditEvent(r, 1, comment_id, created_by, CurrentUser, map[string]interface{}{"is_rm_by_admin": false}, map[string]interface{}{"is_rm_by_admin": true})
 	} else {
 		_, err = db.Exec("UPDATE comments SET is_rm = 1 WHERE id = ?", comment_id)
 	}
@@ -1236,6 +2050,56 @@ func deleteCommentYeah(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 }
 
+// Lift a user's ban from a community.
+func deleteCommunityBan(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	var userID int
+	db.QueryRow("SELECT user FROM community_bans WHERE id = ? AND community = ?", vars["ban"], communityID).Scan(&userID)
+	if userID == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	_, err := db.Exec("UPDATE community_bans SET until = NOW() WHERE id = ? AND until > NOW()", vars["ban"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 4 - unban user
+	logCommunityModAction(communityID, 4, vars["ban"], userID, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Cancel a community event.
+func deleteCommunityEvent(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM community_events WHERE id = ? AND community = ?", vars["event"], communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	// type 16 - cancel event
+	logCommunityModAction(communityID, 16, vars["event"], 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
 // Remove a favorite from a community.
 func deleteCommunityFavorite(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
@@ -1261,6 +2125,155 @@ func deleteCommunityFavorite(w http.ResponseWriter, r *http.Request, CurrentUser
 	stmt.Close()
 }
 
+// Remove a user from a community's members, turn down their request to join or take back their invite.
+func deleteCommunityMember(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityOwner(communityID, CurrentUser) {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	var userID int
+	db.QueryRow("SELECT id FROM users WHERE username = ?", vars["username"]).Scan(&userID)
+	membership := getCommunityMembership(communityID, userID)
+	_, err := db.Exec("DELETE FROM community_members WHERE community = ? AND user = ?", communityID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if membership == 1 {
+		// type 9 - remove member
+		logCommunityModAction(communityID, 9, userID, userID, CurrentUser)
+	}
+
+	http.Redirect(w, r, "/communities/"+communityID+"/members", 302)
+}
+
+// Remove a user from a community's moderators.
+func deleteCommunityModerator(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityOwner(communityID, CurrentUser) {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	var userID int
+	db.QueryRow("SELECT id FROM users WHERE username = ?", vars["username"]).Scan(&userID)
+	_, err := db.Exec("DELETE FROM community_moderators WHERE community = ? AND user = ?", communityID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 7 - remove moderator
+	logCommunityModAction(communityID, 7, userID, userID, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Remove a flair from a community. Posts that had it are left without a flair.
+func deleteCommunityFlair(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM community_flairs WHERE id = ? AND community = ?", vars["flair"], communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	// type 12 - edit flairs
+	logCommunityModAction(communityID, 12, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Remove a community's report reason. Reports already made for it keep showing their message.
+func deleteCommunityReportReason(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM community_report_reasons WHERE id = ? AND community = ?", vars["reason"], communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	// type 13 - edit report reasons
+	logCommunityModAction(communityID, 13, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Remove a rule from a community.
+func deleteCommunityRule(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM community_rules WHERE id = ? AND community = ?", vars["rule"], communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	// type 11 - edit rules
+	logCommunityModAction(communityID, 11, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Delete a draft or scheduled post.
+func deleteDraft(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	res, err := db.Exec("DELETE FROM drafts WHERE id = ? AND created_by = ?", vars["id"], CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+
+	http.Redirect(w, r, "/drafts", 302)
+}
+
+// Take back an RSVP to a community event.
+func deleteEventRSVP(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	eventID := vars["id"]
+
+	_, err := db.Exec("DELETE FROM community_event_rsvps WHERE event = ? AND user = ?", eventID, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/events/"+eventID, 302)
+}
+
 // Unfollow a user.
 func deleteFollow(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
@@ -1420,7 +2433,7 @@ func deletePost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if created_by != CurrentUser.ID {
 		var otherUserLevel int
 		db.QueryRow("SELECT level FROM users WHERE id = ?", created_by).Scan(&otherUserLevel)
-		if otherUserLevel > CurrentUser.Level || CurrentUser.Level == 0 {
+		if otherUserLevel > CurrentUser.Level || (CurrentUser.Level == 0 && !checkIfCommunityModerator(community_id, CurrentUser)) {
 			http.Error(w, "You do not have permission to delete this post.", http.StatusForbidden)
 			return
 		}
@@ -1435,7 +2448,7 @@ func deletePost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 
 	if created_by != CurrentUser.ID {
 		reason := -1
-		db.QueryRow("SELECT reason FROM reports WHERE pid = ? AND type = 0 ORDER BY COUNT(reason) DESC LIMIT 1", post_id).Scan(&reason)
+		db.QueryRow("SELECT reason FROM reports WHERE pid = ? AND type = 0 AND reason >= 0 ORDER BY COUNT(reason) DESC LIMIT 1", post_id).Scan(&reason)
 		if reason != -1 {
 			_, err = db.Exec("INSERT INTO admin_notifications (reason, post, type, user) VALUES (?, ?, 0, ?)", reason, post_id, created_by)
 			if err != nil {
@@ -1450,7 +2463,9 @@ func deletePost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		}
 		// audit log
 		// type 0 - delete post
-		db.Exec("INSERT INTO audit_log_entries(type, context, created_by) values(0, ?, ?)", post_id, CurrentUser.ID)
+		logAuditEvent(r, 0, post_id, created_by, CurrentUser, map[string]interface{}{"is_rm_by_admin": false}, map[string]interface{}{"is_rm_by_admin": true})
+		// type 0 - delete post
+		logCommunityModAction(community_id, 0, post_id, created_by, CurrentUser)
 	}
 	db.Exec("DELETE FROM reports WHERE pid = ? AND type = 0", post_id)
 
@@ -1568,17 +2583,44 @@ func editComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		is_spoiler = "0"
 	}
 
-	stmt, err := db.Prepare("UPDATE comments SET edited_at = now(), body = ?, is_spoiler = ?, feeling = ? WHERE id = ?")
+	// Edits go through the automod too, and held comments go back into the queue until they're approved again.
+	var image string
+	var postType int
+	db.QueryRow("SELECT image, post_type FROM comments WHERE id = ?", comment_id).Scan(&image, &postType)
+	automod := checkAutomod(CurrentUser, 1, body, len(image) > 0 || postType == 1)
+	if automod.Block {
+		http.Error(w, "Your comment was blocked by the automatic moderation.", http.StatusBadRequest)
+		return
+	}
+	if automod.Spoiler {
+		is_spoiler = "1"
+	}
+
+	// Keep the old version around if the text changed.
+	_, err = db.Exec("INSERT INTO revisions (post, on_comment, body, created_at) SELECT id, 1, body, edited_at FROM comments WHERE id = ? AND BINARY body != ?", comment_id, body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = stmt.Exec(&body, &is_spoiler, &feeling, &comment_id)
+
+	stmt, err := db.Prepare("UPDATE comments SET edited_at = now(), body = ?, is_spoiler = ?, feeling = ?, pending = pending | ? WHERE id = ?")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = stmt.Exec(&body, &is_spoiler, &feeling, automod.Hold, &comment_id)
 	stmt.Close()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if automod.Report || automod.Hold {
+		commentID, _ := strconv.Atoi(comment_id)
+		createAutomodReport(1, commentID, automod.Rules)
+	}
+	if automod.Hold {
+		return
+	}
 
 	var msg wsMessage
 	msg.ID = comment_id
@@ -1597,6 +2639,194 @@ func editComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 }
 
+// Edit a community's description, icon and banner.
+func editCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	description := r.FormValue("description")
+	if utf8.RuneCountInString(description) > 2000 {
+		http.Error(w, "The description is too long. (2000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	// The icon and banner have to go through the uploader, so leaving them empty keeps the current ones.
+	var icon, banner string
+	db.QueryRow("SELECT icon, banner FROM communities WHERE id = ?", communityID).Scan(&icon, &banner)
+	if len(r.FormValue("icon")) > 0 {
+		icon = ""
+		db.QueryRow("SELECT value FROM images WHERE id = ?", r.FormValue("icon")).Scan(&icon)
+		if len(icon) == 0 {
+			http.Error(w, "Invalid icon.", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(r.FormValue("banner")) > 0 {
+		banner = ""
+		db.QueryRow("SELECT value FROM images WHERE id = ?", r.FormValue("banner")).Scan(&banner)
+		if len(banner) == 0 {
+			http.Error(w, "Invalid banner.", http.StatusBadRequest)
+			return
+		}
+	} else if r.FormValue("remove_banner") == "1" {
+		banner = ""
+	}
+	category, _ := strconv.Atoi(r.FormValue("category"))
+	if category < 0 || category >= len(settings.CommunityCategories) {
+		http.Error(w, "Invalid category.", http.StatusBadRequest)
+		return
+	}
+	tags, err := parseCommunityTags(r.FormValue("tags"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Staff can limit posting to users of a certain level, though not above their own.
+	// Communities already locked above their level are left alone.
+	permissions := -1
+	if len(r.FormValue("permissions")) > 0 {
+		permissions, err = strconv.Atoi(r.FormValue("permissions"))
+		if err != nil || permissions < 0 || permissions > CurrentUser.Level {
+			http.Error(w, "Invalid permissions.", http.StatusBadRequest)
+			return
+		}
+		var currentPermissions int
+		db.QueryRow("SELECT permissions FROM communities WHERE id = ?", communityID).Scan(&currentPermissions)
+		if currentPermissions > CurrentUser.Level {
+			http.Error(w, "You can't change who can post in this community.", http.StatusForbidden)
+			return
+		}
+	}
+	// only the owner gets to decide who can see the community
+	isOwner := checkIfCommunityOwner(communityID, CurrentUser)
+	visibility, _ := strconv.Atoi(r.FormValue("visibility"))
+	if isOwner && (visibility < 0 || visibility > 2) {
+		http.Error(w, "Invalid visibility.", http.StatusBadRequest)
+		return
+	}
+
+	// Everything's been checked by now, so a bad field can't leave the others half saved.
+	_, err = db.Exec("UPDATE communities SET description = ?, icon = ?, banner = ?, category = ? WHERE id = ?", description, icon, banner, category, communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = setCommunityTags(communityID, tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if permissions >= 0 {
+		_, err = db.Exec("UPDATE communities SET permissions = ? WHERE id = ?", permissions, communityID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if isOwner {
+		_, err = db.Exec("UPDATE communities SET visibility = ? WHERE id = ?", visibility, communityID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	// type 5 - edit community
+	logCommunityModAction(communityID, 5, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Choose whether a favorite community's sub-communities show up in the favorites sidebar too.
+func editCommunityFavorite(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+
+	_, err := db.Exec("UPDATE community_favorites SET include_children = ? WHERE community = ? AND favorite_by = ?", r.FormValue("include_children") == "1", communityID, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/communities/"+communityID, 302)
+}
+
+// Edit or move one of a community's rules. Everyone has to agree to the rules again before their next post.
+func editCommunityRule(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	if len(title) == 0 || utf8.RuneCountInString(title) > 100 {
+		http.Error(w, "Rules need a title of up to 100 characters.", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > 1000 {
+		http.Error(w, "The rule is too long. (1000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	position, err := strconv.Atoi(r.FormValue("position"))
+	if err != nil {
+		http.Error(w, "Invalid position.", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("UPDATE community_rules SET position = ?, title = ?, body = ? WHERE id = ? AND community = ?", position, title, body, vars["rule"], communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected > 0 {
+		db.Exec("DELETE FROM community_rule_agreements WHERE community = ?", communityID)
+	}
+	// type 11 - edit rules
+	logCommunityModAction(communityID, 11, communityID, 0, CurrentUser)
+
+	http.Redirect(w, r, "/communities/"+communityID+"/moderation", 302)
+}
+
+// Edit a draft, or change when it's scheduled to be published.
+func editDraft(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	var communityID, postType int
+	var hasImage bool
+	err := db.QueryRow("SELECT community, post_type, image IS NOT NULL FROM drafts WHERE id = ? AND created_by = ?", vars["id"], CurrentUser.ID).Scan(&communityID, &postType, &hasImage)
+	if err != nil {
+		handle404(w, r, CurrentUser)
+		return
+	}
+
+	body := r.FormValue("body")
+	if utf8.RuneCountInString(body) > 2000 {
+		http.Error(w, "Your post is too long. (2000 characters maximum)", http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 && postType == 0 && !hasImage {
+		http.Error(w, "Your post is empty.", http.StatusBadRequest)
+		return
+	}
+	publishAt, err := getDraftPublishTime(r.Form, strconv.Itoa(communityID), CurrentUser)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE drafts SET body = ?, is_spoiler = ?, publish_at = ?, error = '' WHERE id = ?", body, r.FormValue("is_spoiler") == "1", publishAt, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/drafts", 302)
+}
+
 // Edit a group chat.
 func editGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	var users []int
@@ -1668,15 +2898,45 @@ func editPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		handle404(w, r, CurrentUser)
 		return
 	}
+	var postType, communityID int
+	var image string
+	db.QueryRow("SELECT post_type, community_id, image FROM posts WHERE id = ?", post_id).Scan(&postType, &communityID, &image)
 
 	body := r.FormValue("body")
+	// Drawings keep their image as their body, so only their description can be changed.
+	if postType == 1 {
+		db.QueryRow("SELECT body FROM posts WHERE id = ?", post_id).Scan(&body)
+	}
 	is_spoiler := r.FormValue("is_spoiler")
 	feeling := r.FormValue("feeling_id")
 	privacy := r.FormValue("privacy")
+	paintingAlt := strings.TrimSpace(r.FormValue("painting_alt"))
 	if utf8.RuneCountInString(body) > 2000 {
 		http.Error(w, "Your post is too long. (2000 characters maximum)", http.StatusBadRequest)
 		return
 	}
+	if utf8.RuneCountInString(paintingAlt) > 1000 {
+		http.Error(w, "Image descriptions can't be longer than 1000 characters.", http.StatusBadRequest)
+		return
+	}
+	altRequired := checkIfAltTextRequired(communityID)
+	if postType == 1 && len(paintingAlt) == 0 && altRequired {
+		http.Error(w, "Drawings in this community need a description.", http.StatusBadRequest)
+		return
+	}
+	var imageAlts []string
+	for _, alt := range r.Form["image_alt"] {
+		alt = strings.TrimSpace(alt)
+		if utf8.RuneCountInString(alt) > 1000 {
+			http.Error(w, "Image descriptions can't be longer than 1000 characters.", http.StatusBadRequest)
+			return
+		}
+		if len(alt) == 0 && altRequired {
+			http.Error(w, "Images in this community need a description.", http.StatusBadRequest)
+			return
+		}
+		imageAlts = append(imageAlts, alt)
+	}
 	if len(body) == 0 { // todo: add code to make this work with blank image posts
 		http.Error(w, "Your post is empty.", http.StatusBadRequest)
 		return
@@ -1691,17 +2951,55 @@ func editPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		privacy = "0"
 	}
 
-	stmt, err := db.Prepare("UPDATE posts SET edited_at = now(), body = ?, is_spoiler = ?, feeling = ?, privacy = ? WHERE id = ?")
+	// Edits go through the automod too, so posts can't be cleaned up to get past it and changed afterwards.
+	// Held posts go back into the queue until they're approved again.
+	automodBody := body
+	if postType == 1 {
+		automodBody = paintingAlt
+	}
+	automod := checkAutomod(CurrentUser, 0, automodBody, len(image) > 0 || postType == 1)
+	if automod.Block {
+		http.Error(w, "Your post was blocked by the automatic moderation.", http.StatusBadRequest)
+		return
+	}
+	if automod.Spoiler {
+		is_spoiler = "1"
+	}
+
+	// Keep the old version around if the text changed.
+	_, err = db.Exec("INSERT INTO revisions (post, on_comment, body, created_at) SELECT id, 0, body, edited_at FROM posts WHERE id = ? AND BINARY body != ?", post_id, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stmt, err := db.Prepare("UPDATE posts SET edited_at = now(), body = ?, is_spoiler = ?, feeling = ?, privacy = ?, painting_alt = ?, pending = pending | ? WHERE id = ?")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = stmt.Exec(&body, &is_spoiler, &feeling, &privacy, &post_id)
+	_, err = stmt.Exec(&body, &is_spoiler, &feeling, &privacy, &paintingAlt, automod.Hold, &post_id)
 	stmt.Close()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	postID, _ := strconv.Atoi(post_id)
+	if automod.Report || automod.Hold {
+		createAutomodReport(0, postID, automod.Rules)
+	}
+	for i, alt := range imageAlts {
+		imageSpoiler := i < len(r.Form["image_spoiler"]) && r.Form["image_spoiler"][i] == "1"
+		db.Exec("UPDATE attachments SET alt = ?, is_spoiler = ? WHERE type = 0 AND target = ? AND position = ?", alt, imageSpoiler, post_id, i)
+	}
+	// Drawings don't have any text to update.
+	if postType == 1 {
+		return
+	}
+	indexPostTags(postID, body)
+	if automod.Hold {
+		return
+	}
 
 	var msg wsMessage
 	msg.ID = post_id
@@ -1745,6 +3043,7 @@ func editProfileSettings(w http.ResponseWriter, r *http.Request, CurrentUser use
 	newProfile.YeahVisibility, _ = strconv.Atoi(r.FormValue("yeahs_visibility"))
 	newProfile.ReplyVisibility, _ = strconv.Atoi(r.FormValue("comments_visibility"))
 	newUser.DefaultPrivacy, _ = strconv.Atoi(r.FormValue("default_privacy"))
+	newUser.MentionPrivacy, _ = strconv.Atoi(r.FormValue("mention_privacy"))
 	newUser.ForbiddenKeywords = r.FormValue("forbidden_keywords")
 	newUser.Email = r.FormValue("email")
 	newProfile.NNID = r.FormValue("nnid")
@@ -1864,6 +3163,10 @@ func editProfileSettings(w http.ResponseWriter, r *http.Request, CurrentUser use
 		http.Error(w, "Invalid default privacy value.", http.StatusBadRequest)
 		return
 	}
+	if newUser.MentionPrivacy > 3 || newUser.MentionPrivacy < 0 {
+		http.Error(w, "Invalid mention privacy value.", http.StatusBadRequest)
+		return
+	}
 	if len(newUser.ForbiddenKeywords) > 2000 {
 		http.Error(w, "Your set of forbidden keywords is too long.", http.StatusBadRequest)
 		return
@@ -1895,12 +3198,22 @@ func editProfileSettings(w http.ResponseWriter, r *http.Request, CurrentUser use
 		newUser.Avatar = newProfile.AvatarImage
 	}
 
-	stmt, err := db.Prepare("UPDATE users SET nickname = ?, color = ?, theme = ?, forbidden_keywords = ?, default_privacy = ?, has_mh = ?, avatar = ?, email = ? WHERE id = ?")
+	// Run the public parts of the profile through the automod. Profiles can't be held, so holding one blocks it instead.
+	automod := checkAutomod(CurrentUser, 3, newUser.Nickname+"\n"+newProfile.CommentText+"\n"+newProfile.YouTube, !newUser.HasMii && newProfile.AvatarID > 0)
+	if automod.Block || automod.Hold {
+		http.Error(w, "Your profile was blocked by the automatic moderation.", http.StatusBadRequest)
+		return
+	}
+	if automod.Report {
+		createAutomodReport(2, CurrentUser.ID, automod.Rules)
+	}
+
+	stmt, err := db.Prepare("UPDATE users SET nickname = ?, color = ?, theme = ?, forbidden_keywords = ?, default_privacy = ?, mention_privacy = ?, has_mh = ?, avatar = ?, email = ? WHERE id = ?")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = stmt.Exec(newUser.Nickname, newUser.Color, newUser.Theme, newUser.ForbiddenKeywords, newUser.DefaultPrivacy, newUser.HasMii, newUser.Avatar, newUser.Email, CurrentUser.ID)
+	_, err = stmt.Exec(newUser.Nickname, newUser.Color, newUser.Theme, newUser.ForbiddenKeywords, newUser.DefaultPrivacy, newUser.MentionPrivacy, newUser.HasMii, newUser.Avatar, newUser.Email, CurrentUser.ID)
 	stmt.Close()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1948,6 +3261,42 @@ func favoritePost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 }
 
+// Suggest people to mention while typing a post or comment, with the people the current user follows first.
+func getMentionSuggestions(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	w.Header().Add("Content-Type", "application/json")
+	query := strings.TrimPrefix(r.FormValue("q"), "@")
+	usernameCheck, _ := regexp.MatchString("^[A-Za-z0-9-._]{1,32}$", query)
+	if !usernameCheck {
+		w.Write([]byte("[]"))
+		return
+	}
+
+	user_rows, err := db.Query("SELECT username, nickname, avatar, has_mh FROM users WHERE username LIKE CONCAT(?, '%') AND id != ? AND id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE source = ? OR target = ?) ORDER BY id IN (SELECT follow_to FROM follows WHERE follow_by = ?) DESC, username ASC LIMIT 8", query, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	suggestions := []map[string]string{}
+	for user_rows.Next() {
+		var username, nickname, avatar string
+		var hasMii bool
+		user_rows.Scan(&username, &nickname, &avatar, &hasMii)
+		suggestions = append(suggestions, map[string]string{
+			"username": username,
+			"nickname": nickname,
+			"avatar":   getAvatar(avatar, hasMii, 0),
+		})
+	}
+	user_rows.Close()
+
+	suggestionsJSON, err := json.Marshal(suggestions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(suggestionsJSON)
+}
+
 // Get a Mii from a Nintendo Network ID.
 func getMii(w http.ResponseWriter, r *http.Request) {
 	nnid := r.FormValue("a")
@@ -2226,6 +3575,51 @@ func index(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 }
 
+// Join a community, ask to join it if it's private or accept an invite to it.
+func joinCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	community := QueryCommunity(communityID, false)
+	if len(community.Title) == 0 {
+		http.Error(w, "The community could not be found.", http.StatusNotFound)
+		return
+	}
+	if checkIfCommunityBanned(communityID, CurrentUser.ID) {
+		http.Error(w, "You have been banned from this community.", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	membership := getCommunityMembership(communityID, CurrentUser.ID)
+	if community.Visibility == 0 || membership == 2 {
+		_, err = db.Exec("INSERT INTO community_members (community, user, status) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE status = 1", communityID, CurrentUser.ID)
+	} else if community.Visibility == 1 {
+		_, err = db.Exec("INSERT IGNORE INTO community_members (community, user, status) VALUES (?, ?, 0)", communityID, CurrentUser.ID)
+	} else if membership != 1 {
+		http.Error(w, "This community is invite-only.", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/communities/"+communityID, 302)
+}
+
+// Leave a community, or cancel a request to join or an invite to it.
+func leaveCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	_, err := db.Exec("DELETE FROM community_members WHERE community = ? AND user = ?", communityID, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/communities/"+communityID, 302)
+}
+
 // Leave a group chat.
 func leaveGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	// No need to validate any of this since you can't fake a CurrentUser.
@@ -2289,20 +3683,13 @@ func login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(settings.IPHubKey) > 0 {
-		client := &http.Client{}
 		ipHost, _, _ := net.SplitHostPort(getIP(r))
-		req, _ := http.NewRequest("GET", "https://v2.api.iphub.info/ip/"+ipHost, nil)
-		req.Header.Set("X-Key", settings.IPHubKey)
-		res, _ := client.Do(req)
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
+		ipInfo, err := getIPHubInfo(ipHost)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		var jsonBody iphubBlockResponse
-		json.Unmarshal(body, &jsonBody)
-		if jsonBody.Block == 1 || jsonBody.Block == 2 {
+		if checkIfASNBanned(ipInfo.ASN) || ipInfo.Block == 1 || ipInfo.Block == 2 {
 			fmt.Println("login deny ", ipHost)
 			http.Error(w, "You cannot log in using a proxy.", http.StatusBadRequest)
 			return
@@ -2344,6 +3731,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 		}
 		stmt.Exec(loginToken, users.ID)
 		stmt.Close()
+		recordLoginDevice(w, r, users.ID)
 
 		if settings.Webhooks.Enabled && len(settings.Webhooks.Logins) > 0 {
 			ip, _, _ := net.SplitHostPort(getIP(r))
@@ -2488,24 +3876,8 @@ func migratePosts(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 				post.EditedAt = post.CreatedAt
 			}
 			urlType := 0
-			if len(post.URL) > 0 {
-				matched := youtube.FindAllStringSubmatch(post.URL, 1)
-				if len(matched) > 0 {
-					post.URL = matched[0][1]
-					urlType = 1
-				} else {
-					matched = spotify.FindAllStringSubmatch(post.URL, 1)
-					if len(matched) > 0 {
-						post.URL = matched[0][1]
-						urlType = 2
-					} else {
-						matched = soundcloud.FindAllStringSubmatch(post.URL, 1)
-						if len(matched) > 0 {
-							post.URL = matched[0][0]
-							urlType = 3
-						}
-					}
-				}
+			if embedURL, embedType := getEmbed(post.URL); embedType > 0 {
+				post.URL, urlType = embedURL, embedType
 			}
 			if utf8.RuneCountInString(post.Body) > 2000 {
 				runes := []rune(post.Body) // What is this, fucking RuneScape!?
@@ -2599,6 +3971,55 @@ func newFriendRequest(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 }
 
+// Pin a post to the top of its community.
+func pinPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	postID := vars["id"]
+
+	communityID := -1
+	var createdBy int
+	db.QueryRow("SELECT community_id, created_by FROM posts WHERE id = ? AND is_rm = 0 AND is_rm_by_admin = 0", postID).Scan(&communityID, &createdBy)
+	if communityID == -1 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+	_, err := db.Exec("UPDATE posts SET pinned = 1 WHERE id = ?", postID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 1 - pin post
+	logCommunityModAction(communityID, 1, postID, createdBy, CurrentUser)
+}
+
+// Publish a draft right away.
+func publishDraft(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	draftID, _ := strconv.Atoi(vars["id"])
+	form, err := getDraftForm(draftID, CurrentUser.ID)
+	if err != nil {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	// Take the draft off the schedule so it doesn't get published twice.
+	db.Exec("UPDATE drafts SET publish_at = NULL WHERE id = ?", draftID)
+
+	form.Set("rules_read", r.FormValue("rules_read"))
+	posts, status, err := submitPost(form, CurrentUser)
+	if err != nil {
+		db.Exec("UPDATE drafts SET error = LEFT(?, 255) WHERE id = ?", err.Error(), draftID)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	db.Exec("DELETE FROM drafts WHERE id = ?", draftID)
+
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(posts.ID), 302)
+}
+
 // Reject a friend request.
 func rejectFriendRequest(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
@@ -2648,19 +4069,25 @@ func reportComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if count > 0 {
 		return
 	}
-	reason := r.FormValue("type")
-	if reason == "spoiler" {
-		reason = "0"
+	var communityID int
+	db.QueryRow("SELECT community_id FROM comments INNER JOIN posts ON posts.id = post WHERE comments.id = ?", comment_id).Scan(&communityID)
+	reason, communityReason, reasonName, bodyRequired, ok := getReportReason(r.FormValue("type"), communityID)
+	if !ok {
+		http.Error(w, "Invalid report reason.", http.StatusBadRequest)
+		return
 	}
 	message := r.FormValue("body")
+	if bodyRequired && len(strings.TrimSpace(message)) == 0 {
+		http.Error(w, "Please explain why you're reporting this.", http.StatusBadRequest)
+		return
+	}
 
-	stmt, err := db.Prepare("INSERT INTO reports (type, pid, user, reason, message) VALUES (1, ?, ?, ?, ?)")
-	stmt.Exec(&comment_id, &CurrentUser.ID, &reason, &message)
+	stmt, err := db.Prepare("INSERT INTO reports (type, pid, user, reason, community_reason, message) VALUES (1, ?, ?, ?, ?, ?)")
+	stmt.Exec(&comment_id, &CurrentUser.ID, &reason, &communityReason, &message)
 	stmt.Close()
 
 	if settings.Webhooks.Enabled && len(settings.Webhooks.Reports) > 0 {
-		reasonInt, _ := strconv.Atoi(reason)
-		content := "New report from **" + escapeMarkdown(CurrentUser.Nickname) + "**.\nReason: " + settings.ReportReasons[reasonInt].Name + "\n"
+		content := "New report from **" + escapeMarkdown(CurrentUser.Nickname) + "**.\nReason: " + reasonName + "\n"
 		if len(message) > 0 {
 			content += "Message: " + escapeMarkdown(message) + "\n"
 		}
@@ -2688,13 +4115,14 @@ func reportIgnore(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 
 	vars := mux.Vars(r)
 	reportID := vars["id"]
-	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM reports WHERE id = ?", reportID).Scan(&count)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var reportType, pid, reason, reportedBy, target int
+	var message string
+	err = db.QueryRow("SELECT reports.type, pid, reason, message, IFNULL(reports.user, 0), IFNULL(CASE reports.type WHEN 0 THEN posts.created_by WHEN 1 THEN comments.created_by WHEN 3 THEN messages.created_by ELSE pid END, 0) FROM reports LEFT JOIN posts ON reports.type = 0 AND posts.id = pid LEFT JOIN comments ON reports.type = 1 AND comments.id = pid LEFT JOIN messages ON reports.type = 3 AND messages.id = pid WHERE reports.id = ?", reportID).Scan(&reportType, &pid, &reason, &message, &reportedBy, &target)
+	if err == sql.ErrNoRows {
+		handle404(w, r, CurrentUser)
 		return
 	}
-	if count == 0 {
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -2703,6 +4131,11 @@ func reportIgnore(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	// audit log
+	// type 10 - dismiss report
+	report := map[string]interface{}{"type": reportType, "pid": pid, "reason": reason, "message": message, "reported_by": reportedBy, "dismissed": false}
+	logAuditEvent(r, 10, reportID, target, CurrentUser, report, map[string]interface{}{"dismissed": true})
 }
 
 // Report a post.
@@ -2729,19 +4162,25 @@ func reportPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if count > 0 {
 		return
 	}
-	reason := r.FormValue("type")
-	if reason == "spoiler" {
-		reason = "0"
+	var communityID int
+	db.QueryRow("SELECT community_id FROM posts WHERE id = ?", post_id).Scan(&communityID)
+	reason, communityReason, reasonName, bodyRequired, ok := getReportReason(r.FormValue("type"), communityID)
+	if !ok {
+		http.Error(w, "Invalid report reason.", http.StatusBadRequest)
+		return
 	}
 	message := r.FormValue("body")
+	if bodyRequired && len(strings.TrimSpace(message)) == 0 {
+		http.Error(w, "Please explain why you're reporting this.", http.StatusBadRequest)
+		return
+	}
 
-	stmt, err := db.Prepare("INSERT INTO reports (type, pid, user, reason, message) VALUES (0, ?, ?, ?, ?)")
-	stmt.Exec(&post_id, &CurrentUser.ID, &reason, &message)
+	stmt, err := db.Prepare("INSERT INTO reports (type, pid, user, reason, community_reason, message) VALUES (0, ?, ?, ?, ?, ?)")
+	stmt.Exec(&post_id, &CurrentUser.ID, &reason, &communityReason, &message)
 	stmt.Close()
 
 	if settings.Webhooks.Enabled && len(settings.Webhooks.Reports) > 0 {
-		reasonInt, _ := strconv.Atoi(reason)
-		content := "New report from **" + escapeMarkdown(CurrentUser.Nickname) + "**.\nReason: " + settings.ReportReasons[reasonInt].Name + "\n"
+		content := "New report from **" + escapeMarkdown(CurrentUser.Nickname) + "**.\nReason: " + reasonName + "\n"
 		if len(message) > 0 {
 			content += "Message: " + escapeMarkdown(message) + "\n"
 		}
@@ -2813,6 +4252,22 @@ func reportUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 }
 
+// Give the user a new calendar feed link, so the old one stops working.
+func resetEventCalendarToken(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	calendarToken, err := generateSecureToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("UPDATE users SET calendar_token = ? WHERE id = ?", calendarToken, CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/events", 302)
+}
+
 // Reset a user's password.
 func resetPassword(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	var data map[string]interface{}
@@ -2947,6 +4402,7 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	messageURL := ""
 	url_type := 0
 	feeling := r.FormValue("feeling_id")
+	var paintingAlt string
 
 	var otherUserID int
 	var target int
@@ -2980,18 +4436,19 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		http.Error(w, "Your message is empty.", http.StatusBadRequest)
 		return
 	}
-	if len(image) > 0 {
-		imageURL := ""
-		db.QueryRow("SELECT value FROM images WHERE id = ?", image).Scan(&imageURL)
-		if len(imageURL) == 0 {
-			http.Error(w, "Invalid image.", http.StatusBadRequest)
-			return
-		}
-		image = imageURL
-	}
-	if len(attachment_type) == 0 {
-		attachment_type = "0"
-	}
+	attachments, err := getFormAttachments(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(attachments) > 0 {
+		image = attachments[0].URL
+	}
+	attachment_type, err = getAttachmentType(attachment_type, attachments)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if len(post_type) == 0 {
 		post_type = "0"
 	} else if post_type == "1" {
@@ -3004,46 +4461,49 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			http.Error(w, "Invalid drawing.", http.StatusBadRequest)
 			return
 		}
+		paintingAlt, err = getFormPaintingAlt(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	} else if post_type != "0" {
 		http.Error(w, "Invalid post type.", http.StatusBadRequest)
 		return
 	}
 
-	if len(body) > 0 {
-		matched := youtube.FindAllStringSubmatch(body, 1)
-		if len(matched) > 0 {
-			messageURL = matched[0][1]
-			url_type = 1
-		} else {
-			matched = spotify.FindAllStringSubmatch(body, 1)
-			if len(matched) > 0 {
-				messageURL = matched[0][1]
-				url_type = 2
-			} else {
-				matched = soundcloud.FindAllStringSubmatch(body, 1)
-				if len(matched) > 0 {
-					messageURL = "https://" + matched[0][0]
-					url_type = 3
-				}
-			}
-		}
+	if embedURL, embedType := getEmbed(body); embedType > 0 {
+		messageURL, url_type = embedURL, embedType
+	}
+
+	// Run the message through the automod. Messages can't be held or spoilered, so holding one blocks it instead.
+	automodBody := body
+	if post_type == "1" {
+		automodBody = ""
+	}
+	automod := checkAutomod(CurrentUser, 2, automodBody, len(image) > 0 || post_type == "1")
+	if automod.Block || automod.Hold {
+		http.Error(w, "Your message was blocked by the automatic moderation.", http.StatusBadRequest)
+		return
+	}
+	if automod.Limit {
+		CurrentUser.Limited = true
 	}
 
 	var msg_read bool
-	if target == 0 {
+	if target == 0 || CurrentUser.Limited {
 		msg_read = true
 	} else {
 		msg_read = false
 	}
 
-	stmt, err := db.Prepare("INSERT messages SET created_by = ?, conversation_id = ?, body = ?, image = ?, attachment_type = ?, url = ?, url_type = ?, post_type = ?, feeling = ?, msg_read = ?")
+	stmt, err := db.Prepare("INSERT messages SET created_by = ?, conversation_id = ?, body = ?, image = ?, attachment_type = ?, painting_alt = ?, url = ?, url_type = ?, post_type = ?, feeling = ?, msg_read = ?")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// If there's no errors, we can go ahead and execute the statement.
-	_, err = stmt.Exec(user_id, conversation_id, body, image, attachment_type, messageURL, url_type, post_type, feeling, msg_read)
+	_, err = stmt.Exec(user_id, conversation_id, body, image, attachment_type, paintingAlt, messageURL, url_type, post_type, feeling, msg_read)
 	stmt.Close()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -3076,6 +4536,16 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 	messages.URL = messageURL
 	messages.URLType = url_type
+	err = saveAttachments(2, messages.ID, attachments)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if automod.Report {
+		createAutomodReport(3, messages.ID, automod.Rules)
+	}
+	messages.Attachments = attachments
+	messages.PaintingAlt = paintingAlt
 	messages.ByUsername = CurrentUser.Username
 	messages.ByAvatar = getAvatar(messages.ByAvatar, CurrentUser.HasMii, messages.Feeling)
 	messages.ByOnline = CurrentUser.Online
@@ -3093,7 +4563,7 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	messages.ByMe = false
 	templates.ExecuteTemplate(&msgTpl, "render_message.html", messages)
 
-	if target == 0 {
+	if target == 0 && !CurrentUser.Limited {
 		_, err = db.Exec("UPDATE group_members SET unread_messages = unread_messages + 1 WHERE user != ? AND conversation = ?", CurrentUser.ID, conversation_id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -3106,6 +4576,10 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	msg.Content = msgTpl.String()
 
 	for client := range clients {
+		// Messages from limited users are only shown to staff.
+		if CurrentUser.Limited && clients[client].Level == 0 {
+			continue
+		}
 		var qualifies bool
 		if target == 0 {
 			qualifies = clients[client].OnPage == "/conversations/"+conversation_id && clients[client].UserID != CurrentUser.ID // not checking if the user is in the conversation or not is a SECURITY ISSUE, change this ASAP!
@@ -3170,7 +4644,7 @@ func sendMessage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			} else {
 				msg.Type = "messageNotif"
 				var unread int
-				db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND conversations.is_rm = 0", &otherUserID, &otherUserID, &otherUserID).Scan(&unread)
+				db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND messages.is_rm_by_admin = 0 AND conversations.is_rm = 0", &otherUserID, &otherUserID, &otherUserID).Scan(&unread)
 				var groupUnread int
 				db.QueryRow("SELECT SUM(unread_messages) FROM group_members WHERE user = ?", otherUserID).Scan(&groupUnread)
 				unread += groupUnread
@@ -3209,25 +4683,25 @@ func showActivityFeed(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	var rp repostPreview
 
 	if len(repost) > 0 {
-		repost_row, err := db.Query("SELECT posts.id, nickname, body, post_type FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", repost, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
+		repost_row, err := db.Query("SELECT posts.id, nickname, body, post_type, painting_alt FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", repost, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		if repost_row.Next() {
-			err = repost_row.Scan(&rp.ID, &rp.Nickname, &rp.Text, &rp.PostType)
+			err = repost_row.Scan(&rp.ID, &rp.Nickname, &rp.Text, &rp.PostType, &rp.PaintingAlt)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			rp.Text = parsePreview(rp.Text, rp.PostType, false)
+			rp.Text = parsePreview(rp.Text, rp.PostType, false, rp.PaintingAlt)
 		}
 		repost_row.Close()
 	}
 
 	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" && pjax {
 		offset, _ := strconv.Atoi(r.FormValue("offset"))
-		post_rows, err := db.Query("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, communities.id, title, icon, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE created_by IN (SELECT follow_to FROM follows WHERE follow_by = ?) AND is_rm = 0 AND is_rm_by_admin = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY posts.created_at DESC, posts.id DESC LIMIT 20 OFFSET ?", CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+		post_rows, err := db.Query("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, communities.id, title, icon, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE created_by IN (SELECT follow_to FROM follows WHERE follow_by = ?) AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (posts.pending = 0 OR posts.created_by = ?) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY posts.created_at DESC, posts.id DESC LIMIT 20 OFFSET ?", CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -3246,6 +4720,7 @@ func showActivityFeed(w http.ResponseWriter, r *http.Request, CurrentUser user)
 			posts = append(posts, row)
 		}
 		post_rows.Close()
+		setupPostAttachments(posts...)
 		offset += 20
 		var data = map[string]interface{}{
 			"Offset": offset,
@@ -3258,14 +4733,16 @@ func showActivityFeed(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		}
 	} else {
 		var data = map[string]interface{}{
-			"Title":          "Activity Feed",
-			"Pjax":           pjax,
-			"CurrentUser":    CurrentUser,
-			"FriendCount":    friendCount,
-			"FollowingCount": followingCount,
-			"FollowerCount":  followerCount,
-			"Repost":         rp,
-			"MaxUploadSize":  settings.ImageHost.MaxUploadSize,
+			"Title":           "Activity Feed",
+			"Pjax":            pjax,
+			"CurrentUser":     CurrentUser,
+			"FriendCount":     friendCount,
+			"FollowingCount":  followingCount,
+			"FollowerCount":   followerCount,
+			"Repost":          rp,
+			"MaxUploadSize":   settings.ImageHost.MaxUploadSize,
+			"MaxClipDuration": settings.Clips.MaxDuration,
+			"MaxImages":       settings.MaxImages,
 		}
 		err := templates.ExecuteTemplate(w, "activity_loading.html", data)
 		if err != nil {
@@ -3275,6 +4752,268 @@ func showActivityFeed(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 }
 
+// Show the automod rules, and create new ones.
+func showAdminAutomod(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		var rule automodRule
+		rule.Name = r.FormValue("name")
+		rule.ConditionType, _ = strconv.Atoi(r.FormValue("condition_type"))
+		rule.Value = r.FormValue("value")
+		rule.Action, _ = strconv.Atoi(r.FormValue("action"))
+		rule.DryRun = r.FormValue("dry_run") == "1"
+
+		if ruleError := checkAutomodRule(rule); len(ruleError) > 0 {
+			http.Error(w, ruleError, http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("INSERT INTO automod_rules (name, condition_type, value, action, dry_run, created_by) VALUES (?, ?, ?, ?, ?, ?)", rule.Name, rule.ConditionType, rule.Value, rule.Action, rule.DryRun, CurrentUser.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("Success!"))
+		// audit log
+		// type 12 - change automod rule
+		ruleID, _ := res.LastInsertId()
+		logAuditEvent(r, 12, ruleID, 0, CurrentUser, nil, getAutomodRuleForAuditLog(ruleID))
+		return
+	}
+
+	rule_rows, err := db.Query("SELECT automod_rules.id, name, condition_type, value, action, automod_rules.dry_run, enabled, COUNT(automod_hits.id), IFNULL(SUM(automod_hits.dry_run), 0), IFNULL(SUM(automod_hits.created_at > NOW() - INTERVAL 1 DAY), 0), MAX(automod_hits.created_at) FROM automod_rules LEFT JOIN automod_hits ON rule = automod_rules.id GROUP BY automod_rules.id ORDER BY automod_rules.id ASC")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var rules []automodRule
+
+	for rule_rows.Next() {
+		var row automodRule
+		var lastHit sql.NullTime
+
+		err = rule_rows.Scan(&row.ID, &row.Name, &row.ConditionType, &row.Value, &row.Action, &row.DryRun, &row.Enabled, &row.Hits, &row.DryRunHits, &row.RecentHits, &lastHit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if lastHit.Valid {
+			row.LastHit = humanTiming(lastHit.Time, CurrentUser.Timezone)
+		}
+		rules = append(rules, row)
+	}
+	rule_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":       "Automod",
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Admin":       admin,
+		"Rules":       rules,
+	}
+	err = templates.ExecuteTemplate(w, "automod.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the list of bans, and ban IP ranges and ASNs.
+func showAdminBans(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		length := r.FormValue("length")
+		reason := r.FormValue("reason")
+		if utf8.RuneCountInString(reason) > 255 {
+			http.Error(w, "The reason is too long. (255 characters maximum)", http.StatusBadRequest)
+			return
+		}
+
+		if asn := strings.TrimPrefix(strings.ToUpper(r.FormValue("asn")), "AS"); len(asn) > 0 {
+			asnNumber, err := strconv.ParseUint(asn, 10, 32)
+			if err != nil {
+				http.Error(w, "Invalid ASN.", http.StatusBadRequest)
+				return
+			}
+			res, err := db.Exec("INSERT INTO ip_bans (asn, reason, until, ban_by) VALUES (?, ?, NOW() + INTERVAL ? DAY, ?)", asnNumber, reason, length, CurrentUser.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			banID, _ := res.LastInsertId()
+			// type 15 - create ban
+			logAuditEvent(r, 15, banID, 0, CurrentUser, nil, map[string]interface{}{"asn": asnNumber, "reason": reason, "length": length})
+		} else {
+			prefix, err := parseIPRange(r.FormValue("ip"), 0)
+			if err != nil {
+				http.Error(w, "Invalid IP range.", http.StatusBadRequest)
+				return
+			}
+			err = checkIPRangeSize(prefix)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rangeStart, rangeEnd := getIPRangeBounds(prefix)
+			res, err := db.Exec("INSERT INTO bans (ip, range_start, range_end, reason, until, ban_by) VALUES (?, ?, ?, ?, NOW() + INTERVAL ? DAY, ?)", prefix.String(), rangeStart, rangeEnd, reason, length, CurrentUser.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			banID, _ := res.LastInsertId()
+			// type 15 - create ban
+			logAuditEvent(r, 15, banID, 0, CurrentUser, nil, map[string]interface{}{"range": prefix.String(), "reason": reason, "length": length})
+		}
+
+		w.Write([]byte("Success!"))
+		return
+	}
+
+	query := strings.TrimSpace(r.FormValue("q"))
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+
+	// Searching for an IP or a range shows every ban that overlaps it, otherwise it matches usernames and reasons.
+	var ban_rows *sql.Rows
+	prefix, prefixErr := parseIPRange(query, 0)
+	if prefixErr == nil {
+		rangeStart, rangeEnd := getIPRangeBounds(prefix)
+		ban_rows, err = db.Query("SELECT bans.id, IFNULL(users.username, ''), IFNULL(users.nickname, ''), bans.ip, reason, bans.created_at, until, until > NOW(), IFNULL(issuer.username, ''), IFNULL(issuer.nickname, '') FROM bans LEFT JOIN users ON users.id = bans.user LEFT JOIN users AS issuer ON issuer.id = ban_by WHERE LENGTH(range_start) = ? AND range_start <= ? AND range_end >= ? ORDER BY bans.id DESC LIMIT 50 OFFSET ?", len(rangeStart), rangeEnd, rangeStart, offset)
+	} else {
+		ban_rows, err = db.Query("SELECT bans.id, IFNULL(users.username, ''), IFNULL(users.nickname, ''), bans.ip, reason, bans.created_at, until, until > NOW(), IFNULL(issuer.username, ''), IFNULL(issuer.nickname, '') FROM bans LEFT JOIN users ON users.id = bans.user LEFT JOIN users AS issuer ON issuer.id = ban_by WHERE ? = '' OR users.username LIKE CONCAT('%', ?, '%') OR reason LIKE CONCAT('%', ?, '%') ORDER BY bans.id DESC LIMIT 50 OFFSET ?", query, query, query, offset)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var bans []ban
+
+	for ban_rows.Next() {
+		var row ban
+		var createdAt, until time.Time
+
+		err = ban_rows.Scan(&row.ID, &row.Username, &row.Nickname, &row.IP, &row.Reason, &createdAt, &until, &row.Active, &row.IssuerUsername, &row.IssuerNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		row.Until = until.Format("01/02/2006 3:04 PM")
+		row.UntilForever = until.Year() > 2100
+		bans = append(bans, row)
+	}
+	ban_rows.Close()
+
+	asn_rows, err := db.Query("SELECT ip_bans.id, asn, reason, ip_bans.created_at, until, until > NOW(), IFNULL(issuer.username, ''), IFNULL(issuer.nickname, '') FROM ip_bans LEFT JOIN users AS issuer ON issuer.id = ban_by WHERE ? = '' OR CONCAT('AS', asn) = UPPER(?) OR asn = ? OR reason LIKE CONCAT('%', ?, '%') ORDER BY ip_bans.id DESC", query, query, query, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var asnBans []ban
+
+	for asn_rows.Next() {
+		var row ban
+		var createdAt, until time.Time
+
+		err = asn_rows.Scan(&row.ID, &row.ASN, &row.Reason, &createdAt, &until, &row.Active, &row.IssuerUsername, &row.IssuerNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		row.Until = until.Format("01/02/2006 3:04 PM")
+		row.UntilForever = until.Year() > 2100
+		asnBans = append(asnBans, row)
+	}
+	asn_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":       "Bans",
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Admin":       admin,
+		"Query":       query,
+		"Offset":      offset + 50,
+		"Bans":        bans,
+		"ASNBans":     asnBans,
+	}
+	err = templates.ExecuteTemplate(w, "bans.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the community request queue and the list of communities.
+func showAdminCommunities(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	query := r.FormValue("q")
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+
+	request_rows, err := db.Query("SELECT community_requests.id, title, description, icon, banner, category, community_requests.created_at, username, nickname FROM community_requests INNER JOIN users ON users.id = created_by WHERE status = 0 ORDER BY community_requests.id ASC")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var requests []communityRequest
+
+	for request_rows.Next() {
+		var row communityRequest
+		var createdAt time.Time
+
+		err = request_rows.Scan(&row.ID, &row.Title, &row.Description, &row.Icon, &row.Banner, &row.Category, &createdAt, &row.Username, &row.Nickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		row.CategoryName = getCommunityCategoryName(row.Category)
+		requests = append(requests, row)
+	}
+	request_rows.Close()
+
+	community_rows, err := db.Query("SELECT id, title, icon, is_featured, rm FROM communities WHERE ? = '' OR title LIKE CONCAT('%', ?, '%') ORDER BY id DESC LIMIT 50 OFFSET ?", query, query, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var communities []community
+
+	for community_rows.Next() {
+		var row community
+		err = community_rows.Scan(&row.ID, &row.Title, &row.Icon, &row.IsFeatured, &row.RM)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		communities = append(communities, row)
+	}
+	community_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":       "Communities",
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Admin":       admin,
+		"Query":       query,
+		"Offset":      offset + 50,
+		"Requests":    requests,
+		"Communities": communities,
+	}
+	err = templates.ExecuteTemplate(w, "community_list.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Show the admin dashboard.
 func showAdminDashboard(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	if CurrentUser.Level < 1 {
@@ -3284,7 +5023,7 @@ func showAdminDashboard(w http.ResponseWriter, r *http.Request, CurrentUser user
 
 	offset, _ := strconv.Atoi(r.FormValue("offset"))
 
-	report_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, posts.is_rm, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm, source_identifier, posts.type, reports.id, reports.type, message, reason, user FROM (SELECT posts.id, posts.created_by, posts.community_id, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, posts.privacy, repost, migration, migrated_id, migrated_community, posts.is_rm, posts.is_rm_by_admin, users.username, users.nickname, users.avatar, users.has_mh, users.online, users.hide_online, users.color, users.role, title, icon, rm, 0 source_identifier, 0 type FROM posts LEFT JOIN users ON posts.created_by = users.id LEFT JOIN communities ON community_id = communities.id UNION SELECT comments.id, comments.created_by, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, op.privacy, 0, 0, 0, 0, comments.is_rm, comments.is_rm_by_admin, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, poster.nickname, poster.avatar, op.is_rm, poster.has_mh, 1 FROM comments LEFT JOIN posts AS op ON post = op.id LEFT JOIN users AS creator ON comments.created_by = creator.id LEFT JOIN users AS poster ON op.created_by = poster.id) posts LEFT JOIN reports ON pid = posts.id AND reports.type = posts.type WHERE reports.is_rm = 0 AND posts.is_rm = 0 AND is_rm_by_admin = 0 ORDER BY reports.id DESC LIMIT 25 OFFSET ?", offset)
+	report_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, posts.is_rm, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm, source_identifier, posts.type, reports.id, reports.type, message, reason, IFNULL(user, 0) FROM (SELECT posts.id, posts.created_by, posts.community_id, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, posts.privacy, repost, migration, migrated_id, migrated_community, posts.is_rm, posts.is_rm_by_admin, users.username, users.nickname, users.avatar, users.has_mh, users.online, users.hide_online, users.color, users.role, title, icon, rm, 0 source_identifier, 0 type FROM posts LEFT JOIN users ON posts.created_by = users.id LEFT JOIN communities ON community_id = communities.id UNION SELECT comments.id, comments.created_by, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, op.privacy, 0, 0, 0, 0, comments.is_rm, comments.is_rm_by_admin, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, poster.nickname, poster.avatar, op.is_rm, poster.has_mh, 1 FROM comments LEFT JOIN posts AS op ON post = op.id LEFT JOIN users AS creator ON comments.created_by = creator.id LEFT JOIN users AS poster ON op.created_by = poster.id UNION SELECT messages.id, messages.created_by, 0, messages.created_at, messages.created_at, messages.feeling, messages.body, messages.image, messages.attachment_type, 0, messages.post_type, messages.url, messages.url_type, 0, 0, 0, 0, 0, 0, messages.is_rm, messages.is_rm_by_admin, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, 'a message', '', 0, 0, 3 FROM messages LEFT JOIN users AS creator ON messages.created_by = creator.id) posts LEFT JOIN reports ON pid = posts.id AND reports.type = posts.type WHERE reports.is_rm = 0 AND posts.is_rm = 0 AND is_rm_by_admin = 0 ORDER BY reports.id DESC LIMIT 25 OFFSET ?", offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3295,28 +5034,44 @@ func showAdminDashboard(w http.ResponseWriter, r *http.Request, CurrentUser user
 		var row = &post{}
 		var report = report{}
 		var communityHasMii bool
-		var onComment bool
+		var sourceType int
 
-		err = report_rows.Scan(&row.ID, &row.CreatedBy, &row.CommunityID, &row.CreatedAtTime, &row.EditedAtTime, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.Privacy, &row.RepostID, &row.MigrationID, &row.MigratedID, &row.MigratedCommunity, &row.IsRM, &row.IsRMByAdmin, &row.PosterUsername, &row.PosterNickname, &row.PosterIcon, &row.PosterHasMii, &row.PosterOnline, &row.PosterHideOnline, &row.PosterColor, &row.PosterRoleID, &row.CommunityName, &row.CommunityIcon, &row.CommunityRM, &communityHasMii, &onComment, &report.ID, &report.Type, &report.Message, &report.Reason, &report.ByID)
+		err = report_rows.Scan(&row.ID, &row.CreatedBy, &row.CommunityID, &row.CreatedAtTime, &row.EditedAtTime, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.Privacy, &row.RepostID, &row.MigrationID, &row.MigratedID, &row.MigratedCommunity, &row.IsRM, &row.IsRMByAdmin, &row.PosterUsername, &row.PosterNickname, &row.PosterIcon, &row.PosterHasMii, &row.PosterOnline, &row.PosterHideOnline, &row.PosterColor, &row.PosterRoleID, &row.CommunityName, &row.CommunityIcon, &row.CommunityRM, &communityHasMii, &sourceType, &report.ID, &report.Type, &report.Message, &report.Reason, &report.ByID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if len(report.Message) == 0 {
+		// Community reasons are shown on their own so they don't get lost behind the reporter's message.
+		if report.Reason < 0 {
+			db.QueryRow("SELECT name FROM community_report_reasons INNER JOIN reports ON reports.community_reason = community_report_reasons.id WHERE reports.id = ?", report.ID).Scan(&report.ReasonName)
+		} else if len(report.Message) == 0 {
 			report.Message = settings.ReportReasons[report.Reason].Name
 		}
 		db.QueryRow("SELECT username, nickname, color FROM users WHERE id = ?", report.ByID).Scan(&report.ByUsername, &report.ByNickname, &report.ByColor)
+		onComment := sourceType == 1
+		if report.Type < 2 {
+			db.QueryRow("SELECT COUNT(*) FROM revisions WHERE post = ? AND on_comment = ?", row.ID, onComment).Scan(&report.Revisions)
+		}
 
 		if onComment {
 			row.CommunityIcon = getAvatar(row.CommunityIcon, communityHasMii, 0)
 			row.CommunityName = "Comment on " + row.CommunityName + "'s Post"
 			row.CommentCount = -1
+		} else if sourceType == 3 {
+			row.CommunityIcon = getAvatar(row.PosterIcon, row.PosterHasMii, 0)
+			row.CommunityName = "Private message"
+			row.CommentCount = -1
 		}
 		row = setupPost(row, CurrentUser, 3, 2)
 		report.Post = row
 		reports = append(reports, report)
 	}
 	report_rows.Close()
+	var reportedPosts []*post
+	for _, report := range reports {
+		reportedPosts = append(reportedPosts, report.Post)
+	}
+	setupPostAttachments(reportedPosts...)
 
 	offset += 25
 
@@ -3353,56 +5108,318 @@ func showAdminManagerList(w http.ResponseWriter, r *http.Request, CurrentUser us
 	}
 }
 
-// Show the admin settings.
-func showAdminSettings(w http.ResponseWriter, r *http.Request, CurrentUser user) {
-	if CurrentUser.Level < admin.Settings.MinimumLevel {
+// Show the nuke page, or nuke a user or IP range.
+func showAdminNuke(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
 		http.Redirect(w, r, "/", 302)
 		return
 	}
 
-	if r.Method == "POST" {
-		settings.ImageHost.Provider = r.FormValue("imagehost_provider")
-		settings.ImageHost.Username = r.FormValue("imagehost_username")
-		settings.ImageHost.UploadPreset = r.FormValue("imagehost_uploadpreset")
-		settings.ImageHost.APIEndpoint = r.FormValue("imagehost_apiendpoint")
-		settings.ImageHost.MaxUploadSize = r.FormValue("imagehost_maxuploadsize")
+	username := strings.TrimSpace(r.FormValue("username"))
+	ipRange := strings.TrimSpace(r.FormValue("ip"))
+	location, err := time.LoadLocation(CurrentUser.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	since, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("since"), location)
+	if err != nil {
+		since = time.Unix(0, 0)
+	}
+	until, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("until"), location)
+	if err != nil {
+		until = time.Now()
+	}
 
-		if r.FormValue("recaptcha_enabled") == "1" {
-			settings.ReCAPTCHA.Enabled = true
-		} else {
-			settings.ReCAPTCHA.Enabled = false
+	var userID int
+	var prefix netip.Prefix
+	if len(username) > 0 {
+		db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+		if userID == 0 {
+			http.Error(w, "The user could not be found.", http.StatusBadRequest)
+			return
 		}
-		settings.ReCAPTCHA.SiteKey = r.FormValue("recaptcha_sitekey")
-		settings.ReCAPTCHA.SecretKey = r.FormValue("recaptcha_secretkey")
-
-		if r.FormValue("webhooks_enabled") == "1" {
-			settings.Webhooks.Enabled = true
-		} else {
-			settings.Webhooks.Enabled = false
+	} else if len(ipRange) > 0 {
+		prefix, err = parseIPRange(ipRange, 0)
+		if err != nil {
+			http.Error(w, "Invalid IP range.", http.StatusBadRequest)
+			return
 		}
-		settings.Webhooks.Reports = r.FormValue("webhooks_reports")
-		settings.Webhooks.Signups = r.FormValue("webhooks_signups")
-		settings.Webhooks.Logins = r.FormValue("webhooks_logins")
-
-		if r.FormValue("smtp_enabled") == "1" {
-			settings.SMTP.Enabled = true
-		} else {
-			settings.SMTP.Enabled = false
+		err = checkIPRangeSize(prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		settings.SMTP.Hostname = r.FormValue("smtp_hostname")
-		settings.SMTP.Port = r.FormValue("smtp_port")
-		settings.SMTP.Email = r.FormValue("smtp_email")
-		settings.SMTP.Password = r.FormValue("smtp_password")
+	} else if r.Method == "POST" {
+		http.Error(w, "Enter a username or an IP range.", http.StatusBadRequest)
+		return
+	}
 
-		if r.FormValue("proxy") == "1" {
-			settings.Proxy = true
+	targets, targetArgs := getNukeTargets(userID, prefix, CurrentUser)
+	nukeArgs := func(args ...interface{}) []interface{} {
+		args = append(args, targetArgs...)
+		return append(args, since, until)
+	}
+
+	if r.Method == "POST" {
+		var nukeUser sql.NullInt64
+		var nukeIP sql.NullString
+		var rangeStart, rangeEnd []byte
+		if userID > 0 {
+			nukeUser = sql.NullInt64{Int64: int64(userID), Valid: true}
 		} else {
-			settings.Proxy = false
+			nukeIP = sql.NullString{String: prefix.String(), Valid: true}
+			rangeStart, rangeEnd = getIPRangeBounds(prefix)
 		}
-		if r.FormValue("forcelogins") == "1" {
-			settings.ForceLogins = true
-		} else {
-			settings.ForceLogins = false
+		res, err := db.Exec("INSERT INTO nukes (user, ip, range_start, range_end, since, until, created_by) VALUES (?, ?, ?, ?, ?, ?, ?)", nukeUser, nukeIP, rangeStart, rangeEnd, since, until, CurrentUser.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nukeID, _ := res.LastInsertId()
+
+		// Everything removed is tagged with the nuke so it can all be put back later.
+		var counts [4]int64
+		for i, table := range []string{"posts", "comments", "messages"} {
+			res, err = db.Exec("UPDATE "+table+" SET is_rm_by_admin = 1, nuke = ? WHERE created_by IN ("+targets+") AND created_at BETWEEN ? AND ? AND is_rm = 0 AND is_rm_by_admin = 0", nukeArgs(nukeID)...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			counts[i], _ = res.RowsAffected()
+		}
+		// Yeahs have nowhere to be marked as removed, so they're moved out of the way instead.
+		res, err = db.Exec("INSERT INTO nuked_yeahs (nuke, yeah_id, yeah_post, yeah_by, on_comment, created_at) SELECT ?, id, yeah_post, yeah_by, on_comment, created_at FROM yeahs WHERE yeah_by IN ("+targets+") AND created_at BETWEEN ? AND ?", nukeArgs(nukeID)...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		counts[3], _ = res.RowsAffected()
+		db.Exec("DELETE yeahs FROM yeahs INNER JOIN nuked_yeahs ON nuked_yeahs.yeah_id = yeahs.id WHERE nuked_yeahs.nuke = ?", nukeID)
+		db.Exec("UPDATE nukes SET post_count = ?, comment_count = ?, message_count = ?, yeah_count = ? WHERE id = ?", counts[0], counts[1], counts[2], counts[3], nukeID)
+		// Reports on what was removed go with it, and come back if the nuke is undone.
+		_, err = db.Exec("INSERT INTO nuked_reports (nuke, report_id, type, pid, message, user, reason, is_rm, community_reason, created_at) SELECT ?, id, type, pid, message, user, reason, is_rm, community_reason, created_at FROM reports WHERE (type = 0 AND pid IN (SELECT id FROM posts WHERE nuke = ?)) OR (type = 1 AND pid IN (SELECT id FROM comments WHERE nuke = ?))", nukeID, nukeID, nukeID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		db.Exec("DELETE reports FROM reports INNER JOIN nuked_reports ON nuked_reports.report_id = reports.id WHERE nuked_reports.nuke = ?", nukeID)
+
+		// audit log
+		// type 7 - nuke
+		logAuditEvent(r, 7, nukeID, userID, CurrentUser, nil, map[string]interface{}{"range": nukeIP.String, "since": since, "until": until, "posts": counts[0], "comments": counts[1], "messages": counts[2], "yeahs": counts[3]})
+
+		var msg wsMessage
+		msg.Type = "delete"
+		post_rows, err := db.Query("SELECT id, community_id FROM posts WHERE nuke = ?", nukeID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for post_rows.Next() {
+			var communityID int
+			post_rows.Scan(&msg.ID, &communityID)
+			for client := range clients {
+				if clients[client].OnPage != "/communities/"+strconv.Itoa(communityID) {
+					continue
+				}
+				err := writeWs(clients[client], client, msg)
+				if err != nil {
+					client.Close()
+					delete(clients, client)
+				}
+			}
+		}
+		post_rows.Close()
+
+		comment_rows, err := db.Query("SELECT id, post FROM comments WHERE nuke = ?", nukeID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for comment_rows.Next() {
+			var postID int
+			comment_rows.Scan(&msg.ID, &postID)
+			for client := range clients {
+				if clients[client].OnPage != "/posts/"+strconv.Itoa(postID) {
+					continue
+				}
+				err := writeWs(clients[client], client, msg)
+				if err != nil {
+					client.Close()
+					delete(clients, client)
+				}
+			}
+		}
+		comment_rows.Close()
+
+		w.Write([]byte("Success!"))
+		return
+	}
+
+	// Show how much would be removed before actually doing it.
+	var preview *nuke
+	if userID > 0 || prefix.IsValid() {
+		preview = &nuke{}
+		var previewArgs []interface{}
+		for i := 0; i < 4; i++ {
+			previewArgs = append(previewArgs, nukeArgs()...)
+		}
+		err = db.QueryRow("SELECT (SELECT COUNT(*) FROM posts WHERE created_by IN ("+targets+") AND created_at BETWEEN ? AND ? AND is_rm = 0 AND is_rm_by_admin = 0), (SELECT COUNT(*) FROM comments WHERE created_by IN ("+targets+") AND created_at BETWEEN ? AND ? AND is_rm = 0 AND is_rm_by_admin = 0), (SELECT COUNT(*) FROM messages WHERE created_by IN ("+targets+") AND created_at BETWEEN ? AND ? AND is_rm = 0 AND is_rm_by_admin = 0), (SELECT COUNT(*) FROM yeahs WHERE yeah_by IN ("+targets+") AND created_at BETWEEN ? AND ?)", previewArgs...).Scan(&preview.PostCount, &preview.CommentCount, &preview.MessageCount, &preview.YeahCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	nuke_rows, err := db.Query("SELECT nukes.id, IFNULL(users.username, ''), IFNULL(users.nickname, ''), IFNULL(nukes.ip, ''), since, until, post_count, comment_count, message_count, yeah_count, undone, nukes.created_at, IFNULL(issuer.username, ''), IFNULL(issuer.nickname, '') FROM nukes LEFT JOIN users ON users.id = nukes.user LEFT JOIN users AS issuer ON issuer.id = nukes.created_by ORDER BY nukes.id DESC LIMIT 25")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var nukes []nuke
+
+	for nuke_rows.Next() {
+		var row nuke
+		var nukeSince, nukeUntil, createdAt time.Time
+
+		err = nuke_rows.Scan(&row.ID, &row.Username, &row.Nickname, &row.IP, &nukeSince, &nukeUntil, &row.PostCount, &row.CommentCount, &row.MessageCount, &row.YeahCount, &row.Undone, &createdAt, &row.IssuerUsername, &row.IssuerNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if nukeSince.Unix() > 0 {
+			row.Since = nukeSince.In(location).Format("01/02/2006 3:04 PM")
+		}
+		row.Until = nukeUntil.In(location).Format("01/02/2006 3:04 PM")
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		nukes = append(nukes, row)
+	}
+	nuke_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":       "Nuke",
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Admin":       admin,
+		"Username":    username,
+		"IP":          ipRange,
+		"Since":       r.FormValue("since"),
+		"Until":       r.FormValue("until"),
+		"Preview":     preview,
+		"Nukes":       nukes,
+	}
+	err = templates.ExecuteTemplate(w, "nuke.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the queue of posts and comments waiting for approval.
+func showAdminQueue(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < 1 {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+
+	pending_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm, source_identifier, posts.type FROM (SELECT posts.id, posts.created_by, posts.community_id, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, posts.privacy, repost, migration, migrated_id, migrated_community, users.username, users.nickname, users.avatar, users.has_mh, users.online, users.hide_online, users.color, users.role, title, icon, rm, 0 source_identifier, 0 type FROM posts LEFT JOIN users ON posts.created_by = users.id LEFT JOIN communities ON community_id = communities.id WHERE posts.pending = 1 AND posts.is_rm = 0 AND posts.is_rm_by_admin = 0 UNION ALL SELECT comments.id, comments.created_by, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, op.privacy, 0, 0, 0, 0, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, poster.nickname, poster.avatar, op.is_rm, poster.has_mh, 1 FROM comments LEFT JOIN posts AS op ON post = op.id LEFT JOIN users AS creator ON comments.created_by = creator.id LEFT JOIN users AS poster ON op.created_by = poster.id WHERE comments.pending = 1 AND comments.is_rm = 0 AND comments.is_rm_by_admin = 0) posts ORDER BY created_at ASC LIMIT 25 OFFSET ?", offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var posts []*post
+
+	for pending_rows.Next() {
+		var row = &post{}
+		var communityHasMii bool
+		var onComment bool
+
+		err = pending_rows.Scan(&row.ID, &row.CreatedBy, &row.CommunityID, &row.CreatedAtTime, &row.EditedAtTime, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.Privacy, &row.RepostID, &row.MigrationID, &row.MigratedID, &row.MigratedCommunity, &row.PosterUsername, &row.PosterNickname, &row.PosterIcon, &row.PosterHasMii, &row.PosterOnline, &row.PosterHideOnline, &row.PosterColor, &row.PosterRoleID, &row.CommunityName, &row.CommunityIcon, &row.CommunityRM, &communityHasMii, &onComment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if onComment {
+			row.CommunityIcon = getAvatar(row.CommunityIcon, communityHasMii, 0)
+			row.CommunityName = "Comment on " + row.CommunityName + "'s Post"
+			row.CommentCount = -1
+		}
+		row = setupPost(row, CurrentUser, 3, 2)
+		row.Pending = true
+		posts = append(posts, row)
+	}
+	pending_rows.Close()
+	setupPostAttachments(posts...)
+
+	offset += 25
+
+	var data = map[string]interface{}{
+		"Title":       "Review Queue",
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"Offset":      offset,
+		"CurrentUser": CurrentUser,
+		"Admin":       admin,
+		"Posts":       posts,
+	}
+	err = templates.ExecuteTemplate(w, "queue.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the admin settings.
+func showAdminSettings(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Settings.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		oldSettings := settings
+		settings.ImageHost.Provider = r.FormValue("imagehost_provider")
+		settings.ImageHost.Username = r.FormValue("imagehost_username")
+		settings.ImageHost.UploadPreset = r.FormValue("imagehost_uploadpreset")
+		settings.ImageHost.APIEndpoint = r.FormValue("imagehost_apiendpoint")
+		settings.ImageHost.MaxUploadSize = r.FormValue("imagehost_maxuploadsize")
+
+		if r.FormValue("recaptcha_enabled") == "1" {
+			settings.ReCAPTCHA.Enabled = true
+		} else {
+			settings.ReCAPTCHA.Enabled = false
+		}
+		settings.ReCAPTCHA.SiteKey = r.FormValue("recaptcha_sitekey")
+		settings.ReCAPTCHA.SecretKey = r.FormValue("recaptcha_secretkey")
+
+		if r.FormValue("webhooks_enabled") == "1" {
+			settings.Webhooks.Enabled = true
+		} else {
+			settings.Webhooks.Enabled = false
+		}
+		settings.Webhooks.Reports = r.FormValue("webhooks_reports")
+		settings.Webhooks.Signups = r.FormValue("webhooks_signups")
+		settings.Webhooks.Logins = r.FormValue("webhooks_logins")
+
+		if r.FormValue("smtp_enabled") == "1" {
+			settings.SMTP.Enabled = true
+		} else {
+			settings.SMTP.Enabled = false
+		}
+		settings.SMTP.Hostname = r.FormValue("smtp_hostname")
+		settings.SMTP.Port = r.FormValue("smtp_port")
+		settings.SMTP.Email = r.FormValue("smtp_email")
+		settings.SMTP.Password = r.FormValue("smtp_password")
+
+		if r.FormValue("proxy") == "1" {
+			settings.Proxy = true
+		} else {
+			settings.Proxy = false
+		}
+		if r.FormValue("forcelogins") == "1" {
+			settings.ForceLogins = true
+		} else {
+			settings.ForceLogins = false
 		}
 		if r.FormValue("allowsignups") == "1" {
 			settings.AllowSignups = true
@@ -3415,6 +5432,86 @@ func showAdminSettings(w http.ResponseWriter, r *http.Request, CurrentUser user)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		settings.MaxPollOptions, err = strconv.Atoi(r.FormValue("maxpolloptions"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings.MaxPollOptions < 2 || settings.MaxPollOptions > 26 {
+			http.Error(w, "Polls have to allow between 2 and 26 options.", http.StatusBadRequest)
+			return
+		}
+		settings.MaxImages, err = strconv.Atoi(r.FormValue("maximages"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings.MaxImages < 1 || settings.MaxImages > 10 {
+			http.Error(w, "Posts have to allow between 1 and 10 images.", http.StatusBadRequest)
+			return
+		}
+		// Providers are turned off by leaving their boxes unchecked.
+		settings.DisabledEmbeds = nil
+		for _, provider := range embedProviders {
+			enabled := false
+			for _, key := range r.Form["embeds"] {
+				if key == provider.Key {
+					enabled = true
+				}
+			}
+			if !enabled {
+				settings.DisabledEmbeds = append(settings.DisabledEmbeds, provider.Key)
+			}
+		}
+		settings.Clips.MaxSize, err = strconv.Atoi(r.FormValue("clips_maxsize"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		settings.Clips.MaxDuration, err = strconv.Atoi(r.FormValue("clips_maxduration"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings.Clips.MaxSize < 1 || settings.Clips.MaxDuration < 1 {
+			http.Error(w, "Clips have to be allowed to be at least 1 MB and 1 second long.", http.StatusBadRequest)
+			return
+		}
+		settings.AltTextCommunities = nil
+		for _, id := range strings.Split(r.FormValue("alttextcommunities"), ",") {
+			id = strings.TrimSpace(id)
+			if len(id) == 0 {
+				continue
+			}
+			communityID, err := strconv.Atoi(id)
+			if err != nil {
+				http.Error(w, "Invalid community ID: "+id, http.StatusBadRequest)
+				return
+			}
+			settings.AltTextCommunities = append(settings.AltTextCommunities, communityID)
+		}
+
+		if r.FormValue("holdingqueue_enabled") == "1" {
+			settings.HoldingQueue.Enabled = true
+		} else {
+			settings.HoldingQueue.Enabled = false
+		}
+		settings.HoldingQueue.AccountAge, err = strconv.Atoi(r.FormValue("holdingqueue_accountage"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		settings.HoldingQueue.MinimumTrust, err = strconv.Atoi(r.FormValue("holdingqueue_minimumtrust"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		settings.AuditLogRetention, err = strconv.Atoi(r.FormValue("auditlogretention"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		changedBefore, changedAfter := diffSettings(oldSettings, settings)
 
 		settings.ReportReasons = append(settings.ReportReasons[:0], settings.ReportReasons[1:]...) // Remove the auto-added "spoilers" reason so it doesn't show up in the config.json file.
 		settingsJSON, err := json.MarshalIndent(settings, "", "	")
@@ -3429,6 +5526,21 @@ func showAdminSettings(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		}
 
 		settings = getSettings() // Get a new copy of the settings.
+
+		if len(changedAfter) > 0 {
+			// audit log
+			// type 9 - change settings
+			logAuditEvent(r, 9, 0, 0, CurrentUser, changedBefore, changedAfter)
+		}
+	}
+
+	var embeds []map[string]interface{}
+	for _, provider := range embedProviders {
+		embeds = append(embeds, map[string]interface{}{
+			"Key":     provider.Key,
+			"Name":    provider.Name,
+			"Enabled": checkIfEmbedEnabled(provider.Key),
+		})
 	}
 
 	var data = map[string]interface{}{
@@ -3437,6 +5549,7 @@ func showAdminSettings(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		"CurrentUser": CurrentUser,
 		"Admin":       admin,
 		"Settings":    settings,
+		"Embeds":      embeds,
 	}
 	err = templates.ExecuteTemplate(w, "settings.html", data)
 	if err != nil {
@@ -3449,18 +5562,18 @@ func showAllComments(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
 	post_id := vars["id"]
 
-	var createdBy int
-	err := db.QueryRow("SELECT created_by FROM posts WHERE id = ? AND is_rm = 0 AND is_rm_by_admin = 0", post_id).Scan(&createdBy)
-	if err != nil {
+	var createdBy, communityID int
+	err := db.QueryRow("SELECT created_by, community_id FROM posts WHERE id = ? AND is_rm = 0 AND is_rm_by_admin = 0", post_id).Scan(&createdBy, &communityID)
+	if err != nil && err != sql.ErrNoRows {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if createdBy == 0 {
-		http.Error(w, "The post could not be found.", http.StatusNotFound)
+	if createdBy == 0 || !checkIfCommunityMember(communityID, CurrentUser) {
+		handle404(w, r, CurrentUser)
 		return
 	}
 
-	comment_rows, _ := db.Query("SELECT comments.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments LEFT JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) ORDER BY created_at ASC", post_id, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords))
+	comment_rows, _ := db.Query("SELECT comments.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, painting_alt, url, url_type, pinned, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role, IFNULL(comments.parent, 0), IFNULL((SELECT parent_users.nickname FROM comments AS parent_comments LEFT JOIN users AS parent_users ON parent_users.id = parent_comments.created_by WHERE parent_comments.id = comments.parent AND parent_comments.is_rm = 0 AND parent_comments.is_rm_by_admin = 0), '') FROM comments LEFT JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (comments.pending = 0 OR comments.created_by = ?) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) ORDER BY created_at ASC", post_id, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords))
 	var comments []comment
 	var pinnedComments []comment
 
@@ -3470,7 +5583,7 @@ func showAllComments(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		var editedAt time.Time
 		var role int
 
-		err = comment_rows.Scan(&row.ID, &row.CreatedBy, &timestamp, &editedAt, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.IsRMByAdmin, &row.CommenterUsername, &row.CommenterNickname, &row.CommenterIcon, &row.CommenterHasMii, &row.CommenterOnline, &row.CommenterHideOnline, &row.CommenterColor, &role)
+		err = comment_rows.Scan(&row.ID, &row.CreatedBy, &timestamp, &editedAt, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.PaintingAlt, &row.URL, &row.URLType, &row.Pinned, &row.IsRMByAdmin, &row.CommenterUsername, &row.CommenterNickname, &row.CommenterIcon, &row.CommenterHasMii, &row.CommenterOnline, &row.CommenterHideOnline, &row.CommenterColor, &role, &row.ParentID, &row.ParentNickname)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -3503,6 +5616,9 @@ func showAllComments(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		}
 	}
 	comment_rows.Close()
+	setupCommentAttachments(pinnedComments)
+	setupCommentAttachments(comments)
+	comments = threadComments(comments)
 	var data = map[string]interface{}{
 		"CurrentUser":    CurrentUser,
 		"PinnedComments": pinnedComments,
@@ -3620,7 +5736,7 @@ func showComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	var yeahed string
 	var role int
 
-	db.QueryRow("SELECT comments.id, created_by, created_at, edited_at, post, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments LEFT JOIN users ON users.id = created_by WHERE comments.id = ? AND is_rm = 0", comment_id).Scan(&comments.ID, &comments.CreatedBy, &timestamp, &editedAt, &comments.PostID, &comments.Feeling, &comments.BodyText, &comments.Image, &comments.AttachmentType, &comments.IsSpoiler, &comments.PostType, &comments.URL, &comments.URLType, &comments.Pinned, &comments.IsRMByAdmin, &comments.CommenterUsername, &comments.CommenterNickname, &comments.CommenterIcon, &comments.CommenterHasMii, &comments.CommenterOnline, &comments.CommenterHideOnline, &comments.CommenterColor, &role)
+	db.QueryRow("SELECT comments.id, created_by, created_at, edited_at, post, feeling, body, image, attachment_type, is_spoiler, post_type, painting_alt, url, url_type, pinned, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments LEFT JOIN users ON users.id = created_by WHERE comments.id = ? AND is_rm = 0 AND (comments.pending = 0 OR comments.created_by = ? OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0)", comment_id, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level).Scan(&comments.ID, &comments.CreatedBy, &timestamp, &editedAt, &comments.PostID, &comments.Feeling, &comments.BodyText, &comments.Image, &comments.AttachmentType, &comments.IsSpoiler, &comments.PostType, &comments.PaintingAlt, &comments.URL, &comments.URLType, &comments.Pinned, &comments.IsRMByAdmin, &comments.CommenterUsername, &comments.CommenterNickname, &comments.CommenterIcon, &comments.CommenterHasMii, &comments.CommenterOnline, &comments.CommenterHideOnline, &comments.CommenterColor, &role)
 	if len(string(comments.CommenterUsername)) == 0 {
 		handle404(w, r, CurrentUser)
 		return
@@ -3638,18 +5754,21 @@ func showComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		comments.EditedAtUnix = editedAt.Unix()
 	}
 	comments.Body = parseBody(comments.BodyText, false, true)
+	if len(comments.Image) > 0 && (comments.AttachmentType == 0 || comments.AttachmentType == 3) {
+		comments.Attachments = getAttachments(1, comments.ID)
+	}
 	if comments.CreatedBy == CurrentUser.ID {
 		comments.ByMe = true
 	}
 	comments.CanYeah = checkIfCanYeah(CurrentUser, comments.CreatedBy)
 
-	db.QueryRow("SELECT feeling, body, privacy, post_type, is_rm | is_rm_by_admin, nickname, avatar, has_mh, communities.id, title, icon, rm FROM posts INNER JOIN users ON users.id = posts.created_by INNER JOIN communities ON communities.id = community_id WHERE posts.id = ? AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?)", comments.PostID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&posts.Feeling, &posts.BodyText, &posts.Privacy, &posts.PostType, &posts.IsRM, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.CommunityID, &posts.CommunityName, &posts.CommunityIcon, &posts.CommunityRM)
-	if len(posts.CommunityName) == 0 {
+	db.QueryRow("SELECT feeling, body, privacy, post_type, painting_alt, is_rm | is_rm_by_admin, nickname, avatar, has_mh, communities.id, title, icon, rm FROM posts INNER JOIN users ON users.id = posts.created_by INNER JOIN communities ON communities.id = community_id WHERE posts.id = ? AND (posts.pending = 0 OR posts.created_by = ? OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?)", comments.PostID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&posts.Feeling, &posts.BodyText, &posts.Privacy, &posts.PostType, &posts.PaintingAlt, &posts.IsRM, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.CommunityID, &posts.CommunityName, &posts.CommunityIcon, &posts.CommunityRM)
+	if len(posts.CommunityName) == 0 || !checkIfCommunityMember(posts.CommunityID, CurrentUser) {
 		handle404(w, r, CurrentUser)
 		return
 	}
 	posts.PosterIcon = getAvatar(posts.PosterIcon, posts.PosterHasMii, posts.Feeling)
-	posts.BodyText = parsePreview(posts.BodyText, posts.PostType, posts.IsRM)
+	posts.BodyText = parsePreview(posts.BodyText, posts.PostType, posts.IsRM, posts.PaintingAlt)
 
 	db.QueryRow("SELECT id FROM yeahs WHERE yeah_post = ? AND yeah_by = ? AND on_comment = 1", comments.ID, CurrentUser.ID).Scan(&yeahed)
 	if yeahed != "" {
@@ -3681,13 +5800,14 @@ func showComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	yeah_rows.Close()
 
 	var data = map[string]interface{}{
-		"Title":       comments.CommenterNickname + "'s Comment on " + posts.PosterNickname + "'s Post",
-		"Pjax":        r.Header.Get("X-PJAX") == "",
-		"CurrentUser": CurrentUser,
-		"Comment":     comments,
-		"Post":        posts,
-		"Yeahs":       yeahs,
-		"Reasons":     settings.ReportReasons,
+		"Title":            comments.CommenterNickname + "'s Comment on " + posts.PosterNickname + "'s Post",
+		"Pjax":             r.Header.Get("X-PJAX") == "",
+		"CurrentUser":      CurrentUser,
+		"Comment":          comments,
+		"Post":             posts,
+		"Yeahs":            yeahs,
+		"Reasons":          settings.ReportReasons,
+		"CommunityReasons": getCommunityReportReasons(posts.CommunityID),
 	}
 	err := templates.ExecuteTemplate(w, "comment.html", data)
 	if err != nil {
@@ -3695,46 +5815,89 @@ func showComment(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 }
 
-// Show a community.
-func showCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+// Show the edit history of a comment.
+func showCommentRevisions(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
-	community_id := vars["id"]
-	communities := QueryCommunity(community_id, false)
-	if len(communities.Title) == 0 {
+	commentID := vars["id"]
+
+	var createdBy, communityID, postID int
+	var body string
+	var editedAt time.Time
+	var removed, hidden bool
+	err := db.QueryRow("SELECT comments.created_by, community_id, posts.id, comments.body, comments.edited_at, comments.is_rm | comments.is_rm_by_admin | posts.is_rm | posts.is_rm_by_admin, comments.pending | posts.pending | IFNULL((SELECT limited FROM users WHERE users.id = comments.created_by), 0) | IFNULL((SELECT limited FROM users WHERE users.id = posts.created_by), 0) FROM comments INNER JOIN posts ON posts.id = post WHERE comments.id = ?", commentID).Scan(&createdBy, &communityID, &postID, &body, &editedAt, &removed, &hidden)
+	if err != nil {
 		handle404(w, r, CurrentUser)
 		return
 	}
-	offset, _ := strconv.Atoi(r.FormValue("offset"))
-	// per-second precision
-	offsetTime, err := strconv.ParseInt(r.FormValue("offset_time"), 10, 64)
-	if err != nil {
-		offsetTime = time.Now().Unix()
-	}
+	if !checkIfCanSeeRevisions(createdBy, communityID, postID, removed, hidden, CurrentUser) {
+		handle404(w, r, CurrentUser)
+		return
+	}
+
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+
+	var data = map[string]interface{}{
+		"Title":          "Comment History",
+		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"CurrentUser":    CurrentUser,
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+		"URL":            "/comments/" + commentID,
+		"Removed":        removed,
+		"Revisions":      getRevisions(commentID, true, body, editedAt, CurrentUser),
+	}
+	err = templates.ExecuteTemplate(w, "revisions.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show a community.
+func showCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	community_id := vars["id"]
+	communities := QueryCommunity(community_id, false)
+	if len(communities.Title) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if !checkIfCommunityMember(community_id, CurrentUser) {
+		showPrivateCommunity(w, r, CurrentUser, communities)
+		return
+	}
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	// per-second precision
+	offsetTime, err := strconv.ParseInt(r.FormValue("offset_time"), 10, 64)
+	if err != nil {
+		offsetTime = time.Now().Unix()
+	}
 	query := r.URL.Query().Get("q")
+	flair, _ := strconv.Atoi(r.URL.Query().Get("flair"))
 	repost := r.FormValue("repost")
 	var rp repostPreview
 
 	if len(repost) > 0 {
-		repost_row, err := db.Query("SELECT posts.id, nickname, body, post_type FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", repost, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
+		repost_row, err := db.Query("SELECT posts.id, nickname, body, post_type, painting_alt FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", repost, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		if repost_row.Next() {
-			err = repost_row.Scan(&rp.ID, &rp.Nickname, &rp.Text, &rp.PostType)
+			err = repost_row.Scan(&rp.ID, &rp.Nickname, &rp.Text, &rp.PostType, &rp.PaintingAlt)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			rp.Text = parsePreview(rp.Text, rp.PostType, false)
+			rp.Text = parsePreview(rp.Text, rp.PostType, false, rp.PaintingAlt)
 		}
 		repost_row.Close()
 	}
 
-	var favoriteGiven bool
+	var favoriteGiven, includeChildren bool
 	if len(CurrentUser.Username) > 0 {
 		var favorited int
-		err = db.QueryRow("SELECT COUNT(*) FROM community_favorites WHERE community = ? AND favorite_by = ?", community_id, CurrentUser.ID).Scan(&favorited)
+		err = db.QueryRow("SELECT COUNT(*), IFNULL(MAX(include_children), 0) FROM community_favorites WHERE community = ? AND favorite_by = ?", community_id, CurrentUser.ID).Scan(&favorited, &includeChildren)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -3744,7 +5907,7 @@ func showCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		}
 	}
 
-	post_rows, err := db.Query("SELECT posts.id, created_by, posts.created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts INNER JOIN users ON users.id = created_by WHERE community_id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND migration = 0 AND UNIX_TIMESTAMP(posts.created_at) <= ? AND body LIKE CONCAT('%', ?, '%') AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY pinned DESC, posts.id DESC, posts.created_at DESC LIMIT 25 OFFSET ?", community_id, offsetTime, query, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+	post_rows, err := db.Query("SELECT posts.id, created_by, posts.created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts INNER JOIN users ON users.id = created_by WHERE community_id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND migration = 0 AND UNIX_TIMESTAMP(posts.created_at) <= ? AND body LIKE CONCAT('%', ?, '%') AND (? = 0 OR flair = ?) AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (posts.pending = 0 OR posts.created_by = ?) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY pinned DESC, posts.id DESC, posts.created_at DESC LIMIT 25 OFFSET ?", community_id, offsetTime, query, flair, flair, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3758,33 +5921,517 @@ func showCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		row = setupPost(row, CurrentUser, 0, 0)
-		posts = append(posts, row)
+		row = setupPost(row, CurrentUser, 0, 0)
+		posts = append(posts, row)
+	}
+	post_rows.Close()
+	setupPostAttachments(posts...)
+
+	offset += 25
+
+	var data = map[string]interface{}{
+		"Title":      communities.Title,
+		"Pjax":       r.Header.Get("X-PJAX") == "",
+		"Offset":     offset,
+		"OffsetTime": offsetTime,
+		// determines whether page is being extended via JS
+		// might have to be added to other pages
+		// as js-less "load more posts" buttons are added
+		// but currently ".eq offset 25" is being used to determine this
+		"AutoPagerize":    r.Header.Get("X-AUTOPAGERIZE") == "",
+		"Query":           query,
+		"Flair":           flair,
+		"Flairs":          getCommunityFlairs(community_id),
+		"Rules":           getCommunityRules(community_id),
+		"RulesAgreed":     checkIfAgreedToCommunityRules(community_id, CurrentUser.ID),
+		"Events":          getCommunityEvents(CurrentUser, "community = ? AND ends_at > NOW() ORDER BY starts_at ASC LIMIT 3", community_id),
+		"Repost":          rp,
+		"CurrentUser":     CurrentUser,
+		"Community":       communities,
+		"FavoriteGiven":   favoriteGiven,
+		"Channels":        getCommunityChannels(communities),
+		"IncludeChildren": includeChildren,
+		"CanModerate":     checkIfCommunityModerator(community_id, CurrentUser),
+		"Membership":      getCommunityMembership(community_id, CurrentUser.ID),
+		"PopularPosts":    false,
+		"Posts":           posts,
+		"MaxUploadSize":   settings.ImageHost.MaxUploadSize,
+		"MaxClipDuration": settings.Clips.MaxDuration,
+		"MaxImages":       settings.MaxImages,
+	}
+	err = templates.ExecuteTemplate(w, "communities.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the community directory, optionally narrowed down to a single category.
+func showCommunityDirectory(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	title := "Community Directory"
+	category := -1
+	if categoryID, ok := vars["category"]; ok {
+		category, _ = strconv.Atoi(categoryID)
+		if category >= len(settings.CommunityCategories) {
+			handle404(w, r, CurrentUser)
+			return
+		}
+		title = settings.CommunityCategories[category]
+	} else if len(r.FormValue("category")) > 0 {
+		category, _ = strconv.Atoi(r.FormValue("category"))
+	}
+	query := strings.TrimSpace(r.FormValue("q"))
+	tag := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(r.FormValue("tag")), "#"))
+	sort := r.FormValue("sort")
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+
+	var order string
+	switch sort {
+	case "active":
+		order = "recent_posts DESC, id DESC"
+	case "favorites":
+		order = "favorites DESC, id DESC"
+	case "title":
+		order = "title ASC"
+	default:
+		sort = "new"
+		order = "id DESC"
+	}
+
+	community_rows, err := db.Query("SELECT id, title, icon, category, (SELECT COUNT(*) FROM community_favorites WHERE community = communities.id) AS favorites, (SELECT COUNT(*) FROM posts WHERE community_id = communities.id AND created_at > DATE_SUB(NOW(), INTERVAL 7 DAY) AND is_rm = 0 AND is_rm_by_admin = 0) AS recent_posts FROM communities WHERE rm = 0 AND (? < 0 OR category = ?) AND (? = '' OR id IN (SELECT community FROM community_tags WHERE tag = ?)) AND (? = '' OR title LIKE CONCAT('%', ?, '%')) ORDER BY "+order+" LIMIT 25 OFFSET ?", category, category, tag, tag, query, query, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var communities []community
+
+	for community_rows.Next() {
+		var row = community{}
+		err = community_rows.Scan(&row.ID, &row.Title, &row.Icon, &row.Category, &row.FavoriteCount, &row.RecentPostCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CategoryName = getCommunityCategoryName(row.Category)
+		communities = append(communities, row)
+	}
+	community_rows.Close()
+
+	tag_rows, err := db.Query("SELECT tag FROM community_tags INNER JOIN communities ON communities.id = community WHERE rm = 0 GROUP BY tag ORDER BY COUNT(*) DESC, tag ASC LIMIT 20")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var popularTags []string
+
+	for tag_rows.Next() {
+		var row string
+		tag_rows.Scan(&row)
+		popularTags = append(popularTags, row)
+	}
+	tag_rows.Close()
+
+	nextPage := url.Values{}
+	if category >= 0 && len(vars["category"]) == 0 {
+		nextPage.Set("category", strconv.Itoa(category))
+	}
+	if len(query) > 0 {
+		nextPage.Set("q", query)
+	}
+	if len(tag) > 0 {
+		nextPage.Set("tag", tag)
+	}
+	nextPage.Set("sort", sort)
+	nextPage.Set("offset", strconv.Itoa(offset+25))
+
+	var data = map[string]interface{}{
+		"Title":          title,
+		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"AutoPagerize":   r.Header.Get("X-AUTOPAGERIZE") == "",
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+		"CurrentUser":    CurrentUser,
+		"Communities":    communities,
+		"Categories":     settings.CommunityCategories,
+		"Category":       category,
+		"IsCategoryPage": len(vars["category"]) > 0,
+		"PopularTags":    popularTags,
+		"Query":          query,
+		"Tag":            tag,
+		"Sort":           sort,
+		"NextPage":       r.URL.Path + "?" + nextPage.Encode(),
+	}
+	err = templates.ExecuteTemplate(w, "community_directory.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show a community event and who's going to it.
+func showCommunityEvent(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	eventID := vars["id"]
+	events := getCommunityEvents(CurrentUser, "community_events.id = ? AND communities.rm = 0", eventID)
+	if len(events) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	event := events[0]
+	communityID := strconv.Itoa(event.Community)
+	if !checkIfCommunityMember(communityID, CurrentUser) {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	communities := QueryCommunity(communityID, false)
+
+	rsvp_rows, err := db.Query("SELECT username, nickname, avatar, has_mh FROM community_event_rsvps INNER JOIN users ON users.id = user WHERE event = ? ORDER BY community_event_rsvps.id ASC LIMIT 100", eventID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var rsvps []user
+
+	for rsvp_rows.Next() {
+		var row user
+		err = rsvp_rows.Scan(&row.Username, &row.Nickname, &row.Avatar, &row.HasMii)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.Avatar = getAvatar(row.Avatar, row.HasMii, 0)
+		rsvps = append(rsvps, row)
+	}
+	rsvp_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":       event.Title,
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Community":   communities,
+		"Event":       event,
+		"RSVPs":       rsvps,
+		"CanModerate": checkIfCommunityModerator(communityID, CurrentUser),
+	}
+	err = templates.ExecuteTemplate(w, "community_event.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show a community's members, along with pending requests and invites for its owner.
+func showCommunityMembers(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	communities := QueryCommunity(communityID, false)
+	if len(communities.Title) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if !checkIfCommunityMember(communityID, CurrentUser) {
+		showPrivateCommunity(w, r, CurrentUser, communities)
+		return
+	}
+	isOwner := checkIfCommunityOwner(communityID, CurrentUser)
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+
+	// only the owner can see who has asked to join or been invited
+	statuses := "1"
+	if isOwner {
+		statuses = "0, 1, 2"
+	}
+	member_rows, err := db.Query("SELECT username, nickname, avatar, has_mh, status FROM community_members INNER JOIN users ON users.id = user WHERE community = ? AND status IN ("+statuses+") ORDER BY status = 1 ASC, community_members.id DESC LIMIT 50 OFFSET ?", communityID, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var members, requests, invites []user
+
+	for member_rows.Next() {
+		var row user
+		var status int
+		err = member_rows.Scan(&row.Username, &row.Nickname, &row.Avatar, &row.HasMii, &status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.Avatar = getAvatar(row.Avatar, row.HasMii, 0)
+		switch status {
+		case 0:
+			requests = append(requests, row)
+		case 1:
+			members = append(members, row)
+		case 2:
+			invites = append(invites, row)
+		}
+	}
+	member_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":       communities.Title + " Members",
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Community":   communities,
+		"IsOwner":     isOwner,
+		"Members":     members,
+		"Requests":    requests,
+		"Invites":     invites,
+		"Offset":      offset + 50,
+		"HasNextPage": len(members)+len(requests)+len(invites) == 50,
+	}
+	err = templates.ExecuteTemplate(w, "community_members.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show a community's moderation page.
+func showCommunityModeration(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	communities := QueryCommunity(communityID, false)
+	if len(communities.Title) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Redirect(w, r, "/communities/"+communityID, 302)
+		return
+	}
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+
+	moderator_rows, err := db.Query("SELECT username, nickname, avatar, has_mh FROM community_moderators INNER JOIN users ON users.id = user WHERE community = ? ORDER BY community_moderators.id ASC", communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var moderators []user
+
+	for moderator_rows.Next() {
+		var row user
+		err = moderator_rows.Scan(&row.Username, &row.Nickname, &row.Avatar, &row.HasMii)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.Avatar = getAvatar(row.Avatar, row.HasMii, 0)
+		moderators = append(moderators, row)
+	}
+	moderator_rows.Close()
+
+	ban_rows, err := db.Query("SELECT community_bans.id, users.username, users.nickname, reason, community_bans.created_at, until, IFNULL(issuer.username, ''), IFNULL(issuer.nickname, '') FROM community_bans INNER JOIN users ON users.id = community_bans.user LEFT JOIN users AS issuer ON issuer.id = ban_by WHERE community = ? AND until > NOW() ORDER BY community_bans.id DESC", communityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var bans []ban
+
+	for ban_rows.Next() {
+		var row ban
+		var createdAt, until time.Time
+
+		err = ban_rows.Scan(&row.ID, &row.Username, &row.Nickname, &row.Reason, &createdAt, &until, &row.IssuerUsername, &row.IssuerNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		row.Until = until.Format("01/02/2006 3:04 PM")
+		row.UntilForever = until.Year() > 2100
+		row.Active = true
+		bans = append(bans, row)
+	}
+	ban_rows.Close()
+
+	log_rows, err := db.Query("SELECT community_mod_log.id, type, context, community_mod_log.created_at, IFNULL(creator.username, ''), IFNULL(creator.nickname, ''), IFNULL(target.username, ''), IFNULL(posts.body, ''), IFNULL(posts.post_type, 0), IFNULL(posts.painting_alt, '') FROM community_mod_log LEFT JOIN users AS creator ON creator.id = community_mod_log.created_by LEFT JOIN users AS target ON target.id = community_mod_log.target LEFT JOIN posts ON type IN (0, 1, 2) AND posts.id = context WHERE community = ? ORDER BY community_mod_log.id DESC LIMIT 50 OFFSET ?", communityID, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var modLog []auditLogEntry
+
+	for log_rows.Next() {
+		var row auditLogEntry
+		var createdAt time.Time
+		var postBody, paintingAlt string
+		var postType int
+
+		err = log_rows.Scan(&row.ID, &row.Type, &row.Context, &createdAt, &row.CreatorUsername, &row.CreatorNickname, &row.TargetUsername, &postBody, &postType, &paintingAlt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		if postBody != "" {
+			row.PostSummary = parsePreview(postBody, postType, false, paintingAlt)
+		}
+		switch row.Type {
+		case 0:
+			row.TypeText = "deleted a post by"
+			row.TypeURI = "/posts/" + strconv.Itoa(row.Context)
+		case 1:
+			row.TypeText = "pinned a post by"
+			row.TypeURI = "/posts/" + strconv.Itoa(row.Context)
+		case 2:
+			row.TypeText = "unpinned a post by"
+			row.TypeURI = "/posts/" + strconv.Itoa(row.Context)
+		case 3:
+			row.TypeText = "banned"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 4:
+			row.TypeText = "unbanned"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 5:
+			row.TypeText = "edited the community"
+			row.TypeURI = "/communities/" + communityID
+		case 6:
+			row.TypeText = "made a moderator:"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 7:
+			row.TypeText = "removed a moderator:"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 8:
+			row.TypeText = "added a member:"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 9:
+			row.TypeText = "removed a member:"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 10:
+			row.TypeText = "invited"
+			row.TypeURI = "/users/" + row.TargetUsername
+		case 11:
+			row.TypeText = "edited the rules"
+			row.TypeURI = "/communities/" + communityID
+		case 12:
+			row.TypeText = "edited the flairs"
+			row.TypeURI = "/communities/" + communityID
+		case 13:
+			row.TypeText = "edited the report reasons"
+			row.TypeURI = "/communities/" + communityID + "/moderation"
+		case 14:
+			row.TypeText = "created a sub-community"
+			row.TypeURI = "/communities/" + strconv.Itoa(row.Context)
+		case 15:
+			row.TypeText = "scheduled an event"
+			row.TypeURI = "/events/" + strconv.Itoa(row.Context)
+		case 16:
+			row.TypeText = "cancelled an event"
+			row.TypeURI = "/communities/" + communityID
+		}
+		modLog = append(modLog, row)
+	}
+	log_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":         communities.Title + " Moderation",
+		"Pjax":          r.Header.Get("X-PJAX") == "",
+		"CurrentUser":   CurrentUser,
+		"Community":     communities,
+		"IsOwner":       checkIfCommunityOwner(communityID, CurrentUser),
+		"Categories":    settings.CommunityCategories,
+		"Rules":         getCommunityRules(communityID),
+		"Flairs":        getCommunityFlairs(communityID),
+		"ReportReasons": getCommunityReportReasons(communityID),
+		"Children":      getCommunityChildren(communityID),
+		"Events":        getCommunityEvents(CurrentUser, "community = ? AND ends_at > NOW() ORDER BY starts_at ASC", communityID),
+		"Moderators":    moderators,
+		"Bans":          bans,
+		"ModLog":        modLog,
+		"Offset":        offset + 50,
+	}
+	err = templates.ExecuteTemplate(w, "community_moderation.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the community request form and the current user's past requests, or submit a new request.
+func showCommunityRequest(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if r.Method == "POST" {
+		title := strings.TrimSpace(r.FormValue("title"))
+		description := r.FormValue("description")
+		icon := r.FormValue("icon")
+		banner := r.FormValue("banner")
+
+		if len(title) == 0 || utf8.RuneCountInString(title) > 64 {
+			http.Error(w, "The title must be between 1 and 64 characters long.", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(description) > 2000 {
+			http.Error(w, "The description is too long. (2000 characters maximum)", http.StatusBadRequest)
+			return
+		}
+		category, _ := strconv.Atoi(r.FormValue("category"))
+		if category < 0 || category >= len(settings.CommunityCategories) {
+			http.Error(w, "Invalid category.", http.StatusBadRequest)
+			return
+		}
+		var pending int
+		db.QueryRow("SELECT COUNT(*) FROM community_requests WHERE created_by = ? AND status = 0", CurrentUser.ID).Scan(&pending)
+		if pending > 0 {
+			http.Error(w, "You already have a community request waiting to be reviewed.", http.StatusBadRequest)
+			return
+		}
+
+		iconURL := ""
+		db.QueryRow("SELECT value FROM images WHERE id = ?", icon).Scan(&iconURL)
+		if len(iconURL) == 0 {
+			http.Error(w, "You must upload an icon.", http.StatusBadRequest)
+			return
+		}
+		bannerURL := ""
+		if len(banner) > 0 {
+			db.QueryRow("SELECT value FROM images WHERE id = ?", banner).Scan(&bannerURL)
+			if len(bannerURL) == 0 {
+				http.Error(w, "Invalid banner.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		_, err := db.Exec("INSERT INTO community_requests (title, description, icon, banner, category, created_by) VALUES (?, ?, ?, ?, ?, ?)", title, description, iconURL, bannerURL, category, CurrentUser.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/communities/request", 302)
+		return
+	}
+
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+
+	request_rows, err := db.Query("SELECT id, title, icon, created_at, status, reason, IFNULL(community, 0) FROM community_requests WHERE created_by = ? ORDER BY id DESC LIMIT 20", CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var requests []communityRequest
+
+	for request_rows.Next() {
+		var row communityRequest
+		var createdAt time.Time
+
+		err = request_rows.Scan(&row.ID, &row.Title, &row.Icon, &createdAt, &row.Status, &row.Reason, &row.CommunityID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		requests = append(requests, row)
 	}
-	post_rows.Close()
-
-	offset += 25
+	request_rows.Close()
 
 	var data = map[string]interface{}{
-		"Title":      communities.Title,
-		"Pjax":       r.Header.Get("X-PJAX") == "",
-		"Offset":     offset,
-		"OffsetTime": offsetTime,
-		// determines whether page is being extended via JS
-		// might have to be added to other pages
-		// as js-less "load more posts" buttons are added
-		// but currently ".eq offset 25" is being used to determine this
-		"AutoPagerize":  r.Header.Get("X-AUTOPAGERIZE") == "",
-		"Query":         query,
-		"Repost":        rp,
-		"CurrentUser":   CurrentUser,
-		"Community":     communities,
-		"FavoriteGiven": favoriteGiven,
-		"PopularPosts":  false,
-		"Posts":         posts,
-		"MaxUploadSize": settings.ImageHost.MaxUploadSize,
+		"Title":          "Request a Community",
+		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"Categories":     settings.CommunityCategories,
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+		"CurrentUser":    CurrentUser,
+		"Requests":       requests,
 	}
-	err = templates.ExecuteTemplate(w, "communities.html", data)
+	err = templates.ExecuteTemplate(w, "community_request.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -3800,7 +6447,7 @@ func showCommunitySearch(w http.ResponseWriter, r *http.Request, CurrentUser use
 	}
 	offset, _ := strconv.Atoi(r.FormValue("offset"))
 
-	user_rows, err := db.Query("SELECT id, title, description, icon FROM communities WHERE (title LIKE CONCAT('%', ?, '%') OR description LIKE CONCAT('%', ?, '%')) AND rm = 0 ORDER BY title ASC LIMIT 20 OFFSET ?", query, query, offset)
+	user_rows, err := db.Query("SELECT id, title, description, icon FROM communities WHERE (title LIKE CONCAT('%', ?, '%') OR description LIKE CONCAT('%', ?, '%') OR id IN (SELECT community FROM community_tags WHERE tag = ?)) AND rm = 0 ORDER BY title ASC LIMIT 20 OFFSET ?", query, query, strings.ToLower(strings.TrimPrefix(query, "#")), offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3842,6 +6489,120 @@ func showCommunitySearch(w http.ResponseWriter, r *http.Request, CurrentUser use
 	}
 }
 
+// Show a community's stats over a range of days, or export them as CSV.
+func showCommunityStats(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	communityID := vars["id"]
+	communities := QueryCommunity(communityID, false)
+	if len(communities.Title) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if !checkIfCommunityOwner(communityID, CurrentUser) {
+		http.Redirect(w, r, "/communities/"+communityID, 302)
+		return
+	}
+
+	until, err := time.Parse("2006-01-02", r.FormValue("until"))
+	if err != nil {
+		until = time.Now()
+	}
+	since, err := time.Parse("2006-01-02", r.FormValue("since"))
+	if err != nil || since.After(until) {
+		since = until.AddDate(0, 0, -29)
+	}
+	if until.Sub(since).Hours() > 366*24 {
+		since = until.AddDate(0, 0, -366)
+	}
+	sinceDate := since.Format("2006-01-02")
+	untilDate := until.Format("2006-01-02")
+
+	stat_rows, err := db.Query("SELECT DATE_FORMAT(date, '%Y-%m-%d'), posts, comments, yeahs, active_posters, favorites, reports, deletions FROM community_stats WHERE community = ? AND date BETWEEN ? AND ? ORDER BY date ASC", communityID, sinceDate, untilDate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var stats []communityStats
+
+	for stat_rows.Next() {
+		var row communityStats
+		err = stat_rows.Scan(&row.Date, &row.Posts, &row.Comments, &row.Yeahs, &row.ActivePosters, &row.Favorites, &row.Reports, &row.Deletions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats = append(stats, row)
+	}
+	stat_rows.Close()
+
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=community_"+communityID+"_stats.csv")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"date", "posts", "comments", "yeahs", "active_posters", "favorites", "reports", "deletions"})
+		for _, day := range stats {
+			writer.Write([]string{day.Date, strconv.Itoa(day.Posts), strconv.Itoa(day.Comments), strconv.Itoa(day.Yeahs), strconv.Itoa(day.ActivePosters), strconv.Itoa(day.Favorites), strconv.Itoa(day.Reports), strconv.Itoa(day.Deletions)})
+		}
+		writer.Flush()
+		return
+	}
+
+	charts := []statChart{
+		getStatChart("Posts", stats, func(day communityStats) int { return day.Posts }),
+		getStatChart("Comments", stats, func(day communityStats) int { return day.Comments }),
+		getStatChart("Yeahs", stats, func(day communityStats) int { return day.Yeahs }),
+		getStatChart("Active Posters", stats, func(day communityStats) int { return day.ActivePosters }),
+		getStatChart("New Favorites", stats, func(day communityStats) int { return day.Favorites }),
+		getStatChart("Reports", stats, func(day communityStats) int { return day.Reports }),
+		getStatChart("Deletions", stats, func(day communityStats) int { return day.Deletions }),
+	}
+	// Reports can be made on posts and comments, but only posts get deleted by moderators.
+	reportRate, deletionRate := "0%", "0%"
+	if charts[0].Total+charts[1].Total > 0 {
+		reportRate = fmt.Sprintf("%.1f%%", float64(charts[5].Total)*100/float64(charts[0].Total+charts[1].Total))
+	}
+	if charts[0].Total > 0 {
+		deletionRate = fmt.Sprintf("%.1f%%", float64(charts[6].Total)*100/float64(charts[0].Total))
+	}
+
+	// The top posts are the ones that got the most yeahs and comments during the period, going by the rollups.
+	post_rows, err := db.Query("SELECT posts.id, body, post_type, painting_alt, username, nickname, SUM(community_post_stats.yeahs) AS yeah_count, SUM(community_post_stats.comments) AS comment_count FROM community_post_stats INNER JOIN posts ON posts.id = community_post_stats.post INNER JOIN users ON users.id = posts.created_by WHERE community = ? AND date BETWEEN ? AND ? AND is_rm = 0 AND is_rm_by_admin = 0 AND pending = 0 AND privacy = 0 GROUP BY posts.id ORDER BY yeah_count + comment_count DESC, posts.id DESC LIMIT 10", communityID, sinceDate, untilDate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var topPosts []post
+
+	for post_rows.Next() {
+		var row post
+		err = post_rows.Scan(&row.ID, &row.BodyText, &row.PostType, &row.PaintingAlt, &row.PosterUsername, &row.PosterNickname, &row.YeahCount, &row.CommentCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.BodyText = parsePreview(row.BodyText, row.PostType, false, row.PaintingAlt)
+		topPosts = append(topPosts, row)
+	}
+	post_rows.Close()
+
+	var data = map[string]interface{}{
+		"Title":        communities.Title + " Stats",
+		"Pjax":         r.Header.Get("X-PJAX") == "",
+		"CurrentUser":  CurrentUser,
+		"Community":    communities,
+		"Since":        sinceDate,
+		"Until":        untilDate,
+		"Charts":       charts,
+		"ReportRate":   reportRate,
+		"DeletionRate": deletionRate,
+		"TopPosts":     topPosts,
+	}
+	err = templates.ExecuteTemplate(w, "community_stats.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Show the team contact page.
 func showContactPage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
@@ -3883,7 +6644,7 @@ func showConversation(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		return
 	}
 
-	message_rows, err := db.Query("SELECT messages.id, created_at, created_by, feeling, body, image, attachment_type, url, url_type, post_type, username, avatar, has_mh, online, hide_online, color, role FROM messages LEFT JOIN users ON users.id = created_by WHERE conversation_id = ? AND UNIX_TIMESTAMP(created_at) <= ? AND is_rm = 0 AND body LIKE CONCAT('%', ?, '%') ORDER BY messages.id DESC LIMIT 20 OFFSET ?", conversationID, offsetTime, query, offset)
+	message_rows, err := db.Query("SELECT messages.id, created_at, created_by, feeling, body, image, attachment_type, url, url_type, post_type, painting_alt, username, avatar, has_mh, online, hide_online, color, role FROM messages LEFT JOIN users ON users.id = created_by WHERE conversation_id = ? AND UNIX_TIMESTAMP(created_at) <= ? AND is_rm = 0 AND is_rm_by_admin = 0 AND (users.limited = 0 OR users.id = ? OR ? > 0) AND body LIKE CONCAT('%', ?, '%') ORDER BY messages.id DESC LIMIT 20 OFFSET ?", conversationID, offsetTime, CurrentUser.ID, CurrentUser.Level, query, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3896,7 +6657,7 @@ func showConversation(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		var role int
 		var createdBy int
 
-		err = message_rows.Scan(&row.ID, &timestamp, &createdBy, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.URL, &row.URLType, &row.PostType, &row.ByUsername, &row.ByAvatar, &row.ByHasMii, &row.ByOnline, &row.ByHideOnline, &row.ByColor, &role)
+		err = message_rows.Scan(&row.ID, &timestamp, &createdBy, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.URL, &row.URLType, &row.PostType, &row.PaintingAlt, &row.ByUsername, &row.ByAvatar, &row.ByHasMii, &row.ByOnline, &row.ByHideOnline, &row.ByColor, &role)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -3918,6 +6679,7 @@ func showConversation(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		messages = append(messages, row)
 	}
 	message_rows.Close()
+	setupMessageAttachments(messages)
 
 	stmt, err := db.Prepare("UPDATE messages SET msg_read = 1 WHERE msg_read = 0 AND conversation_id = ? AND created_by = ?")
 	if err != nil {
@@ -3935,20 +6697,22 @@ func showConversation(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
 
 	var data = map[string]interface{}{
-		"Title":          "Conversation with " + user.Nickname + " (" + user.Username + ")",
-		"Offset":         offset,
-		"OffsetTime":     offsetTime,
-		"Pjax":           r.Header.Get("X-PJAX") == "",
-		"Query":          query,
-		"User":           user,
-		"ConversationID": conversationID,
-		"IsGroupChat":    false,
-		"CurrentUser":    CurrentUser,
-		"FriendCount":    friendCount,
-		"FollowingCount": followingCount,
-		"FollowerCount":  followerCount,
-		"Messages":       messages,
-		"MaxUploadSize":  settings.ImageHost.MaxUploadSize,
+		"Title":           "Conversation with " + user.Nickname + " (" + user.Username + ")",
+		"Offset":          offset,
+		"OffsetTime":      offsetTime,
+		"Pjax":            r.Header.Get("X-PJAX") == "",
+		"Query":           query,
+		"User":            user,
+		"ConversationID":  conversationID,
+		"IsGroupChat":     false,
+		"CurrentUser":     CurrentUser,
+		"FriendCount":     friendCount,
+		"FollowingCount":  followingCount,
+		"FollowerCount":   followerCount,
+		"Messages":        messages,
+		"MaxUploadSize":   settings.ImageHost.MaxUploadSize,
+		"MaxClipDuration": settings.Clips.MaxDuration,
+		"MaxImages":       settings.MaxImages,
 	}
 	err = templates.ExecuteTemplate(w, "conversation.html", data)
 	if err != nil {
@@ -3958,7 +6722,7 @@ func showConversation(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	var msg wsMessage
 	msg.Type = "messageNotif"
 	var unread int
-	db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND conversations.is_rm = 0", &CurrentUser.ID, &CurrentUser.ID, &CurrentUser.ID).Scan(&unread)
+	db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND messages.is_rm_by_admin = 0 AND conversations.is_rm = 0", &CurrentUser.ID, &CurrentUser.ID, &CurrentUser.ID).Scan(&unread)
 	var groupUnread int
 	db.QueryRow("SELECT SUM(unread_messages) FROM group_members WHERE user = ?", CurrentUser.ID).Scan(&groupUnread)
 	unread += groupUnread
@@ -4019,6 +6783,65 @@ func showCreateGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser use
 	}
 }
 
+// Show a user's drafts and scheduled posts.
+func showDrafts(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	location, err := time.LoadLocation(CurrentUser.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	draft_rows, err := db.Query("SELECT drafts.id, community, communities.title, communities.icon, post_type, body, IFNULL(paintings.value, ''), drafts.painting_alt, IFNULL(images.value, ''), attachment_type, is_spoiler, poll_options, attachments, publish_at, error, updated_at FROM drafts LEFT JOIN communities ON communities.id = community LEFT JOIN images AS paintings ON paintings.id = painting LEFT JOIN images ON images.id = image WHERE created_by = ? ORDER BY publish_at IS NULL, publish_at ASC, updated_at DESC", CurrentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var drafts []draft
+	for draft_rows.Next() {
+		var row = draft{}
+		var pollOptions, attachments sql.NullString
+		var publishAt sql.NullTime
+		var updatedAt time.Time
+
+		err = draft_rows.Scan(&row.ID, &row.CommunityID, &row.CommunityTitle, &row.CommunityIcon, &row.PostType, &row.Body, &row.Painting, &row.PaintingAlt, &row.Image, &row.AttachmentType, &row.IsSpoiler, &pollOptions, &attachments, &publishAt, &row.Error, &updatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if pollOptions.Valid {
+			json.Unmarshal([]byte(pollOptions.String), &row.PollOptions)
+		}
+		if attachments.Valid {
+			json.Unmarshal([]byte(attachments.String), &row.Attachments)
+		}
+		if publishAt.Valid {
+			row.Scheduled = true
+			row.PublishAt = eventTiming(publishAt.Time, CurrentUser.Timezone)
+			row.PublishAtInput = publishAt.Time.In(location).Format("2006-01-02T15:04")
+		}
+		row.UpdatedAt = humanTiming(updatedAt, CurrentUser.Timezone)
+		row.UpdatedAtUnix = updatedAt.Unix()
+
+		drafts = append(drafts, row)
+	}
+	draft_rows.Close()
+
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+
+	var data = map[string]interface{}{
+		"Title":          "Drafts",
+		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"CurrentUser":    CurrentUser,
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+		"Drafts":         drafts,
+	}
+	err = templates.ExecuteTemplate(w, "drafts.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Show the "Edit Group Chat" page.
 func showEditGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
@@ -4095,6 +6918,82 @@ func showEditGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 }
 
+// Show the upcoming events from every community the user can see.
+func showEventCalendar(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	mine := r.FormValue("mine") == "1" && CurrentUser.ID != 0
+
+	var calendarToken string
+	if CurrentUser.ID != 0 {
+		db.QueryRow("SELECT IFNULL(calendar_token, '') FROM users WHERE id = ?", CurrentUser.ID).Scan(&calendarToken)
+		// Tokens shorter than this were made with a guessable generator, so they're replaced too.
+		if len(calendarToken) != 32 {
+			newToken, err := generateSecureToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			calendarToken = newToken
+			db.Exec("UPDATE users SET calendar_token = ? WHERE id = ?", calendarToken, CurrentUser.ID)
+		}
+	}
+
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+	events := getCommunityEvents(CurrentUser, "ends_at > NOW() AND communities.rm = 0 AND "+getCommunityMembershipFilter("community", CurrentUser)+" AND (? = 0 OR community_events.id IN (SELECT event FROM community_event_rsvps WHERE user = ?)) ORDER BY starts_at ASC, community_events.id ASC LIMIT 50 OFFSET ?", mine, CurrentUser.ID, offset)
+
+	var data = map[string]interface{}{
+		"Title":          "Events",
+		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"CurrentUser":    CurrentUser,
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+		"Events":         events,
+		"Mine":           mine,
+		"Offset":         offset + 50,
+		"HasNextPage":    len(events) == 50,
+		"FeedURL":        getHostname(r.Host) + "/events/calendar/" + calendarToken + ".ics",
+	}
+	err := templates.ExecuteTemplate(w, "event_calendar.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Serve an iCalendar feed of the events a user has RSVP'd to, for subscribing to from calendar apps.
+func showEventCalendarFeed(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	var feedUser user
+	db.QueryRow("SELECT id, level FROM users WHERE calendar_token = ?", vars["token"]).Scan(&feedUser.ID, &feedUser.Level)
+	if feedUser.ID == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+
+	events := getCommunityEvents(feedUser, "ends_at > NOW() - INTERVAL 30 DAY AND communities.rm = 0 AND "+getCommunityMembershipFilter("community", feedUser)+" AND community_events.id IN (SELECT event FROM community_event_rsvps WHERE user = ?) ORDER BY starts_at ASC", feedUser.ID)
+	hostname := getHostname(r.Host)
+	const timeFormat = "20060102T150405Z"
+
+	var feed strings.Builder
+	feed.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Riiverse//Community Events//EN\r\nCALSCALE:GREGORIAN\r\nX-WR-CALNAME:Riiverse Events\r\n")
+	for _, event := range events {
+		feed.WriteString("BEGIN:VEVENT\r\n")
+		feed.WriteString("UID:event-" + strconv.Itoa(event.ID) + "@" + r.Host + "\r\n")
+		feed.WriteString("DTSTAMP:" + time.Now().UTC().Format(timeFormat) + "\r\n")
+		feed.WriteString("DTSTART:" + event.StartsAtTime.UTC().Format(timeFormat) + "\r\n")
+		feed.WriteString("DTEND:" + event.EndsAtTime.UTC().Format(timeFormat) + "\r\n")
+		feed.WriteString("SUMMARY:" + escapeICalendarText(event.Title) + "\r\n")
+		feed.WriteString("DESCRIPTION:" + escapeICalendarText(event.DescriptionText) + "\r\n")
+		feed.WriteString("LOCATION:" + escapeICalendarText(event.CommunityTitle) + "\r\n")
+		feed.WriteString("URL:" + hostname + "/events/" + strconv.Itoa(event.ID) + "\r\n")
+		feed.WriteString("END:VEVENT\r\n")
+	}
+	feed.WriteString("END:VCALENDAR\r\n")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(feed.String()))
+}
+
 // Show the FAQ page.
 func showFAQPage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
@@ -4425,7 +7324,7 @@ func showGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		return
 	}
 
-	message_rows, err := db.Query("SELECT messages.id, created_at, created_by, feeling, body, image, attachment_type, url, url_type, post_type, username, avatar, has_mh, online, hide_online, color, role FROM messages LEFT JOIN users ON users.id = created_by WHERE conversation_id = ? AND UNIX_TIMESTAMP(created_at) <= ? AND is_rm = 0 AND body LIKE CONCAT('%', ?, '%') ORDER BY messages.id DESC LIMIT 20 OFFSET ?", id, offsetTime, query, offset)
+	message_rows, err := db.Query("SELECT messages.id, created_at, created_by, feeling, body, image, attachment_type, url, url_type, post_type, painting_alt, username, avatar, has_mh, online, hide_online, color, role FROM messages LEFT JOIN users ON users.id = created_by WHERE conversation_id = ? AND UNIX_TIMESTAMP(created_at) <= ? AND is_rm = 0 AND is_rm_by_admin = 0 AND (users.limited = 0 OR users.id = ? OR ? > 0) AND body LIKE CONCAT('%', ?, '%') ORDER BY messages.id DESC LIMIT 20 OFFSET ?", id, offsetTime, CurrentUser.ID, CurrentUser.Level, query, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -4438,7 +7337,7 @@ func showGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		var timestamp time.Time
 		var createdBy int
 
-		err = message_rows.Scan(&row.ID, &timestamp, &createdBy, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.URL, &row.URLType, &row.PostType, &row.ByUsername, &row.ByAvatar, &row.ByHasMii, &row.ByOnline, &row.ByHideOnline, &row.ByColor, &role)
+		err = message_rows.Scan(&row.ID, &timestamp, &createdBy, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.URL, &row.URLType, &row.PostType, &row.PaintingAlt, &row.ByUsername, &row.ByAvatar, &row.ByHasMii, &row.ByOnline, &row.ByHideOnline, &row.ByColor, &role)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -4460,6 +7359,7 @@ func showGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		messages = append(messages, row)
 	}
 	message_rows.Close()
+	setupMessageAttachments(messages)
 
 	var users []string
 	user_rows, err := db.Query("SELECT nickname FROM group_members LEFT JOIN users ON user = users.id WHERE conversation = ? AND user != ? ORDER BY nickname ASC", id, CurrentUser.ID)
@@ -4485,19 +7385,21 @@ func showGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
 
 	var data = map[string]interface{}{
-		"Title":          title,
-		"Offset":         offset,
-		"OffsetTime":     offsetTime,
-		"Pjax":           r.Header.Get("X-PJAX") == "",
-		"Query":          query,
-		"ConversationID": id,
-		"IsGroupChat":    true,
-		"CurrentUser":    CurrentUser,
-		"FriendCount":    friendCount,
-		"FollowingCount": followingCount,
-		"FollowerCount":  followerCount,
-		"Messages":       messages,
-		"MaxUploadSize":  settings.ImageHost.MaxUploadSize,
+		"Title":           title,
+		"Offset":          offset,
+		"OffsetTime":      offsetTime,
+		"Pjax":            r.Header.Get("X-PJAX") == "",
+		"Query":           query,
+		"ConversationID":  id,
+		"IsGroupChat":     true,
+		"CurrentUser":     CurrentUser,
+		"FriendCount":     friendCount,
+		"FollowingCount":  followingCount,
+		"FollowerCount":   followerCount,
+		"Messages":        messages,
+		"MaxUploadSize":   settings.ImageHost.MaxUploadSize,
+		"MaxClipDuration": settings.Clips.MaxDuration,
+		"MaxImages":       settings.MaxImages,
 	}
 	err = templates.ExecuteTemplate(w, "conversation.html", data)
 	if err != nil {
@@ -4507,7 +7409,7 @@ func showGroupChat(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	var msg wsMessage
 	msg.Type = "messageNotif"
 	var unread int
-	db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND conversations.is_rm = 0", &CurrentUser.ID, &CurrentUser.ID, &CurrentUser.ID).Scan(&unread)
+	db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND messages.is_rm_by_admin = 0 AND conversations.is_rm = 0", &CurrentUser.ID, &CurrentUser.ID, &CurrentUser.ID).Scan(&unread)
 	var groupUnread int
 	db.QueryRow("SELECT SUM(unread_messages) FROM group_members WHERE user = ?", CurrentUser.ID).Scan(&groupUnread)
 	for client := range clients {
@@ -4549,7 +7451,7 @@ func showMessages(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		offsetTime = time.Now().Unix()
 	}
 
-	conversation_rows, err := db.Query("SELECT conversations.id, target, IFNULL(created_by, if(source = ?, target, source)), IFNULL(messages.created_at, conversations.created_at) lastdate, IFNULL(body, ''), IFNULL(image, ''), IFNULL(post_type, 0), IFNULL(msg_read, 1), IFNULL(username, conversations.id), IFNULL(nickname, ''), IFNULL(avatar, ''), IFNULL(has_mh, 0), IFNULL(online, 0), IFNULL(hide_online, 1), IFNULL(color, ''), IFNULL(role, 0) FROM conversations LEFT JOIN messages ON messages.id = (SELECT MAX(id) FROM messages WHERE messages.conversation_id = conversations.id AND is_rm = 0) LEFT JOIN users ON if(source = ?, target, source) = users.id LEFT JOIN group_members ON conversations.id = conversation WHERE (source = ? OR target = ? OR user = ?) AND conversations.is_rm = 0 GROUP BY conversations.id, messages.id, users.id ORDER BY lastdate DESC LIMIT 20 OFFSET ?", CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, offset)
+	conversation_rows, err := db.Query("SELECT conversations.id, target, IFNULL(created_by, if(source = ?, target, source)), IFNULL(messages.created_at, conversations.created_at) lastdate, IFNULL(body, ''), IFNULL(image, ''), IFNULL(post_type, 0), IFNULL(msg_read, 1), IFNULL(username, conversations.id), IFNULL(nickname, ''), IFNULL(avatar, ''), IFNULL(has_mh, 0), IFNULL(online, 0), IFNULL(hide_online, 1), IFNULL(color, ''), IFNULL(role, 0) FROM conversations LEFT JOIN messages ON messages.id = (SELECT MAX(id) FROM messages WHERE messages.conversation_id = conversations.id AND is_rm = 0 AND is_rm_by_admin = 0) LEFT JOIN users ON if(source = ?, target, source) = users.id LEFT JOIN group_members ON conversations.id = conversation WHERE (source = ? OR target = ? OR user = ?) AND conversations.is_rm = 0 GROUP BY conversations.id, messages.id, users.id ORDER BY lastdate DESC LIMIT 20 OFFSET ?", CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -4638,6 +7540,7 @@ func showNotifications(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		var row = &notification{}
 		var timestamp time.Time
 		var role int
+		var paintingAlt string
 
 		notif_rows.Scan(&row.ID, &row.Type, &row.By, &row.Post, &timestamp, &row.Read, &row.ByUsername, &row.ByNickname, &row.ByAvatar, &row.ByHasMii, &row.ByOnline, &row.ByHideOnline, &row.ByColor, &role)
 
@@ -4649,12 +7552,16 @@ func showNotifications(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		row.Date = humanTiming(timestamp, CurrentUser.Timezone)
 		row.DateUnix = timestamp.Unix()
 
-		if row.Type == 0 || row.Type == 2 || row.Type == 3 || row.Type == 7 {
-			db.QueryRow("SELECT body, post_type, is_rm | is_rm_by_admin FROM posts WHERE id = ?", row.Post).Scan(&row.PostText, &row.PostType, &row.PostIsRM)
-		} else if row.Type == 1 {
-			db.QueryRow("SELECT body, post_type, is_rm | is_rm_by_admin FROM comments WHERE id = ?", row.Post).Scan(&row.PostText, &row.PostType, &row.PostIsRM)
+		if row.Type == 0 || row.Type == 2 || row.Type == 3 || row.Type == 7 || row.Type == 11 {
+			db.QueryRow("SELECT body, post_type, painting_alt, is_rm | is_rm_by_admin FROM posts WHERE id = ?", row.Post).Scan(&row.PostText, &row.PostType, &paintingAlt, &row.PostIsRM)
+		} else if row.Type == 1 || row.Type == 12 || row.Type == 13 {
+			db.QueryRow("SELECT body, post_type, painting_alt, is_rm | is_rm_by_admin FROM comments WHERE id = ?", row.Post).Scan(&row.PostText, &row.PostType, &paintingAlt, &row.PostIsRM)
+		} else if row.Type == 9 {
+			db.QueryRow("SELECT title FROM community_events WHERE id = ?", row.Post).Scan(&row.PostText)
+		} else if row.Type == 10 {
+			db.QueryRow("SELECT error FROM drafts WHERE id = ?", row.Post).Scan(&row.PostText)
 		}
-		row.PostText = parsePreview(row.PostText, row.PostType, row.PostIsRM)
+		row.PostText = parsePreview(row.PostText, row.PostType, row.PostIsRM, paintingAlt)
 
 		db.QueryRow("SELECT COUNT(notif_by) FROM notifications WHERE merged = ? AND notif_by != ?", row.ID, row.By).Scan(&row.MergedCount)
 		row.MergedOthers = row.MergedCount - 3
@@ -4725,6 +7632,10 @@ func showPopularPosts(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		handle404(w, r, CurrentUser)
 		return
 	}
+	if !checkIfCommunityMember(community_id, CurrentUser) {
+		showPrivateCommunity(w, r, CurrentUser, communities)
+		return
+	}
 	offset, _ := strconv.Atoi(r.FormValue("offset"))
 
 	date := r.URL.Query().Get("date")
@@ -4742,10 +7653,10 @@ func showPopularPosts(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 	nextDate := dateParsed.AddDate(0, 0, -1).Format("2006-01-02")
 
-	var favoriteGiven bool
+	var favoriteGiven, includeChildren bool
 	if len(CurrentUser.Username) > 0 {
 		var favorited int
-		err = db.QueryRow("SELECT COUNT(*) FROM community_favorites WHERE community = ? AND favorite_by = ?", &community_id, &CurrentUser.ID).Scan(&favorited)
+		err = db.QueryRow("SELECT COUNT(*), IFNULL(MAX(include_children), 0) FROM community_favorites WHERE community = ? AND favorite_by = ?", &community_id, &CurrentUser.ID).Scan(&favorited, &includeChildren)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -4755,7 +7666,7 @@ func showPopularPosts(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		}
 	}
 
-	post_rows, err := db.Query("SELECT posts.id, posts.created_by, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, privacy, repost, username, nickname, avatar, has_mh, online, hide_online, color, role, (SELECT COUNT(*) FROM yeahs WHERE yeah_post = posts.id) + (SELECT COUNT(*) FROM comments WHERE post = posts.id AND is_rm = 0 AND is_rm_by_admin = 0) AS rating FROM posts INNER JOIN users ON users.id = created_by INNER JOIN yeahs ON yeah_post = posts.id LEFT JOIN comments ON post = comments.id WHERE community_id = ? AND cast(posts.created_at as date) = ? AND posts.is_rm = 0 AND posts.is_rm_by_admin = 0 AND migration = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND IF(posts.created_by = ?, true, LOWER(posts.body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = posts.created_by OR source = posts.created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = posts.created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = posts.created_by) = 1) OR (privacy = 8 AND ? > 0) OR posts.created_by = ?) GROUP BY posts.id ORDER BY rating DESC LIMIT 25 OFFSET ?", community_id, dateParsed, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+	post_rows, err := db.Query("SELECT posts.id, posts.created_by, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, privacy, repost, username, nickname, avatar, has_mh, online, hide_online, color, role, (SELECT COUNT(*) FROM yeahs WHERE yeah_post = posts.id) + (SELECT COUNT(*) FROM comments WHERE post = posts.id AND is_rm = 0 AND is_rm_by_admin = 0) AS rating FROM posts INNER JOIN users ON users.id = created_by INNER JOIN yeahs ON yeah_post = posts.id LEFT JOIN comments ON post = comments.id WHERE community_id = ? AND cast(posts.created_at as date) = ? AND posts.is_rm = 0 AND posts.is_rm_by_admin = 0 AND migration = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (posts.pending = 0 OR posts.created_by = ?) AND IF(posts.created_by = ?, true, LOWER(posts.body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = posts.created_by OR source = posts.created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = posts.created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = posts.created_by) = 1) OR (privacy = 8 AND ? > 0) OR posts.created_by = ?) GROUP BY posts.id ORDER BY rating DESC LIMIT 25 OFFSET ?", community_id, dateParsed, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -4775,22 +7686,29 @@ func showPopularPosts(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		posts = append(posts, row)
 	}
 	post_rows.Close()
+	setupPostAttachments(posts...)
 
 	offset += 25
 
 	var data = map[string]interface{}{
-		"Title":         communities.Title,
-		"Pjax":          r.Header.Get("X-PJAX") == "",
-		"Offset":        offset,
-		"AutoPagerize":  r.Header.Get("X-AUTOPAGERIZE") == "",
-		"CurrentUser":   CurrentUser,
-		"Community":     communities,
-		"FavoriteGiven": favoriteGiven,
-		"PopularPosts":  true,
-		"PrevDate":      prevDate,
-		"CurrentDate":   date,
-		"NextDate":      nextDate,
-		"Posts":         posts,
+		"Title":           communities.Title,
+		"Pjax":            r.Header.Get("X-PJAX") == "",
+		"Offset":          offset,
+		"AutoPagerize":    r.Header.Get("X-AUTOPAGERIZE") == "",
+		"CurrentUser":     CurrentUser,
+		"Community":       communities,
+		"FavoriteGiven":   favoriteGiven,
+		"Channels":        getCommunityChannels(communities),
+		"IncludeChildren": includeChildren,
+		"CanModerate":     checkIfCommunityModerator(communities.ID, CurrentUser),
+		"Membership":      getCommunityMembership(communities.ID, CurrentUser.ID),
+		"Rules":           getCommunityRules(communities.ID),
+		"Events":          getCommunityEvents(CurrentUser, "community = ? AND ends_at > NOW() ORDER BY starts_at ASC LIMIT 3", communities.ID),
+		"PopularPosts":    true,
+		"PrevDate":        prevDate,
+		"CurrentDate":     date,
+		"NextDate":        nextDate,
+		"Posts":           posts,
 	}
 	err = templates.ExecuteTemplate(w, "communities.html", data)
 	if err != nil {
@@ -4805,12 +7723,16 @@ func showPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	post_id := vars["id"]
 
 	var posts = post{}
-	db.QueryRow("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, url, url_type, pinned, privacy, repost, post_type, migration, migrated_id, migrated_community, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?)", post_id, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&posts.ID, &posts.CreatedBy, &posts.CommunityID, &posts.CreatedAtTime, &posts.EditedAtTime, &posts.Feeling, &posts.BodyText, &posts.Image, &posts.AttachmentType, &posts.IsSpoiler, &posts.URL, &posts.URLType, &posts.Pinned, &posts.Privacy, &posts.RepostID, &posts.PostType, &posts.MigrationID, &posts.MigratedID, &posts.MigratedCommunity, &posts.IsRMByAdmin, &posts.PosterUsername, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.PosterOnline, &posts.PosterHideOnline, &posts.PosterColor, &posts.PosterRoleID)
+	db.QueryRow("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, url, url_type, pinned, privacy, repost, post_type, migration, migrated_id, migrated_community, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND (pending = 0 OR created_by = ? OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?)", post_id, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&posts.ID, &posts.CreatedBy, &posts.CommunityID, &posts.CreatedAtTime, &posts.EditedAtTime, &posts.Feeling, &posts.BodyText, &posts.Image, &posts.AttachmentType, &posts.IsSpoiler, &posts.URL, &posts.URLType, &posts.Pinned, &posts.Privacy, &posts.RepostID, &posts.PostType, &posts.MigrationID, &posts.MigratedID, &posts.MigratedCommunity, &posts.IsRMByAdmin, &posts.PosterUsername, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.PosterOnline, &posts.PosterHideOnline, &posts.PosterColor, &posts.PosterRoleID)
 	if len(posts.PosterUsername) == 0 {
 		handle404(w, r, CurrentUser)
 		return
 	}
 
+	if !checkIfCommunityMember(posts.CommunityID, CurrentUser) {
+		handle404(w, r, CurrentUser)
+		return
+	}
 	community := QueryCommunity(strconv.Itoa(posts.CommunityID), true) // todo: get rid of this
 
 	posts.PosterIcon = getAvatar(posts.PosterIcon, posts.PosterHasMii, posts.Feeling)
@@ -4829,22 +7751,30 @@ func showPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	} else {
 		posts.Body = parseBodyWithLineBreaks(posts.BodyText, false, false)
 	}
+	if len(posts.Image) > 0 && (posts.AttachmentType == 0 || posts.AttachmentType == 3) {
+		posts.Attachments = getAttachments(0, posts.ID)
+	}
+	if posts.PostType == 1 {
+		db.QueryRow("SELECT painting_alt FROM posts WHERE id = ?", posts.ID).Scan(&posts.PaintingAlt)
+	}
 	if posts.RepostID > 0 {
 		var repost post
-		db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, communities.id, title, icon, rm, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", posts.RepostID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&repost.ID, &repost.CreatedBy, &repost.CreatedAtTime, &repost.EditedAtTime, &repost.Feeling, &repost.BodyText, &repost.Image, &repost.AttachmentType, &repost.IsSpoiler, &repost.PostType, &repost.URL, &repost.URLType, &repost.Pinned, &repost.Privacy, &repost.RepostID, &repost.MigrationID, &repost.MigratedID, &repost.MigratedCommunity, &repost.IsRMByAdmin, &repost.CommunityID, &repost.CommunityName, &repost.CommunityIcon, &repost.CommunityRM, &repost.PosterUsername, &repost.PosterNickname, &repost.PosterIcon, &repost.PosterHasMii, &repost.PosterOnline, &repost.PosterHideOnline, &repost.PosterColor, &repost.PosterRoleID)
+		db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, communities.id, title, icon, rm, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", posts.RepostID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&repost.ID, &repost.CreatedBy, &repost.CreatedAtTime, &repost.EditedAtTime, &repost.Feeling, &repost.BodyText, &repost.Image, &repost.AttachmentType, &repost.IsSpoiler, &repost.PostType, &repost.URL, &repost.URLType, &repost.Pinned, &repost.Privacy, &repost.RepostID, &repost.MigrationID, &repost.MigratedID, &repost.MigratedCommunity, &repost.IsRMByAdmin, &repost.CommunityID, &repost.CommunityName, &repost.CommunityIcon, &repost.CommunityRM, &repost.PosterUsername, &repost.PosterNickname, &repost.PosterIcon, &repost.PosterHasMii, &repost.PosterOnline, &repost.PosterHideOnline, &repost.PosterColor, &repost.PosterRoleID)
 		posts.Repost = &repost
 		posts.Repost.Type = 3
 		if len(posts.Repost.CommunityName) > 0 {
 			posts.Repost = setupPost(posts.Repost, CurrentUser, 3, 0)
+			setupPostAttachments(posts.Repost)
 		}
 	}
 	if posts.PostType == 2 {
-		posts.Poll = getPoll(posts.ID, CurrentUser.ID)
+		posts.Poll = getPoll(posts.ID, CurrentUser)
 	}
 	if posts.MigrationID > 0 {
 		posts.MigrationImage, posts.MigrationURL, community.Title, community.Icon = getPostMigration(posts.MigrationID, posts.MigratedCommunity)
 	}
 	posts.CanYeah = checkIfCanYeah(CurrentUser, posts.CreatedBy)
+	db.QueryRow("SELECT community_flairs.id, name, color FROM posts INNER JOIN community_flairs ON community_flairs.id = flair WHERE posts.id = ?", posts.ID).Scan(&posts.FlairID, &posts.FlairName, &posts.FlairColor)
 
 	var favoritePost string
 	isFavorite := false
@@ -4861,7 +7791,7 @@ func showPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			db.QueryRow("SELECT COUNT(*) FROM yeahs WHERE yeah_post = ? AND yeah_by = ? AND on_comment = 0 LIMIT 1", posts.ID, CurrentUser.ID).Scan(&posts.Yeahed)
 		}
 		db.QueryRow("SELECT COUNT(*) FROM yeahs WHERE yeah_post = ? AND on_comment=0", post_id).Scan(&posts.YeahCount)
-		db.QueryRow("SELECT COUNT(*) FROM comments WHERE post = ? AND is_rm = 0", post_id).Scan(&posts.CommentCount)
+		db.QueryRow("SELECT COUNT(*) FROM comments LEFT JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND pending = 0 AND (users.limited = 0 OR users.id = ? OR ? > 0)", post_id, CurrentUser.ID, CurrentUser.Level).Scan(&posts.CommentCount)
 
 		yeah_rows, _ := db.Query("SELECT yeahs.id, username, avatar, has_mh, role FROM yeahs LEFT JOIN users ON users.id = yeah_by WHERE yeah_post = ? AND yeah_by != ? AND on_comment=0 ORDER BY yeahs.id DESC", post_id, CurrentUser.ID)
 
@@ -4888,14 +7818,14 @@ func showPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		if offset < 0 {
 			offset = 0
 		}
-		comment_rows, _ := db.Query("SELECT comments.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments LEFT JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) ORDER BY created_at ASC LIMIT 20 OFFSET ?", post_id, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), offset)
+		comment_rows, _ := db.Query("SELECT comments.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, painting_alt, url, url_type, pinned, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role, IFNULL(comments.parent, 0), IFNULL((SELECT parent_users.nickname FROM comments AS parent_comments LEFT JOIN users AS parent_users ON parent_users.id = parent_comments.created_by WHERE parent_comments.id = comments.parent AND parent_comments.is_rm = 0 AND parent_comments.is_rm_by_admin = 0), '') FROM comments LEFT JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (comments.pending = 0 OR comments.created_by = ?) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) ORDER BY created_at ASC LIMIT 20 OFFSET ?", post_id, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), offset)
 		for comment_rows.Next() {
 			var row = comment{}
 			var timestamp time.Time
 			var editedAt time.Time
 			var role int
 
-			err := comment_rows.Scan(&row.ID, &row.CreatedBy, &timestamp, &editedAt, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.IsRMByAdmin, &row.CommenterUsername, &row.CommenterNickname, &row.CommenterIcon, &row.CommenterHasMii, &row.CommenterOnline, &row.CommenterHideOnline, &row.CommenterColor, &role)
+			err := comment_rows.Scan(&row.ID, &row.CreatedBy, &timestamp, &editedAt, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.PaintingAlt, &row.URL, &row.URLType, &row.Pinned, &row.IsRMByAdmin, &row.CommenterUsername, &row.CommenterNickname, &row.CommenterIcon, &row.CommenterHasMii, &row.CommenterOnline, &row.CommenterHideOnline, &row.CommenterColor, &role, &row.ParentID, &row.ParentNickname)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -4929,6 +7859,9 @@ func showPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			}
 		}
 		comment_rows.Close()
+		setupCommentAttachments(pinnedComments)
+		setupCommentAttachments(comments)
+		comments = threadComments(comments)
 	}
 
 	isBlocked := false
@@ -4937,20 +7870,78 @@ func showPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 
 	var data = map[string]interface{}{
-		"Title":          posts.PosterNickname + "'s Post",
+		"Title":            posts.PosterNickname + "'s Post",
+		"Pjax":             r.Header.Get("X-PJAX") == "",
+		"CurrentUser":      CurrentUser,
+		"Community":        community,
+		"Post":             posts,
+		"Yeahs":            yeahs,
+		"Reasons":          settings.ReportReasons,
+		"CommunityReasons": getCommunityReportReasons(posts.CommunityID),
+		"PinnedComments":   pinnedComments,
+		"Comments":         comments,
+		"IsFavorite":       isFavorite,
+		"IsBlocked":        isBlocked,
+		"CanModerate":      checkIfCommunityModerator(posts.CommunityID, CurrentUser),
+		"MaxUploadSize":    settings.ImageHost.MaxUploadSize,
+		"MaxClipDuration":  settings.Clips.MaxDuration,
+		"MaxImages":        settings.MaxImages,
+	}
+	err := templates.ExecuteTemplate(w, "post.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the edit history of a post.
+func showPostRevisions(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	postID := vars["id"]
+
+	var createdBy, communityID int
+	var body string
+	var editedAt time.Time
+	var removed, hidden bool
+	err := db.QueryRow("SELECT created_by, community_id, body, edited_at, is_rm | is_rm_by_admin, pending | IFNULL((SELECT limited FROM users WHERE users.id = posts.created_by), 0) FROM posts WHERE id = ?", postID).Scan(&createdBy, &communityID, &body, &editedAt, &removed, &hidden)
+	if err != nil {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	postIDInt, _ := strconv.Atoi(postID)
+	if !checkIfCanSeeRevisions(createdBy, communityID, postIDInt, removed, hidden, CurrentUser) {
+		handle404(w, r, CurrentUser)
+		return
+	}
+
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+
+	var data = map[string]interface{}{
+		"Title":          "Post History",
 		"Pjax":           r.Header.Get("X-PJAX") == "",
 		"CurrentUser":    CurrentUser,
-		"Community":      community,
-		"Post":           posts,
-		"Yeahs":          yeahs,
-		"Reasons":        settings.ReportReasons,
-		"PinnedComments": pinnedComments,
-		"Comments":       comments,
-		"IsFavorite":     isFavorite,
-		"IsBlocked":      isBlocked,
-		"MaxUploadSize":  settings.ImageHost.MaxUploadSize,
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+		"URL":            "/posts/" + postID,
+		"Removed":        removed,
+		"Revisions":      getRevisions(postID, false, body, editedAt, CurrentUser),
 	}
-	err := templates.ExecuteTemplate(w, "post.html", data)
+	err = templates.ExecuteTemplate(w, "revisions.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Show the page people see instead of a private community when they aren't a member of it.
+func showPrivateCommunity(w http.ResponseWriter, r *http.Request, CurrentUser user, communities community) {
+	var data = map[string]interface{}{
+		"Title":       communities.Title,
+		"Pjax":        r.Header.Get("X-PJAX") == "",
+		"CurrentUser": CurrentUser,
+		"Community":   communities,
+		"Membership":  getCommunityMembership(communities.ID, CurrentUser.ID),
+	}
+	err := templates.ExecuteTemplate(w, "community_private.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -5144,23 +8135,13 @@ func signup(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if len(settings.IPHubKey) > 0 {
-			client := &http.Client{}
-			req, _ := http.NewRequest("GET", "https://v2.api.iphub.info/ip/"+ipHost, nil)
-			req.Header.Set("X-Key", settings.IPHubKey)
-			res, _ := client.Do(req)
-			defer res.Body.Close()
-			body, err := ioutil.ReadAll(res.Body)
+			ipInfo, err := getIPHubInfo(ipHost)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			var jsonBody iphubBlockResponse
-			json.Unmarshal(body, &jsonBody)
-
-			var bannedASN int
-			db.QueryRow("SELECT asn FROM ip_bans WHERE asn = ?", jsonBody.ASN).Scan(&bannedASN)
-			if bannedASN != 0 || jsonBody.Block == 1 || jsonBody.Block == 2 {
-				fmt.Println("signup asn deny ", jsonBody.ASN)
+			if checkIfASNBanned(ipInfo.ASN) || ipInfo.Block == 1 || ipInfo.Block == 2 {
+				fmt.Println("signup asn deny ", ipInfo.ASN)
 				http.Error(w, "You cannot sign up using a proxy.", http.StatusBadRequest)
 				return
 			}
@@ -5202,6 +8183,8 @@ func signup(w http.ResponseWriter, r *http.Request) {
 				//session := sessions.Start(w, r)
 				session.Set("username", users.Username)
 				session.Set("user_id", users.ID)
+				// Signing up logs the user in, so alts made in the same browser show up right away.
+				recordLoginDevice(w, r, users.ID)
 
 				if settings.Webhooks.Enabled && len(settings.Webhooks.Signups) > 0 {
 					/*if username != nickname {
@@ -5402,17 +8385,74 @@ func showRulesPage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	db.QueryRow("SELECT COUNT(*) FROM follows WHERE follow_to = ?", CurrentUser.ID).Scan(&followerCount)
 
 	var data = map[string]interface{}{
-		"Title":          "Riiverse Rules",
+		"Title":          "Riiverse Rules",
+		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"CurrentUser":    CurrentUser,
+		"FriendCount":    friendCount,
+		"FollowingCount": followingCount,
+		"FollowerCount":  followerCount,
+	}
+	err := templates.ExecuteTemplate(w, "rules.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Show the posts with a certain hashtag, from every community the current user can see.
+func showTag(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	tag := strings.ToLower(vars["tag"])
+	if utf8.RuneCountInString(tag) > 64 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	offsetTime, err := strconv.ParseInt(r.FormValue("offset_time"), 10, 64)
+	if err != nil {
+		offsetTime = time.Now().Unix()
+	}
+
+	post_rows, err := db.Query("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, communities.id, title, icon, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id IN (SELECT post FROM post_tags WHERE tag = ?) AND UNIX_TIMESTAMP(posts.created_at) <= ? AND is_rm = 0 AND is_rm_by_admin = 0 AND communities.rm = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (posts.pending = 0 OR posts.created_by = ?) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY posts.created_at DESC, posts.id DESC LIMIT 25 OFFSET ?", tag, offsetTime, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var posts []*post
+	for post_rows.Next() {
+		var row = &post{}
+
+		err = post_rows.Scan(&row.ID, &row.CreatedBy, &row.CreatedAtTime, &row.EditedAtTime, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.Privacy, &row.RepostID, &row.MigrationID, &row.MigratedID, &row.MigratedCommunity, &row.CommunityID, &row.CommunityName, &row.CommunityIcon, &row.PosterUsername, &row.PosterNickname, &row.PosterIcon, &row.PosterHasMii, &row.PosterOnline, &row.PosterHideOnline, &row.PosterColor, &row.PosterRoleID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row = setupPost(row, CurrentUser, 2, 0)
+		posts = append(posts, row)
+	}
+	post_rows.Close()
+	setupPostAttachments(posts...)
+	offset += 25
+
+	friendCount, followingCount, followerCount := setupSidebarStatus(CurrentUser.ID)
+
+	var data = map[string]interface{}{
+		"Title":          "#" + tag,
 		"Pjax":           r.Header.Get("X-PJAX") == "",
+		"AutoPagerize":   r.Header.Get("X-AUTOPAGERIZE") == "",
 		"CurrentUser":    CurrentUser,
 		"FriendCount":    friendCount,
 		"FollowingCount": followingCount,
 		"FollowerCount":  followerCount,
+		"Tag":            tag,
+		"Posts":          posts,
+		"Offset":         offset,
+		"OffsetTime":     offsetTime,
 	}
-	err := templates.ExecuteTemplate(w, "rules.html", data)
+	err = templates.ExecuteTemplate(w, "tag.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
 }
 
@@ -5429,7 +8469,7 @@ func showUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	user.Avatar = getAvatar(user.Avatar, user.HasMii, 0)
 	sidebar := setupProfileSidebar(user, CurrentUser, "main")
 
-	post_rows, err := db.Query("SELECT posts.id, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, title, icon, rm FROM posts LEFT JOIN communities ON communities.id = community_id WHERE created_by = ? AND is_rm = 0 AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? < 0) OR created_by = ?) ORDER BY created_at DESC, posts.id DESC LIMIT 3", user.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
+	post_rows, err := db.Query("SELECT posts.id, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, title, icon, rm FROM posts LEFT JOIN communities ON communities.id = community_id WHERE created_by = ? AND is_rm = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND (posts.pending = 0 OR posts.created_by = ?) AND ((SELECT limited FROM users WHERE users.id = posts.created_by) = 0 OR posts.created_by = ? OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? < 0) OR created_by = ?) ORDER BY created_at DESC, posts.id DESC LIMIT 3", user.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -5453,8 +8493,9 @@ func showUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		posts = append(posts, row)
 	}
 	post_rows.Close()
+	setupPostAttachments(posts...)
 
-	yeah_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm FROM yeahs INNER JOIN posts ON posts.id = yeah_post INNER JOIN users ON users.id = posts.created_by INNER JOIN communities ON communities.id = community_id WHERE yeah_by = ? AND on_comment = 0 AND is_rm = 0 AND is_rm_by_admin = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY created_at DESC LIMIT 3", user.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
+	yeah_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm FROM yeahs INNER JOIN posts ON posts.id = yeah_post INNER JOIN users ON users.id = posts.created_by INNER JOIN communities ON communities.id = community_id WHERE yeah_by = ? AND on_comment = 0 AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND (users.limited = 0 OR users.id = ? OR ? > 0) AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY created_at DESC LIMIT 3", user.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -5469,6 +8510,7 @@ func showUser(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		yeahs = append(yeahs, row)
 	}
 	yeah_rows.Close()
+	setupPostAttachments(yeahs...)
 
 	var data = map[string]interface{}{
 		"Title":       user.Nickname + "'s Profile",
@@ -5505,7 +8547,7 @@ func showUserComments(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	query := r.URL.Query().Get("q")
 	sidebar := setupProfileSidebar(user, CurrentUser, "comments")
 
-	post_rows, err := db.Query("SELECT comments.id, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, privacy, comments.is_rm_by_admin, nickname, avatar, has_mh, posts.is_rm FROM comments LEFT JOIN posts ON posts.id = post LEFT JOIN users ON posts.created_by = users.id WHERE comments.created_by = ? AND UNIX_TIMESTAMP(comments.created_at) <= ? AND comments.is_rm = 0 AND comments.body LIKE CONCAT('%', ?, '%') AND IF(comments.created_by = ?, true, LOWER(comments.body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = posts.created_by OR source = posts.created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = posts.created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = posts.created_by) = 1) OR (privacy = 8 AND ? > 0) OR posts.created_by = ?) ORDER BY comments.id DESC LIMIT 50 OFFSET ?", user.ID, offsetTime, query, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+	post_rows, err := db.Query("SELECT comments.id, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, privacy, comments.is_rm_by_admin, nickname, avatar, has_mh, posts.is_rm FROM comments LEFT JOIN posts ON posts.id = post LEFT JOIN users ON posts.created_by = users.id WHERE comments.created_by = ? AND UNIX_TIMESTAMP(comments.created_at) <= ? AND comments.is_rm = 0 AND comments.body LIKE CONCAT('%', ?, '%') AND (comments.pending = 0 OR comments.created_by = ?) AND ((SELECT limited FROM users WHERE users.id = comments.created_by) = 0 OR comments.created_by = ? OR ? > 0) AND IF(comments.created_by = ?, true, LOWER(comments.body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = posts.created_by OR source = posts.created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = posts.created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = posts.created_by) = 1) OR (privacy = 8 AND ? > 0) OR posts.created_by = ?) AND "+getCommunityMembershipFilter("posts.community_id", CurrentUser)+" ORDER BY comments.id DESC LIMIT 50 OFFSET ?", user.ID, offsetTime, query, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -5535,6 +8577,7 @@ func showUserComments(w http.ResponseWriter, r *http.Request, CurrentUser user)
 		posts = append(posts, row)
 	}
 	post_rows.Close()
+	setupPostAttachments(posts...)
 
 	offset += 25
 
@@ -5556,6 +8599,194 @@ func showUserComments(w http.ResponseWriter, r *http.Request, CurrentUser user)
 	}
 }
 
+// Show a user's dossier.
+func showUserDossier(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	if CurrentUser.Level < admin.Manage.MinimumLevel {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	vars := mux.Vars(r)
+	username := vars["username"]
+	user := QueryUser(username, CurrentUser.Timezone)
+	if len(user.Username) == 0 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	user.Avatar = getAvatar(user.Avatar, user.HasMii, 0)
+	sidebar := setupProfileSidebar(user, CurrentUser, "dossier")
+
+	note_rows, err := db.Query("SELECT mod_notes.id, body, mod_notes.created_at, mod_notes.created_by, IFNULL(username, ''), IFNULL(nickname, '') FROM mod_notes LEFT JOIN users ON users.id = mod_notes.created_by WHERE user = ? ORDER BY mod_notes.id DESC", user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var notes []modNote
+
+	for note_rows.Next() {
+		var row modNote
+		var createdAt time.Time
+		var createdBy int
+
+		err = note_rows.Scan(&row.ID, &row.Body, &createdAt, &createdBy, &row.ByUsername, &row.ByNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		row.ByMe = createdBy == CurrentUser.ID
+		notes = append(notes, row)
+	}
+	note_rows.Close()
+
+	// Linked accounts share an IP, a browser they've logged in from, or an email domain.
+	// Email domains are compared by their hash so the addresses never end up on the page, and domains with
+	// more than 10 accounts are skipped since those are almost always public email providers.
+	var alts []*altAccount
+	altIndex := make(map[string]*altAccount)
+	altQueries := []struct {
+		Reason string
+		Query  string
+	}{
+		{"Same IP", "SELECT username, nickname, avatar, has_mh FROM users WHERE id != ? AND ip = (SELECT ip FROM users WHERE id = ? AND ip != '') LIMIT 50"},
+		{"Same browser", "SELECT DISTINCT username, nickname, avatar, has_mh FROM login_devices AS mine INNER JOIN login_devices AS theirs ON theirs.device = mine.device AND theirs.user != mine.user INNER JOIN users ON users.id = theirs.user WHERE users.id != ? AND mine.user = ? LIMIT 50"},
+		{"Same email domain", "SELECT username, nickname, avatar, has_mh FROM users WHERE id != ? AND email LIKE '%@%' AND MD5(LOWER(SUBSTRING_INDEX(email, '@', -1))) = (SELECT MD5(LOWER(SUBSTRING_INDEX(email, '@', -1))) FROM users WHERE id = ? AND email LIKE '%@%') AND (SELECT COUNT(*) FROM users AS same WHERE LOWER(SUBSTRING_INDEX(same.email, '@', -1)) = LOWER(SUBSTRING_INDEX(users.email, '@', -1))) <= 10 LIMIT 50"},
+	}
+	for _, altQuery := range altQueries {
+		alt_rows, err := db.Query(altQuery.Query, user.ID, user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for alt_rows.Next() {
+			var row altAccount
+			var hasMii bool
+
+			err = alt_rows.Scan(&row.Username, &row.Nickname, &row.Avatar, &hasMii)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if alt, exists := altIndex[row.Username]; exists {
+				alt.Reasons = append(alt.Reasons, altQuery.Reason)
+				continue
+			}
+			row.Avatar = getAvatar(row.Avatar, hasMii, 0)
+			row.Reasons = []string{altQuery.Reason}
+			altIndex[row.Username] = &row
+			alts = append(alts, &row)
+		}
+		alt_rows.Close()
+	}
+
+	ban_rows, err := db.Query("SELECT bans.id, bans.ip, reason, bans.created_at, until, until > NOW(), IFNULL(issuer.username, ''), IFNULL(issuer.nickname, '') FROM bans LEFT JOIN users AS issuer ON issuer.id = ban_by WHERE bans.user = ? ORDER BY bans.id DESC", user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var bans []ban
+
+	for ban_rows.Next() {
+		var row ban
+		var createdAt, until time.Time
+
+		err = ban_rows.Scan(&row.ID, &row.IP, &row.Reason, &createdAt, &until, &row.Active, &row.IssuerUsername, &row.IssuerNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		row.Until = until.Format("01/02/2006 3:04 PM")
+		row.UntilForever = until.Year() > 2100
+		bans = append(bans, row)
+	}
+	ban_rows.Close()
+
+	// Sanctions from the audit log, which also covers limits and unbans.
+	sanction_rows, err := db.Query("SELECT audit_log_entries.id, type, audit_log_entries.created_at, IFNULL(username, ''), IFNULL(nickname, '') FROM audit_log_entries LEFT JOIN users ON users.id = audit_log_entries.created_by WHERE type IN (2, 3, 5, 6) AND context = ? ORDER BY audit_log_entries.id DESC", user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var sanctions []auditLogEntry
+
+	for sanction_rows.Next() {
+		var row auditLogEntry
+		var createdAt time.Time
+
+		err = sanction_rows.Scan(&row.ID, &row.Type, &createdAt, &row.CreatorUsername, &row.CreatorNickname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch row.Type {
+		case 2:
+			row.TypeText = "Banned"
+		case 3:
+			row.TypeText = "Unbanned"
+		case 5:
+			row.TypeText = "Limited"
+		case 6:
+			row.TypeText = "Unlimited"
+		}
+		row.CreatedAt = humanTiming(createdAt, CurrentUser.Timezone)
+		sanctions = append(sanctions, row)
+	}
+	sanction_rows.Close()
+
+	var reportsMade, reportsReceived int
+	db.QueryRow("SELECT COUNT(*) FROM reports WHERE user = ?", user.ID).Scan(&reportsMade)
+	db.QueryRow("SELECT COUNT(*) FROM reports LEFT JOIN posts ON reports.type = 0 AND posts.id = pid LEFT JOIN comments ON reports.type = 1 AND comments.id = pid LEFT JOIN messages ON reports.type = 3 AND messages.id = pid WHERE posts.created_by = ? OR comments.created_by = ? OR messages.created_by = ? OR (reports.type = 2 AND pid = ?)", user.ID, user.ID, user.ID, user.ID).Scan(&reportsReceived)
+
+	post_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm, source_identifier, posts.type FROM (SELECT posts.id, posts.created_by, posts.community_id, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, posts.privacy, repost, migration, migrated_id, migrated_community, users.username, users.nickname, users.avatar, users.has_mh, users.online, users.hide_online, users.color, users.role, title, icon, rm, 0 source_identifier, 0 type FROM posts LEFT JOIN users ON posts.created_by = users.id LEFT JOIN communities ON community_id = communities.id WHERE posts.created_by = ? AND posts.is_rm_by_admin = 1 UNION ALL SELECT comments.id, comments.created_by, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, op.privacy, 0, 0, 0, 0, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, poster.nickname, poster.avatar, op.is_rm, poster.has_mh, 1 FROM comments LEFT JOIN posts AS op ON post = op.id LEFT JOIN users AS creator ON comments.created_by = creator.id LEFT JOIN users AS poster ON op.created_by = poster.id WHERE comments.created_by = ? AND comments.is_rm_by_admin = 1) posts ORDER BY created_at DESC LIMIT 10", user.ID, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var posts []*post
+
+	for post_rows.Next() {
+		var row = &post{}
+		var communityHasMii bool
+		var onComment bool
+
+		err = post_rows.Scan(&row.ID, &row.CreatedBy, &row.CommunityID, &row.CreatedAtTime, &row.EditedAtTime, &row.Feeling, &row.BodyText, &row.Image, &row.AttachmentType, &row.IsSpoiler, &row.PostType, &row.URL, &row.URLType, &row.Pinned, &row.Privacy, &row.RepostID, &row.MigrationID, &row.MigratedID, &row.MigratedCommunity, &row.PosterUsername, &row.PosterNickname, &row.PosterIcon, &row.PosterHasMii, &row.PosterOnline, &row.PosterHideOnline, &row.PosterColor, &row.PosterRoleID, &row.CommunityName, &row.CommunityIcon, &row.CommunityRM, &communityHasMii, &onComment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if onComment {
+			row.CommunityIcon = getAvatar(row.CommunityIcon, communityHasMii, 0)
+			row.CommunityName = "Comment on " + row.CommunityName + "'s Post"
+			row.CommentCount = -1
+		}
+		row = setupPost(row, CurrentUser, 3, 2)
+		row.IsRMByAdmin = true
+		posts = append(posts, row)
+	}
+	post_rows.Close()
+	setupPostAttachments(posts...)
+
+	var data = map[string]interface{}{
+		"Title":           user.Nickname + "'s Dossier",
+		"Pjax":            r.Header.Get("X-PJAX") == "",
+		"CurrentUser":     CurrentUser,
+		"User":            user,
+		"Sidebar":         sidebar,
+		"Notes":           notes,
+		"Alts":            alts,
+		"Bans":            bans,
+		"Sanctions":       sanctions,
+		"ReportsMade":     reportsMade,
+		"ReportsReceived": reportsReceived,
+		"Posts":           posts,
+	}
+	err = templates.ExecuteTemplate(w, "user_dossier.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Show a user's posts.
 func showUserPosts(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
@@ -5575,7 +8806,7 @@ func showUserPosts(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	query := r.URL.Query().Get("q")
 	sidebar := setupProfileSidebar(user, CurrentUser, "posts")
 
-	post_rows, err := db.Query("SELECT posts.id, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, title, icon, rm FROM posts LEFT JOIN communities ON communities.id = community_id WHERE created_by = ? AND UNIX_TIMESTAMP(created_at) <= ? AND is_rm = 0 AND body LIKE CONCAT('%', ?, '%') AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY created_at DESC, posts.id DESC LIMIT 50 OFFSET ?", user.ID, offsetTime, query, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+	post_rows, err := db.Query("SELECT posts.id, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, title, icon, rm FROM posts LEFT JOIN communities ON communities.id = community_id WHERE created_by = ? AND UNIX_TIMESTAMP(created_at) <= ? AND is_rm = 0 AND body LIKE CONCAT('%', ?, '%') AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND (posts.pending = 0 OR posts.created_by = ?) AND ((SELECT limited FROM users WHERE users.id = posts.created_by) = 0 OR posts.created_by = ? OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY created_at DESC, posts.id DESC LIMIT 50 OFFSET ?", user.ID, offsetTime, query, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -5603,6 +8834,7 @@ func showUserPosts(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		posts = append(posts, row)
 	}
 	post_rows.Close()
+	setupPostAttachments(posts...)
 	offset += 25
 
 	var data = map[string]interface{}{
@@ -5696,7 +8928,7 @@ func showUserYeahs(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	query := r.URL.Query().Get("q")
 	sidebar := setupProfileSidebar(user, CurrentUser, "yeahs")
 
-	post_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm, source_identifier, type FROM (SELECT posts.id, posts.created_by, posts.community_id, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, posts.privacy, repost, migration, migrated_id, migrated_community, is_rm, is_rm_by_admin, users.username, users.nickname, users.avatar, users.has_mh, users.online, users.hide_online, users.color, users.role, title, icon, rm, 0 source_identifier, 0 type FROM posts LEFT JOIN users ON posts.created_by = users.id LEFT JOIN communities ON community_id = communities.id UNION SELECT comments.id, comments.created_by, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, op.privacy, 0, 0, 0, 0, comments.is_rm, comments.is_rm_by_admin, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, poster.nickname, poster.avatar, op.is_rm, poster.has_mh, 1 FROM comments LEFT JOIN posts AS op ON post = op.id LEFT JOIN users AS creator ON comments.created_by = creator.id LEFT JOIN users AS poster ON op.created_by = poster.id) posts LEFT JOIN yeahs ON yeah_post = posts.id WHERE yeah_by = ? AND on_comment = type AND body LIKE CONCAT('%', ?, '%') AND is_rm = 0 AND is_rm_by_admin = 0 AND created_by NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = created_by) OR (source = created_by AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY yeahs.id DESC LIMIT 25 OFFSET ?", user.ID, query, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
+	post_rows, err := db.Query("SELECT posts.id, created_by, community_id, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm, is_rm_by_admin, username, nickname, avatar, has_mh, online, hide_online, color, role, title, icon, rm, source_identifier, type FROM (SELECT posts.id, posts.created_by, posts.community_id, posts.created_at, posts.edited_at, posts.feeling, posts.body, posts.image, posts.attachment_type, posts.is_spoiler, posts.post_type, posts.url, posts.url_type, posts.pinned, posts.privacy, repost, migration, migrated_id, migrated_community, is_rm, is_rm_by_admin, users.username, users.nickname, users.avatar, users.has_mh, users.online, users.hide_online, users.color, users.role, title, icon, rm, 0 source_identifier, 0 type, users.limited, posts.pending FROM posts LEFT JOIN users ON posts.created_by = users.id LEFT JOIN communities ON community_id = communities.id UNION SELECT comments.id, comments.created_by, post, comments.created_at, comments.edited_at, comments.feeling, comments.body, comments.image, comments.attachment_type, comments.is_spoiler, comments.post_type, comments.url, comments.url_type, comments.pinned, op.privacy, 0, 0, 0, 0, comments.is_rm, comments.is_rm_by_admin, creator.username, creator.nickname, creator.avatar, creator.has_mh, creator.online, creator.hide_online, creator.color, creator.role, poster.nickname, poster.avatar, op.is_rm, poster.has_mh, 1, creator.limited, comments.pending | op.pending FROM comments LEFT JOIN posts AS op ON post = op.id LEFT JOIN users AS creator ON comments.created_by = creator.id LEFT JOIN users AS poster ON op.created_by = poster.id) posts LEFT JOIN yeahs ON yeah_post = posts.id WHERE yeah_by = ? AND on_comment = type AND "+getCommunityMembershipFilter("IF(type = 0, community_id, (SELECT op.community_id FROM posts AS op WHERE op.id = posts.community_id))", CurrentUser)+" AND body LIKE CONCAT('%', ?, '%') AND is_rm = 0 AND is_rm_by_admin = 0 AND (pending = 0 OR created_by = ? OR ? > 0) AND (limited = 0 OR created_by = ? OR ? > 0) AND created_by NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = created_by) OR (source = created_by AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) ORDER BY yeahs.id DESC LIMIT 25 OFFSET ?", user.ID, query, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -5723,6 +8955,7 @@ func showUserYeahs(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 		posts = append(posts, row)
 	}
 	post_rows.Close()
+	setupPostAttachments(posts...)
 
 	offset += 25
 
@@ -5813,7 +9046,39 @@ func unfavoritePost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	}
 }
 
-func uploadImage(w http.ResponseWriter, r *http.Request) {
+// Unpin a post from its community.
+func unpinPost(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	vars := mux.Vars(r)
+	postID := vars["id"]
+
+	communityID := -1
+	var createdBy int
+	db.QueryRow("SELECT community_id, created_by FROM posts WHERE id = ? AND is_rm = 0 AND is_rm_by_admin = 0", postID).Scan(&communityID, &createdBy)
+	if communityID == -1 {
+		handle404(w, r, CurrentUser)
+		return
+	}
+	if !checkIfCommunityModerator(communityID, CurrentUser) {
+		http.Error(w, "You do not have permission to moderate this community.", http.StatusForbidden)
+		return
+	}
+	_, err := db.Exec("UPDATE posts SET pinned = 0 WHERE id = ?", postID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// type 2 - unpin post
+	logCommunityModAction(communityID, 2, postID, createdBy, CurrentUser)
+}
+
+func uploadImage(w http.ResponseWriter, r *http.Request, CurrentUser user) {
+	// Uploads can be as big as the larger of the form's memory and the clip size limit, and no bigger.
+	maxSize := int64(settings.Clips.MaxSize) << 20
+	if maxSize < 20<<20 {
+		maxSize = 20 << 20
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+
 	// parse multipart form with 32 mb as max memory
 	err := r.ParseMultipartForm(20 << 20)
 	if err != nil {
@@ -5830,13 +9095,25 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// make an md5 hash of this to see if it already exists in the database
-	h := md5.New()
-	if _, err := io.Copy(h, file); err != nil {
+	if handler.Size > maxSize {
+		http.Error(w, "Uploads can't be bigger than "+strconv.FormatInt(maxSize>>20, 10)+" MB.", http.StatusBadRequest)
+		return
+	}
+
+	// Uploads are read whole so clips can have their container checked and a poster taken from them.
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	hash := hex.EncodeToString(h.Sum(nil))
+	if int64(len(data)) > maxSize {
+		http.Error(w, "Uploads can't be bigger than "+strconv.FormatInt(maxSize>>20, 10)+" MB.", http.StatusBadRequest)
+		return
+	}
+
+	// make an md5 hash of this to see if it already exists in the database
+	sum := md5.Sum(data)
+	hash := hex.EncodeToString(sum[:])
 
 	var imageID sql.NullString
 	db.QueryRow("SELECT id FROM images WHERE hash = ?", hash).Scan(&imageID)
@@ -5846,170 +9123,79 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// prepare file for reading again by resetting reader
-	file.Seek(0, 0)
-
-	switch settings.ImageHost.Provider {
-	case "cloudinary":
-		bodyData := &bytes.Buffer{}
-		writer := multipart.NewWriter(bodyData)
-		part, err := writer.CreateFormFile("file", handler.Filename)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Short MP4, WebM and GIF clips get their own player, so they're held to limits other uploads aren't.
+	format, duration, err := getClipInfo(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var poster string
+	if duration > 0 {
+		if CurrentUser.ID == 0 {
+			http.Error(w, "You have to be logged in to upload clips.", http.StatusForbidden)
 			return
 		}
-		io.Copy(part, file)
-		writer.WriteField("upload_preset", settings.ImageHost.UploadPreset)
-		writer.Close()
-
-		resp, err := http.Post(settings.ImageHost.APIEndpoint+"/v1_1/"+settings.ImageHost.Username+"/auto/upload", writer.FormDataContentType(), bodyData)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if int64(len(data)) > int64(settings.Clips.MaxSize)<<20 {
+			http.Error(w, "Clips can't be bigger than "+strconv.Itoa(settings.Clips.MaxSize)+" MB.", http.StatusBadRequest)
 			return
 		}
-		defer resp.Body.Close()
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if duration > float64(settings.Clips.MaxDuration) {
+			http.Error(w, "Clips can't be longer than "+strconv.Itoa(settings.Clips.MaxDuration)+" seconds.", http.StatusBadRequest)
 			return
 		}
-
-		jsonBody := make(map[string]interface{})
-		json.Unmarshal(body, &jsonBody)
-
-		if image, ok := jsonBody["secure_url"].(string); ok {
-			_, err = db.Exec("INSERT INTO images (value, hash) VALUES (?, ?)", image, hash)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			var image_id string
-			err = db.QueryRow("SELECT id FROM images WHERE value = ? ORDER BY id DESC LIMIT 1", image).Scan(&image_id)
+		// Clips can still be played without a poster, so failing to make one isn't fatal.
+		posterData, err := getClipPoster(data, format)
+		if err != nil {
+			fmt.Println("Could not make a poster for clip " + hash + ": " + err.Error())
+		} else if len(posterData) > 0 {
+			poster, err = storeUpload(bytes.NewReader(posterData), hash+"-poster.png", "image/png", hash+"-poster")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			w.Write([]byte(image_id))
-		} else {
-			http.Error(w, "cloudinary sent an unexpected response: \n"+string(body), http.StatusInternalServerError)
-			return
-		}
-	case "local":
-		fileExtension := filepath.Ext(handler.Filename)
-		if fileExtension == "" {
-			// if extension is not provided then use mime type
-			extensions, err := mime.ExtensionsByType(handler.Header.Get("Content-Type"))
-			if err == nil && len(extensions) != 0 {
-				fileExtension = extensions[0] // Use the first extension in the list
-			}
-		}
-		imageFilePath := settings.ImageHost.ImageEndpoint + "/" + hash + fileExtension
-		outputFile, err := os.Create(imageFilePath)
-		if err != nil {
-			http.Error(w, "Could not create output file: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer outputFile.Close()
-
-		io.Copy(outputFile, file)
-
-		// NOW ADD SLASH BEFORE IMAGEFILEPATH I DON'T F&CKING KNOW
-		imageFilePath = "/" + imageFilePath
-
-		_, err = db.Exec("INSERT INTO images (value, hash) VALUES (?, ?)", imageFilePath, hash)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
 		}
+	}
 
-		var image_id string
-		err = db.QueryRow("SELECT id FROM images WHERE value = ? ORDER BY id DESC LIMIT 1", imageFilePath).Scan(&image_id)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(image_id))
-		/*	case "lambda": // WIP
-				file := &bytes.Buffer{}
-				writer := multipart.NewWriter(file)
-				part, err := writer.CreateFormFile("file", "indigo.jpg")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				_, err = io.Copy(part, buffer)
-				writer.Close()
-				req, err := http.NewRequest("POST", settings.ImageHost.APIEndpoint + "/api/upload", buffer)
-				req.Header.Set("Content-Type", writer.FormDataContentType())
-				client := &http.Client{}
-				resp, err := client.Do(req)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				_, err = buffer.ReadFrom(resp.Body)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				resp.Body.Close()
-
-				if(buffer.String() == "500") {
-					http.Error(w, buffer.String(), http.StatusInternalServerError)
-					return
-				}
-				jsonBody := make(map[string]interface{})
-				err = json.Unmarshal(buffer.Bytes(), &jsonBody)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				files := jsonBody["files"].([]interface{})
-				thingy := files[0].(map[string]interface{})
-				w.Write([]byte(thingy["url"].(string)))
-				//w.Write(body.Bytes())
-			case "pomf": // WIP
-				file := &bytes.Buffer{}
-				writer := multipart.NewWriter(file)
-				part, err := writer.CreateFormFile("files[]", "indigo.png")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				_, err = io.Copy(part, buffer)
-				writer.Close()
-				req, err := http.NewRequest("POST", settings.ImageHost.APIEndpoint + "/upload.php", buffer)
-				req.Header.Set("Content-Type", writer.FormDataContentType())
-				client := &http.Client{}
-				resp, err := client.Do(req)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
-				_, err = buffer.ReadFrom(resp.Body)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
-				resp.Body.Close()
-
-				jsonBody := make(map[string]interface{})
-				json.Unmarshal(buffer.Bytes(), &jsonBody)
-				files := jsonBody["files"].([]interface{})
-				thingy := files[0].(map[string]interface{})
-				w.Write([]byte(thingy["url"].(string)))
-				//w.Write(body.Bytes())*/
+	image, err := storeUpload(bytes.NewReader(data), handler.Filename, handler.Header.Get("Content-Type"), hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	_, err = db.Exec("INSERT INTO images (value, hash, format, duration, poster) VALUES (?, ?, ?, ?, ?)", image, hash, format, int(duration*1000), poster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var image_id string
+	err = db.QueryRow("SELECT id FROM images WHERE value = ? ORDER BY id DESC LIMIT 1", image).Scan(&image_id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(image_id))
 }
 
-// Vote on a poll.
+// Vote on a poll. Voting for an option on a multiple choice poll toggles it instead of switching to it.
 func voteOnPoll(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 	vars := mux.Vars(r)
 	postID := vars["id"]
 	optionID := r.FormValue("option")
 
-	var msg wsMessage
+	postIDInt, err := strconv.Atoi(postID)
+	if err != nil || !checkIfCanSeePost(postIDInt, CurrentUser) {
+		http.Error(w, "The post could not be found.", http.StatusNotFound)
+		return
+	}
+
+	var multipleChoice, closed bool
+	var resultsVisibility int
+	db.QueryRow("SELECT multiple_choice, IFNULL(closes_at <= NOW(), 0), results_visibility FROM polls WHERE post = ?", postID).Scan(&multipleChoice, &closed, &resultsVisibility)
+	if closed {
+		http.Error(w, "This poll has closed.", http.StatusBadRequest)
+		return
+	}
+
+	var msgs []wsMessage
 	var count int
 	if optionID != "0" {
 		err = db.QueryRow("SELECT COUNT(*) FROM options WHERE post = ? AND id = ?", postID, optionID).Scan(&count)
@@ -6021,38 +9207,84 @@ func voteOnPoll(w http.ResponseWriter, r *http.Request, CurrentUser user) {
 			http.Error(w, "That option does not exist.", http.StatusBadRequest)
 			return
 		}
-		option_id := -1
-		db.QueryRow("SELECT option_id FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID).Scan(&option_id)
-		if option_id != -1 {
-			db.Exec("UPDATE votes SET option_id = ? WHERE poll = ? AND user = ?", optionID, postID, CurrentUser.ID)
-			msg.Type = "pollChange"
-			msg.Content = strconv.Itoa(option_id)
+		var msg wsMessage
+		if multipleChoice {
+			db.QueryRow("SELECT COUNT(*) FROM votes WHERE poll = ? AND user = ? AND option_id = ?", postID, CurrentUser.ID, optionID).Scan(&count)
+			if count > 0 {
+				db.Exec("DELETE FROM votes WHERE poll = ? AND user = ? AND option_id = ?", postID, CurrentUser.ID, optionID)
+				msg.Type = "pollUnvote"
+			} else {
+				_, err = db.Exec("INSERT INTO votes (option_id, user, poll) VALUES (?, ?, ?)", optionID, CurrentUser.ID, postID)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				msg.Type = "pollVote"
+			}
 		} else {
-			_, err = db.Exec("INSERT INTO votes (option_id, user, poll) VALUES (?, ?, ?)", optionID, CurrentUser.ID, postID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			option_id := -1
+			db.QueryRow("SELECT option_id FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID).Scan(&option_id)
+			if option_id != -1 {
+				db.Exec("UPDATE votes SET option_id = ? WHERE poll = ? AND user = ?", optionID, postID, CurrentUser.ID)
+				msg.Type = "pollChange"
+				msg.Content = strconv.Itoa(option_id)
+			} else {
+				_, err = db.Exec("INSERT INTO votes (option_id, user, poll) VALUES (?, ?, ?)", optionID, CurrentUser.ID, postID)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				msg.Type = "pollVote"
 			}
-			msg.Type = "pollVote"
 		}
 		msg.ID = optionID
+		msgs = append(msgs, msg)
 	} else {
-		db.QueryRow("SELECT COUNT(*) FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID).Scan(&count)
-		if count == 0 {
+		vote_rows, err := db.Query("SELECT option_id FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
-		} else {
-			db.QueryRow("SELECT option_id FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID).Scan(&msg.ID)
-			db.Exec("DELETE FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID)
+		}
+		for vote_rows.Next() {
+			var msg wsMessage
+			vote_rows.Scan(&msg.ID)
 			msg.Type = "pollUnvote"
+			msgs = append(msgs, msg)
+		}
+		vote_rows.Close()
+		if len(msgs) == 0 {
+			return
 		}
+		db.Exec("DELETE FROM votes WHERE poll = ? AND user = ?", postID, CurrentUser.ID)
 	}
 
+	// Only send the new results to people who are allowed to see them.
+	if resultsVisibility == 2 {
+		return
+	}
+	voters := make(map[int]bool)
+	if resultsVisibility == 1 {
+		voter_rows, err := db.Query("SELECT DISTINCT user FROM votes WHERE poll = ?", postID)
+		if err != nil {
+			return
+		}
+		for voter_rows.Next() {
+			var voter int
+			voter_rows.Scan(&voter)
+			voters[voter] = true
+		}
+		voter_rows.Close()
+	}
 	for client := range clients {
-		if clients[client].UserID != CurrentUser.ID {
+		if clients[client].UserID == CurrentUser.ID || (resultsVisibility == 1 && !voters[clients[client].UserID]) {
+			continue
+		}
+		for _, msg := range msgs {
 			err := writeWs(clients[client], client, msg)
 			if err != nil {
 				client.Close()
 				delete(clients, client)
+				break
 			}
 		}
 	}
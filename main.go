@@ -43,6 +43,8 @@ import (
 	// "user" is already defined in types
 	osUser "os/user"
 	"strconv"
+	"sync"
+	"time"
 
 	"regexp"
 
@@ -62,14 +64,28 @@ var err error
 var clients = make(map[*websocket.Conn]*wsSession)
 var settings config
 var admin adminConfig
-var youtube *regexp.Regexp
-var spotify *regexp.Regexp
-var soundcloud *regexp.Regexp
+var embedProviders []embedProvider
+var resolvedEmbeds = make(map[string]resolvedEmbed)
+var resolvedEmbedsLock sync.Mutex
+var resolvedEmbedsSwept time.Time
+var ffmpegSlots = make(chan struct{}, 2)
 var symbols *regexp.Regexp
 var emotes *regexp.Regexp
+var links *regexp.Regexp
+var mentions *regexp.Regexp
+var hashtags *regexp.Regexp
+var diffTokens *regexp.Regexp
+var bandcampPlayers *regexp.Regexp
 var renderer *blackfriday.HTMLRenderer
 var geoip *geoip2.Reader
 var isGeoIPEnabled bool
+var trendingTags []trendingTag
+var trendingTagsLock sync.RWMutex
+var iphubCache = make(map[string]iphubCacheEntry)
+var iphubCacheLock sync.RWMutex
+var iphubCacheSwept time.Time
+var automodRegexes = make(map[string]*regexp.Regexp)
+var automodRegexesLock sync.RWMutex
 
 // Configure the upgrader.
 var upgrader = websocket.Upgrader{
@@ -129,10 +145,87 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Convert bans from before IP ranges were stored as bounds.
+	err = migrateLegacyBans()
+	if err != nil {
+		log.Printf("[warn]: unable to convert old IP bans...\n")
+		log.Printf("       %v\n", err)
+	}
+
+	// Initialize the link embed providers, in the order they're checked in.
+	embedProviders = []embedProvider{
+		{
+			Type:     1,
+			Key:      "youtube",
+			Name:     "YouTube",
+			Pattern:  regexp.MustCompile("(?:youtube\\.com/\\S*(?:(?:/e(?:mbed))?/|watch/?\\?(?:\\S*?&?v=))|youtu\\.be/)([a-zA-Z0-9_-]{6,11})"),
+			ID:       func(match []string) string { return match[1] },
+			Link:     func(id string) string { return "https://www.youtube.com/watch?v=" + id },
+			Template: "embed_youtube.html",
+		},
+		{
+			Type:     2,
+			Key:      "spotify",
+			Name:     "Spotify",
+			Pattern:  regexp.MustCompile("(?:embed\\.|open\\.)(?:spotify\\.com/)(?:track/|\\?uri=spotify:track:)((\\w|-){22})"),
+			ID:       func(match []string) string { return match[1] },
+			Link:     func(id string) string { return "https://open.spotify.com/track/" + id },
+			Template: "embed_spotify.html",
+		},
+		{
+			Type:     3,
+			Key:      "soundcloud",
+			Name:     "SoundCloud",
+			Pattern:  regexp.MustCompile("(soundcloud\\.com|snd\\.sc)(.*)"),
+			ID:       func(match []string) string { return "https://" + match[0] },
+			Link:     func(id string) string { return id },
+			Template: "embed_soundcloud.html",
+		},
+		{
+			Type:     4,
+			Key:      "twitch",
+			Name:     "Twitch clips",
+			Pattern:  regexp.MustCompile("(?:clips\\.twitch\\.tv/(?:embed\\?clip=)?|twitch\\.tv/\\w+/clip/)([a-zA-Z0-9_-]+)"),
+			ID:       func(match []string) string { return match[1] },
+			Link:     func(id string) string { return "https://clips.twitch.tv/" + id },
+			Template: "embed_twitch.html",
+		},
+		{
+			Type:     5,
+			Key:      "eshop",
+			Name:     "Nintendo eShop",
+			Pattern:  regexp.MustCompile("nintendo\\.com/((?:[a-z]{2}(?:-[a-z]{2})?/)?(?:store/products|games/detail)/[a-zA-Z0-9_-]+)"),
+			ID:       func(match []string) string { return match[1] },
+			Link:     func(id string) string { return "https://www.nintendo.com/" + id + "/" },
+			Template: "embed_eshop.html",
+		},
+		{
+			Type:     6,
+			Key:      "bandcamp",
+			Name:     "Bandcamp",
+			Pattern:  regexp.MustCompile("[a-z0-9-]+\\.bandcamp\\.com/(?:album|track)/[a-zA-Z0-9_-]+"),
+			ID:       func(match []string) string { return "https://" + match[0] },
+			Link:     func(id string) string { return id },
+			Resolve:  getBandcampPlayerID,
+			Template: "embed_bandcamp.html",
+		},
+		{
+			Type:     7,
+			Key:      "vimeo",
+			Name:     "Vimeo",
+			Pattern:  regexp.MustCompile("vimeo\\.com/(?:video/|channels/[a-zA-Z0-9_-]+/|groups/[a-zA-Z0-9_-]+/videos/)?([0-9]+)"),
+			ID:       func(match []string) string { return match[1] },
+			Link:     func(id string) string { return "https://vimeo.com/" + id },
+			Template: "embed_vimeo.html",
+		},
+	}
+
 	// Initialize some regex.
-	youtube, _ = regexp.Compile("(?:youtube\\.com/\\S*(?:(?:/e(?:mbed))?/|watch/?\\?(?:\\S*?&?v=))|youtu\\.be/)([a-zA-Z0-9_-]{6,11})")
-	spotify, _ = regexp.Compile("(?:embed\\.|open\\.)(?:spotify\\.com/)(?:track/|\\?uri=spotify:track:)((\\w|-){22})")
-	soundcloud, _ = regexp.Compile("(soundcloud\\.com|snd\\.sc)(.*)")
+	links, _ = regexp.Compile("(?i)(?:https?://|www\\.)([a-z0-9.-]+)")
+	diffTokens, _ = regexp.Compile("\\s+|\\S+")
+	bandcampPlayers, _ = regexp.Compile("bandcamp\\.com/EmbeddedPlayer/(?:v=2/)?((?:album|track)=[0-9]+)")
+	hashtags, _ = regexp.Compile("(^|[^\\p{L}\\p{N}_&#/\"'=])#([\\p{L}\\p{N}_]{1,64})")
+	mentions, _ = regexp.Compile("(^|[^A-Za-z0-9._/@\"'=-])@([A-Za-z0-9._-]{1,32})")
 	symbols, _ = regexp.Compile("(\\|\\\\|`|\\*|{|}|\\[|\\](|)|\\+|-|!|_|>|\\n|&|:|<)")
 	emotes, err = regexp.Compile(":([^ :]+):")
 	if err != nil {
@@ -162,6 +255,21 @@ func main() {
 	// Close the database connection after this function exits.
 	defer db.Close()
 
+	// delete old audit log entries in the background
+	go pruneAuditLog()
+
+	// roll up the daily community stats in the background
+	go aggregateCommunityStats()
+
+	// remind people about the events they RSVP'd to in the background
+	go sendEventReminders()
+
+	// publish scheduled posts in the background
+	go publishScheduledPosts()
+
+	// work out the trending tags in the background
+	go updateTrendingTags()
+
 	// initialize the templates by parsing everything from the views directory recursively
 	var tmplFiles []string
 	err = filepath.Walk("views", func(path string, info os.FileInfo, err error) error {
@@ -179,7 +287,11 @@ func main() {
 		log.Fatal("could not add or find templates (they are stored in views, is this accessible?): ", err)
 	}
 
-	templates = template.Must(template.ParseFiles(tmplFiles...))
+	templates = template.Must(template.New("").Funcs(template.FuncMap{
+		"trendingTags": getTrendingTags,
+		"embed":        renderEmbed,
+		"embedLink":    getEmbedLink,
+	}).ParseFiles(tmplFiles...))
 
 	// make the directory for the local image provider if it doesn't exist
 	if settings.ImageHost.Provider == "local" {
@@ -215,6 +327,7 @@ func main() {
 
 	// User routes.
 	r.HandleFunc("/users", requireLogin(showUserSearch)).Methods("GET").Queries("query", "{username}")
+	r.HandleFunc("/users/autocomplete.json", requireLogin(getMentionSuggestions)).Methods("GET")
 	r.HandleFunc("/users/{username}", useLogin(showUser)).Methods("GET")
 	r.HandleFunc("/users/{username}/posts", useLogin(showUserPosts)).Methods("GET")
 	r.HandleFunc("/users/{username}/comments", useLogin(showUserComments)).Methods("GET")
@@ -233,15 +346,21 @@ func main() {
 	r.HandleFunc("/users/{username}/violators", requireLogin(reportUser)).Methods("POST")
 	r.HandleFunc("/users/{username}/block", requireLogin(blockUser)).Methods("POST")
 	r.HandleFunc("/users/{username}/unblock", requireLogin(unblockUser)).Methods("POST")
+	r.HandleFunc("/users/{username}/dossier", requireLogin(showUserDossier)).Methods("GET")
+	r.HandleFunc("/users/{username}/notes", requireLogin(adminCreateModNote)).Methods("POST")
+	r.HandleFunc("/users/{username}/notes/{id:[0-9]+}/delete", requireLogin(adminDeleteModNote)).Methods("POST")
 
 	// Post routes.
 	r.HandleFunc("/posts/{id:[0-9]+}", useLogin(showPost)).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}/revisions", useLogin(showPostRevisions)).Methods("GET")
 	r.HandleFunc("/posts/{id:[0-9]+}/yeah", requireLogin(createPostYeah)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/yeahu", requireLogin(deletePostYeah)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/comments", useLogin(showAllComments)).Methods("GET")
 	r.HandleFunc("/posts/{id:[0-9]+}/comments", requireLogin(createComment)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/favorite", requireLogin(favoritePost)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/unfavorite", requireLogin(unfavoritePost)).Methods("POST")
+	r.HandleFunc("/posts/{id:[0-9]+}/pin", requireLogin(pinPost)).Methods("POST")
+	r.HandleFunc("/posts/{id:[0-9]+}/unpin", requireLogin(unpinPost)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/violations", requireLogin(reportPost)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/vote", requireLogin(voteOnPoll)).Methods("POST")
 	r.HandleFunc("/posts/{id:[0-9]+}/edit", requireLogin(editPost)).Methods("POST")
@@ -249,6 +368,7 @@ func main() {
 
 	// Comment routes.
 	r.HandleFunc("/comments/{id:[0-9]+}", useLogin(showComment)).Methods("GET")
+	r.HandleFunc("/comments/{id:[0-9]+}/revisions", useLogin(showCommentRevisions)).Methods("GET")
 	r.HandleFunc("/comments/{id:[0-9]+}/yeah", requireLogin(createCommentYeah)).Methods("POST")
 	r.HandleFunc("/comments/{id:[0-9]+}/yeahu", requireLogin(deleteCommentYeah)).Methods("POST")
 	r.HandleFunc("/comments/{id:[0-9]+}/violations", requireLogin(reportComment)).Methods("POST")
@@ -259,11 +379,37 @@ func main() {
 	r.HandleFunc("/communities/all", useLogin(showAllCommunities)).Methods("GET")
 	r.HandleFunc("/communities/recent", requireLogin(showRecentCommunities)).Methods("GET")
 	r.HandleFunc("/communities/search", useLogin(showCommunitySearch)).Methods("GET").Queries("query", "{search}")
+	r.HandleFunc("/communities/request", requireLogin(showCommunityRequest)).Methods("GET", "POST")
+	r.HandleFunc("/communities/directory", useLogin(showCommunityDirectory)).Methods("GET")
+	r.HandleFunc("/communities/categories/{category:[0-9]+}", useLogin(showCommunityDirectory)).Methods("GET")
 	r.HandleFunc("/communities/{id:[0-9]+}", useLogin(showCommunity)).Methods("GET")
 	r.HandleFunc("/communities/{id:[0-9]+}/hot", useLogin(showPopularPosts)).Methods("GET")
 	r.HandleFunc("/communities/{id:[0-9]+}/posts", requireLogin(createPost)).Methods("POST")
 	r.HandleFunc("/communities/{id:[0-9]+}/favorite", requireLogin(addCommunityFavorite)).Methods("POST")
 	r.HandleFunc("/communities/{id:[0-9]+}/unfavorite", requireLogin(deleteCommunityFavorite)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/favorite/children", requireLogin(editCommunityFavorite)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/join", requireLogin(joinCommunity)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/leave", requireLogin(leaveCommunity)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/members", useLogin(showCommunityMembers)).Methods("GET")
+	r.HandleFunc("/communities/{id:[0-9]+}/members", requireLogin(addCommunityMember)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/members/{username}/delete", requireLogin(deleteCommunityMember)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/moderation", requireLogin(showCommunityModeration)).Methods("GET")
+	r.HandleFunc("/communities/{id:[0-9]+}/stats", requireLogin(showCommunityStats)).Methods("GET")
+	r.HandleFunc("/communities/{id:[0-9]+}/edit", requireLogin(editCommunity)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/bans", requireLogin(createCommunityBan)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/bans/{ban:[0-9]+}/delete", requireLogin(deleteCommunityBan)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/moderators", requireLogin(addCommunityModerator)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/moderators/{username}/delete", requireLogin(deleteCommunityModerator)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/children", requireLogin(createCommunityChild)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/events", requireLogin(createCommunityEvent)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/events/{event:[0-9]+}/delete", requireLogin(deleteCommunityEvent)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/rules", requireLogin(createCommunityRule)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/rules/{rule:[0-9]+}/edit", requireLogin(editCommunityRule)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/rules/{rule:[0-9]+}/delete", requireLogin(deleteCommunityRule)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/flairs", requireLogin(createCommunityFlair)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/flairs/{flair:[0-9]+}/delete", requireLogin(deleteCommunityFlair)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/report-reasons", requireLogin(createCommunityReportReason)).Methods("POST")
+	r.HandleFunc("/communities/{id:[0-9]+}/report-reasons/{reason:[0-9]+}/delete", requireLogin(deleteCommunityReportReason)).Methods("POST")
 
 	// Activiy Feed route.
 	r.HandleFunc("/activity", requireLogin(showActivityFeed)).Methods("GET")
@@ -281,6 +427,24 @@ func main() {
 	r.HandleFunc("/conversations/{id:[0-9]+}/leave", requireLogin(leaveGroupChat)).Methods("POST")
 	r.HandleFunc("/conversations/{id:[0-9]+}/delete", requireLogin(deleteGroupChat)).Methods("POST")
 
+	// Draft routes.
+	r.HandleFunc("/drafts", requireLogin(showDrafts)).Methods("GET")
+	r.HandleFunc("/drafts", requireLogin(createDraft)).Methods("POST")
+	r.HandleFunc("/drafts/{id:[0-9]+}/edit", requireLogin(editDraft)).Methods("POST")
+	r.HandleFunc("/drafts/{id:[0-9]+}/delete", requireLogin(deleteDraft)).Methods("POST")
+	r.HandleFunc("/drafts/{id:[0-9]+}/publish", requireLogin(publishDraft)).Methods("POST")
+
+	// Tag routes.
+	r.HandleFunc("/tags/{tag}", useLogin(showTag)).Methods("GET")
+
+	// Event routes.
+	r.HandleFunc("/events", useLogin(showEventCalendar)).Methods("GET")
+	r.HandleFunc("/events/calendar/reset", requireLogin(resetEventCalendarToken)).Methods("POST")
+	r.HandleFunc("/events/calendar/{token:[A-Za-z0-9]+}.ics", useLogin(showEventCalendarFeed)).Methods("GET")
+	r.HandleFunc("/events/{id:[0-9]+}", useLogin(showCommunityEvent)).Methods("GET")
+	r.HandleFunc("/events/{id:[0-9]+}/rsvp", requireLogin(addEventRSVP)).Methods("POST")
+	r.HandleFunc("/events/{id:[0-9]+}/unrsvp", requireLogin(deleteEventRSVP)).Methods("POST")
+
 	// Notification routes.
 	r.HandleFunc("/check_update.json", requireLogin(getNotificationCounts)).Methods("GET")
 	r.HandleFunc("/notifications", requireLogin(showNotifications)).Methods("GET")
@@ -304,14 +468,30 @@ func main() {
 	r.HandleFunc("/help/contact", useLogin(showContactPage)).Methods("GET")
 
 	// Image upload route.
-	r.HandleFunc("/upload", uploadImage).Methods("POST")
+	r.HandleFunc("/upload", useLogin(uploadImage)).Methods("POST")
 
 	// Admin routes.
 	r.HandleFunc("/admin", requireLogin(showAdminDashboard)).Methods("GET")
+	r.HandleFunc("/admin/queue", requireLogin(showAdminQueue)).Methods("GET")
+	r.HandleFunc("/admin/queue/{type:posts|comments}/{id:[0-9]+}/approve", requireLogin(adminApprovePending)).Methods("POST")
 	r.HandleFunc("/reports/{id:[0-9]+}/ignore", requireLogin(reportIgnore)).Methods("POST")
 	r.HandleFunc("/admin/manage", requireLogin(showAdminManagerList)).Methods("GET")
 	r.HandleFunc("/admin/manage/bantemp", requireLogin(adminBanUser)).Methods("POST")
 	r.HandleFunc("/admin/manage/unbantemp", requireLogin(adminUnbanUser)).Methods("POST")
+	r.HandleFunc("/admin/manage/limit", requireLogin(adminLimitUser)).Methods("POST")
+	r.HandleFunc("/admin/manage/unlimit", requireLogin(adminUnlimitUser)).Methods("POST")
+	r.HandleFunc("/admin/bans", requireLogin(showAdminBans)).Methods("GET", "POST")
+	r.HandleFunc("/admin/bans/{type:ip|asn}/{id:[0-9]+}", requireLogin(adminEditBan)).Methods("POST")
+	r.HandleFunc("/admin/bans/{type:ip|asn}/{id:[0-9]+}/expire", requireLogin(adminExpireBan)).Methods("POST")
+	r.HandleFunc("/admin/automod", requireLogin(showAdminAutomod)).Methods("GET", "POST")
+	r.HandleFunc("/admin/automod/{id:[0-9]+}", requireLogin(adminEditAutomodRule)).Methods("POST")
+	r.HandleFunc("/admin/automod/{id:[0-9]+}/delete", requireLogin(adminDeleteAutomodRule)).Methods("POST")
+	r.HandleFunc("/admin/nuke", requireLogin(showAdminNuke)).Methods("GET", "POST")
+	r.HandleFunc("/admin/nuke/{id:[0-9]+}/undo", requireLogin(adminUndoNuke)).Methods("POST")
+	r.HandleFunc("/admin/communities", requireLogin(showAdminCommunities)).Methods("GET")
+	r.HandleFunc("/admin/communities/requests/{id:[0-9]+}/approve", requireLogin(adminApproveCommunityRequest)).Methods("POST")
+	r.HandleFunc("/admin/communities/requests/{id:[0-9]+}/reject", requireLogin(adminRejectCommunityRequest)).Methods("POST")
+	r.HandleFunc("/admin/communities/{id:[0-9]+}/{action:feature|unfeature|archive|unarchive}", requireLogin(adminEditCommunityStatus)).Methods("POST")
 	//r.HandleFunc("/admin/manage/{table}", requireLogin(showAdminManager)).Methods("GET")
 	//r.HandleFunc("/admin/manage/{table}/{id:[0-9]+}", requireLogin(showAdminEditor)).Methods("GET", "POST")
 	r.HandleFunc("/admin/settings", requireLogin(showAdminSettings)).Methods("GET", "POST")
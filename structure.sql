@@ -34,6 +34,28 @@ CREATE TABLE `admin_notifications` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `attachments`
+--
+
+DROP TABLE IF EXISTS `attachments`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `attachments` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `type` tinyint(1) NOT NULL,
+  `target` int(11) NOT NULL,
+  `image` int(11) NOT NULL,
+  `position` tinyint(2) NOT NULL DEFAULT '0',
+  `is_spoiler` tinyint(1) NOT NULL DEFAULT '0',
+  `alt` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  KEY `target` (`type`,`target`),
+  KEY `image` (`image`),
+  CONSTRAINT `attachments_ibfk_1` FOREIGN KEY (`image`) REFERENCES `images` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `audit_log_entries`
 --
@@ -45,13 +67,62 @@ CREATE TABLE `audit_log_entries` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `type` tinyint(1) NOT NULL,
   `context` int(11) NOT NULL,
+  `target` int(11) DEFAULT NULL,
+  `before_value` text,
+  `after_value` text,
+  `ip` varchar(39) DEFAULT NULL,
   `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   `created_by` int(11) NOT NULL,
   PRIMARY KEY (`id`),
-  KEY `created_by` (`created_by`)
+  KEY `created_by` (`created_by`),
+  KEY `created_at` (`created_at`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `automod_hits`
+--
+
+DROP TABLE IF EXISTS `automod_hits`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `automod_hits` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `rule` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `type` tinyint(1) NOT NULL,
+  `dry_run` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `rule` (`rule`),
+  KEY `user` (`user`),
+  CONSTRAINT `automod_hits_ibfk_1` FOREIGN KEY (`rule`) REFERENCES `automod_rules` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `automod_hits_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `automod_rules`
+--
+
+DROP TABLE IF EXISTS `automod_rules`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `automod_rules` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(64) COLLATE utf8mb4_bin NOT NULL,
+  `condition_type` tinyint(1) NOT NULL DEFAULT '0',
+  `value` varchar(1024) COLLATE utf8mb4_bin NOT NULL,
+  `action` tinyint(1) NOT NULL DEFAULT '0',
+  `dry_run` tinyint(1) NOT NULL DEFAULT '1',
+  `enabled` tinyint(1) NOT NULL DEFAULT '1',
+  `created_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `created_by` (`created_by`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `bans`
 --
@@ -61,13 +132,18 @@ DROP TABLE IF EXISTS `bans`;
 /*!40101 SET character_set_client = utf8 */;
 CREATE TABLE `bans` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
-  `user` int(11) NOT NULL,
-  `ip` varchar(42) NOT NULL,
-  `cidr` tinyint(1) NOT NULL,
+  `user` int(11) DEFAULT NULL,
+  `ip` varchar(49) NOT NULL DEFAULT '',
+  `cidr` tinyint(1) NOT NULL DEFAULT 0,
+  `range_start` varbinary(16) DEFAULT NULL,
+  `range_end` varbinary(16) DEFAULT NULL,
+  `reason` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `until` datetime NOT NULL,
   `ban_by` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
   KEY `bans_ibfk_1` (`user`),
+  KEY `range_start` (`range_start`,`range_end`),
   CONSTRAINT `bans_ibfk_1` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -114,13 +190,20 @@ CREATE TABLE `comments` (
   `is_rm` tinyint(1) NOT NULL DEFAULT '0',
   `is_rm_by_admin` tinyint(1) NOT NULL DEFAULT '0',
   `attachment_type` tinyint(1) NOT NULL DEFAULT '0',
+  `painting_alt` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
   `pinned` tinyint(1) NOT NULL DEFAULT '0',
   `url_type` tinyint(1) NOT NULL DEFAULT '0',
+  `pending` tinyint(1) NOT NULL DEFAULT '0',
+  `nuke` int(11) DEFAULT NULL,
+  `parent` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
+  KEY `nuke` (`nuke`),
   KEY `created_by` (`created_by`),
   KEY `post` (`post`),
+  KEY `parent` (`parent`),
   CONSTRAINT `comments_ibfk_1` FOREIGN KEY (`created_by`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
-  CONSTRAINT `comments_ibfk_2` FOREIGN KEY (`post`) REFERENCES `posts` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+  CONSTRAINT `comments_ibfk_2` FOREIGN KEY (`post`) REFERENCES `posts` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `comments_ibfk_3` FOREIGN KEY (`parent`) REFERENCES `comments` (`id`) ON DELETE SET NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -140,7 +223,84 @@ CREATE TABLE `communities` (
   `is_featured` tinyint(1) NOT NULL,
   `permissions` tinyint(1) NOT NULL DEFAULT '0',
   `rm` tinyint(1) NOT NULL DEFAULT '0',
-  PRIMARY KEY (`id`)
+  `owner` int(11) DEFAULT NULL,
+  `category` int(11) NOT NULL DEFAULT '0',
+  `visibility` tinyint(1) NOT NULL DEFAULT '0',
+  `parent` int(11) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `owner` (`owner`),
+  KEY `category` (`category`),
+  KEY `parent` (`parent`),
+  CONSTRAINT `communities_ibfk_1` FOREIGN KEY (`owner`) REFERENCES `users` (`id`) ON DELETE SET NULL,
+  CONSTRAINT `communities_ibfk_2` FOREIGN KEY (`parent`) REFERENCES `communities` (`id`) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_bans`
+--
+
+DROP TABLE IF EXISTS `community_bans`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_bans` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `reason` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `until` datetime NOT NULL,
+  `ban_by` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `community` (`community`,`user`),
+  CONSTRAINT `community_bans_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_bans_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_event_rsvps`
+--
+
+DROP TABLE IF EXISTS `community_event_rsvps`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_event_rsvps` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `event` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `event` (`event`,`user`),
+  KEY `user` (`user`),
+  CONSTRAINT `community_event_rsvps_ibfk_1` FOREIGN KEY (`event`) REFERENCES `community_events` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_event_rsvps_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_events`
+--
+
+DROP TABLE IF EXISTS `community_events`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_events` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `title` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `description` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
+  `starts_at` datetime NOT NULL,
+  `ends_at` datetime NOT NULL,
+  `created_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `reminded` tinyint(1) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  KEY `community` (`community`,`starts_at`),
+  KEY `starts_at` (`starts_at`,`reminded`),
+  KEY `created_by` (`created_by`),
+  CONSTRAINT `community_events_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_events_ibfk_2` FOREIGN KEY (`created_by`) REFERENCES `users` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -155,6 +315,8 @@ CREATE TABLE `community_favorites` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `community` int(11) NOT NULL,
   `favorite_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `include_children` tinyint(1) NOT NULL DEFAULT '0',
   PRIMARY KEY (`id`),
   KEY `community_favorites_ibfk_1` (`community`),
   KEY `community_favorites_ibfk_2` (`favorite_by`),
@@ -163,6 +325,237 @@ CREATE TABLE `community_favorites` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `community_flairs`
+--
+
+DROP TABLE IF EXISTS `community_flairs`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_flairs` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `name` varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `color` varchar(7) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  KEY `community` (`community`),
+  CONSTRAINT `community_flairs_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_members`
+--
+
+DROP TABLE IF EXISTS `community_members`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_members` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `status` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `added_by` int(11) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `community` (`community`,`user`),
+  KEY `user` (`user`,`status`),
+  CONSTRAINT `community_members_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_members_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_mod_log`
+--
+
+DROP TABLE IF EXISTS `community_mod_log`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_mod_log` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `type` tinyint(1) NOT NULL,
+  `context` int(11) NOT NULL,
+  `target` int(11) DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `created_by` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `community` (`community`),
+  CONSTRAINT `community_mod_log_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_moderators`
+--
+
+DROP TABLE IF EXISTS `community_moderators`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_moderators` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `created_by` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `community` (`community`,`user`),
+  KEY `user` (`user`),
+  CONSTRAINT `community_moderators_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_moderators_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_post_stats`
+--
+
+DROP TABLE IF EXISTS `community_post_stats`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_post_stats` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `post` int(11) NOT NULL,
+  `date` date NOT NULL,
+  `yeahs` int(11) NOT NULL DEFAULT '0',
+  `comments` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `post` (`post`,`date`),
+  KEY `community` (`community`,`date`),
+  CONSTRAINT `community_post_stats_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_report_reasons`
+--
+
+DROP TABLE IF EXISTS `community_report_reasons`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_report_reasons` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `name` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `body_required` tinyint(1) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  KEY `community` (`community`),
+  CONSTRAINT `community_report_reasons_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_requests`
+--
+
+DROP TABLE IF EXISTS `community_requests`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_requests` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `title` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `description` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `icon` tinytext COLLATE utf8mb4_bin NOT NULL,
+  `banner` tinytext COLLATE utf8mb4_bin NOT NULL,
+  `created_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `status` tinyint(1) NOT NULL DEFAULT '0',
+  `reviewed_by` int(11) DEFAULT NULL,
+  `reviewed_at` datetime DEFAULT NULL,
+  `reason` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `category` int(11) NOT NULL DEFAULT '0',
+  `community` int(11) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `status` (`status`),
+  KEY `created_by` (`created_by`),
+  CONSTRAINT `community_requests_ibfk_1` FOREIGN KEY (`created_by`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_requests_ibfk_2` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_rule_agreements`
+--
+
+DROP TABLE IF EXISTS `community_rule_agreements`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_rule_agreements` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `community` (`community`,`user`),
+  KEY `user` (`user`),
+  CONSTRAINT `community_rule_agreements_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `community_rule_agreements_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_rules`
+--
+
+DROP TABLE IF EXISTS `community_rules`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_rules` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `position` int(11) NOT NULL DEFAULT '0',
+  `title` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `body` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  KEY `community` (`community`,`position`),
+  CONSTRAINT `community_rules_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_stats`
+--
+
+DROP TABLE IF EXISTS `community_stats`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_stats` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `date` date NOT NULL,
+  `posts` int(11) NOT NULL DEFAULT '0',
+  `comments` int(11) NOT NULL DEFAULT '0',
+  `yeahs` int(11) NOT NULL DEFAULT '0',
+  `active_posters` int(11) NOT NULL DEFAULT '0',
+  `favorites` int(11) NOT NULL DEFAULT '0',
+  `reports` int(11) NOT NULL DEFAULT '0',
+  `deletions` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `community` (`community`,`date`),
+  CONSTRAINT `community_stats_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `community_tags`
+--
+
+DROP TABLE IF EXISTS `community_tags`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `community_tags` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `community` int(11) NOT NULL,
+  `tag` varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `community` (`community`,`tag`),
+  KEY `tag` (`tag`),
+  CONSTRAINT `community_tags_ibfk_1` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `conversations`
 --
@@ -182,6 +575,47 @@ CREATE TABLE `conversations` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `drafts`
+--
+
+DROP TABLE IF EXISTS `drafts`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `drafts` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `created_by` int(11) NOT NULL,
+  `community` int(11) NOT NULL,
+  `post_type` tinyint(1) NOT NULL DEFAULT '0',
+  `body` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
+  `painting` int(11) DEFAULT NULL,
+  `painting_alt` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
+  `image` int(11) DEFAULT NULL,
+  `attachment_type` tinyint(1) NOT NULL DEFAULT '0',
+  `is_spoiler` tinyint(1) NOT NULL DEFAULT '0',
+  `feeling` tinyint(1) NOT NULL DEFAULT '0',
+  `privacy` tinyint(1) NOT NULL DEFAULT '0',
+  `flair` int(11) DEFAULT NULL,
+  `poll_options` text CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci,
+  `attachments` text CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci,
+  `poll_multiple_choice` tinyint(1) NOT NULL DEFAULT '0',
+  `poll_results` tinyint(1) NOT NULL DEFAULT '0',
+  `poll_closes` smallint(6) NOT NULL DEFAULT '0',
+  `publish_at` datetime DEFAULT NULL,
+  `error` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `created_by` (`created_by`),
+  KEY `community` (`community`),
+  KEY `flair` (`flair`),
+  KEY `publish_at` (`publish_at`),
+  CONSTRAINT `drafts_ibfk_1` FOREIGN KEY (`created_by`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `drafts_ibfk_2` FOREIGN KEY (`community`) REFERENCES `communities` (`id`) ON DELETE CASCADE,
+  CONSTRAINT `drafts_ibfk_3` FOREIGN KEY (`flair`) REFERENCES `community_flairs` (`id`) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `emotes`
 --
@@ -288,6 +722,9 @@ CREATE TABLE `images` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `value` varchar(1024) COLLATE utf8mb4_bin NOT NULL,
   `hash` char(32) COLLATE utf8mb4_bin NOT NULL,
+  `format` varchar(4) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `duration` int(11) NOT NULL DEFAULT 0,
+  `poster` varchar(1024) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -312,6 +749,44 @@ CREATE TABLE `imports` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `ip_bans`
+--
+
+DROP TABLE IF EXISTS `ip_bans`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `ip_bans` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `asn` int(10) unsigned NOT NULL,
+  `reason` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `until` datetime NOT NULL,
+  `ban_by` int(11) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `asn` (`asn`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `login_devices`
+--
+
+DROP TABLE IF EXISTS `login_devices`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `login_devices` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` int(11) NOT NULL,
+  `device` varchar(32) COLLATE utf8mb4_bin NOT NULL,
+  `last_login` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user` (`user`,`device`),
+  KEY `device` (`device`),
+  CONSTRAINT `login_devices_ibfk_1` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `login_tokens`
 --
@@ -345,12 +820,16 @@ CREATE TABLE `messages` (
   `body` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
   `image` tinytext NOT NULL,
   `attachment_type` tinyint(1) NOT NULL DEFAULT '0',
+  `painting_alt` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
   `url` varchar(1024) NOT NULL,
   `url_type` tinyint(1) NOT NULL DEFAULT '0',
   `post_type` tinyint(1) NOT NULL DEFAULT '0',
   `is_rm` tinyint(1) NOT NULL DEFAULT '0',
+  `is_rm_by_admin` tinyint(1) NOT NULL DEFAULT '0',
   `msg_read` tinyint(1) NOT NULL DEFAULT '0',
+  `nuke` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
+  KEY `nuke` (`nuke`),
   KEY `created_by` (`created_by`),
   KEY `messages_ibfk_2` (`conversation_id`),
   CONSTRAINT `messages_ibfk_1` FOREIGN KEY (`created_by`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
@@ -393,6 +872,25 @@ CREATE TABLE `migrations` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `mod_notes`
+--
+
+DROP TABLE IF EXISTS `mod_notes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `mod_notes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` int(11) NOT NULL,
+  `body` varchar(2000) COLLATE utf8mb4_bin NOT NULL,
+  `created_by` int(11) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `user` (`user`),
+  CONSTRAINT `mod_notes_ibfk_1` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `notifications`
 --
@@ -416,6 +914,78 @@ CREATE TABLE `notifications` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `nuked_reports`
+--
+
+DROP TABLE IF EXISTS `nuked_reports`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `nuked_reports` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `nuke` int(11) NOT NULL,
+  `report_id` int(11) NOT NULL,
+  `type` tinyint(1) NOT NULL,
+  `pid` int(11) NOT NULL,
+  `message` varchar(100) COLLATE utf8mb4_bin NOT NULL,
+  `user` int(11) DEFAULT NULL,
+  `reason` int(11) NOT NULL,
+  `is_rm` tinyint(1) NOT NULL DEFAULT '0',
+  `community_reason` int(11) DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `nuke` (`nuke`),
+  CONSTRAINT `nuked_reports_ibfk_1` FOREIGN KEY (`nuke`) REFERENCES `nukes` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nuked_yeahs`
+--
+
+DROP TABLE IF EXISTS `nuked_yeahs`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `nuked_yeahs` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `nuke` int(11) NOT NULL,
+  `yeah_id` int(11) NOT NULL,
+  `yeah_post` int(11) NOT NULL,
+  `yeah_by` int(11) NOT NULL,
+  `on_comment` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `nuke` (`nuke`),
+  CONSTRAINT `nuked_yeahs_ibfk_1` FOREIGN KEY (`nuke`) REFERENCES `nukes` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `nukes`
+--
+
+DROP TABLE IF EXISTS `nukes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `nukes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` int(11) DEFAULT NULL,
+  `ip` varchar(49) COLLATE utf8mb4_bin DEFAULT NULL,
+  `range_start` varbinary(16) DEFAULT NULL,
+  `range_end` varbinary(16) DEFAULT NULL,
+  `since` datetime NOT NULL,
+  `until` datetime NOT NULL,
+  `post_count` int(11) NOT NULL DEFAULT '0',
+  `comment_count` int(11) NOT NULL DEFAULT '0',
+  `message_count` int(11) NOT NULL DEFAULT '0',
+  `yeah_count` int(11) NOT NULL DEFAULT '0',
+  `undone` tinyint(1) NOT NULL DEFAULT '0',
+  `created_by` int(11) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `options`
 --
@@ -450,6 +1020,39 @@ CREATE TABLE `password_resets` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `polls`
+--
+
+DROP TABLE IF EXISTS `polls`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `polls` (
+  `post` int(11) NOT NULL,
+  `multiple_choice` tinyint(1) NOT NULL DEFAULT '0',
+  `closes_at` datetime DEFAULT NULL,
+  `results_visibility` tinyint(1) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`post`),
+  CONSTRAINT `polls_ibfk_1` FOREIGN KEY (`post`) REFERENCES `posts` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `post_tags`
+--
+
+DROP TABLE IF EXISTS `post_tags`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `post_tags` (
+  `post` int(11) NOT NULL,
+  `tag` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  PRIMARY KEY (`post`,`tag`),
+  KEY `tag` (`tag`),
+  CONSTRAINT `post_tags_ibfk_1` FOREIGN KEY (`post`) REFERENCES `posts` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `posts`
 --
@@ -467,6 +1070,7 @@ CREATE TABLE `posts` (
   `body` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
   `image` tinytext COLLATE utf8mb4_bin,
   `attachment_type` tinyint(1) NOT NULL DEFAULT '0',
+  `painting_alt` varchar(1000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL DEFAULT '',
   `url` varchar(1024) COLLATE utf8mb4_bin NOT NULL,
   `is_spoiler` tinyint(1) NOT NULL DEFAULT '0',
   `is_rm` tinyint(1) NOT NULL DEFAULT '0',
@@ -480,11 +1084,17 @@ CREATE TABLE `posts` (
   `privacy` tinyint(1) NOT NULL DEFAULT '0',
   `url_type` tinyint(1) NOT NULL DEFAULT '0',
   `repost` int(11) NOT NULL DEFAULT '0',
+  `pending` tinyint(1) NOT NULL DEFAULT '0',
+  `nuke` int(11) DEFAULT NULL,
+  `flair` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
+  KEY `nuke` (`nuke`),
   KEY `created_by` (`created_by`),
   KEY `community_id` (`community_id`),
+  KEY `flair` (`flair`),
   CONSTRAINT `posts_ibfk_1` FOREIGN KEY (`created_by`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
-  CONSTRAINT `posts_ibfk_2` FOREIGN KEY (`community_id`) REFERENCES `communities` (`id`)
+  CONSTRAINT `posts_ibfk_2` FOREIGN KEY (`community_id`) REFERENCES `communities` (`id`),
+  CONSTRAINT `posts_ibfk_3` FOREIGN KEY (`flair`) REFERENCES `community_flairs` (`id`) ON DELETE SET NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -533,12 +1143,35 @@ CREATE TABLE `reports` (
   `type` tinyint(1) NOT NULL,
   `pid` int(11) NOT NULL,
   `message` varchar(100) COLLATE utf8mb4_bin NOT NULL,
-  `user` int(11) NOT NULL,
+  `user` int(11) DEFAULT NULL,
   `reason` int(11) NOT NULL,
   `is_rm` tinyint(1) NOT NULL DEFAULT '0',
+  `community_reason` int(11) DEFAULT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
   KEY `reports_ibfk_1` (`user`),
-  CONSTRAINT `reports_ibfk_1` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+  KEY `community_reason` (`community_reason`),
+  CONSTRAINT `reports_ibfk_1` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `reports_ibfk_2` FOREIGN KEY (`community_reason`) REFERENCES `community_report_reasons` (`id`) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `revisions`
+--
+
+DROP TABLE IF EXISTS `revisions`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `revisions` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `post` int(11) NOT NULL,
+  `on_comment` tinyint(1) NOT NULL DEFAULT '0',
+  `body` varchar(2000) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `created_at` datetime NOT NULL,
+  `replaced_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `post` (`post`,`on_comment`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -601,7 +1234,11 @@ CREATE TABLE `users` (
   `websockets_enabled` tinyint(1) NOT NULL DEFAULT '1',
   `forbidden_keywords` longtext COLLATE utf8mb4_bin NOT NULL,
   `default_privacy` tinyint(1) NOT NULL DEFAULT '0',
-  PRIMARY KEY (`id`)
+  `mention_privacy` tinyint(1) NOT NULL DEFAULT '0',
+  `limited` tinyint(1) NOT NULL DEFAULT '0',
+  `calendar_token` varchar(32) COLLATE utf8mb4_bin DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `calendar_token` (`calendar_token`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -618,6 +1255,7 @@ CREATE TABLE `votes` (
   `user` int(11) NOT NULL,
   `poll` int(11) NOT NULL,
   PRIMARY KEY (`id`),
+  UNIQUE KEY `option_id` (`option_id`,`user`),
   KEY `votes_ibfk_1` (`poll`),
   KEY `votes_ibfk_2` (`user`),
   CONSTRAINT `votes_ibfk_2` FOREIGN KEY (`user`) REFERENCES `users` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
@@ -636,6 +1274,7 @@ CREATE TABLE `yeahs` (
   `yeah_post` int(11) NOT NULL,
   `yeah_by` int(11) NOT NULL,
   `on_comment` tinyint(1) NOT NULL DEFAULT '0',
+  `created_at` datetime DEFAULT NULL,
   PRIMARY KEY (`id`),
   UNIQUE KEY `yeah_post` (`yeah_post`,`yeah_by`,`on_comment`),
   KEY `yeah_by` (`yeah_by`),
@@ -5,6 +5,7 @@ package main
 import (
 	"database/sql"
 	"html/template"
+	"regexp"
 	"sync"
 	"time"
 )
@@ -30,12 +31,93 @@ type auditLogEntry struct {
 	CreatorAvatar    string
 	CreatorFinalAva  string
 	Context          int
+	TargetUsername   string
 	TargetUserAvatar string
 	PostSummary      string
+	Before           string
+	After            string
+	IP               string
 	CreatedAt        string
+	CreatedAtTime    time.Time
 	CreatedBy        int
 }
 
+// Variable declarations for exported audit log entries.
+type auditLogExport struct {
+	ID        int         `json:"id"`
+	Type      int         `json:"type"`
+	Action    string      `json:"action"`
+	Actor     string      `json:"actor"`
+	Target    string      `json:"target"`
+	Context   int         `json:"context"`
+	Before    interface{} `json:"before"`
+	After     interface{} `json:"after"`
+	IP        string      `json:"ip"`
+	CreatedAt string      `json:"created_at"`
+}
+
+// Variable declarations for alt accounts.
+type altAccount struct {
+	Username string
+	Nickname string
+	Avatar   string
+	Reasons  []string
+}
+
+// Variable declarations for the images attached to posts, comments and messages.
+type attachment struct {
+	ImageID   int
+	URL       string
+	Position  int
+	IsSpoiler bool
+	Alt       string
+	// clips are mp4, webm or gif, and last for this many milliseconds
+	Format   string
+	Duration int
+	Poster   string
+}
+
+// Variable declarations for automod results.
+type automodResult struct {
+	Block   bool
+	Hold    bool
+	Report  bool
+	Spoiler bool
+	Limit   bool
+	Rules   []string
+}
+
+// Variable declarations for automod rules.
+type automodRule struct {
+	ID            int
+	Name          string
+	ConditionType int
+	Value         string
+	Action        int
+	DryRun        bool
+	Enabled       bool
+	Hits          int
+	DryRunHits    int
+	RecentHits    int
+	LastHit       string
+}
+
+// Variable declarations for bans.
+type ban struct {
+	ID             int
+	Username       string
+	Nickname       string
+	IP             string
+	ASN            int
+	Reason         string
+	CreatedAt      string
+	Until          string
+	UntilForever   bool
+	Active         bool
+	IssuerUsername string
+	IssuerNickname string
+}
+
 // Variable declarations for comments.
 type comment struct {
 	ID                        int
@@ -50,11 +132,14 @@ type comment struct {
 	Body                      template.HTML
 	Image                     string
 	AttachmentType            int
+	Attachments               []attachment
+	PaintingAlt               string
 	URL                       string
 	URLType                   int
 	Pinned                    bool
 	IsSpoiler                 bool
 	IsRMByAdmin               bool
+	Pending                   bool
 	PostType                  int
 	CommenterUsername         string
 	CommenterNickname         string
@@ -70,6 +155,9 @@ type comment struct {
 	ByMe                      bool
 	ByMii                     bool
 	CanYeah                   bool
+	ParentID                  int
+	ParentNickname            string
+	Replies                   []comment
 }
 
 // Variable declarations for communities.
@@ -83,6 +171,88 @@ type community struct {
 	IsFeatured      bool
 	Permissions     int
 	RM              bool
+	Category        int
+	CategoryName    string
+	Tags            []string
+	FavoriteCount   int
+	RecentPostCount int
+	Visibility      int
+	MemberCount     int
+	Parent          int
+	ParentTitle     string
+}
+
+// Variable declarations for community events.
+type communityEvent struct {
+	ID                int
+	Community         int
+	CommunityTitle    string
+	CommunityIcon     string
+	Title             string
+	Description       template.HTML
+	DescriptionText   string
+	StartsAt          string
+	StartsAtTime      time.Time
+	EndsAt            string
+	EndsAtTime        time.Time
+	Day               string
+	Live              bool
+	Ended             bool
+	CreatedByUsername string
+	CreatedByNickname string
+	RSVPCount         int
+	RSVPGiven         bool
+}
+
+// Variable declarations for community post flairs.
+type communityFlair struct {
+	ID    int
+	Name  string
+	Color string
+}
+
+// Variable declarations for community report reasons.
+type communityReportReason struct {
+	ID           int
+	Name         string
+	BodyRequired bool
+}
+
+// Variable declarations for community requests.
+type communityRequest struct {
+	ID           int
+	Title        string
+	Description  string
+	Icon         string
+	Banner       string
+	CreatedAt    string
+	Status       int
+	Reason       string
+	Category     int
+	CategoryName string
+	Username     string
+	Nickname     string
+	CommunityID  int
+}
+
+// Variable declarations for community rules.
+type communityRule struct {
+	ID       int
+	Position int
+	Title    string
+	Body     string
+}
+
+// Variable declarations for a community's stats on a single day.
+type communityStats struct {
+	Date          string
+	Posts         int
+	Comments      int
+	Yeahs         int
+	ActivePosters int
+	Favorites     int
+	Reports       int
+	Deletions     int
 }
 
 // Variable declarations for settings.
@@ -145,11 +315,38 @@ type config struct {
 	AllowSignups      bool
 	DefaultTimezone   string
 	ReportReasons     []reportReason
-	TextToReplace     []struct {
+	// the categories communities can be sorted into, the first one is the default
+	CommunityCategories []string
+	TextToReplace       []struct {
 		Original string
 		Replaced string
 	}
 	EmoteLimit int
+	// the most options a poll can have, up to 26
+	MaxPollOptions int
+	// the most images a post, comment or message can have, up to 10
+	MaxImages int
+	// image posts and drawings in these communities need alt text
+	AltTextCommunities []int
+	// audit log entries older than this many days are deleted, 0 keeps them forever
+	AuditLogRetention int
+	HoldingQueue      struct {
+		Enabled bool
+		// posts and comments from accounts younger than this many days are held for review
+		AccountAge int
+		// as are those from accounts with fewer approved posts and comments than this
+		MinimumTrust int
+	}
+	// keys of the link embed providers that are turned off
+	DisabledEmbeds []string
+	Clips          struct {
+		// clips bigger than this many megabytes are turned away
+		MaxSize int
+		// as are those longer than this many seconds
+		MaxDuration int
+		// used to take posters from videos, gifs don't need it
+		FFmpegPath string
+	}
 }
 
 // Variable declarations for conversations.
@@ -174,6 +371,56 @@ type conversation struct {
 	Read       bool
 }
 
+// Variable declarations for the parts of a diff between two revisions.
+type diffPart struct {
+	Text    string
+	Added   bool
+	Removed bool
+}
+
+// Variable declarations for drafts and scheduled posts.
+type draft struct {
+	ID             int
+	CommunityID    int
+	CommunityTitle string
+	CommunityIcon  string
+	PostType       int
+	Body           string
+	Painting       string
+	Image          string
+	AttachmentType int
+	Attachments    []attachment
+	PaintingAlt    string
+	IsSpoiler      bool
+	PollOptions    []string
+	Scheduled      bool
+	PublishAt      string
+	PublishAtInput string
+	Error          string
+	UpdatedAt      string
+	UpdatedAtUnix  int64
+}
+
+// Variable declarations for link embed providers.
+type embedProvider struct {
+	// saved as the url_type of posts, comments and messages, so it can't change once used
+	Type int
+	// how admins turn it off in the settings
+	Key  string
+	Name string
+	// the first match in a body is what gets embedded
+	Pattern *regexp.Regexp
+	// turns a match into what's saved as the url, or nothing if it can't be embedded
+	ID func(match []string) string
+	// turns what was saved back into a link
+	Link func(id string) string
+	// looks up what the template needs from what was saved, for providers whose links don't have it
+	// it's run in the background and cached, and the embed is a plain link until it's done
+	Resolve func(id string) string
+	// the template it's shown with, which is given the ID and link
+	Template string
+}
+
 // Variable declarations for friend requests.
 type friendRequest struct {
 	ID                 int
@@ -211,6 +458,8 @@ type message struct {
 	Body           template.HTML
 	Image          string
 	AttachmentType int
+	Attachments    []attachment
+	PaintingAlt    string
 	URL            string
 	URLType        int
 	PostType       int
@@ -258,6 +507,16 @@ type migrationOption struct {
 	PasswordRequired bool
 }
 
+// Variable declarations for moderator notes.
+type modNote struct {
+	ID         int
+	Body       string
+	CreatedAt  string
+	ByUsername string
+	ByNickname string
+	ByMe       bool
+}
+
 // Variable declarations for notifications.
 type notification struct {
 	ID             int
@@ -292,6 +551,24 @@ type notificationCount struct {
 	Notifications int
 }
 
+// Variable declarations for nukes.
+type nuke struct {
+	ID             int
+	Username       string
+	Nickname       string
+	IP             string
+	Since          string
+	Until          string
+	PostCount      int
+	CommentCount   int
+	MessageCount   int
+	YeahCount      int
+	Undone         bool
+	CreatedAt      string
+	IssuerUsername string
+	IssuerNickname string
+}
+
 // Variable declarations for poll options.
 type option struct {
 	ID         int
@@ -303,10 +580,15 @@ type option struct {
 
 // Variable declarations for polls.
 type poll struct {
-	ID       int
-	Votes    float64
-	Options  []option
-	Selected bool
+	ID                int
+	Votes             float64
+	Options           []option
+	Selected          bool
+	MultipleChoice    bool
+	ClosesAt          string
+	Closed            bool
+	ResultsVisibility int
+	ResultsHidden     bool
 }
 
 // Variable declarations for posts.
@@ -325,6 +607,8 @@ type post struct {
 	BodyText               string
 	Image                  string
 	AttachmentType         int
+	Attachments            []attachment
+	PaintingAlt            string
 	URL                    string
 	URLType                int
 	Pinned                 bool
@@ -332,6 +616,7 @@ type post struct {
 	IsSpoiler              bool
 	IsRM                   bool
 	IsRMByAdmin            bool
+	Pending                bool
 	ByMe                   bool
 	Poll                   poll
 	HasPoll                bool
@@ -357,6 +642,9 @@ type post struct {
 	CommunityName          string
 	CommunityIcon          string
 	CommunityRM            bool
+	FlairID                int
+	FlairName              string
+	FlairColor             string
 	Yeahed                 bool
 	CanYeah                bool
 	YeahCount              int
@@ -410,6 +698,7 @@ type profileSidebar struct {
 	FriendStatus        int
 	Request             friendRequest
 	RequestTime         string
+	CanViewDossier      bool
 }
 
 // Variable declarations for reports.
@@ -418,12 +707,14 @@ type report struct {
 	Type       int
 	Message    string
 	Reason     int
+	ReasonName string
 	ByID       int
 	ByUsername string
 	ByNickname string
 	ByColor    string
 	Post       *post
 	User       *user
+	Revisions  int
 }
 
 // Variable declarations for report reasons.
@@ -436,10 +727,41 @@ type reportReason struct {
 
 // Variable declarations for repost previews.
 type repostPreview struct {
-	ID       int
-	Nickname string
-	Text     string
-	PostType int
+	ID          int
+	Nickname    string
+	Text        string
+	PostType    int
+	PaintingAlt string
+}
+
+// Variable declarations for revisions of posts and comments.
+type revision struct {
+	ID            int
+	Body          string
+	CreatedAt     string
+	CreatedAtUnix int64
+	Current       bool
+	Diff          []diffPart
+}
+
+// Variable declarations for the bars of a stat chart.
+type statBar struct {
+	Date   string
+	Value  int
+	Height int
+}
+
+// Variable declarations for stat charts.
+type statChart struct {
+	Name  string
+	Total int
+	Bars  []statBar
+}
+
+// Variable declarations for trending tags.
+type trendingTag struct {
+	Tag   string
+	Posts int
 }
 
 // Variable declarations for users.
@@ -470,6 +792,8 @@ type user struct {
 	LightMode         bool
 	WebsocketsEnabled bool
 	DefaultPrivacy    int
+	MentionPrivacy    int
+	Limited           bool
 	Blocked           bool
 	Timezone          string
 	Notifications     notificationCount
@@ -505,5 +829,18 @@ type yeah struct {
 
 type iphubBlockResponse struct {
 	Block int8   `json:"block"`
-	ASN   uint16 `json:"asn""`
+	ASN   uint32 `json:"asn"`
+}
+
+// Variable declarations for cached IPHub lookups.
+type iphubCacheEntry struct {
+	Response iphubBlockResponse
+	Err      error
+	Expires  time.Time
+}
+
+// Variable declarations for cached embed lookups.
+type resolvedEmbed struct {
+	ID      string
+	Expires time.Time
 }
@@ -3,16 +3,33 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"image/gif"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"math"
+	"math/bits"
 	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -41,16 +58,27 @@ func doSession(w http.ResponseWriter, r *http.Request) (user, bool) {
 	currentUser.Timezone = timezone.Value
 
 	host, _, _ := net.SplitHostPort(ip)
-	cidr := getCIDR(host, "1")
-	cidr2 := getCIDR(host, "2")
+	hostBytes := getIPBytes(host)
 	var banLength time.Time
-	db.QueryRow("SELECT until FROM bans WHERE (cidr = 0 AND ip = ?) OR (cidr = 1 AND ip = ?) OR (cidr = 2 AND ip = ?)", host, cidr, cidr2).Scan(&banLength)
+	db.QueryRow("SELECT until FROM bans WHERE LENGTH(range_start) = ? AND ? BETWEEN range_start AND range_end AND until > NOW() ORDER BY until DESC LIMIT 1", len(hostBytes), hostBytes).Scan(&banLength)
 	if int64(banLength.Unix()) != -62135596800 {
 		success := showBan(w, currentUser, banLength)
 		if success {
 			return currentUser, false
 		}
 	}
+	if len(settings.IPHubKey) > 0 {
+		ipInfo, err := getIPHubInfo(host)
+		if err == nil {
+			db.QueryRow("SELECT until FROM ip_bans WHERE asn = ? AND until > NOW() ORDER BY until DESC LIMIT 1", ipInfo.ASN).Scan(&banLength)
+			if int64(banLength.Unix()) != -62135596800 {
+				success := showBan(w, currentUser, banLength)
+				if success {
+					return currentUser, false
+				}
+			}
+		}
+	}
 	if len(session.GetString("username")) != 0 {
 		currentUser = QueryUser(session.GetString("username"), currentUser.Timezone)
 		if len(currentUser.Theme) > 0 {
@@ -58,7 +86,7 @@ func doSession(w http.ResponseWriter, r *http.Request) (user, bool) {
 		}
 		currentUser.Avatar = getAvatar(currentUser.Avatar, currentUser.HasMii, 0)
 
-		db.QueryRow("SELECT until FROM bans WHERE user = ?", currentUser.ID).Scan(&banLength)
+		db.QueryRow("SELECT until FROM bans WHERE user = ? AND until > NOW() ORDER BY until DESC LIMIT 1", currentUser.ID).Scan(&banLength)
 		if int64(banLength.Unix()) != -62135596800 {
 			success := showBan(w, currentUser, banLength)
 			if success {
@@ -87,7 +115,7 @@ func doSession(w http.ResponseWriter, r *http.Request) (user, bool) {
 				stmt.Exec(session.ID(), currentUser.ID)
 				stmt.Close()
 
-				db.QueryRow("SELECT until FROM bans WHERE user = ?", currentUser.ID).Scan(&banLength)
+				db.QueryRow("SELECT until FROM bans WHERE user = ? AND until > NOW() ORDER BY until DESC LIMIT 1", currentUser.ID).Scan(&banLength)
 				if int64(banLength.Unix()) != -62135596800 {
 					success := showBan(w, currentUser, banLength)
 					if success {
@@ -95,14 +123,14 @@ func doSession(w http.ResponseWriter, r *http.Request) (user, bool) {
 					}
 				}
 			} else {
-				if settings.ForceLogins && r.URL.Path != "/reset" {
+				if settings.ForceLogins && r.URL.Path != "/reset" && r.URL.Path != "/upload" {
 					http.Redirect(w, r, "/login", 301)
 					return currentUser, false
 				}
 				return currentUser, true
 			}
 		} else {
-			if settings.ForceLogins && r.URL.Path != "/reset" {
+			if settings.ForceLogins && r.URL.Path != "/reset" && r.URL.Path != "/upload" {
 				http.Redirect(w, r, "/login", 301)
 				return currentUser, false
 			}
@@ -115,7 +143,7 @@ func doSession(w http.ResponseWriter, r *http.Request) (user, bool) {
 
 	if r.Header.Get("X-PJAX") == "" {
 		var friendRequests int
-		db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND conversations.is_rm = 0", currentUser.ID, currentUser.ID, currentUser.ID).Scan(&currentUser.Notifications.Messages)
+		db.QueryRow("SELECT COUNT(*) FROM messages LEFT JOIN conversations ON conversation_id = conversations.id WHERE (source = ? OR target = ?) AND created_by <> ? AND msg_read = 0 AND messages.is_rm = 0 AND messages.is_rm_by_admin = 0 AND conversations.is_rm = 0", currentUser.ID, currentUser.ID, currentUser.ID).Scan(&currentUser.Notifications.Messages)
 		var groupUnread int
 		db.QueryRow("SELECT SUM(unread_messages) FROM group_members WHERE user = ?", currentUser.ID).Scan(&groupUnread)
 		currentUser.Notifications.Messages += groupUnread
@@ -151,26 +179,199 @@ func escapeMarkdown(text string) string {
 	return text
 }
 
-// Get a CIDR-esque range from an IP.
-func getCIDR(ip string, cidr string) string {
-	netmasks := strings.Split(ip, ".")
+// Parse an IP address or CIDR range into a prefix. Bare addresses are widened to the given prefix length, or left as a single address if it's 0.
+func parseIPRange(ip string, bits int) (netip.Prefix, error) {
+	if strings.Contains(ip, "/") {
+		prefix, err := netip.ParsePrefix(ip)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap().WithZone("")
+	if bits <= 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	return addr.Prefix(bits)
+}
+
+// The broadest ranges that can be banned or nuked, so a typo can't lock everyone out.
+const minIPv4RangeBits = 16
+const minIPv6RangeBits = 32
+
+// Check that a range is narrow enough to ban or nuke.
+func checkIPRangeSize(prefix netip.Prefix) error {
+	minBits := minIPv4RangeBits
+	if prefix.Addr().Is6() {
+		minBits = minIPv6RangeBits
+	}
+	if prefix.Bits() < minBits {
+		return fmt.Errorf("That range is too broad. (/%d at most)", minBits)
+	}
+	return nil
+}
+
+// Get the first and last addresses of an IP range as bytes, which is how they're compared in the database.
+func getIPRangeBounds(prefix netip.Prefix) ([]byte, []byte) {
+	if !prefix.IsValid() {
+		return nil, nil
+	}
+	start := prefix.Masked().Addr().AsSlice()
+	end := make([]byte, len(start))
+	copy(end, start)
+	for i := prefix.Bits(); i < len(end)*8; i++ {
+		end[i/8] |= 1 << (7 - i%8)
+	}
+	return start, end
+}
+
+// Get the bytes of an IP address for comparing against ban ranges.
+func getIPBytes(ip string) []byte {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	return addr.Unmap().AsSlice()
+}
+
+// Fill in the ranges of bans made when only the IP and a CIDR flag were stored.
+// A flag of 1 banned the /24 the IP was in, and 2 banned the /16.
+func migrateLegacyBans() error {
+	ban_rows, err := db.Query("SELECT id, ip, cidr FROM bans WHERE range_start IS NULL AND ip != ''")
+	if err != nil {
+		return err
+	}
+	type legacyBan struct {
+		ID   int
+		IP   string
+		CIDR int
+	}
+	var bans []legacyBan
+	for ban_rows.Next() {
+		var row legacyBan
+		err = ban_rows.Scan(&row.ID, &row.IP, &row.CIDR)
+		if err != nil {
+			ban_rows.Close()
+			return err
+		}
+		bans = append(bans, row)
+	}
+	ban_rows.Close()
+
+	for _, ban := range bans {
+		bits := 0
+		switch ban.CIDR {
+		case 1:
+			bits = 24
+		case 2:
+			bits = 16
+		}
+		prefix, err := parseIPRange(ban.IP, bits)
+		if err != nil {
+			continue
+		}
+		rangeStart, rangeEnd := getIPRangeBounds(prefix)
+		_, err = db.Exec("UPDATE bans SET ip = ?, cidr = 0, range_start = ?, range_end = ? WHERE id = ?", prefix.String(), rangeStart, rangeEnd, ban.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Look up an IP address on IPHub, keeping the result for a day so pages don't each make a request.
+// Failed lookups are kept for a few minutes too, so pages don't all wait on IPHub while it's down.
+func getIPHubInfo(ip string) (iphubBlockResponse, error) {
+	iphubCacheLock.RLock()
+	cached, ok := iphubCache[ip]
+	iphubCacheLock.RUnlock()
+	if ok && time.Now().Before(cached.Expires) {
+		return cached.Response, cached.Err
+	}
+
+	ipInfo, err := lookupIPHub(ip)
+	entry := iphubCacheEntry{Response: ipInfo, Err: err, Expires: time.Now().Add(24 * time.Hour)}
+	if err != nil {
+		entry.Expires = time.Now().Add(5 * time.Minute)
+	}
 
-	// Check if the IP address has exactly 4 parts
-	if len(netmasks) != 4 {
-		log.Println("Invalid IP address format:", ip)
-		return "" // Handle the error accordingly
+	iphubCacheLock.Lock()
+	// expired entries are cleared out once an hour rather than on every lookup
+	if time.Since(iphubCacheSwept) > time.Hour {
+		for key, entry := range iphubCache {
+			if time.Now().After(entry.Expires) {
+				delete(iphubCache, key)
+			}
+		}
+		iphubCacheSwept = time.Now()
 	}
+	iphubCache[ip] = entry
+	iphubCacheLock.Unlock()
+	return ipInfo, err
+}
 
-	// Set the last octet to 0
-	netmasks[3] = "0"
-	if cidr == "2" {
-		// Set the third octet to 0 for /2 CIDR
-		netmasks[2] = "0"
+// Make the actual request to IPHub for getIPHubInfo.
+func lookupIPHub(ip string) (iphubBlockResponse, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", "https://v2.api.iphub.info/ip/"+ip, nil)
+	if err != nil {
+		return iphubBlockResponse{}, err
+	}
+	req.Header.Set("X-Key", settings.IPHubKey)
+	res, err := client.Do(req)
+	if err != nil {
+		return iphubBlockResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return iphubBlockResponse{}, errors.New("IPHub returned " + res.Status)
 	}
+	var ipInfo iphubBlockResponse
+	err = json.NewDecoder(res.Body).Decode(&ipInfo)
+	if err != nil {
+		return iphubBlockResponse{}, err
+	}
+	return ipInfo, nil
+}
+
+// Check if an ASN has an active ban.
+func checkIfASNBanned(asn uint32) bool {
+	var bannedASN uint32
+	db.QueryRow("SELECT asn FROM ip_bans WHERE asn = ? AND until > NOW() LIMIT 1", asn).Scan(&bannedASN)
+	return bannedASN != 0
+}
 
-	return strings.Join(netmasks, ".")
+// Check if an IP address is in a banned range or belongs to a banned ASN.
+// This is for when there's no request to go through doSession, like scheduled posts.
+func checkIfIPBanned(ip string) bool {
+	ipBytes := getIPBytes(ip)
+	if ipBytes == nil {
+		return false
+	}
+	var banCount int
+	db.QueryRow("SELECT COUNT(*) FROM bans WHERE LENGTH(range_start) = ? AND ? BETWEEN range_start AND range_end AND until > NOW()", len(ipBytes), ipBytes).Scan(&banCount)
+	if banCount > 0 {
+		return true
+	}
+	if len(settings.IPHubKey) > 0 {
+		ipInfo, err := getIPHubInfo(ip)
+		if err == nil && checkIfASNBanned(ipInfo.ASN) {
+			return true
+		}
+	}
+	return false
 }
 
+// Get a subquery for the users a nuke applies to, either a single user or everyone whose last IP is in a range.
+// The moderator and anyone at or above their level are always left out.
+func getNukeTargets(userID int, prefix netip.Prefix, currentUser user) (string, []interface{}) {
+	if userID > 0 {
+		return "SELECT id FROM users WHERE id = ? AND level < ? AND id != ?", []interface{}{userID, currentUser.Level, currentUser.ID}
+	}
+	rangeStart, rangeEnd := getIPRangeBounds(prefix)
+	return "SELECT id FROM users WHERE LENGTH(INET6_ATON(ip)) = ? AND INET6_ATON(ip) BETWEEN ? AND ? AND level < ? AND id != ?", []interface{}{len(rangeStart), rangeStart, rangeEnd, currentUser.Level, currentUser.ID}
+}
 
 // Get the user's light mode status.
 func getLightMode(w http.ResponseWriter, r *http.Request) bool {
@@ -252,12 +453,88 @@ func humanTiming(timestamp time.Time, timezone string) string {
 	*/
 }
 
+// Format the time of a community event in the user's timezone.
+// Unlike humanTiming, this works for times in the future.
+func eventTiming(timestamp time.Time, timezone string) string {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	timestamp = timestamp.In(location)
+	now := time.Now().In(location)
+	if now.YearDay() == timestamp.YearDay() && now.Year() == timestamp.Year() {
+		return timestamp.Format("Today at 3:04 PM MST")
+	}
+	tomorrow := now.AddDate(0, 0, 1)
+	if tomorrow.YearDay() == timestamp.YearDay() && tomorrow.Year() == timestamp.Year() {
+		return timestamp.Format("Tomorrow at 3:04 PM MST")
+	}
+	if now.Year() == timestamp.Year() {
+		return timestamp.Format("Mon, Jan 2 at 3:04 PM MST")
+	}
+	return timestamp.Format("Mon, Jan 2, 2006 at 3:04 PM MST")
+}
+
+// Record an audit log entry, along with who it affected, what changed and where it was done from.
+// The before and after values are stored as JSON and can be left nil.
+func logAuditEvent(r *http.Request, entryType int, context interface{}, target int, currentUser user, before interface{}, after interface{}) {
+	var targetID sql.NullInt64
+	if target > 0 {
+		targetID = sql.NullInt64{Int64: int64(target), Valid: true}
+	}
+	var beforeJSON, afterJSON sql.NullString
+	if before != nil {
+		value, err := json.Marshal(before)
+		if err == nil {
+			beforeJSON = sql.NullString{String: string(value), Valid: true}
+		}
+	}
+	if after != nil {
+		value, err := json.Marshal(after)
+		if err == nil {
+			afterJSON = sql.NullString{String: string(value), Valid: true}
+		}
+	}
+	ip, _, err := net.SplitHostPort(getIP(r))
+	if err != nil {
+		ip = getIP(r)
+	}
+	db.Exec("INSERT INTO audit_log_entries (type, context, target, before_value, after_value, ip, created_by) VALUES (?, ?, ?, ?, ?, ?, ?)", entryType, context, targetID, beforeJSON, afterJSON, ip, currentUser.ID)
+}
+
+// Get a ban as it's shown in the audit log, along with the user it's for.
+func getBanForAuditLog(table string, banID string) (map[string]interface{}, int) {
+	var userID int
+	var ip, reason string
+	var until time.Time
+	var err error
+	if table == "ip_bans" {
+		err = db.QueryRow("SELECT CONCAT('AS', asn), reason, until FROM ip_bans WHERE id = ?", banID).Scan(&ip, &reason, &until)
+	} else {
+		err = db.QueryRow("SELECT IFNULL(user, 0), ip, reason, until FROM bans WHERE id = ?", banID).Scan(&userID, &ip, &reason, &until)
+	}
+	if err != nil {
+		return nil, 0
+	}
+	return map[string]interface{}{"ip": ip, "reason": reason, "until": until}, userID
+}
+
+// Get an automod rule as it's shown in the audit log.
+func getAutomodRuleForAuditLog(ruleID interface{}) map[string]interface{} {
+	var rule automodRule
+	err := db.QueryRow("SELECT name, condition_type, value, action, dry_run, enabled FROM automod_rules WHERE id = ?", ruleID).Scan(&rule.Name, &rule.ConditionType, &rule.Value, &rule.Action, &rule.DryRun, &rule.Enabled)
+	if err != nil {
+		return nil
+	}
+	return map[string]interface{}{"name": rule.Name, "condition_type": rule.ConditionType, "value": rule.Value, "action": rule.Action, "dry_run": rule.DryRun, "enabled": rule.Enabled}
+}
+
 // Send a notification to a user.
 func createNotif(to int, notif_type int, post string, currentUser int) {
 	notif_read := 0
 	for client := range clients {
 		if clients[client].UserID == to {
-			if ((notif_type == 0 || notif_type == 2 || notif_type == 3) && clients[client].OnPage == "/posts/"+post) || (notif_type == 1 && clients[client].OnPage == "/comments/"+post) {
+			if ((notif_type == 0 || notif_type == 2 || notif_type == 3) && clients[client].OnPage == "/posts/"+post) || ((notif_type == 1 || notif_type == 13) && clients[client].OnPage == "/comments/"+post) {
 				notif_read = 1
 				break
 			}
@@ -341,7 +618,7 @@ func QueryUser(username string, timezone string) user {
 	var users = user{}
 	var role int
 	var lastSeenTime time.Time
-	db.QueryRow("SELECT id, username, nickname, avatar, has_mh, email, password, ip, level, role, online, hide_online, last_seen, hide_last_seen, color, theme, yeah_notifications, websockets_enabled, forbidden_keywords, default_privacy FROM users WHERE username=?", username).Scan(&users.ID, &users.Username, &users.Nickname, &users.Avatar, &users.HasMii, &users.Email, &users.Password, &users.IP, &users.Level, &role, &users.Online, &users.HideOnline, &lastSeenTime, &users.HideLastSeen, &users.Color, &users.Theme, &users.YeahNotifications, &users.WebsocketsEnabled, &users.ForbiddenKeywords, &users.DefaultPrivacy)
+	db.QueryRow("SELECT id, username, nickname, avatar, has_mh, email, password, ip, level, role, online, hide_online, last_seen, hide_last_seen, color, theme, yeah_notifications, websockets_enabled, forbidden_keywords, default_privacy, mention_privacy, limited FROM users WHERE username=?", username).Scan(&users.ID, &users.Username, &users.Nickname, &users.Avatar, &users.HasMii, &users.Email, &users.Password, &users.IP, &users.Level, &role, &users.Online, &users.HideOnline, &lastSeenTime, &users.HideLastSeen, &users.Color, &users.Theme, &users.YeahNotifications, &users.WebsocketsEnabled, &users.ForbiddenKeywords, &users.DefaultPrivacy, &users.MentionPrivacy, &users.Limited)
 
 	if role > 0 {
 		db.QueryRow("SELECT image, organization FROM roles WHERE id = ?", role).Scan(&users.Role.Image, &users.Role.Organization)
@@ -378,13 +655,16 @@ func setupPost(row *post, currentUser user, postType int, repostLayer int) *post
 		row.ByMe = true
 	}
 	if row.PostType == 2 {
-		row.Poll = getPoll(row.ID, currentUser.ID)
+		row.Poll = getPoll(row.ID, currentUser)
+	}
+	if row.PostType == 1 {
+		db.QueryRow("SELECT painting_alt FROM posts WHERE id = ?", row.ID).Scan(&row.PaintingAlt)
 	}
 	row.Type = postType
 	if row.RepostID > 0 {
 		var repost post
 		if repostLayer < 3 {
-			db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, communities.id, title, icon, rm, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", row.RepostID, currentUser.ID, currentUser.ID, currentUser.ID, currentUser.ID, escapeForbiddenKeywords(currentUser.ForbiddenKeywords), currentUser.ID, currentUser.ID, currentUser.ID, currentUser.ID, currentUser.Level, currentUser.ID).Scan(&repost.ID, &repost.CreatedBy, &repost.CreatedAtTime, &repost.EditedAtTime, &repost.Feeling, &repost.BodyText, &repost.Image, &repost.AttachmentType, &repost.IsSpoiler, &repost.PostType, &repost.URL, &repost.URLType, &repost.Pinned, &repost.Privacy, &repost.RepostID, &repost.MigrationID, &repost.MigratedID, &repost.MigratedCommunity, &repost.IsRMByAdmin, &repost.CommunityID, &repost.CommunityName, &repost.CommunityIcon, &repost.CommunityRM, &repost.PosterUsername, &repost.PosterNickname, &repost.PosterIcon, &repost.PosterHasMii, &repost.PosterOnline, &repost.PosterHideOnline, &repost.PosterColor, &repost.PosterRoleID)
+			db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, communities.id, title, icon, rm, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND "+getCommunityMembershipFilter("community_id", currentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", row.RepostID, currentUser.ID, currentUser.ID, currentUser.ID, currentUser.ID, escapeForbiddenKeywords(currentUser.ForbiddenKeywords), currentUser.ID, currentUser.ID, currentUser.ID, currentUser.ID, currentUser.Level, currentUser.ID).Scan(&repost.ID, &repost.CreatedBy, &repost.CreatedAtTime, &repost.EditedAtTime, &repost.Feeling, &repost.BodyText, &repost.Image, &repost.AttachmentType, &repost.IsSpoiler, &repost.PostType, &repost.URL, &repost.URLType, &repost.Pinned, &repost.Privacy, &repost.RepostID, &repost.MigrationID, &repost.MigratedID, &repost.MigratedCommunity, &repost.IsRMByAdmin, &repost.CommunityID, &repost.CommunityName, &repost.CommunityIcon, &repost.CommunityRM, &repost.PosterUsername, &repost.PosterNickname, &repost.PosterIcon, &repost.PosterHasMii, &repost.PosterOnline, &repost.PosterHideOnline, &repost.PosterColor, &repost.PosterRoleID)
 			row.Repost = &repost
 			row.Repost.Type = 3
 			if len(row.Repost.CommunityName) > 0 {
@@ -403,11 +683,12 @@ func setupPost(row *post, currentUser user, postType int, repostLayer int) *post
 	}
 
 	db.QueryRow("SELECT COUNT(*) FROM yeahs WHERE yeah_post = ? AND yeah_by = ? AND on_comment = 0 LIMIT 1", row.ID, currentUser.ID).Scan(&row.Yeahed)
+	db.QueryRow("SELECT community_flairs.id, name, color FROM posts INNER JOIN community_flairs ON community_flairs.id = flair WHERE posts.id = ?", row.ID).Scan(&row.FlairID, &row.FlairName, &row.FlairColor)
 	row.CanYeah = checkIfCanYeah(currentUser, row.CreatedBy)
 
 	if row.CommentCount != -1 {
 		db.QueryRow("SELECT COUNT(*) FROM yeahs WHERE yeah_post = ? AND on_comment = 0", row.ID).Scan(&row.YeahCount)
-		db.QueryRow("SELECT COUNT(*) FROM comments WHERE post = ? AND is_rm = 0", row.ID).Scan(&row.CommentCount)
+		db.QueryRow("SELECT COUNT(*) FROM comments LEFT JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND pending = 0 AND (users.limited = 0 OR users.id = ? OR ? > 0)", row.ID, currentUser.ID, currentUser.Level).Scan(&row.CommentCount)
 		if row.CommentCount > 0 && postType != -1 && postType != 3 {
 			row.CommentPreview = getCommentPreview(row.ID, currentUser)
 		}
@@ -418,136 +699,687 @@ func setupPost(row *post, currentUser user, postType int, repostLayer int) *post
 	return row
 }
 
-// Show a ban screen.
-func showBan(w http.ResponseWriter, currentUser user, banLength time.Time) bool {
-	if time.Now().Sub(banLength).Seconds() > 1 {
-		stmt, _ := db.Prepare("DELETE FROM bans WHERE user = ?")
-		stmt.Exec(currentUser.ID)
-		stmt.Close()
+// Check if a user's posts and comments should be held in the review queue.
+func shouldHoldContent(currentUser user) bool {
+	if !settings.HoldingQueue.Enabled || currentUser.Level > 0 {
 		return false
-	} else {
-		var data = map[string]interface{}{
-			"CurrentUser":   currentUser,
-			"Length":        banLength.Format("01/02/2006 3:04 PM"),
-			"LengthForever": banLength.Year() > 2100,
-		}
-		err := templates.ExecuteTemplate(w, "ban.html", data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return true
 	}
-}
 
-// Find a profile by user ID.
-func QueryProfile(id int, timezone string) profile {
-	var profiles = profile{}
-	var createdAtTime time.Time
-	var genderNumber int // Gender is just a number.
-	db.QueryRow("SELECT created_at, nnid, mh, avatar_image, avatar_id, gender, region, comment, nnid_visibility, yeah_visibility, reply_visibility, discord, steam, psn, switch_code, twitter, youtube, allow_friend, favorite FROM profiles WHERE user = ?", id).Scan(&createdAtTime, &profiles.NNID, &profiles.MiiHash, &profiles.AvatarImage, &profiles.AvatarID, &genderNumber, &profiles.Region, &profiles.CommentText, &profiles.NNIDVisibility, &profiles.YeahVisibility, &profiles.ReplyVisibility, &profiles.Discord, &profiles.Steam, &profiles.PSN, &profiles.SwitchCode, &profiles.Twitter, &profiles.YouTube, &profiles.AllowFriend, &profiles.FavoritePostID)
+	var isNew bool
+	db.QueryRow("SELECT created_at > NOW() - INTERVAL ? DAY FROM profiles WHERE user = ?", settings.HoldingQueue.AccountAge, currentUser.ID).Scan(&isNew)
+	if isNew {
+		return true
+	}
 
-	profiles.Gender = [6]string{"", "He/him", "She/her", "He/she", "Nonbinary", "They/them"}[genderNumber]
-	profiles.User = id
-	profiles.Comment = parseBodyWithLineBreaks(profiles.CommentText, false, true)
-	profiles.CreatedAt = humanTiming(createdAtTime, timezone)
-	profiles.CreatedAtUnix = createdAtTime.Unix()
-	return profiles
+	// A user's trust is how much of what they've posted has made it through moderation.
+	var trust int
+	db.QueryRow("SELECT (SELECT COUNT(*) FROM posts WHERE created_by = ? AND pending = 0 AND is_rm_by_admin = 0) + (SELECT COUNT(*) FROM comments WHERE created_by = ? AND pending = 0 AND is_rm_by_admin = 0)", currentUser.ID, currentUser.ID).Scan(&trust)
+	return trust < settings.HoldingQueue.MinimumTrust
 }
 
-// Find a community by ID.
-func QueryCommunity(id string, canBeRM bool) community {
-	var communities = community{}
-	if canBeRM {
-		db.QueryRow("SELECT id, title, description, icon, banner, is_featured, permissions, rm FROM communities WHERE id = ?", id).Scan(&communities.ID, &communities.Title, &communities.DescriptionText, &communities.Icon, &communities.Banner, &communities.IsFeatured, &communities.Permissions, &communities.RM)
-	} else {
-		db.QueryRow("SELECT id, title, description, icon, banner, is_featured, permissions, rm FROM communities WHERE id = ? AND rm = 0", id).Scan(&communities.ID, &communities.Title, &communities.DescriptionText, &communities.Icon, &communities.Banner, &communities.IsFeatured, &communities.Permissions, &communities.RM)
-	}
+// Send out a newly published post to everyone on its community page and its poster's post list.
+func publishPost(posts post, poster user) {
+	var CommunityPostTpl, UserPostTpl bytes.Buffer
+	posts.ByMe = false
+	templates.ExecuteTemplate(&CommunityPostTpl, "render_post.html", posts)
+	posts.Type = 1
+	templates.ExecuteTemplate(&UserPostTpl, "render_post.html", posts)
 
-	communities.Description = parseBodyWithLineBreaks(communities.DescriptionText, false, true)
-	return communities
-}
+	if posts.RepostID > 0 && posts.Repost.CreatedBy != poster.ID && !poster.Limited {
+		createNotif(posts.Repost.CreatedBy, 7, strconv.Itoa(posts.ID), poster.ID)
+	}
+	// Drawings only have an image URL as their body, so there's nobody to mention.
+	if posts.PostType != 1 {
+		notifyMentions(posts.BodyText, posts.ID, 0, poster)
+	}
 
-// Set variables for profile sidebar.
-func setupProfileSidebar(user user, currentUser user, profileOnPage string) profileSidebar {
-	var sidebar profileSidebar
-	sidebar.Profile = QueryProfile(user.ID, currentUser.Timezone)
-	sidebar.User = user
-	sidebar.CurrentUser = currentUser
-	sidebar.ProfileOnPage = profileOnPage
-	sidebar.Reasons = settings.ReportReasons
+	var msg wsMessage
+	msg.Type = "post"
+	msg.Content = CommunityPostTpl.String()
+	community_id := strconv.Itoa(posts.CommunityID)
 
-	if len(sidebar.User.Theme) > 0 {
-		sidebar.User.ThemeColors = strings.Split(sidebar.User.Theme, ",")
+	// Clients say which page they're on themselves, so private communities are checked for each of them.
+	for client := range clients {
+		if clients[client].OnPage == "/communities/"+community_id &&
+			clients[client].UserID != posts.CreatedBy &&
+			(!checkIfEitherBlocked(clients[client].UserID, posts.CreatedBy) ||
+				clients[client].Level > 0) &&
+			(!poster.Limited || clients[client].Level > 0) &&
+			!inForbiddenKeywords(posts.BodyText, clients[client].UserID) &&
+			(posts.Privacy == 0) &&
+			checkIfCommunityMember(community_id, user{ID: clients[client].UserID, Level: clients[client].Level}) {
+			msg.Content = CommunityPostTpl.String()
+			err := writeWs(clients[client], client, msg)
+			if err != nil {
+				fmt.Println("posts")
+				client.Close()
+				delete(clients, client)
+			}
+		} else if clients[client].OnPage == "/users/"+poster.Username+"/posts" && (!checkIfEitherBlocked(clients[client].UserID, posts.CreatedBy) || clients[client].Level > 0) && (!poster.Limited || clients[client].Level > 0) && !inForbiddenKeywords(posts.BodyText, clients[client].UserID) && (posts.Privacy == 0) && checkIfCommunityMember(community_id, user{ID: clients[client].UserID, Level: clients[client].Level}) {
+			msg.Content = UserPostTpl.String()
+			err := writeWs(clients[client], client, msg)
+			if err != nil {
+				fmt.Println("postsuser")
+				client.Close()
+				delete(clients, client)
+			}
+		}
 	}
+}
 
-	db.QueryRow("SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = ? LIMIT 1", user.ID, currentUser.ID).Scan(&sidebar.IsFollowing)
-	var requestTimestamp time.Time
-	_ = db.QueryRow("SELECT COUNT(*), created_at FROM friend_requests WHERE request_to = ? AND request_by = ? GROUP BY created_at", user.ID, currentUser.ID).Scan(&sidebar.FriendStatus, &requestTimestamp)
-	if sidebar.FriendStatus > 0 {
-		sidebar.FriendStatus = 2
-		sidebar.RequestTime = requestTimestamp.Format("01/02/2006 3:04 PM")
-	} else {
-		db.QueryRow("SELECT COUNT(*) FROM friend_requests WHERE request_to = ? AND request_by = ?", currentUser.ID, user.ID).Scan(&sidebar.FriendStatus)
-		if sidebar.FriendStatus > 0 {
-			sidebar.FriendStatus = 1
-			var createdAt time.Time
-			db.QueryRow("SELECT id, message, created_at FROM friend_requests WHERE request_to = ? AND request_by = ? ORDER BY friend_requests.id DESC", currentUser.ID, user.ID).Scan(&sidebar.Request.ID, &sidebar.Request.Message, &createdAt)
-			sidebar.Request.CreatedAt = createdAt.Format("01/02/2006 3:04 PM")
-		} else {
-			db.QueryRow("SELECT COUNT(*) FROM friendships WHERE (source = ? AND target = ?) OR (source = ? AND target = ?)", user.ID, currentUser.ID, currentUser.ID, user.ID).Scan(&sidebar.FriendStatus)
-			if sidebar.FriendStatus > 0 {
-				sidebar.FriendStatus = 3
-			} else {
-				sidebar.FriendStatus = 0
-				if sidebar.Profile.AllowFriend == 1 {
-					db.QueryRow("SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = ? LIMIT 1", currentUser.ID, user.ID).Scan(&sidebar.IsFollowingMe)
-				}
+// Validate and create a post from a submitted post form, then send it out unless it has been held.
+// Errors caused by the form come back with a 4xx status and a message that can be shown to the poster.
+func submitPost(form url.Values, CurrentUser user) (post, int, error) {
+	var err error
+	user_id := CurrentUser.ID
+	community_id := form.Get("community")
+	post_type := form.Get("post_type")
+	body := form.Get("body")
+	painting := form.Get("painting")
+	if post_type == "1" {
+		body = painting
+	}
+	image := form.Get("image")
+	attachment_type := form.Get("attachment_type")
+	url := ""
+	url_type := 0
+	is_spoiler := form.Get("is_spoiler")
+	feeling := form.Get("feeling_id")
+	privacy := form.Get("privacy")
+	repost := form.Get("repost")
+	var paintingAlt string
+	var pollOptions []string
+	var pollMultipleChoice bool
+	var pollResults int
+	var pollClosesAt sql.NullTime
+
+	if len(community_id) == 0 {
+		return post{}, http.StatusBadRequest, errors.New("You must specify a community.")
+	}
+	var communityCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM communities WHERE id = ? AND (rm = 0 OR id = 0) AND permissions <= ? LIMIT 1", community_id, CurrentUser.Level).Scan(&communityCount)
+	if err != nil {
+		return post{}, http.StatusInternalServerError, err
+	}
+	if communityCount == 0 {
+		return post{}, http.StatusBadRequest, errors.New("The community could not be found.")
+	}
+	if checkIfCommunityBanned(community_id, CurrentUser.ID) {
+		return post{}, http.StatusForbidden, errors.New("You have been banned from posting in this community.")
+	}
+	if !checkIfCommunityMember(community_id, CurrentUser) {
+		return post{}, http.StatusForbidden, errors.New("You have to be a member of this community to post in it.")
+	}
+	// People have to agree to the community's rules again whenever they change.
+	if len(getCommunityRules(community_id)) > 0 && !checkIfAgreedToCommunityRules(community_id, CurrentUser.ID) {
+		if form.Get("rules_read") != "1" {
+			return post{}, http.StatusBadRequest, errors.New("You have to read this community's rules before posting in it.")
+		}
+		db.Exec("INSERT IGNORE INTO community_rule_agreements (community, user) VALUES (?, ?)", community_id, CurrentUser.ID)
+	}
+	var flair sql.NullInt64
+	if len(form.Get("flair")) > 0 && form.Get("flair") != "0" {
+		db.QueryRow("SELECT id FROM community_flairs WHERE id = ? AND community = ?", form.Get("flair"), community_id).Scan(&flair)
+		if !flair.Valid {
+			return post{}, http.StatusBadRequest, errors.New("Invalid flair.")
+		}
+	}
+	if utf8.RuneCountInString(body) > 2000 {
+		return post{}, http.StatusBadRequest, errors.New("Your post is too long. (2000 characters maximum)")
+	}
+	if len(body) == 0 && len(image) == 0 && len(repost) == 0 {
+		return post{}, http.StatusBadRequest, errors.New("Your post is empty.")
+	}
+	// The first image is kept in the post's image column too, for everything that only shows one.
+	attachments, err := getFormAttachments(form)
+	if err != nil {
+		return post{}, http.StatusBadRequest, err
+	}
+	if len(attachments) > 0 {
+		image = attachments[0].URL
+	}
+	attachment_type, err = getAttachmentType(attachment_type, attachments)
+	if err != nil {
+		return post{}, http.StatusBadRequest, err
+	}
+	if (attachment_type == "0" || attachment_type == "3") && checkIfAltTextRequired(community_id) {
+		for _, row := range attachments {
+			if len(row.Alt) == 0 {
+				return post{}, http.StatusBadRequest, errors.New("Images in this community need a description.")
 			}
 		}
 	}
-	sidebar.User.Blocked = checkIfBlocked(currentUser.ID, user.ID)
-	sidebar.Profile.FriendCount, sidebar.Profile.FollowingCount, sidebar.Profile.FollowerCount = setupSidebarStatus(user.ID)
-	var banCount int
-	db.QueryRow("SELECT COUNT(*) FROM bans WHERE user = ?", user.ID).Scan(&banCount)
-	if banCount > 0 {
-		if len(sidebar.User.Role.Organization) > 0 {
-			sidebar.User.Role.Organization = "Banned<br>" + sidebar.User.Role.Organization
-		} else {
-			sidebar.User.Role.Organization = "Banned"
+	if is_spoiler != "1" {
+		is_spoiler = "0"
+	}
+	if len(privacy) != 1 {
+		privacy = "0"
+	}
+	if len(repost) == 0 {
+		repost = "0"
+	} else {
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM posts LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", repost, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&count)
+		if err != nil {
+			return post{}, http.StatusInternalServerError, err
+		}
+		if count != 1 {
+			return post{}, http.StatusBadRequest, errors.New("The post could not be found.")
+		}
+	}
+	if len(post_type) == 0 {
+		post_type = "0"
+	} else if post_type == "1" {
+		if len(painting) == 0 {
+			return post{}, http.StatusBadRequest, errors.New("You must add a drawing.")
+		}
+		db.QueryRow("SELECT value FROM images WHERE id = ?", painting).Scan(&body)
+		if body == painting {
+			return post{}, http.StatusBadRequest, errors.New("Invalid drawing.")
+		}
+		paintingAlt, err = getFormPaintingAlt(form)
+		if err != nil {
+			return post{}, http.StatusBadRequest, err
 		}
+		if len(paintingAlt) == 0 && checkIfAltTextRequired(community_id) {
+			return post{}, http.StatusBadRequest, errors.New("Drawings in this community need a description.")
+		}
+	} else if post_type == "2" {
+		// Options are named option-a, option-b and so on.
+		for i := 0; i < 26; i++ {
+			option := strings.TrimSpace(form.Get("option-" + string(rune('a'+i))))
+			if len(option) == 0 {
+				continue
+			}
+			if utf8.RuneCountInString(option) > 64 {
+				return post{}, http.StatusBadRequest, errors.New("Poll options can't be longer than 64 characters.")
+			}
+			pollOptions = append(pollOptions, option)
+		}
+		if len(pollOptions) < 2 {
+			return post{}, http.StatusBadRequest, errors.New("Polls must have at least two options.")
+		}
+		if len(pollOptions) > settings.MaxPollOptions {
+			return post{}, http.StatusBadRequest, errors.New("Polls can't have more than " + strconv.Itoa(settings.MaxPollOptions) + " options.")
+		}
+		pollMultipleChoice = form.Get("poll_multiple_choice") == "1"
+		pollResults, _ = strconv.Atoi(form.Get("poll_results"))
+		if pollResults < 0 || pollResults > 2 {
+			return post{}, http.StatusBadRequest, errors.New("Invalid poll result visibility.")
+		}
+		// The closing time is given in hours from now, up to 30 days.
+		pollHours, _ := strconv.Atoi(form.Get("poll_closes"))
+		if pollHours < 0 || pollHours > 720 {
+			return post{}, http.StatusBadRequest, errors.New("Polls can't stay open for more than 30 days.")
+		}
+		if pollHours > 0 {
+			pollClosesAt = sql.NullTime{Time: time.Now().Add(time.Duration(pollHours) * time.Hour), Valid: true}
+		} else if pollResults == 2 {
+			return post{}, http.StatusBadRequest, errors.New("Polls that hide their results until they close need a closing time.")
+		}
+	} else if post_type != "0" {
+		return post{}, http.StatusBadRequest, errors.New("Invalid post type.")
 	}
 
-	db.QueryRow("SELECT COUNT(*) FROM posts WHERE created_by = ? AND is_rm = 0", user.ID).Scan(&sidebar.Profile.PostCount)
-	db.QueryRow("SELECT COUNT(*) FROM comments WHERE created_by = ? AND is_rm = 0", user.ID).Scan(&sidebar.Profile.CommentCount)
-	db.QueryRow("SELECT COUNT(*) FROM yeahs WHERE yeah_by = ?", user.ID).Scan(&sidebar.Profile.YeahCount)
+	if embedURL, embedType := getEmbed(body); embedType > 0 {
+		url, url_type = embedURL, embedType
+	}
 
-	db.QueryRow("SELECT image FROM posts WHERE id = ?", sidebar.Profile.FavoritePostID).Scan(&sidebar.Profile.FavoritePostImage)
+	// Run the post through the automod. Drawings only have an image URL as their body.
+	automodBody := body
+	if post_type == "1" {
+		automodBody = ""
+	}
+	automod := checkAutomod(CurrentUser, 0, automodBody, len(image) > 0 || post_type == "1")
+	if automod.Block {
+		return post{}, http.StatusBadRequest, errors.New("Your post was blocked by the automatic moderation.")
+	}
+	if automod.Spoiler {
+		is_spoiler = "1"
+	}
+	if automod.Limit {
+		CurrentUser.Limited = true
+	}
+	pending := automod.Hold || shouldHoldContent(CurrentUser)
 
-	favorite_rows, err := db.Query("SELECT communities.id, title, icon FROM communities LEFT JOIN community_favorites ON communities.id = community WHERE favorite_by = ? AND rm = 0 ORDER BY community_favorites.id DESC LIMIT 10", user.ID)
+	stmt, err := db.Prepare("INSERT posts SET created_by = ?, community_id = ?, body = ?, image = ?, attachment_type = ?, painting_alt = ?, url = ?, url_type = ?, is_spoiler = ?, feeling = ?, privacy = ?, repost = ?, post_type = ?, pending = ?, flair = ?, migrated_id = '', migrated_community = 0")
 	if err != nil {
-		fmt.Println("error while getting favorite communities")
-		fmt.Println(err.Error())
-		return sidebar
+		return post{}, http.StatusInternalServerError, err
+	}
+	_, err = stmt.Exec(&user_id, &community_id, &body, &image, &attachment_type, &paintingAlt, &url, &url_type, &is_spoiler, &feeling, &privacy, &repost, &post_type, &pending, &flair)
+	stmt.Close()
+	if err != nil {
+		return post{}, http.StatusInternalServerError, err
 	}
 
-	var favorites []community
-	for favorite_rows.Next() {
-		var row = community{}
+	var posts = post{}
+	var timestamp time.Time
+	var role int
 
-		err := favorite_rows.Scan(&row.ID, &row.Title, &row.Icon)
+	err = db.QueryRow("SELECT posts.id, created_by, created_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, communities.id, title, icon, username, nickname, avatar, has_mh, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE created_by = ? ORDER BY created_at DESC LIMIT 1", user_id).Scan(&posts.ID, &posts.CreatedBy, &timestamp, &posts.Feeling, &posts.BodyText, &posts.Image, &posts.AttachmentType, &posts.IsSpoiler, &posts.PostType, &posts.URL, &posts.URLType, &posts.Pinned, &posts.Privacy, &posts.RepostID, &posts.CommunityID, &posts.CommunityName, &posts.CommunityIcon, &posts.PosterUsername, &posts.PosterNickname, &posts.PosterIcon, &posts.PosterHasMii, &posts.PosterHideOnline, &posts.PosterColor, &role)
+	if err != nil {
+		return post{}, http.StatusInternalServerError, err
+	}
+
+	if posts.PostType == 2 {
+		var optionValues []string
+		var optionArgs []interface{}
+		for _, option := range pollOptions {
+			optionValues = append(optionValues, "(?, ?)")
+			optionArgs = append(optionArgs, posts.ID, option)
+		}
+		_, err = db.Exec("INSERT INTO options (post, name) VALUES "+strings.Join(optionValues, ", "), optionArgs...)
 		if err != nil {
-			fmt.Println("error while scanning favorite communities")
-			fmt.Println(err.Error())
+			return post{}, http.StatusInternalServerError, err
+		}
+		_, err = db.Exec("INSERT INTO polls (post, multiple_choice, closes_at, results_visibility) VALUES (?, ?, ?, ?)", posts.ID, pollMultipleChoice, pollClosesAt, pollResults)
+		if err != nil {
+			return post{}, http.StatusInternalServerError, err
 		}
+		posts.Poll = getPoll(posts.ID, CurrentUser)
+	}
+	err = saveAttachments(0, posts.ID, attachments)
+	if err != nil {
+		return post{}, http.StatusInternalServerError, err
+	}
+	posts.Attachments = attachments
+	posts.PaintingAlt = paintingAlt
 
-		favorites = append(favorites, row)
+	posts.PosterIcon = getAvatar(posts.PosterIcon, posts.PosterHasMii, posts.Feeling)
+	if role > 0 {
+		posts.PosterRoleImage = getRoleImage(role)
+	}
+	posts.CreatedAt = humanTiming(timestamp, CurrentUser.Timezone)
+	posts.CreatedAtUnix = timestamp.Unix()
+	posts.Body = parseBodyWithLineBreaks(posts.BodyText, true, true)
+	posts.ByMe = true
+	posts.CanYeah = true // temporary!
+	posts.Pending = pending
+	db.QueryRow("SELECT id, name, color FROM community_flairs WHERE id = ?", flair).Scan(&posts.FlairID, &posts.FlairName, &posts.FlairColor)
+	if posts.PostType != 1 {
+		indexPostTags(posts.ID, posts.BodyText)
+	}
+	if posts.RepostID > 0 {
+		var repost post
+		db.QueryRow("SELECT posts.id, created_by, created_at, edited_at, feeling, body, image, attachment_type, is_spoiler, post_type, url, url_type, pinned, privacy, repost, migration, migrated_id, migrated_community, is_rm_by_admin, communities.id, title, icon, rm, username, nickname, avatar, has_mh, online, hide_online, color, role FROM posts LEFT JOIN communities ON communities.id = community_id LEFT JOIN users ON users.id = created_by WHERE posts.id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", CurrentUser)+" AND users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?) LIMIT 1", posts.RepostID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, escapeForbiddenKeywords(CurrentUser.ForbiddenKeywords), CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.ID, CurrentUser.Level, CurrentUser.ID).Scan(&repost.ID, &repost.CreatedBy, &repost.CreatedAtTime, &repost.EditedAtTime, &repost.Feeling, &repost.BodyText, &repost.Image, &repost.AttachmentType, &repost.IsSpoiler, &repost.PostType, &repost.URL, &repost.URLType, &repost.Pinned, &repost.Privacy, &repost.RepostID, &repost.MigrationID, &repost.MigratedID, &repost.MigratedCommunity, &repost.IsRMByAdmin, &repost.CommunityID, &repost.CommunityName, &repost.CommunityIcon, &repost.CommunityRM, &repost.PosterUsername, &repost.PosterNickname, &repost.PosterIcon, &repost.PosterHasMii, &repost.PosterOnline, &repost.PosterHideOnline, &repost.PosterColor, &repost.PosterRoleID)
+		posts.Repost = &repost
+		posts.Repost.Type = 3
+		if len(posts.Repost.CommunityName) > 0 {
+			posts.Repost = setupPost(posts.Repost, CurrentUser, 3, 0)
+			setupPostAttachments(posts.Repost)
+		}
 	}
-	favorite_rows.Close()
-	sidebar.FavoriteCommunities = favorites
-	return sidebar
-}
 
-// Set friend/following/follower counts for sidebars.
+	// Held posts aren't sent out until they're approved.
+	if automod.Report || automod.Hold {
+		createAutomodReport(0, posts.ID, automod.Rules)
+	}
+	if !posts.Pending {
+		publishPost(posts, CurrentUser)
+	}
+	return posts, http.StatusOK, nil
+}
+
+// Read when a draft should be published from its form. Without a time, the draft is only being saved.
+// Scheduling a post counts as posting it, so the poster has to agree to the community's rules first.
+func getDraftPublishTime(form url.Values, communityID string, currentUser user) (sql.NullTime, error) {
+	if len(form.Get("publish_at")) == 0 {
+		return sql.NullTime{}, nil
+	}
+	location, err := time.LoadLocation(currentUser.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	publishAt, err := time.ParseInLocation("2006-01-02T15:04", form.Get("publish_at"), location)
+	if err != nil {
+		return sql.NullTime{}, errors.New("The publishing time is invalid.")
+	}
+	if !publishAt.After(time.Now()) || publishAt.After(time.Now().AddDate(0, 0, 30)) {
+		return sql.NullTime{}, errors.New("Posts can only be scheduled for some time in the next 30 days.")
+	}
+	if len(getCommunityRules(communityID)) > 0 && !checkIfAgreedToCommunityRules(communityID, currentUser.ID) {
+		if form.Get("rules_read") != "1" {
+			return sql.NullTime{}, errors.New("You have to read this community's rules before posting in it.")
+		}
+		db.Exec("INSERT IGNORE INTO community_rule_agreements (community, user) VALUES (?, ?)", communityID, currentUser.ID)
+	}
+	return sql.NullTime{Time: publishAt, Valid: true}, nil
+}
+
+// Turn a draft back into the post form it was saved from, so it can be submitted like any other post.
+func getDraftForm(draftID int, userID int) (url.Values, error) {
+	var communityID, postType, attachmentType, feeling, privacy, pollResults, pollCloses int
+	var body, paintingAlt string
+	var painting, image, flair sql.NullInt64
+	var isSpoiler, pollMultipleChoice bool
+	var pollOptions, attachments sql.NullString
+	err := db.QueryRow("SELECT community, post_type, body, painting, painting_alt, image, attachment_type, is_spoiler, feeling, privacy, flair, poll_options, attachments, poll_multiple_choice, poll_results, poll_closes FROM drafts WHERE id = ? AND created_by = ?", draftID, userID).Scan(&communityID, &postType, &body, &painting, &paintingAlt, &image, &attachmentType, &isSpoiler, &feeling, &privacy, &flair, &pollOptions, &attachments, &pollMultipleChoice, &pollResults, &pollCloses)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("community", strconv.Itoa(communityID))
+	form.Set("post_type", strconv.Itoa(postType))
+	form.Set("body", body)
+	if painting.Valid {
+		form.Set("painting", strconv.FormatInt(painting.Int64, 10))
+		form.Set("painting_alt", paintingAlt)
+	}
+	// Drafts saved before they could have more than one image only have the image column.
+	if attachments.Valid {
+		var images []attachment
+		json.Unmarshal([]byte(attachments.String), &images)
+		for _, row := range images {
+			form.Add("image", strconv.Itoa(row.ImageID))
+			form.Add("image_alt", row.Alt)
+			if row.IsSpoiler {
+				form.Add("image_spoiler", "1")
+			} else {
+				form.Add("image_spoiler", "0")
+			}
+		}
+	} else if image.Valid {
+		form.Set("image", strconv.FormatInt(image.Int64, 10))
+	}
+	form.Set("attachment_type", strconv.Itoa(attachmentType))
+	if isSpoiler {
+		form.Set("is_spoiler", "1")
+	}
+	form.Set("feeling_id", strconv.Itoa(feeling))
+	form.Set("privacy", strconv.Itoa(privacy))
+	if flair.Valid {
+		form.Set("flair", strconv.FormatInt(flair.Int64, 10))
+	}
+	if pollOptions.Valid {
+		var options []string
+		json.Unmarshal([]byte(pollOptions.String), &options)
+		for i, option := range options {
+			if i < 26 {
+				form.Set("option-"+string(rune('a'+i)), option)
+			}
+		}
+	}
+	if pollMultipleChoice {
+		form.Set("poll_multiple_choice", "1")
+	}
+	form.Set("poll_results", strconv.Itoa(pollResults))
+	form.Set("poll_closes", strconv.Itoa(pollCloses))
+	return form, nil
+}
+
+// Send out a newly published comment to everyone on its post and community pages, and notify the people following the post.
+func publishComment(comments comment, postID string, postBy int, commenter user) {
+	var parentBy int
+	if comments.ParentID > 0 {
+		db.QueryRow("SELECT created_by, nickname FROM comments LEFT JOIN users ON users.id = created_by WHERE comments.id = ? AND is_rm = 0", comments.ParentID).Scan(&parentBy, &comments.ParentNickname)
+	}
+
+	// Limited users' comments are only visible to themselves and staff, so nobody gets notified.
+	if !commenter.Limited {
+		// The author of the comment being replied to gets their own notification instead of the usual one.
+		if parentBy > 0 {
+			if parentBy == commenter.ID || parentBy == postBy || checkIfEitherBlocked(parentBy, commenter.ID) {
+				parentBy = 0
+			}
+			if parentBy > 0 {
+				createNotif(parentBy, 13, strconv.Itoa(comments.ParentID), commenter.ID)
+			}
+		}
+		if commenter.ID == postBy {
+			notif_getcomments, _ := db.Query("SELECT created_by FROM comments WHERE post = ? AND created_by != ? AND created_by != ? AND is_rm = 0 AND pending = 0 GROUP BY created_by", postID, commenter.ID, parentBy)
+			var notif_comment_by int
+
+			for notif_getcomments.Next() {
+				notif_getcomments.Scan(&notif_comment_by)
+
+				createNotif(notif_comment_by, 3, postID, commenter.ID)
+			}
+			notif_getcomments.Close()
+		} else {
+			createNotif(postBy, 2, postID, commenter.ID)
+		}
+	}
+	if comments.PostType != 1 {
+		post, _ := strconv.Atoi(postID)
+		notifyMentions(comments.BodyText, post, comments.ID, commenter)
+	}
+
+	var commentTpl bytes.Buffer
+	var commentPreviewTpl bytes.Buffer
+	comments.ByMii = false
+	var data = map[string]interface{}{
+		"CanYeah": true,
+		"Comment": comments,
+		"ByMe":    commenter.ID == postBy,
+	}
+	templates.ExecuteTemplate(&commentTpl, "create_comment.html", data)
+	var commentCount int
+	db.QueryRow("SELECT COUNT(*) FROM comments WHERE post = ? AND pending = 0", postID).Scan(&commentCount)
+	data = map[string]interface{}{
+		"CommentPreview": comments,
+		"CommentCount":   commentCount,
+	}
+	templates.ExecuteTemplate(&commentPreviewTpl, "render_comment_preview.html", data)
+
+	var msg wsMessage
+	var community_id string
+
+	db.QueryRow("SELECT community_id FROM posts WHERE id = ?", postID).Scan(&community_id)
+	postNumber, _ := strconv.Atoi(postID)
+
+	for client := range clients {
+		// Clients say which page they're on themselves, so only send comments to the ones that can see the post.
+		if clients[client].OnPage != "/posts/"+postID && clients[client].OnPage != "/communities/"+community_id {
+			continue
+		}
+		if (!checkIfEitherBlocked(clients[client].UserID, comments.CreatedBy) || clients[client].Level > 0) && (!commenter.Limited || clients[client].Level > 0) && !inForbiddenKeywords(comments.BodyText, clients[client].UserID) && checkIfCanSeePost(postNumber, user{ID: clients[client].UserID, Level: clients[client].Level}) {
+			if clients[client].OnPage == "/posts/"+postID && clients[client].UserID != comments.CreatedBy {
+				msg.Type = "comment"
+				msg.Content = commentTpl.String()
+				err := writeWs(clients[client], client, msg)
+				if err != nil {
+					client.Close()
+					delete(clients, client)
+				}
+			} else if clients[client].OnPage == "/communities/"+community_id && !comments.IsSpoiler {
+				msg.Type = "commentPreview"
+				msg.ID = postID
+				msg.Content = commentPreviewTpl.String()
+				err := writeWs(clients[client], client, msg)
+				if err != nil {
+					client.Close()
+					delete(clients, client)
+				}
+			}
+		}
+	}
+}
+
+// The deepest a comment thread can nest before further replies are shown alongside their parent.
+const maxCommentDepth = 4
+
+// Nest a post's comments under the comments they're replying to, keeping their order.
+// Replies to comments that aren't in the list are shown at the top level.
+func threadComments(comments []comment) []comment {
+	indexes := make(map[int]int)
+	parents := make(map[int]int)
+	depths := make(map[int]int)
+	replies := make(map[int][]int)
+	var roots []int
+
+	for i, comment := range comments {
+		parent, ok := indexes[comment.ParentID]
+		if comment.ParentID == 0 || !ok {
+			roots = append(roots, i)
+		} else {
+			for depths[parent] >= maxCommentDepth-1 {
+				parent = parents[parent]
+			}
+			parents[i] = parent
+			depths[i] = depths[parent] + 1
+			replies[parent] = append(replies[parent], i)
+		}
+		indexes[comment.ID] = i
+	}
+
+	var nest func(i int) comment
+	nest = func(i int) comment {
+		comment := comments[i]
+		for _, reply := range replies[i] {
+			comment.Replies = append(comment.Replies, nest(reply))
+		}
+		return comment
+	}
+	var threaded []comment
+	for _, root := range roots {
+		threaded = append(threaded, nest(root))
+	}
+	return threaded
+}
+
+// Show a ban screen.
+func showBan(w http.ResponseWriter, currentUser user, banLength time.Time) bool {
+	if time.Now().Sub(banLength).Seconds() > 1 {
+		return false
+	} else {
+		var data = map[string]interface{}{
+			"CurrentUser":   currentUser,
+			"Length":        banLength.Format("01/02/2006 3:04 PM"),
+			"LengthForever": banLength.Year() > 2100,
+		}
+		err := templates.ExecuteTemplate(w, "ban.html", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return true
+	}
+}
+
+// Find a profile by user ID.
+func QueryProfile(id int, timezone string) profile {
+	var profiles = profile{}
+	var createdAtTime time.Time
+	var genderNumber int // Gender is just a number.
+	db.QueryRow("SELECT created_at, nnid, mh, avatar_image, avatar_id, gender, region, comment, nnid_visibility, yeah_visibility, reply_visibility, discord, steam, psn, switch_code, twitter, youtube, allow_friend, favorite FROM profiles WHERE user = ?", id).Scan(&createdAtTime, &profiles.NNID, &profiles.MiiHash, &profiles.AvatarImage, &profiles.AvatarID, &genderNumber, &profiles.Region, &profiles.CommentText, &profiles.NNIDVisibility, &profiles.YeahVisibility, &profiles.ReplyVisibility, &profiles.Discord, &profiles.Steam, &profiles.PSN, &profiles.SwitchCode, &profiles.Twitter, &profiles.YouTube, &profiles.AllowFriend, &profiles.FavoritePostID)
+
+	profiles.Gender = [6]string{"", "He/him", "She/her", "He/she", "Nonbinary", "They/them"}[genderNumber]
+	profiles.User = id
+	profiles.Comment = parseBodyWithLineBreaks(profiles.CommentText, false, true)
+	profiles.CreatedAt = humanTiming(createdAtTime, timezone)
+	profiles.CreatedAtUnix = createdAtTime.Unix()
+	return profiles
+}
+
+// Find a community by ID.
+func QueryCommunity(id string, canBeRM bool) community {
+	var communities = community{}
+	if canBeRM {
+		db.QueryRow("SELECT id, title, description, icon, banner, is_featured, permissions, rm, category, visibility, IFNULL(parent, -1) FROM communities WHERE id = ?", id).Scan(&communities.ID, &communities.Title, &communities.DescriptionText, &communities.Icon, &communities.Banner, &communities.IsFeatured, &communities.Permissions, &communities.RM, &communities.Category, &communities.Visibility, &communities.Parent)
+	} else {
+		db.QueryRow("SELECT id, title, description, icon, banner, is_featured, permissions, rm, category, visibility, IFNULL(parent, -1) FROM communities WHERE id = ? AND rm = 0", id).Scan(&communities.ID, &communities.Title, &communities.DescriptionText, &communities.Icon, &communities.Banner, &communities.IsFeatured, &communities.Permissions, &communities.RM, &communities.Category, &communities.Visibility, &communities.Parent)
+	}
+
+	communities.Description = parseBodyWithLineBreaks(communities.DescriptionText, false, true)
+	communities.CategoryName = getCommunityCategoryName(communities.Category)
+	communities.Tags = getCommunityTags(communities.ID)
+	db.QueryRow("SELECT COUNT(*) FROM community_members WHERE community = ? AND status = 1", communities.ID).Scan(&communities.MemberCount)
+	if communities.Parent >= 0 {
+		db.QueryRow("SELECT title FROM communities WHERE id = ?", communities.Parent).Scan(&communities.ParentTitle)
+	}
+	return communities
+}
+
+// Set variables for profile sidebar.
+func setupProfileSidebar(user user, currentUser user, profileOnPage string) profileSidebar {
+	var sidebar profileSidebar
+	sidebar.Profile = QueryProfile(user.ID, currentUser.Timezone)
+	sidebar.User = user
+	sidebar.CurrentUser = currentUser
+	sidebar.ProfileOnPage = profileOnPage
+	sidebar.Reasons = settings.ReportReasons
+	sidebar.CanViewDossier = currentUser.Level >= admin.Manage.MinimumLevel
+
+	if len(sidebar.User.Theme) > 0 {
+		sidebar.User.ThemeColors = strings.Split(sidebar.User.Theme, ",")
+	}
+
+	db.QueryRow("SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = ? LIMIT 1", user.ID, currentUser.ID).Scan(&sidebar.IsFollowing)
+	var requestTimestamp time.Time
+	_ = db.QueryRow("SELECT COUNT(*), created_at FROM friend_requests WHERE request_to = ? AND request_by = ? GROUP BY created_at", user.ID, currentUser.ID).Scan(&sidebar.FriendStatus, &requestTimestamp)
+	if sidebar.FriendStatus > 0 {
+		sidebar.FriendStatus = 2
+		sidebar.RequestTime = requestTimestamp.Format("01/02/2006 3:04 PM")
+	} else {
+		db.QueryRow("SELECT COUNT(*) FROM friend_requests WHERE request_to = ? AND request_by = ?", currentUser.ID, user.ID).Scan(&sidebar.FriendStatus)
+		if sidebar.FriendStatus > 0 {
+			sidebar.FriendStatus = 1
+			var createdAt time.Time
+			db.QueryRow("SELECT id, message, created_at FROM friend_requests WHERE request_to = ? AND request_by = ? ORDER BY friend_requests.id DESC", currentUser.ID, user.ID).Scan(&sidebar.Request.ID, &sidebar.Request.Message, &createdAt)
+			sidebar.Request.CreatedAt = createdAt.Format("01/02/2006 3:04 PM")
+		} else {
+			db.QueryRow("SELECT COUNT(*) FROM friendships WHERE (source = ? AND target = ?) OR (source = ? AND target = ?)", user.ID, currentUser.ID, currentUser.ID, user.ID).Scan(&sidebar.FriendStatus)
+			if sidebar.FriendStatus > 0 {
+				sidebar.FriendStatus = 3
+			} else {
+				sidebar.FriendStatus = 0
+				if sidebar.Profile.AllowFriend == 1 {
+					db.QueryRow("SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = ? LIMIT 1", currentUser.ID, user.ID).Scan(&sidebar.IsFollowingMe)
+				}
+			}
+		}
+	}
+	sidebar.User.Blocked = checkIfBlocked(currentUser.ID, user.ID)
+	sidebar.Profile.FriendCount, sidebar.Profile.FollowingCount, sidebar.Profile.FollowerCount = setupSidebarStatus(user.ID)
+	var banCount int
+	db.QueryRow("SELECT COUNT(*) FROM bans WHERE user = ? AND until > NOW()", user.ID).Scan(&banCount)
+	if banCount > 0 {
+		if len(sidebar.User.Role.Organization) > 0 {
+			sidebar.User.Role.Organization = "Banned<br>" + sidebar.User.Role.Organization
+		} else {
+			sidebar.User.Role.Organization = "Banned"
+		}
+	}
+	if sidebar.User.Limited && currentUser.Level > 0 {
+		if len(sidebar.User.Role.Organization) > 0 {
+			sidebar.User.Role.Organization = "Limited<br>" + sidebar.User.Role.Organization
+		} else {
+			sidebar.User.Role.Organization = "Limited"
+		}
+	}
+
+	db.QueryRow("SELECT COUNT(*) FROM posts WHERE created_by = ? AND is_rm = 0", user.ID).Scan(&sidebar.Profile.PostCount)
+	db.QueryRow("SELECT COUNT(*) FROM comments WHERE created_by = ? AND is_rm = 0", user.ID).Scan(&sidebar.Profile.CommentCount)
+	db.QueryRow("SELECT COUNT(*) FROM yeahs WHERE yeah_by = ?", user.ID).Scan(&sidebar.Profile.YeahCount)
+
+	db.QueryRow("SELECT image FROM posts WHERE id = ? AND "+getCommunityMembershipFilter("community_id", currentUser), sidebar.Profile.FavoritePostID).Scan(&sidebar.Profile.FavoritePostImage)
+
+	// Favorites can bring their sub-communities along with them.
+	favorite_rows, err := db.Query("SELECT communities.id, title, icon FROM community_favorites INNER JOIN communities ON communities.id = community OR (include_children = 1 AND parent = community) WHERE favorite_by = ? AND rm = 0 GROUP BY communities.id ORDER BY MAX(community_favorites.id) DESC, communities.id ASC LIMIT 10", user.ID)
+	if err != nil {
+		fmt.Println("error while getting favorite communities")
+		fmt.Println(err.Error())
+		return sidebar
+	}
+
+	var favorites []community
+	for favorite_rows.Next() {
+		var row = community{}
+
+		err := favorite_rows.Scan(&row.ID, &row.Title, &row.Icon)
+		if err != nil {
+			fmt.Println("error while scanning favorite communities")
+			fmt.Println(err.Error())
+		}
+
+		favorites = append(favorites, row)
+	}
+	favorite_rows.Close()
+	sidebar.FavoriteCommunities = favorites
+	return sidebar
+}
+
+// Set friend/following/follower counts for sidebars.
 func setupSidebarStatus(userID int) (int, int, int) {
 	friendCount, followingCount, followerCount := 0, 0, 0
 	if userID != 0 {
@@ -593,6 +1425,31 @@ func parseBody(body string, cutoff bool, parseMarkdown bool) template.HTML {
 		}
 	}
 
+	// Link mentions to the profiles of the people mentioned.
+	mentionedUsers := findMentionedUsers(mentions.FindAllStringSubmatch(body, mentionLimit))
+	mentionCount := 0
+	body = mentions.ReplaceAllStringFunc(body, func(match string) string {
+		mentionCount++
+		if mentionCount > mentionLimit {
+			return match
+		}
+		submatch := mentions.FindStringSubmatch(match)
+		mentioned := findMentionedUser(mentionedUsers, submatch[2])
+		if mentioned.ID == 0 {
+			return match
+		}
+		return submatch[1] + "<a href=\"/users/" + mentioned.Username + "\" class=\"mention\">@" + mentioned.Username + "</a>" + submatch[2][len(mentioned.Username):]
+	})
+
+	// Link hashtags to their tag pages.
+	body = hashtags.ReplaceAllStringFunc(body, func(match string) string {
+		submatch := hashtags.FindStringSubmatch(match)
+		if len(strings.Trim(submatch[2], "0123456789")) == 0 {
+			return match
+		}
+		return submatch[1] + "<a href=\"/tags/" + url.PathEscape(strings.ToLower(submatch[2])) + "\" class=\"hashtag\">#" + submatch[2] + "</a>"
+	})
+
 	// Return the output.
 	return template.HTML(body)
 }
@@ -610,13 +1467,16 @@ func parseCutoff(body template.HTML) template.HTML {
 }
 
 // Cut a string off at 15 characters. Used for notifications and the "View _____'s post for this comment" bar thingy at the top of the comments page.
-func parsePreview(body string, postType int, isRM bool) string {
+// Drawings are described by their alt text when they have some.
+func parsePreview(body string, postType int, isRM bool, paintingAlt string) string {
 	if isRM {
 		body = "deleted"
 	} else if len(body) == 0 {
 		body = "empty"
-	} else if postType == 1 {
+	} else if postType == 1 && len(paintingAlt) == 0 {
 		body = "handwritten"
+	} else if postType == 1 {
+		body = parsePreview("handwritten: "+paintingAlt, 0, false, "")
 	} else if utf8.RuneCountInString(body) > 18 {
 		runes := []rune(body)
 		body = string(runes[0:15]) + "..."
@@ -624,6 +1484,171 @@ func parsePreview(body string, postType int, isRM bool) string {
 	return body
 }
 
+// How many mentions in a single body get linked and notified.
+const mentionLimit = 10
+
+// Look up everyone mentioned in a body in one query, keyed by their lowercased username.
+// Mentions at the end of a sentence pick up its period, so the names are looked up without it too.
+func findMentionedUsers(matches [][]string) map[string]user {
+	mentioned := make(map[string]user)
+	var names []interface{}
+	var placeholders []string
+	for _, match := range matches {
+		for name := match[2]; len(name) > 0; name = strings.TrimSuffix(name, ".") {
+			names = append(names, name)
+			placeholders = append(placeholders, "?")
+			if !strings.HasSuffix(name, ".") {
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return mentioned
+	}
+	user_rows, err := db.Query("SELECT id, username, level, mention_privacy FROM users WHERE username IN ("+strings.Join(placeholders, ", ")+")", names...)
+	if err != nil {
+		return mentioned
+	}
+	for user_rows.Next() {
+		var row user
+		user_rows.Scan(&row.ID, &row.Username, &row.Level, &row.MentionPrivacy)
+		mentioned[strings.ToLower(row.Username)] = row
+	}
+	user_rows.Close()
+	return mentioned
+}
+
+// Find a mentioned user among the ones looked up by findMentionedUsers(), dropping periods from the end if nobody has the full username.
+func findMentionedUser(mentioned map[string]user, username string) user {
+	for {
+		if row, exists := mentioned[strings.ToLower(username)]; exists {
+			return row
+		}
+		if !strings.HasSuffix(username, ".") {
+			return user{}
+		}
+		username = strings.TrimSuffix(username, ".")
+	}
+}
+
+// Check if someone's mention privacy setting lets them be notified by a certain user.
+func checkIfCanMention(mentioned user, mentionedBy int) bool {
+	var count int
+	switch mentioned.MentionPrivacy {
+	case 0:
+		return true
+	case 1:
+		db.QueryRow("SELECT COUNT(*) FROM follows WHERE follow_by = ? AND follow_to = ?", mentioned.ID, mentionedBy).Scan(&count)
+	case 2:
+		db.QueryRow("SELECT COUNT(*) FROM friendships WHERE source = ? AND target = ? OR source = ? AND target = ?", mentioned.ID, mentionedBy, mentionedBy, mentioned.ID).Scan(&count)
+	}
+	return count > 0
+}
+
+// Check if a user can see a post, going by its community, privacy setting and blocks.
+func checkIfCanSeePost(postID int, viewer user) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM posts WHERE id = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND "+getCommunityMembershipFilter("community_id", viewer)+" AND created_by NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = created_by) OR (source = created_by AND target = ?)) AND (privacy = 0 OR (privacy IN (1, 2, 3, 4) AND (SELECT COUNT(*) FROM friendships WHERE source = ? AND target = created_by OR source = created_by AND target = ? LIMIT 1) = 1) OR (privacy IN (1, 3, 5, 6) AND (SELECT COUNT(*) FROM follows WHERE follow_to = created_by AND follow_by = ? LIMIT 1) = 1) OR (privacy IN (1, 2, 5, 7) AND (SELECT COUNT(*) FROM follows WHERE follow_to = ? AND follow_by = created_by) = 1) OR (privacy = 8 AND ? > 0) OR created_by = ?)", postID, viewer.ID, viewer.ID, viewer.ID, viewer.ID, viewer.ID, viewer.ID, viewer.ID, viewer.Level, viewer.ID).Scan(&count)
+	return count > 0
+}
+
+// Notify the people mentioned in a post or comment, as long as they can see it and allow mentions from its author.
+// The post ID is the post itself or the post a comment is on, and is what decides who can see the mention.
+func notifyMentions(body string, postID int, commentID int, author user) {
+	if author.Limited {
+		return
+	}
+	notified := make(map[int]bool)
+	matches := mentions.FindAllStringSubmatch(body, mentionLimit)
+	mentionedUsers := findMentionedUsers(matches)
+	for _, match := range matches {
+		mentioned := findMentionedUser(mentionedUsers, match[2])
+		if mentioned.ID == 0 || mentioned.ID == author.ID || notified[mentioned.ID] {
+			continue
+		}
+		notified[mentioned.ID] = true
+		if checkIfEitherBlocked(mentioned.ID, author.ID) || !checkIfCanMention(mentioned, author.ID) || !checkIfCanSeePost(postID, mentioned) {
+			continue
+		}
+		if commentID > 0 {
+			createNotif(mentioned.ID, 12, strconv.Itoa(commentID), author.ID)
+		} else {
+			createNotif(mentioned.ID, 11, strconv.Itoa(postID), author.ID)
+		}
+	}
+}
+
+// How many hashtags in a single post get indexed.
+const hashtagLimit = 10
+
+// Find the hashtags in a post body, lowercased and without duplicates. Tags that are only numbers, like #1, don't count.
+func getHashtags(body string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, match := range hashtags.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(match[2])
+		if seen[tag] || len(strings.Trim(tag, "0123456789")) == 0 {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == hashtagLimit {
+			break
+		}
+	}
+	return tags
+}
+
+// Update the tag index for a post after it has been created or edited.
+func indexPostTags(postID int, body string) {
+	tags := getHashtags(body)
+	if len(tags) == 0 {
+		db.Exec("DELETE FROM post_tags WHERE post = ?", postID)
+		return
+	}
+	var placeholders []string
+	var values []string
+	var args []interface{}
+	for _, tag := range tags {
+		placeholders = append(placeholders, "?")
+		values = append(values, "(?, ?)")
+		args = append(args, postID, tag)
+	}
+	deleteArgs := []interface{}{postID}
+	for _, tag := range tags {
+		deleteArgs = append(deleteArgs, tag)
+	}
+	db.Exec("DELETE FROM post_tags WHERE post = ? AND tag NOT IN ("+strings.Join(placeholders, ", ")+")", deleteArgs...)
+	db.Exec("INSERT IGNORE INTO post_tags (post, tag) VALUES "+strings.Join(values, ", "), args...)
+}
+
+// Get the current trending tags. This is called from the general sidebar template.
+func getTrendingTags() []trendingTag {
+	trendingTagsLock.RLock()
+	defer trendingTagsLock.RUnlock()
+	return trendingTags
+}
+
+// Work out the trending tags every few minutes, going by how many people have used each tag in public posts over the last day.
+func updateTrendingTags() {
+	for {
+		rows, err := db.Query("SELECT tag, COUNT(*) FROM post_tags INNER JOIN posts ON posts.id = post INNER JOIN communities ON communities.id = posts.community_id INNER JOIN users ON users.id = posts.created_by WHERE posts.created_at > NOW() - INTERVAL 1 DAY AND posts.is_rm = 0 AND posts.is_rm_by_admin = 0 AND posts.pending = 0 AND posts.privacy = 0 AND communities.rm = 0 AND communities.visibility = 0 AND users.limited = 0 GROUP BY tag ORDER BY COUNT(DISTINCT posts.created_by) DESC, COUNT(*) DESC LIMIT 5")
+		if err == nil {
+			var tags []trendingTag
+			for rows.Next() {
+				var tag trendingTag
+				rows.Scan(&tag.Tag, &tag.Posts)
+				tags = append(tags, tag)
+			}
+			rows.Close()
+			trendingTagsLock.Lock()
+			trendingTags = tags
+			trendingTagsLock.Unlock()
+		}
+		time.Sleep(5 * time.Minute)
+	}
+}
+
 // Really minimal function to check if the user viewing the page can give a Yeah to a certain post.
 func checkIfCanYeah(currentUser user, createdBy int) bool {
 	if len(currentUser.Username) == 0 {
@@ -674,14 +1699,298 @@ func getSettings() config {
 		Enabled:      false,
 		BodyRequired: true,
 	}}, settings.ReportReasons...)
+	if len(settings.CommunityCategories) == 0 {
+		settings.CommunityCategories = []string{"General"}
+	}
+	if settings.MaxPollOptions < 2 {
+		settings.MaxPollOptions = 5
+	} else if settings.MaxPollOptions > 26 {
+		settings.MaxPollOptions = 26
+	}
+	if settings.MaxImages < 1 {
+		settings.MaxImages = 4
+	} else if settings.MaxImages > 10 {
+		settings.MaxImages = 10
+	}
+	if settings.Clips.MaxSize < 1 {
+		settings.Clips.MaxSize = 15
+	}
+	if settings.Clips.MaxDuration < 1 {
+		settings.Clips.MaxDuration = 60
+	}
 	return settings
 }
 
-// Generate a login token for autoauth.
-func generateLoginToken() string {
-	const letterBytes = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890"
-	const (
-		letterIdxBits = 6
+// Get the settings that differ between two configs, with anything secret left out.
+func diffSettings(before config, after config) (map[string]interface{}, map[string]interface{}) {
+	beforeValues := flattenSettings(before)
+	afterValues := flattenSettings(after)
+	changedBefore := make(map[string]interface{})
+	changedAfter := make(map[string]interface{})
+	for key, value := range afterValues {
+		if reflect.DeepEqual(beforeValues[key], value) {
+			continue
+		}
+		if strings.Contains(key, "Password") || strings.Contains(key, "Secret") || strings.HasSuffix(key, "Key") {
+			changedBefore[key] = "[redacted]"
+			changedAfter[key] = "[redacted]"
+			continue
+		}
+		changedBefore[key] = beforeValues[key]
+		changedAfter[key] = value
+	}
+	return changedBefore, changedAfter
+}
+
+// Flatten a config into a map of setting names like "SMTP.Hostname" to their values.
+func flattenSettings(settings config) map[string]interface{} {
+	var values map[string]interface{}
+	settingsJSON, _ := json.Marshal(settings)
+	json.Unmarshal(settingsJSON, &values)
+	flattened := make(map[string]interface{})
+	for key, value := range values {
+		if nested, ok := value.(map[string]interface{}); ok {
+			for nestedKey, nestedValue := range nested {
+				flattened[key+"."+nestedKey] = nestedValue
+			}
+		} else {
+			flattened[key] = value
+		}
+	}
+	return flattened
+}
+
+// Delete audit log entries older than the retention setting, checking once an hour.
+func pruneAuditLog() {
+	for {
+		if settings.AuditLogRetention > 0 {
+			db.Exec("DELETE FROM audit_log_entries WHERE created_at < NOW() - INTERVAL ? DAY", settings.AuditLogRetention)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// Roll up every community's activity on a single day (formatted as YYYY-MM-DD) into the community_stats table.
+func rollupCommunityStats(date string) error {
+	_, err := db.Exec("INSERT IGNORE INTO community_stats (community, date) SELECT id, ? FROM communities", date)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE community_stats SET posts = 0, comments = 0, yeahs = 0, active_posters = 0, favorites = 0, reports = 0, deletions = 0 WHERE date = ?", date)
+	if err != nil {
+		return err
+	}
+
+	// Each query counts something per community for the day and gets written to its column.
+	stats := []struct {
+		column string
+		query  string
+		args   []interface{}
+	}{
+		{"posts", "SELECT community_id AS community, COUNT(*) AS total FROM posts WHERE created_at >= ? AND created_at < ? + INTERVAL 1 DAY GROUP BY community_id", []interface{}{date, date}},
+		{"comments", "SELECT posts.community_id AS community, COUNT(*) AS total FROM comments INNER JOIN posts ON posts.id = post WHERE comments.created_at >= ? AND comments.created_at < ? + INTERVAL 1 DAY GROUP BY posts.community_id", []interface{}{date, date}},
+		{"yeahs", "SELECT posts.community_id AS community, COUNT(*) AS total FROM yeahs LEFT JOIN comments ON on_comment = 1 AND comments.id = yeah_post INNER JOIN posts ON posts.id = IF(on_comment = 1, comments.post, yeah_post) WHERE yeahs.created_at >= ? AND yeahs.created_at < ? + INTERVAL 1 DAY GROUP BY posts.community_id", []interface{}{date, date}},
+		{"active_posters", "SELECT community, COUNT(DISTINCT created_by) AS total FROM (SELECT community_id AS community, created_by FROM posts WHERE created_at >= ? AND created_at < ? + INTERVAL 1 DAY UNION ALL SELECT posts.community_id, comments.created_by FROM comments INNER JOIN posts ON posts.id = post WHERE comments.created_at >= ? AND comments.created_at < ? + INTERVAL 1 DAY) AS activity GROUP BY community", []interface{}{date, date, date, date}},
+		{"favorites", "SELECT community, COUNT(*) AS total FROM community_favorites WHERE created_at >= ? AND created_at < ? + INTERVAL 1 DAY GROUP BY community", []interface{}{date, date}},
+		{"reports", "SELECT IFNULL(posts.community_id, parent.community_id) AS community, COUNT(*) AS total FROM reports LEFT JOIN posts ON reports.type = 0 AND posts.id = pid LEFT JOIN comments ON reports.type = 1 AND comments.id = pid LEFT JOIN posts AS parent ON parent.id = comments.post WHERE reports.type IN (0, 1) AND reports.created_at >= ? AND reports.created_at < ? + INTERVAL 1 DAY GROUP BY community", []interface{}{date, date}},
+		// type 0 - delete post
+		{"deletions", "SELECT community, COUNT(*) AS total FROM community_mod_log WHERE type = 0 AND created_at >= ? AND created_at < ? + INTERVAL 1 DAY GROUP BY community", []interface{}{date, date}},
+	}
+	for _, stat := range stats {
+		_, err = db.Exec("UPDATE community_stats INNER JOIN ("+stat.query+") AS counts ON counts.community = community_stats.community SET community_stats."+stat.column+" = counts.total WHERE date = ?", append(stat.args, date)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The yeahs and comments each post got that day, for the top posts.
+	_, err = db.Exec("DELETE FROM community_post_stats WHERE date = ?", date)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO community_post_stats (community, post, date, yeahs, comments) SELECT posts.community_id, posts.id, ?, SUM(activity.yeah), SUM(activity.comment) FROM (SELECT yeah_post AS post, 1 AS yeah, 0 AS comment FROM yeahs WHERE on_comment = 0 AND created_at >= ? AND created_at < ? + INTERVAL 1 DAY UNION ALL SELECT post, 0, 1 FROM comments WHERE created_at >= ? AND created_at < ? + INTERVAL 1 DAY AND is_rm = 0 AND is_rm_by_admin = 0) AS activity INNER JOIN posts ON posts.id = activity.post GROUP BY posts.id", date, date, date, date, date)
+	return err
+}
+
+// Keep the community stats up to date, rolling up today's activity once an hour.
+// Days that were missed while the server was down are filled in when it starts.
+// Dates come from the database so that days line up with the timestamps stored in it.
+func aggregateCommunityStats() {
+	var lastDate, today string
+	db.QueryRow("SELECT IFNULL(DATE_FORMAT(MAX(date), '%Y-%m-%d'), DATE_FORMAT(CURDATE() - INTERVAL 30 DAY, '%Y-%m-%d')), DATE_FORMAT(CURDATE(), '%Y-%m-%d') FROM community_stats").Scan(&lastDate, &today)
+	day, err := time.Parse("2006-01-02", lastDate)
+	if err != nil {
+		return
+	}
+	for ; day.Format("2006-01-02") <= today; day = day.AddDate(0, 0, 1) {
+		err = rollupCommunityStats(day.Format("2006-01-02"))
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+
+	for {
+		time.Sleep(time.Hour)
+		var date string
+		db.QueryRow("SELECT DATE_FORMAT(CURDATE(), '%Y-%m-%d')").Scan(&date)
+		// finish off the previous day once it's over
+		if date != today {
+			err = rollupCommunityStats(today)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			today = date
+		}
+		err = rollupCommunityStats(today)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// Get community events, along with whether the user has RSVP'd to them.
+// The condition is everything after WHERE, including the ORDER BY and LIMIT.
+func getCommunityEvents(currentUser user, condition string, args ...interface{}) []communityEvent {
+	var events []communityEvent
+	rows, err := db.Query("SELECT community_events.id, community, communities.title, communities.icon, community_events.title, community_events.description, starts_at, ends_at, username, nickname, (SELECT COUNT(*) FROM community_event_rsvps WHERE event = community_events.id), (SELECT COUNT(*) FROM community_event_rsvps WHERE event = community_events.id AND user = ?) FROM community_events INNER JOIN communities ON communities.id = community INNER JOIN users ON users.id = community_events.created_by WHERE "+condition, append([]interface{}{currentUser.ID}, args...)...)
+	if err != nil {
+		return events
+	}
+	defer rows.Close()
+	location, err := time.LoadLocation(currentUser.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	now := time.Now()
+	for rows.Next() {
+		var row communityEvent
+		rows.Scan(&row.ID, &row.Community, &row.CommunityTitle, &row.CommunityIcon, &row.Title, &row.DescriptionText, &row.StartsAtTime, &row.EndsAtTime, &row.CreatedByUsername, &row.CreatedByNickname, &row.RSVPCount, &row.RSVPGiven)
+		row.Description = parseBodyWithLineBreaks(row.DescriptionText, false, true)
+		row.StartsAt = eventTiming(row.StartsAtTime, currentUser.Timezone)
+		row.EndsAt = eventTiming(row.EndsAtTime, currentUser.Timezone)
+		row.Day = row.StartsAtTime.In(location).Format("Monday, January 2, 2006")
+		row.Live = row.StartsAtTime.Before(now) && row.EndsAtTime.After(now)
+		row.Ended = !row.EndsAtTime.After(now)
+		events = append(events, row)
+	}
+	return events
+}
+
+// Remind everyone who RSVP'd to an event an hour before it starts, checking once a minute.
+func sendEventReminders() {
+	for {
+		rows, err := db.Query("SELECT id, created_by FROM community_events WHERE reminded = 0 AND starts_at <= NOW() + INTERVAL 1 HOUR AND ends_at > NOW() AND community IN (SELECT id FROM communities WHERE rm = 0)")
+		if err == nil {
+			var events [][2]int
+			for rows.Next() {
+				var event [2]int
+				rows.Scan(&event[0], &event[1])
+				events = append(events, event)
+			}
+			rows.Close()
+			for _, event := range events {
+				db.Exec("UPDATE community_events SET reminded = 1 WHERE id = ?", event[0])
+				rsvp_rows, err := db.Query("SELECT user FROM community_event_rsvps WHERE event = ?", event[0])
+				if err != nil {
+					continue
+				}
+				var users []int
+				for rsvp_rows.Next() {
+					var userID int
+					rsvp_rows.Scan(&userID)
+					users = append(users, userID)
+				}
+				rsvp_rows.Close()
+				for _, userID := range users {
+					createNotif(userID, 9, strconv.Itoa(event[0]), event[1])
+				}
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// Publish scheduled posts once they're due. If one can't be published anymore, it goes back to being a draft and its poster gets notified.
+func publishScheduledPosts() {
+	for {
+		rows, err := db.Query("SELECT drafts.id, username FROM drafts LEFT JOIN users ON users.id = created_by WHERE publish_at <= NOW()")
+		if err == nil {
+			var draftIDs []int
+			var usernames []string
+			for rows.Next() {
+				var draftID int
+				var username string
+				rows.Scan(&draftID, &username)
+				draftIDs = append(draftIDs, draftID)
+				usernames = append(usernames, username)
+			}
+			rows.Close()
+			for i, draftID := range draftIDs {
+				// Claim the draft first so it can't be published twice.
+				res, err := db.Exec("UPDATE drafts SET publish_at = NULL WHERE id = ? AND publish_at IS NOT NULL", draftID)
+				if err != nil {
+					continue
+				}
+				claimed, _ := res.RowsAffected()
+				if claimed == 0 {
+					continue
+				}
+				poster := QueryUser(usernames[i], "")
+				form, err := getDraftForm(draftID, poster.ID)
+				if err == nil {
+					// There's no request behind this, so the bans doSession would catch are checked here, going by the poster's last IP.
+					var banCount int
+					var lastIP string
+					db.QueryRow("SELECT COUNT(*) FROM bans WHERE user = ? AND until > NOW()", poster.ID).Scan(&banCount)
+					db.QueryRow("SELECT ip FROM users WHERE id = ?", poster.ID).Scan(&lastIP)
+					if banCount > 0 || checkIfIPBanned(lastIP) {
+						err = errors.New("You are banned.")
+					} else {
+						_, _, err = submitPost(form, poster)
+					}
+				}
+				if err != nil {
+					db.Exec("UPDATE drafts SET error = LEFT(?, 255) WHERE id = ?", err.Error(), draftID)
+					createNotif(poster.ID, 10, strconv.Itoa(draftID), poster.ID)
+					continue
+				}
+				db.Exec("DELETE FROM drafts WHERE id = ?", draftID)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// Escape text for use in an iCalendar property value.
+func escapeICalendarText(text string) string {
+	return strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n").Replace(text)
+}
+
+// Turn one of the daily community stats into a bar chart, with the bar heights as a percentage of the busiest day.
+func getStatChart(name string, stats []communityStats, value func(communityStats) int) statChart {
+	chart := statChart{Name: name}
+	var max int
+	for _, day := range stats {
+		chart.Total += value(day)
+		if value(day) > max {
+			max = value(day)
+		}
+	}
+	for _, day := range stats {
+		bar := statBar{Date: day.Date, Value: value(day)}
+		if max > 0 {
+			bar.Height = bar.Value * 100 / max
+		}
+		chart.Bars = append(chart.Bars, bar)
+	}
+	return chart
+}
+
+// Generate a login token for autoauth.
+func generateLoginToken() string {
+	const letterBytes = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890"
+	const (
+		letterIdxBits = 6
 		letterIdxMask = 1<<letterIdxBits - 1
 		letterIdxMax  = 63 / letterIdxBits
 	)
@@ -702,6 +2011,40 @@ func generateLoginToken() string {
 	return string(b)
 }
 
+// Generate a random token that can't be guessed, for things that work like passwords.
+func generateSecureToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get the ID of the browser a request came from, giving it one if it doesn't have one yet.
+// It outlives logins and logouts, so staff can tell when accounts were used from the same browser.
+func getDeviceID(w http.ResponseWriter, r *http.Request) string {
+	device, err := r.Cookie("device")
+	if err == nil && len(device.Value) == 32 {
+		return device.Value
+	}
+	deviceID, err := generateSecureToken()
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: "device", Value: deviceID, Path: "/", HttpOnly: true, Expires: time.Unix(253402300799, 0)})
+	return deviceID
+}
+
+// Remember which browser a user logged in or signed up from.
+// This is kept apart from login tokens, since those go away when the user logs out.
+func recordLoginDevice(w http.ResponseWriter, r *http.Request, userID int) {
+	deviceID := getDeviceID(w, r)
+	if len(deviceID) > 0 {
+		db.Exec("INSERT INTO login_devices (user, device) VALUES (?, ?) ON DUPLICATE KEY UPDATE last_login = NOW()", userID, deviceID)
+	}
+}
+
 // Check if a user is blocking another user.
 func checkIfBlocked(source int, target int) bool {
 	var isBlocked bool
@@ -724,6 +2067,241 @@ func checkIfEitherBlocked(source int, target int) bool {
 	return isBlocked
 }
 
+// Check if a user can moderate a community, either as one of its moderators or as an admin.
+func checkIfCommunityModerator(communityID interface{}, currentUser user) bool {
+	if currentUser.ID == 0 {
+		return false
+	}
+	if currentUser.Level >= admin.Manage.MinimumLevel {
+		return true
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM community_moderators WHERE community = ? AND user = ?", communityID, currentUser.ID).Scan(&count)
+	return count > 0 || checkIfCommunityOwner(communityID, currentUser)
+}
+
+// Check if a user owns a community. Admins count as owners of every community.
+func checkIfCommunityOwner(communityID interface{}, currentUser user) bool {
+	if currentUser.ID == 0 {
+		return false
+	}
+	if currentUser.Level >= admin.Manage.MinimumLevel {
+		return true
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM communities WHERE id = ? AND owner = ?", communityID, currentUser.ID).Scan(&count)
+	return count > 0
+}
+
+// Get the name of a community category, falling back to the default category for ones that no longer exist.
+func getCommunityCategoryName(category int) string {
+	if category < 0 || category >= len(settings.CommunityCategories) {
+		return settings.CommunityCategories[0]
+	}
+	return settings.CommunityCategories[category]
+}
+
+// Get a community's tags.
+func getCommunityTags(communityID interface{}) []string {
+	var tags []string
+	rows, err := db.Query("SELECT tag FROM community_tags WHERE community = ? ORDER BY tag ASC", communityID)
+	if err != nil {
+		return tags
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Get a community's sub-communities.
+func getCommunityChildren(communityID interface{}) []community {
+	var children []community
+	rows, err := db.Query("SELECT id, title, icon, permissions FROM communities WHERE parent = ? AND rm = 0 ORDER BY title ASC", communityID)
+	if err != nil {
+		return children
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row community
+		rows.Scan(&row.ID, &row.Title, &row.Icon, &row.Permissions)
+		children = append(children, row)
+	}
+	return children
+}
+
+// Get the communities shown as tabs on a community's page: its parent (or itself) followed by the parent's sub-communities.
+// Nothing is returned if there are no sub-communities.
+func getCommunityChannels(communities community) []community {
+	parent := community{ID: communities.ID, Title: communities.Title}
+	if communities.Parent >= 0 {
+		parent = community{ID: communities.Parent, Title: communities.ParentTitle}
+	}
+	children := getCommunityChildren(parent.ID)
+	if len(children) == 0 {
+		return nil
+	}
+	return append([]community{parent}, children...)
+}
+
+// Get the tags in a comma separated list, lowercased and without their #s.
+func parseCommunityTags(tagList string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(tagList, ",") {
+		tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+		if len(tag) == 0 {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > 32 {
+			return nil, errors.New("Tags can't be longer than 32 characters.")
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > 10 {
+		return nil, errors.New("Communities can't have more than 10 tags.")
+	}
+	return tags, nil
+}
+
+// Replace a community's tags with new ones from parseCommunityTags().
+func setCommunityTags(communityID interface{}, tags []string) error {
+	_, err := db.Exec("DELETE FROM community_tags WHERE community = ?", communityID)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = db.Exec("INSERT IGNORE INTO community_tags (community, tag) VALUES (?, ?)", communityID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get a user's membership status in a community.
+// -1 - none, 0 - requested to join, 1 - member, 2 - invited
+func getCommunityMembership(communityID interface{}, userID int) int {
+	status := -1
+	db.QueryRow("SELECT status FROM community_members WHERE community = ? AND user = ?", communityID, userID).Scan(&status)
+	return status
+}
+
+// Check if a user can see and take part in a community, which they can if it isn't private or they're a member, moderator or owner.
+func checkIfCommunityMember(communityID interface{}, currentUser user) bool {
+	var visibility int
+	db.QueryRow("SELECT visibility FROM communities WHERE id = ?", communityID).Scan(&visibility)
+	if visibility == 0 || checkIfCommunityModerator(communityID, currentUser) {
+		return true
+	}
+	return getCommunityMembership(communityID, currentUser.ID) == 1
+}
+
+// Get an SQL condition that leaves out posts from private communities the user isn't a member of.
+// The column is whatever holds the community ID of the post being checked.
+func getCommunityMembershipFilter(column string, currentUser user) string {
+	if currentUser.Level >= admin.Manage.MinimumLevel {
+		return "TRUE"
+	}
+	userID := strconv.Itoa(currentUser.ID)
+	return column + " NOT IN (SELECT id FROM communities WHERE visibility > 0 AND IFNULL(owner, 0) != " + userID + " AND id NOT IN (SELECT community FROM community_members WHERE user = " + userID + " AND status = 1) AND id NOT IN (SELECT community FROM community_moderators WHERE user = " + userID + "))"
+}
+
+// Check if a user is banned from a community.
+func checkIfCommunityBanned(communityID interface{}, userID int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM community_bans WHERE community = ? AND user = ? AND until > NOW()", communityID, userID).Scan(&count)
+	return count > 0
+}
+
+// Get a community's rules in the order they're shown in.
+func getCommunityRules(communityID interface{}) []communityRule {
+	var rules []communityRule
+	rows, err := db.Query("SELECT id, position, title, body FROM community_rules WHERE community = ? ORDER BY position ASC, id ASC", communityID)
+	if err != nil {
+		return rules
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row communityRule
+		rows.Scan(&row.ID, &row.Position, &row.Title, &row.Body)
+		rules = append(rules, row)
+	}
+	return rules
+}
+
+// Check if a user has agreed to a community's current rules.
+func checkIfAgreedToCommunityRules(communityID interface{}, userID int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM community_rule_agreements WHERE community = ? AND user = ?", communityID, userID).Scan(&count)
+	return count > 0
+}
+
+// Get the flairs people can pick from when posting to a community.
+func getCommunityFlairs(communityID interface{}) []communityFlair {
+	var flairs []communityFlair
+	rows, err := db.Query("SELECT id, name, color FROM community_flairs WHERE community = ? ORDER BY name ASC", communityID)
+	if err != nil {
+		return flairs
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row communityFlair
+		rows.Scan(&row.ID, &row.Name, &row.Color)
+		flairs = append(flairs, row)
+	}
+	return flairs
+}
+
+// Get a community's own report reasons, which are offered alongside the site-wide ones.
+func getCommunityReportReasons(communityID interface{}) []communityReportReason {
+	var reasons []communityReportReason
+	rows, err := db.Query("SELECT id, name, body_required FROM community_report_reasons WHERE community = ? ORDER BY id ASC", communityID)
+	if err != nil {
+		return reasons
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row communityReportReason
+		rows.Scan(&row.ID, &row.Name, &row.BodyRequired)
+		reasons = append(reasons, row)
+	}
+	return reasons
+}
+
+// Work out which reason a report was made for from the value of the report form.
+// Site-wide reasons are sent as their index, spoilers as "spoiler" and community reasons as "c" followed by their ID.
+// Reports for community reasons are stored with a reason of -1 and the ID of the community reason.
+// The second-to-last value says whether the reason needs a message to go with it.
+func getReportReason(value string, communityID interface{}) (int, sql.NullInt64, string, bool, bool) {
+	var communityReason sql.NullInt64
+	if value == "spoiler" {
+		return 0, communityReason, settings.ReportReasons[0].Name, false, true
+	}
+	if strings.HasPrefix(value, "c") {
+		var name string
+		var bodyRequired bool
+		db.QueryRow("SELECT id, name, body_required FROM community_report_reasons WHERE id = ? AND community = ?", value[1:], communityID).Scan(&communityReason, &name, &bodyRequired)
+		return -1, communityReason, name, bodyRequired, communityReason.Valid
+	}
+	reason, err := strconv.Atoi(value)
+	if err != nil || reason <= 0 || reason >= len(settings.ReportReasons) || !settings.ReportReasons[reason].Enabled {
+		return 0, communityReason, "", false, false
+	}
+	return reason, communityReason, settings.ReportReasons[reason].Name, settings.ReportReasons[reason].BodyRequired, true
+}
+
+// Add an entry to a community's moderation log.
+func logCommunityModAction(communityID interface{}, entryType int, context interface{}, target int, currentUser user) {
+	var targetID sql.NullInt64
+	if target > 0 {
+		targetID = sql.NullInt64{Int64: int64(target), Valid: true}
+	}
+	db.Exec("INSERT INTO community_mod_log (community, type, context, target, created_by) VALUES (?, ?, ?, ?, ?)", communityID, entryType, context, targetID, currentUser.ID)
+}
+
 // Render a user's avatar as a Mii URL with an emotion or return it if it's not a Mii.
 func getAvatar(avatar string, hasMii bool, feeling int) string {
 	const url = "https://mii-secure.cdn.nintendo.net/%s_%s_face.png"
@@ -756,7 +2334,7 @@ func getCommentPreview(postID int, currentUser user) comment {
 	var editedAt time.Time
 	var role int
 
-	db.QueryRow("SELECT comments.id, created_at, edited_at, feeling, body, post_type, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments INNER JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND is_spoiler = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) ORDER BY comments.id DESC LIMIT 1", postID, currentUser.ID, currentUser.ID, currentUser.ID, currentUser.Level, currentUser.ID, escapeForbiddenKeywords(currentUser.ForbiddenKeywords)).Scan(&commentPreview.ID, &timestamp, &editedAt, &commentPreview.Feeling, &commentPreview.BodyText, &commentPreview.PostType, &commentPreview.CommenterUsername, &commentPreview.CommenterNickname, &commentPreview.CommenterIcon, &commentPreview.CommenterHasMii, &commentPreview.CommenterOnline, &commentPreview.CommenterHideOnline, &commentPreview.CommenterColor, &role)
+	db.QueryRow("SELECT comments.id, created_at, edited_at, feeling, body, post_type, username, nickname, avatar, has_mh, online, hide_online, color, role FROM comments INNER JOIN users ON users.id = created_by WHERE post = ? AND is_rm = 0 AND is_rm_by_admin = 0 AND is_spoiler = 0 AND (users.id NOT IN (SELECT if(source = ?, target, source) FROM blocks WHERE (source = ? AND target = users.id) OR (source = users.id AND target = ?)) OR ? > 0) AND (users.limited = 0 OR users.id = ? OR ? > 0) AND (comments.pending = 0 OR comments.created_by = ?) AND IF(created_by = ?, true, LOWER(body) NOT REGEXP LOWER(?)) ORDER BY comments.id DESC LIMIT 1", postID, currentUser.ID, currentUser.ID, currentUser.ID, currentUser.Level, currentUser.ID, currentUser.Level, currentUser.ID, currentUser.ID, escapeForbiddenKeywords(currentUser.ForbiddenKeywords)).Scan(&commentPreview.ID, &timestamp, &editedAt, &commentPreview.Feeling, &commentPreview.BodyText, &commentPreview.PostType, &commentPreview.CommenterUsername, &commentPreview.CommenterNickname, &commentPreview.CommenterIcon, &commentPreview.CommenterHasMii, &commentPreview.CommenterOnline, &commentPreview.CommenterHideOnline, &commentPreview.CommenterColor, &role)
 	commentPreview.CommenterIcon = getAvatar(commentPreview.CommenterIcon, commentPreview.CommenterHasMii, commentPreview.Feeling)
 	if role > 0 {
 		commentPreview.CommenterRoleImage = getRoleImage(role)
@@ -772,6 +2350,278 @@ func getCommentPreview(postID int, currentUser user) comment {
 	return commentPreview
 }
 
+// How many revisions of a post or comment are shown, newest first.
+const revisionLimit = 50
+
+// The most words times words two versions can have before they're shown whole instead of compared, since comparing them takes that much memory.
+const diffCellLimit = 1000000
+
+// Split text into words and the whitespace between them, then work out which words were added and removed between two versions.
+func diffText(before string, after string) []diffPart {
+	var parts []diffPart
+	a := diffTokens.FindAllString(before, -1)
+	b := diffTokens.FindAllString(after, -1)
+	if len(a)*len(b) > diffCellLimit {
+		return []diffPart{{Text: before, Removed: true}, {Text: after, Added: true}}
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]uint16, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]uint16, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Consecutive tokens of the same kind are merged into one part.
+	add := func(text string, added bool, removed bool) {
+		if len(parts) > 0 && parts[len(parts)-1].Added == added && parts[len(parts)-1].Removed == removed {
+			parts[len(parts)-1].Text += text
+			return
+		}
+		parts = append(parts, diffPart{Text: text, Added: added, Removed: removed})
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			add(a[i], false, false)
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			add(a[i], false, true)
+			i++
+		} else {
+			add(b[j], true, false)
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add(a[i], false, true)
+	}
+	for ; j < len(b); j++ {
+		add(b[j], true, false)
+	}
+	return parts
+}
+
+// Check if someone can see the edit history of a post or comment. The post ID is the post itself or the post a comment is on.
+// Staff can see the history of anything, even after it's removed, and so can its author and the community's moderators.
+// Everyone else can only see it on posts they can otherwise see.
+func checkIfCanSeeRevisions(createdBy int, communityID int, postID int, removed bool, hidden bool, viewer user) bool {
+	if viewer.Level > 0 || viewer.ID == createdBy || checkIfCommunityModerator(communityID, viewer) {
+		return true
+	}
+	return !removed && !hidden && !checkIfEitherBlocked(createdBy, viewer.ID) && checkIfCanSeePost(postID, viewer)
+}
+
+// Get the latest versions of a post or comment, newest first, each compared to the one before it.
+// The current version isn't stored in the revisions table, so it has to be passed in.
+func getRevisions(id interface{}, onComment bool, body string, editedAt time.Time, currentUser user) []revision {
+	var revisions []revision
+	revision_rows, err := db.Query("SELECT id, body, created_at FROM (SELECT id, body, created_at FROM revisions WHERE post = ? AND on_comment = ? ORDER BY id DESC LIMIT ?) AS latest ORDER BY id ASC", id, onComment, revisionLimit-1)
+	if err != nil {
+		return revisions
+	}
+	for revision_rows.Next() {
+		var row revision
+		var createdAt time.Time
+		revision_rows.Scan(&row.ID, &row.Body, &createdAt)
+		row.CreatedAt = humanTiming(createdAt, currentUser.Timezone)
+		row.CreatedAtUnix = createdAt.Unix()
+		revisions = append(revisions, row)
+	}
+	revision_rows.Close()
+	revisions = append(revisions, revision{Body: body, CreatedAt: humanTiming(editedAt, currentUser.Timezone), CreatedAtUnix: editedAt.Unix(), Current: true})
+
+	for i := range revisions {
+		if i == 0 {
+			revisions[i].Diff = []diffPart{{Text: revisions[i].Body}}
+		} else {
+			revisions[i].Diff = diffText(revisions[i-1].Body, revisions[i].Body)
+		}
+	}
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+	return revisions
+}
+
+// Check content against the automod rules and record any hits.
+// Content types are 0 for posts, 1 for comments, 2 for messages and 3 for profiles.
+func checkAutomod(currentUser user, contentType int, body string, hasAttachment bool) automodResult {
+	var result automodResult
+	if currentUser.Level > 0 {
+		return result
+	}
+
+	rows, err := db.Query("SELECT id, name, condition_type, value, action, dry_run FROM automod_rules WHERE enabled = 1 ORDER BY id ASC")
+	if err != nil {
+		fmt.Println(err)
+		return result
+	}
+	var rules []automodRule
+	for rows.Next() {
+		var rule automodRule
+		rows.Scan(&rule.ID, &rule.Name, &rule.ConditionType, &rule.Value, &rule.Action, &rule.DryRun)
+		rules = append(rules, rule)
+	}
+	rows.Close()
+
+	for _, rule := range rules {
+		if !matchAutomodRule(rule, currentUser, contentType, body, hasAttachment) {
+			continue
+		}
+		db.Exec("INSERT INTO automod_hits (rule, user, type, dry_run) VALUES (?, ?, ?, ?)", rule.ID, currentUser.ID, contentType, rule.DryRun)
+		if rule.DryRun {
+			continue
+		}
+		result.Rules = append(result.Rules, rule.Name)
+		switch rule.Action {
+		case 0:
+			result.Block = true
+		case 1:
+			result.Hold = true
+		case 2:
+			result.Report = true
+		case 3:
+			result.Spoiler = true
+		case 4:
+			result.Limit = true
+		}
+	}
+
+	if result.Limit && !currentUser.Limited {
+		db.Exec("UPDATE users SET limited = 1 WHERE id = ?", currentUser.ID)
+	}
+	return result
+}
+
+// Check if a single automod rule matches a piece of content.
+func matchAutomodRule(rule automodRule, currentUser user, contentType int, body string, hasAttachment bool) bool {
+	switch rule.ConditionType {
+	case 0:
+		// regex
+		regex, err := getAutomodRegex(rule.Value)
+		if err != nil {
+			return false
+		}
+		return regex.MatchString(body)
+	case 1:
+		// link domain
+		for _, match := range links.FindAllStringSubmatch(body, -1) {
+			host := strings.TrimSuffix(strings.ToLower(match[1]), ".")
+			for _, domain := range strings.Split(rule.Value, ",") {
+				domain = strings.ToLower(strings.TrimSpace(domain))
+				if len(domain) > 0 && (host == domain || strings.HasSuffix(host, "."+domain)) {
+					return true
+				}
+			}
+		}
+	case 2:
+		// account age in hours
+		var isNew bool
+		db.QueryRow("SELECT created_at > NOW() - INTERVAL ? HOUR FROM profiles WHERE user = ?", rule.Value, currentUser.ID).Scan(&isNew)
+		return isNew
+	case 3:
+		// velocity as count/seconds
+		tables := []string{"posts", "comments", "messages"}
+		if contentType >= len(tables) {
+			return false
+		}
+		limit := strings.SplitN(rule.Value, "/", 2)
+		if len(limit) != 2 {
+			return false
+		}
+		count, _ := strconv.Atoi(limit[0])
+		seconds, _ := strconv.Atoi(limit[1])
+		var recent int
+		db.QueryRow("SELECT COUNT(*) FROM "+tables[contentType]+" WHERE created_by = ? AND created_at > NOW() - INTERVAL ? SECOND", currentUser.ID, seconds).Scan(&recent)
+		return recent >= count
+	case 4:
+		// attachment present
+		return hasAttachment
+	}
+	return false
+}
+
+// Get the compiled version of an automod regex, compiling it the first time it's seen.
+// Rules are looked up by their pattern, so editing a rule's pattern compiles the new one.
+func getAutomodRegex(pattern string) (*regexp.Regexp, error) {
+	automodRegexesLock.RLock()
+	regex, ok := automodRegexes[pattern]
+	automodRegexesLock.RUnlock()
+	if ok {
+		return regex, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	automodRegexesLock.Lock()
+	automodRegexes[pattern] = regex
+	automodRegexesLock.Unlock()
+	return regex, nil
+}
+
+// Check if an automod rule's value is valid for its condition. Returns an error message, or an empty string if it's valid.
+func checkAutomodRule(rule automodRule) string {
+	if len(rule.Name) == 0 || utf8.RuneCountInString(rule.Name) > 64 {
+		return "The rule name must be between 1 and 64 characters."
+	}
+	if rule.ConditionType < 0 || rule.ConditionType > 4 {
+		return "Invalid condition."
+	}
+	if rule.Action < 0 || rule.Action > 4 {
+		return "Invalid action."
+	}
+	if len(rule.Value) > 1024 {
+		return "The rule value is too long."
+	}
+	switch rule.ConditionType {
+	case 0:
+		if _, err := getAutomodRegex(rule.Value); err != nil {
+			return "Invalid regular expression: " + err.Error()
+		}
+	case 1:
+		if len(strings.TrimSpace(rule.Value)) == 0 {
+			return "You must specify at least one domain."
+		}
+	case 2:
+		if hours, err := strconv.Atoi(rule.Value); err != nil || hours < 1 {
+			return "The account age must be a number of hours."
+		}
+	case 3:
+		limit := strings.SplitN(rule.Value, "/", 2)
+		if len(limit) != 2 {
+			return "The velocity must be written as count/seconds."
+		}
+		count, err := strconv.Atoi(limit[0])
+		seconds, err2 := strconv.Atoi(limit[1])
+		if err != nil || err2 != nil || count < 1 || seconds < 1 {
+			return "The velocity must be written as count/seconds."
+		}
+	}
+	return ""
+}
+
+// File a report on content that tripped the automod.
+// These have no reporter, so they don't count as reports made by anyone.
+func createAutomodReport(reportType int, pid int, rules []string) {
+	message := "Automod: " + strings.Join(rules, ", ")
+	if utf8.RuneCountInString(message) > 100 {
+		message = string([]rune(message)[:100])
+	}
+	db.Exec("INSERT INTO reports (type, pid, user, reason, message) VALUES (?, ?, NULL, 0, ?)", reportType, pid, message)
+}
+
 // Check if a string violates a user's forbidden keywords.
 func inForbiddenKeywords(text string, userID int) bool {
 	var forbiddenKeywords string
@@ -808,18 +2658,840 @@ func getHostname(host string) string {
 func getIP(r *http.Request) string {
 	ForwardedForHeader := r.Header.Get("X-Forwarded-For")
 	if settings.Proxy && len(ForwardedForHeader) > 0 { // Proxy sites like Cloudflare mask the IP, so grab that from the headers... if it's set in the settings, that is; otherwise, people could fake this and we'd have an impersonation exploit on our hands. (Looking at you, Seth)
-		//ips := strings.Split(r.Header.Get("X-Forwarded-For"), ", ")
-		//return ips[0] + settings.Port
-		return ForwardedForHeader + ":0"
+		// The first address is the client's, anything after it is a proxy along the way.
+		// JoinHostPort puts brackets around IPv6 addresses so they can be split up again.
+		ip := strings.TrimSpace(strings.Split(ForwardedForHeader, ",")[0])
+		return net.JoinHostPort(ip, "0")
 	} else {
 		return r.RemoteAddr
 	}
 }
 
-// Get a poll from an ID.
-func getPoll(pollID int, userID int) poll {
+// Read the images attached to a post, comment or message from its form, in the order they were added.
+// Each image can have alt text and a spoiler flag, sent in the same order as the images themselves.
+func getFormAttachments(form url.Values) ([]attachment, error) {
+	var attachments []attachment
+	for i, image := range form["image"] {
+		if len(image) == 0 {
+			continue
+		}
+		if len(attachments) >= settings.MaxImages {
+			return nil, errors.New("You can't attach more than " + strconv.Itoa(settings.MaxImages) + " images.")
+		}
+		var row attachment
+		db.QueryRow("SELECT id, value, format, duration, poster FROM images WHERE id = ?", image).Scan(&row.ImageID, &row.URL, &row.Format, &row.Duration, &row.Poster)
+		if len(row.URL) == 0 {
+			return nil, errors.New("Invalid image.")
+		}
+		// Images are shared between everyone who uploads the same file, so descriptions only belong to where they're attached.
+		if i < len(form["image_alt"]) {
+			row.Alt = strings.TrimSpace(form["image_alt"][i])
+			if utf8.RuneCountInString(row.Alt) > 1000 {
+				return nil, errors.New("Image descriptions can't be longer than 1000 characters.")
+			}
+		}
+		row.IsSpoiler = i < len(form["image_spoiler"]) && form["image_spoiler"][i] == "1"
+		row.Position = len(attachments)
+		attachments = append(attachments, row)
+	}
+	return attachments, nil
+}
+
+// Save the images attached to a post (0), comment (1) or message (2).
+func saveAttachments(attachmentType int, target int, attachments []attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	var values []string
+	var args []interface{}
+	for _, row := range attachments {
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, attachmentType, target, row.ImageID, row.Position, row.IsSpoiler, row.Alt)
+	}
+	_, err := db.Exec("INSERT INTO attachments (type, target, image, position, is_spoiler, alt) VALUES "+strings.Join(values, ", "), args...)
+	return err
+}
+
+// Get the images attached to a post (0), comment (1) or message (2).
+// Things made before there could be more than one image won't have any, and only use their image column.
+func getAttachments(attachmentType int, target int) []attachment {
+	return getAttachmentsFor(attachmentType, []int{target})[target]
+}
+
+// Get the images attached to a page of posts, comments or messages in one query, keyed by what they're attached to.
+func getAttachmentsFor(attachmentType int, targets []int) map[int][]attachment {
+	attachments := make(map[int][]attachment)
+	if len(targets) == 0 {
+		return attachments
+	}
+	args := []interface{}{attachmentType}
+	var placeholders []string
+	for _, target := range targets {
+		args = append(args, target)
+		placeholders = append(placeholders, "?")
+	}
+	attachment_rows, err := db.Query("SELECT target, image, value, position, is_spoiler, attachments.alt, format, duration, poster FROM attachments LEFT JOIN images ON images.id = image WHERE type = ? AND target IN ("+strings.Join(placeholders, ", ")+") ORDER BY target, position ASC", args...)
+	if err != nil {
+		return attachments
+	}
+	defer attachment_rows.Close()
+	for attachment_rows.Next() {
+		var target int
+		var row attachment
+		attachment_rows.Scan(&target, &row.ImageID, &row.URL, &row.Position, &row.IsSpoiler, &row.Alt, &row.Format, &row.Duration, &row.Poster)
+		attachments[target] = append(attachments[target], row)
+	}
+	return attachments
+}
+
+// Check if something's images are in the attachments table, rather than only its image column.
+func hasAttachments(image string, attachmentType int) bool {
+	return len(image) > 0 && (attachmentType == 0 || attachmentType == 3)
+}
+
+// Load the images attached to posts and whatever they repost, all at once.
+func setupPostAttachments(posts ...*post) {
+	var ids []int
+	for _, row := range posts {
+		for repost := row; repost != nil; repost = repost.Repost {
+			if hasAttachments(repost.Image, repost.AttachmentType) {
+				ids = append(ids, repost.ID)
+			}
+		}
+	}
+	attachments := getAttachmentsFor(0, ids)
+	for _, row := range posts {
+		for repost := row; repost != nil; repost = repost.Repost {
+			if hasAttachments(repost.Image, repost.AttachmentType) {
+				repost.Attachments = attachments[repost.ID]
+			}
+		}
+	}
+}
+
+// Load the images attached to a page of comments all at once.
+func setupCommentAttachments(comments []comment) {
+	var ids []int
+	for _, row := range comments {
+		if hasAttachments(row.Image, row.AttachmentType) {
+			ids = append(ids, row.ID)
+		}
+	}
+	attachments := getAttachmentsFor(1, ids)
+	for i, row := range comments {
+		if hasAttachments(row.Image, row.AttachmentType) {
+			comments[i].Attachments = attachments[row.ID]
+		}
+	}
+}
+
+// Load the images attached to a page of messages all at once.
+func setupMessageAttachments(messages []*message) {
+	var ids []int
+	for _, row := range messages {
+		if hasAttachments(row.Image, row.AttachmentType) {
+			ids = append(ids, row.ID)
+		}
+	}
+	attachments := getAttachmentsFor(2, ids)
+	for _, row := range messages {
+		if hasAttachments(row.Image, row.AttachmentType) {
+			row.Attachments = attachments[row.ID]
+		}
+	}
+}
+
+// Read a drawing's alt text from its form.
+func getFormPaintingAlt(form url.Values) (string, error) {
+	alt := strings.TrimSpace(form.Get("painting_alt"))
+	if utf8.RuneCountInString(alt) > 1000 {
+		return "", errors.New("Image descriptions can't be longer than 1000 characters.")
+	}
+	return alt, nil
+}
+
+// Check if image posts and drawings in a community need alt text.
+func checkIfAltTextRequired(communityID interface{}) bool {
+	for _, id := range settings.AltTextCommunities {
+		if strconv.Itoa(id) == fmt.Sprint(communityID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out how the attachments on a post, comment or message are shown.
+// Clips always get a player of their own, so they can't be attached alongside anything else.
+func getAttachmentType(attachmentType string, attachments []attachment) (string, error) {
+	for _, row := range attachments {
+		if row.Duration == 0 {
+			continue
+		}
+		if len(attachments) > 1 {
+			return "", errors.New("Clips have to be posted on their own.")
+		}
+		return "3", nil
+	}
+	if len(attachmentType) == 0 || attachmentType == "3" {
+		return "0", nil
+	}
+	return attachmentType, nil
+}
+
+// The biggest frame a GIF can have and the most frames it can have, so taking posters from them stays cheap.
+const maxClipPixels = 4096 * 4096
+const maxGIFFrames = 3000
+
+// Check an upload's container to see if it's a clip, and get its format and length in seconds if so.
+// Only MP4 and WebM videos and animated GIFs count, anything else is left alone with a length of 0.
+func getClipInfo(data []byte) (string, float64, error) {
+	switch http.DetectContentType(data) {
+	case "video/mp4":
+		duration, err := getMP4Duration(data)
+		return "mp4", duration, err
+	case "video/webm":
+		duration, err := getWebMDuration(data)
+		return "webm", duration, err
+	case "image/gif":
+		duration, err := getGIFDuration(data)
+		if duration == 0 {
+			return "", 0, err
+		}
+		return "gif", duration, err
+	}
+	return "", 0, nil
+}
+
+// Get the length of an animated GIF in seconds by walking its blocks, or 0 if it only has one frame.
+// Nothing is decoded here, and GIFs too big to safely take a poster from are turned away.
+func getGIFDuration(data []byte) (float64, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil || len(data) < 13 {
+		return 0, errors.New("Invalid GIF.")
+	}
+	if config.Width*config.Height > maxClipPixels {
+		return 0, errors.New("GIFs can't be bigger than " + strconv.Itoa(maxClipPixels/1000000) + " megapixels.")
+	}
+
+	// Skip the header, the screen descriptor and the global color table if there is one.
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	// Skip a run of sub-blocks, which ends with an empty one.
+	skipSubBlocks := func() bool {
+		for i < len(data) {
+			size := int(data[i])
+			i += size + 1
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var frames int
+	var duration float64
+	delay := -1
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension
+			if i+1 >= len(data) {
+				return 0, errors.New("Invalid GIF.")
+			}
+			// Graphic control extensions hold the delay before the frame after them.
+			if data[i+1] == 0xF9 && i+6 < len(data) && data[i+2] == 4 {
+				delay = int(data[i+4]) | int(data[i+5])<<8
+			}
+			i += 2
+			if !skipSubBlocks() {
+				return 0, errors.New("Invalid GIF.")
+			}
+		case 0x2C: // frame
+			if i+10 > len(data) {
+				return 0, errors.New("Invalid GIF.")
+			}
+			if int(binary.LittleEndian.Uint16(data[i+5:]))*int(binary.LittleEndian.Uint16(data[i+7:])) > maxClipPixels {
+				return 0, errors.New("GIFs can't be bigger than " + strconv.Itoa(maxClipPixels/1000000) + " megapixels.")
+			}
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&0x07 + 1)
+			}
+			// Skip the LZW code size, then the image data.
+			i++
+			if !skipSubBlocks() {
+				return 0, errors.New("Invalid GIF.")
+			}
+			frames++
+			if frames > maxGIFFrames {
+				return 0, errors.New("GIFs can't have more than " + strconv.Itoa(maxGIFFrames) + " frames.")
+			}
+			// Browsers play frames with hardly any delay at 10 per second, so they're counted that way too.
+			if delay < 2 {
+				delay = 10
+			}
+			duration += float64(delay) / 100
+			delay = -1
+		case 0x3B: // trailer
+			i = len(data)
+		default:
+			return 0, errors.New("Invalid GIF.")
+		}
+	}
+	if frames < 2 {
+		return 0, nil
+	}
+	return duration, nil
+}
+
+// Find the contents of every box along a path in an MP4 file, like moov then mvhd.
+func findMP4Boxes(data []byte, path ...string) ([][]byte, error) {
+	var boxes [][]byte
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("Invalid MP4 file.")
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				return nil, errors.New("Invalid MP4 file.")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			headerSize = 16
+		} else if size == 0 {
+			// The last box can run to the end of the file.
+			size = uint64(len(data))
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errors.New("Invalid MP4 file.")
+		}
+		if boxType == path[0] {
+			if len(path) == 1 {
+				boxes = append(boxes, data[headerSize:size])
+			} else {
+				children, err := findMP4Boxes(data[headerSize:size], path[1:]...)
+				if err != nil {
+					return nil, err
+				}
+				boxes = append(boxes, children...)
+			}
+		}
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// Get the length of an MP4 video in seconds, or 0 if it doesn't have a video track.
+func getMP4Duration(data []byte) (float64, error) {
+	handlers, err := findMP4Boxes(data, "moov", "trak", "mdia", "hdlr")
+	if err != nil {
+		return 0, err
+	}
+	hasVideo := false
+	for _, handler := range handlers {
+		if len(handler) >= 12 && string(handler[8:12]) == "vide" {
+			hasVideo = true
+		}
+	}
+	if !hasVideo {
+		return 0, nil
+	}
+
+	headers, err := findMP4Boxes(data, "moov", "mvhd")
+	if err != nil {
+		return 0, err
+	}
+	if len(headers) != 1 {
+		return 0, errors.New("Invalid MP4 file.")
+	}
+	var timescale, duration uint64
+	header := headers[0]
+	if len(header) >= 32 && header[0] == 1 {
+		timescale = uint64(binary.BigEndian.Uint32(header[20:]))
+		duration = binary.BigEndian.Uint64(header[24:])
+	} else if len(header) >= 20 {
+		timescale = uint64(binary.BigEndian.Uint32(header[12:]))
+		duration = uint64(binary.BigEndian.Uint32(header[16:]))
+		if duration == math.MaxUint32 {
+			duration = 0
+		}
+	}
+	// Fragmented videos leave the length out of the header and put it here instead.
+	if duration == 0 {
+		fragmentHeaders, err := findMP4Boxes(data, "moov", "mvex", "mehd")
+		if err != nil {
+			return 0, err
+		}
+		for _, fragmentHeader := range fragmentHeaders {
+			if len(fragmentHeader) >= 12 && fragmentHeader[0] == 1 {
+				duration = binary.BigEndian.Uint64(fragmentHeader[4:])
+			} else if len(fragmentHeader) >= 8 {
+				duration = uint64(binary.BigEndian.Uint32(fragmentHeader[4:]))
+			}
+		}
+	}
+	if timescale == 0 || duration == 0 {
+		return 0, errors.New("Couldn't work out how long this video is.")
+	}
+	return float64(duration) / float64(timescale), nil
+}
+
+// Read a variable length number from the start of part of a WebM file, along with how many bytes it took up.
+// Element IDs keep their length marker, sizes don't, and sizes with every bit set are unknown.
+func readEBMLNumber(data []byte, isID bool) (uint64, int, error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, errors.New("Invalid WebM file.")
+	}
+	length := bits.LeadingZeros8(data[0]) + 1
+	if len(data) < length || (isID && length > 4) {
+		return 0, 0, errors.New("Invalid WebM file.")
+	}
+	value := uint64(data[0])
+	if !isID {
+		value &= uint64(0xFF >> length)
+	}
+	unknown := !isID && value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+		unknown = unknown && data[i] == 0xFF
+	}
+	if unknown {
+		return math.MaxUint64, length, nil
+	}
+	return value, length, nil
+}
+
+// Find the contents of every element along a path in a WebM file, like Segment then Info.
+func findEBMLElements(data []byte, path ...uint64) ([][]byte, error) {
+	var elements [][]byte
+	for len(data) > 0 {
+		id, idLength, err := readEBMLNumber(data, true)
+		if err != nil {
+			return nil, err
+		}
+		size, sizeLength, err := readEBMLNumber(data[idLength:], false)
+		if err != nil {
+			return nil, err
+		}
+		data = data[idLength+sizeLength:]
+		// Elements of an unknown size, like the segments of recorded videos, run to the end of whatever they're in.
+		if size == math.MaxUint64 {
+			size = uint64(len(data))
+		} else if size > uint64(len(data)) {
+			return nil, errors.New("Invalid WebM file.")
+		}
+		if id == path[0] {
+			if len(path) == 1 {
+				elements = append(elements, data[:size])
+			} else {
+				children, err := findEBMLElements(data[:size], path[1:]...)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, children...)
+			}
+		}
+		data = data[size:]
+	}
+	return elements, nil
+}
+
+// Get the length of a WebM video in seconds, or 0 if it doesn't have a video track.
+func getWebMDuration(data []byte) (float64, error) {
+	const (
+		ebmlHeader    = 0x1A45DFA3
+		docType       = 0x4282
+		segment       = 0x18538067
+		info          = 0x1549A966
+		timecodeScale = 0x2AD7B1
+		duration      = 0x4489
+		tracks        = 0x1654AE6B
+		trackEntry    = 0xAE
+		trackType     = 0x83
+	)
+	docTypes, err := findEBMLElements(data, ebmlHeader, docType)
+	if err != nil {
+		return 0, err
+	}
+	if len(docTypes) != 1 || string(docTypes[0]) != "webm" {
+		return 0, errors.New("Invalid WebM file.")
+	}
+
+	trackTypes, err := findEBMLElements(data, segment, tracks, trackEntry, trackType)
+	if err != nil {
+		return 0, err
+	}
+	hasVideo := false
+	for _, row := range trackTypes {
+		if len(row) == 1 && row[0] == 1 {
+			hasVideo = true
+		}
+	}
+	if !hasVideo {
+		return 0, nil
+	}
+
+	// Durations are counted in ticks, which are a millisecond unless the file says otherwise.
+	scale := uint64(1000000)
+	scales, err := findEBMLElements(data, segment, info, timecodeScale)
+	if err != nil {
+		return 0, err
+	}
+	if len(scales) == 1 && len(scales[0]) > 0 && len(scales[0]) <= 8 {
+		scale = 0
+		for _, b := range scales[0] {
+			scale = scale<<8 | uint64(b)
+		}
+	}
+	durations, err := findEBMLElements(data, segment, info, duration)
+	if err != nil {
+		return 0, err
+	}
+	var ticks float64
+	if len(durations) == 1 && len(durations[0]) == 4 {
+		ticks = float64(math.Float32frombits(binary.BigEndian.Uint32(durations[0])))
+	} else if len(durations) == 1 && len(durations[0]) == 8 {
+		ticks = math.Float64frombits(binary.BigEndian.Uint64(durations[0]))
+	}
+	if !(ticks > 0) || scale == 0 {
+		return 0, errors.New("Couldn't work out how long this video is.")
+	}
+	return ticks * float64(scale) / 1e9, nil
+}
+
+// Take a still from the start of a clip to show before it's played, as a PNG.
+// Videos need ffmpeg for this and go without one if it isn't set up.
+func getClipPoster(data []byte, format string) ([]byte, error) {
+	var poster bytes.Buffer
+	if format == "gif" {
+		frame, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		err = png.Encode(&poster, frame)
+		return poster.Bytes(), err
+	}
+	if len(settings.Clips.FFmpegPath) == 0 {
+		return nil, nil
+	}
+	// Only a couple of ffmpegs run at once, and clips uploaded while they're busy go without a poster.
+	select {
+	case ffmpegSlots <- struct{}{}:
+		defer func() { <-ffmpegSlots }()
+	default:
+		return nil, nil
+	}
+
+	// MP4 files can keep their index at the end, so ffmpeg has to be able to seek through them.
+	input, err := ioutil.TempFile("", "clip-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(input.Name())
+	_, err = input.Write(data)
+	input.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	// The input format is forced to what was checked, since ffmpeg would otherwise guess it from the contents,
+	// and formats like playlists could have it fetch URLs or read other files.
+	cmd := exec.CommandContext(ctx, settings.Clips.FFmpegPath, "-loglevel", "error", "-protocol_whitelist", "file", "-f", format, "-i", input.Name(), "-frames:v", "1", "-f", "image2", "-c:v", "png", "pipe:1")
+	cmd.Stdout = &poster
+	err = cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+	return poster.Bytes(), nil
+}
+
+// Store an upload with the configured image host and get its URL.
+// The name is what it's saved as when it's stored locally, extension aside.
+func storeUpload(file io.Reader, filename string, contentType string, name string) (string, error) {
+	switch settings.ImageHost.Provider {
+	case "cloudinary":
+		bodyData := &bytes.Buffer{}
+		writer := multipart.NewWriter(bodyData)
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			return "", err
+		}
+		io.Copy(part, file)
+		writer.WriteField("upload_preset", settings.ImageHost.UploadPreset)
+		writer.Close()
+
+		resp, err := http.Post(settings.ImageHost.APIEndpoint+"/v1_1/"+settings.ImageHost.Username+"/auto/upload", writer.FormDataContentType(), bodyData)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+
+		jsonBody := make(map[string]interface{})
+		json.Unmarshal(body, &jsonBody)
+
+		image, ok := jsonBody["secure_url"].(string)
+		if !ok {
+			return "", errors.New("cloudinary sent an unexpected response: \n" + string(body))
+		}
+		return image, nil
+	case "local":
+		fileExtension := filepath.Ext(filename)
+		if fileExtension == "" {
+			// if extension is not provided then use mime type
+			extensions, err := mime.ExtensionsByType(contentType)
+			if err == nil && len(extensions) != 0 {
+				fileExtension = extensions[0] // Use the first extension in the list
+			}
+		}
+		imageFilePath := settings.ImageHost.ImageEndpoint + "/" + name + fileExtension
+		outputFile, err := os.Create(imageFilePath)
+		if err != nil {
+			return "", errors.New("Could not create output file: " + err.Error())
+		}
+		defer outputFile.Close()
+
+		_, err = io.Copy(outputFile, file)
+		if err != nil {
+			return "", err
+		}
+
+		// NOW ADD SLASH BEFORE IMAGEFILEPATH I DON'T F&CKING KNOW
+		return "/" + imageFilePath, nil
+		/*	case "lambda": // WIP
+				file := &bytes.Buffer{}
+				writer := multipart.NewWriter(file)
+				part, err := writer.CreateFormFile("file", "indigo.jpg")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				_, err = io.Copy(part, buffer)
+				writer.Close()
+				req, err := http.NewRequest("POST", settings.ImageHost.APIEndpoint + "/api/upload", buffer)
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				client := &http.Client{}
+				resp, err := client.Do(req)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				_, err = buffer.ReadFrom(resp.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				resp.Body.Close()
+
+				if(buffer.String() == "500") {
+					http.Error(w, buffer.String(), http.StatusInternalServerError)
+					return
+				}
+				jsonBody := make(map[string]interface{})
+				err = json.Unmarshal(buffer.Bytes(), &jsonBody)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				files := jsonBody["files"].([]interface{})
+				thingy := files[0].(map[string]interface{})
+				w.Write([]byte(thingy["url"].(string)))
+				//w.Write(body.Bytes())
+			case "pomf": // WIP
+				file := &bytes.Buffer{}
+				writer := multipart.NewWriter(file)
+				part, err := writer.CreateFormFile("files[]", "indigo.png")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				_, err = io.Copy(part, buffer)
+				writer.Close()
+				req, err := http.NewRequest("POST", settings.ImageHost.APIEndpoint + "/upload.php", buffer)
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				client := &http.Client{}
+				resp, err := client.Do(req)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				_, err = buffer.ReadFrom(resp.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				resp.Body.Close()
+
+				jsonBody := make(map[string]interface{})
+				json.Unmarshal(buffer.Bytes(), &jsonBody)
+				files := jsonBody["files"].([]interface{})
+				thingy := files[0].(map[string]interface{})
+				w.Write([]byte(thingy["url"].(string)))
+				//w.Write(body.Bytes())*/
+	}
+	return "", errors.New("Unknown image host: " + settings.ImageHost.Provider)
+}
+
+// Find the first link in a body that an embed provider can show, and get what's saved for it along with its URL type.
+// Providers are checked in order, so a body with links to more than one only gets the first provider's embed.
+func getEmbed(body string) (string, int) {
+	for _, provider := range embedProviders {
+		if !checkIfEmbedEnabled(provider.Key) {
+			continue
+		}
+		match := provider.Pattern.FindStringSubmatch(body)
+		if match == nil {
+			continue
+		}
+		if id := provider.ID(match); len(id) > 0 {
+			return id, provider.Type
+		}
+	}
+	return "", 0
+}
+
+// Check if an embed provider hasn't been turned off in the settings.
+func checkIfEmbedEnabled(key string) bool {
+	for _, disabled := range settings.DisabledEmbeds {
+		if disabled == key {
+			return false
+		}
+	}
+	return true
+}
+
+// Render the embed for a post, comment or message's link with its provider's template.
+// Embeds from providers that have since been turned off are shown as plain links.
+func renderEmbed(urlType int, id string) (template.HTML, error) {
+	for _, provider := range embedProviders {
+		if provider.Type != urlType {
+			continue
+		}
+		name := provider.Template
+		embedID := id
+		if provider.Resolve != nil {
+			embedID = getResolvedEmbed(provider, id)
+		}
+		if !checkIfEmbedEnabled(provider.Key) || len(embedID) == 0 {
+			name = "embed_link.html"
+		}
+		var embed bytes.Buffer
+		err := templates.ExecuteTemplate(&embed, name, map[string]interface{}{
+			"ID":   embedID,
+			"Link": provider.Link(id),
+		})
+		return template.HTML(embed.String()), err
+	}
+	return "", nil
+}
+
+// Get a link to what a post, comment or message embeds, for places that don't show the embed itself.
+func getEmbedLink(urlType int, id string) string {
+	for _, provider := range embedProviders {
+		if provider.Type == urlType {
+			return provider.Link(id)
+		}
+	}
+	return id
+}
+
+// The most embed lookups kept at once. Past this, old ones are dropped to make room.
+const maxResolvedEmbeds = 10000
+
+// Get what an embed provider looked up for a link, starting the lookup in the background if it hasn't been done yet.
+// Nothing is returned until the lookup finishes. Lookups are kept for a day, and ones that fail are tried again after a few minutes.
+func getResolvedEmbed(provider embedProvider, id string) string {
+	key := provider.Key + " " + id
+	resolvedEmbedsLock.Lock()
+	cached, ok := resolvedEmbeds[key]
+	if ok && time.Now().Before(cached.Expires) {
+		resolvedEmbedsLock.Unlock()
+		return cached.ID
+	}
+	// mark it as in progress so it's only looked up once, giving up on it if the lookup hangs
+	setResolvedEmbed(key, resolvedEmbed{Expires: time.Now().Add(time.Minute)})
+	resolvedEmbedsLock.Unlock()
+
+	go func() {
+		entry := resolvedEmbed{ID: provider.Resolve(id), Expires: time.Now().Add(24 * time.Hour)}
+		if len(entry.ID) == 0 {
+			entry.Expires = time.Now().Add(5 * time.Minute)
+		}
+		resolvedEmbedsLock.Lock()
+		setResolvedEmbed(key, entry)
+		resolvedEmbedsLock.Unlock()
+	}()
+	return ""
+}
+
+// Store an embed lookup, clearing out expired ones once an hour and dropping others if there are too many.
+// The caller has to hold resolvedEmbedsLock.
+func setResolvedEmbed(key string, entry resolvedEmbed) {
+	if time.Since(resolvedEmbedsSwept) > time.Hour {
+		for oldKey, oldEntry := range resolvedEmbeds {
+			if time.Now().After(oldEntry.Expires) {
+				delete(resolvedEmbeds, oldKey)
+			}
+		}
+		resolvedEmbedsSwept = time.Now()
+	}
+	if _, exists := resolvedEmbeds[key]; !exists {
+		// map order is random, so this drops whichever ones come up first
+		for oldKey := range resolvedEmbeds {
+			if len(resolvedEmbeds) < maxResolvedEmbeds {
+				break
+			}
+			delete(resolvedEmbeds, oldKey)
+		}
+	}
+	resolvedEmbeds[key] = entry
+}
+
+// Get the album or track ID Bandcamp's player needs from one of its pages, since the links don't have it.
+func getBandcampPlayerID(pageURL string) string {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(pageURL)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	page, err := ioutil.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		return ""
+	}
+	player := bandcampPlayers.FindSubmatch(page)
+	if player == nil {
+		return ""
+	}
+	return string(player[1])
+}
+
+// Get a poll along with its options and what the user voted for.
+// The vote counts are left out while the poll is hiding its results from the user.
+func getPoll(pollID int, currentUser user) poll {
 	var newPoll poll
-	option_rows, err := db.Query("SELECT options.id, name FROM options WHERE post = ?", pollID)
+	var closesAt sql.NullTime
+	db.QueryRow("SELECT multiple_choice, closes_at, results_visibility FROM polls WHERE post = ?", pollID).Scan(&newPoll.MultipleChoice, &closesAt, &newPoll.ResultsVisibility)
+	if closesAt.Valid {
+		newPoll.ClosesAt = eventTiming(closesAt.Time, currentUser.Timezone)
+		newPoll.Closed = !closesAt.Time.After(time.Now())
+	}
+
+	// Votes is the number of people who voted, which is what the percentages are out of for multiple choice polls.
+	option_rows, err := db.Query("SELECT options.id, IFNULL(name, ''), COUNT(votes.id), IFNULL(MAX(votes.user = ?), 0), (SELECT COUNT(DISTINCT user) FROM votes WHERE poll = ?) FROM options LEFT JOIN votes ON votes.option_id = options.id WHERE post = ? GROUP BY options.id ORDER BY options.id ASC", currentUser.ID, pollID, pollID)
 	if err != nil {
 		fmt.Println("could not get poll")
 		fmt.Println(err.Error())
@@ -827,39 +3499,26 @@ func getPoll(pollID int, userID int) poll {
 	}
 	for option_rows.Next() {
 		var row = option{}
-		option_rows.Scan(&row.ID, &row.Name)
-		user_rows, err := db.Query("SELECT users.id FROM votes LEFT JOIN users ON users.id = user WHERE poll = ? AND option_id = ?", pollID, row.ID)
-		if err != nil {
-			fmt.Println("could not die")
-			fmt.Println(err.Error())
-			return newPoll
+		option_rows.Scan(&row.ID, &row.Name, &row.Votes, &row.Selected, &newPoll.Votes)
+		if row.Selected {
+			newPoll.Selected = true
 		}
-		for user_rows.Next() { // OPTIMIZE THIS!!!
-			var currentID int
-			user_rows.Scan(&currentID)
-			if currentID == userID {
-				row.Selected = true
-				newPoll.Selected = true
-			}
-
-			row.Votes = row.Votes + 1
-		}
-		user_rows.Close()
-
 		newPoll.Options = append(newPoll.Options, row)
 	}
 	option_rows.Close()
 
-	for _, row := range newPoll.Options {
-		newPoll.Votes = newPoll.Votes + row.Votes
-	}
+	newPoll.ResultsHidden = !newPoll.Closed && (newPoll.ResultsVisibility == 2 || (newPoll.ResultsVisibility == 1 && !newPoll.Selected))
 	for i, row := range newPoll.Options {
-		if row.Votes > 0 {
+		if newPoll.ResultsHidden {
+			newPoll.Options[i].Votes = 0
+		} else if row.Votes > 0 {
 			newPoll.Options[i].Percentage = math.Round(row.Votes / newPoll.Votes * 100)
-		} else {
-			row.Percentage = 0
 		}
 	}
+	// The total would give away how the voting's going too.
+	if newPoll.ResultsHidden {
+		newPoll.Votes = 0
+	}
 
 	newPoll.ID = pollID
 	return newPoll